@@ -0,0 +1,93 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/dbauditor"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// auditAccount opens an account database and checks its integrity, returning the account it's for.
+func auditAccount(dbFile string) (string, string, error) {
+	c, err := sqliteOpenAccount(dbFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
+	if db, ok := c.(*sqliteAccount); ok {
+		if err := db.IntegrityCheck(); err != nil {
+			return "", "", err
+		}
+	}
+	info, err := c.GetInfo()
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to get account info: %v", err)
+	}
+	return info.Account, "", nil
+}
+
+// newAuditor returns an account auditor, which checks every account database on the server for corruption and
+// misplacement, quarantining any that fail.
+func newAuditor() *dbauditor.Auditor {
+	return &dbauditor.Auditor{
+		Type:          "account",
+		FindDatabases: findAccountDbs,
+		OpenDatabase:  auditAccount,
+		Missing:       ErrorNoSuchAccount,
+		Cancel:        make(chan struct{}),
+	}
+}
+
+// GetAuditor uses the config settings and command-line flags to configure and return an account auditor daemon struct.
+func GetAuditor(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv.LowLevelLogger, error) {
+	if !serverconf.HasSection("account-auditor") {
+		return nil, nil, fmt.Errorf("Unable to find account-auditor config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	ring, err := GetRing("account", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading account ring")
+	}
+	logLevelString := serverconf.GetDefault("account-auditor", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger("account-auditor", &logLevel, flags); err != nil {
+		return nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	a := newAuditor()
+	a.CheckMounts = serverconf.GetBool("account-auditor", "mount_check", true)
+	a.DeviceRoot = serverconf.GetDefault("account-auditor", "devices", "/srv/node")
+	a.HashPathPrefix = hashPathPrefix
+	a.HashPathSuffix = hashPathSuffix
+	a.PerSecond = serverconf.GetInt("account-auditor", "accounts_per_second", 200)
+	a.Interval = time.Duration(serverconf.GetInt("account-auditor", "interval", 1800)) * time.Second
+	a.LogTime = time.Duration(serverconf.GetInt("account-auditor", "log_time", 3600)) * time.Second
+	a.ReconCachePath = serverconf.GetDefault("account-auditor", "recon_cache_path", "/var/cache/swift")
+	a.Logger = logger
+	a.Ring = ring
+	return a, logger, nil
+}
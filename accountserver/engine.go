@@ -77,6 +77,9 @@ type ContainerListingRecord struct {
 	Bytes        int64    `xml:"bytes" json:"bytes"`
 	Count        int64    `xml:"count" json:"count"`
 	LastModified string   `xml:"last_modified" json:"last_modified"`
+	// StoragePolicy is the name of the container's storage policy, only included in JSON listings.
+	StoragePolicy      string `xml:"-" json:"storage_policy,omitempty"`
+	StoragePolicyIndex int    `xml:"-" json:"-"`
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml account listings.
@@ -116,6 +119,9 @@ type Account interface {
 	Delete(timestamp string) error
 	// ListContainers lists the account's container entries.
 	ListContainers(limit int, marker string, endMarker string, prefix string, delimiter string, reverse bool) ([]interface{}, error)
+	// IterContainers passes the entries ListContainers would return to emit one at a time, reading them from the
+	// database in batches so listings of any size can be streamed. It stops with the first error emit returns.
+	IterContainers(limit int, marker string, endMarker string, prefix string, delimiter string, reverse bool, emit func(entry interface{}) error) error
 	// GetMetadata returns the account's current metadata.
 	GetMetadata() (map[string]string, error)
 	// UpdateMetadata applies updates to the account's metadata.
@@ -130,6 +130,14 @@ func (server *AccountServer) AccountReplicateHandler(writer http.ResponseWriter,
 			status := server.replicateMergeItems(request, vars, records, remoteID)
 			srv.StandardResponse(writer, status)
 		}
+	case "stream_items":
+		var remoteID string
+		if err := extractArgs(&remoteID); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateStreamItems(request, vars, decoder, remoteID)
+			srv.StandardResponse(writer, status)
+		}
 	case "merge_syncs":
 		var records []*SyncRecord
 		if err := extractArgs(&records); err != nil {
@@ -231,6 +239,33 @@ func (server *AccountServer) replicateMergeItems(request *http.Request, vars map
 	return http.StatusAccepted
 }
 
+// replicateStreamItems merges the pages of container records that follow a stream_items message, one page at a time so
+// the sync point with the remote advances as the stream goes.
+func (server *AccountServer) replicateStreamItems(request *http.Request, vars map[string]string, decoder *json.Decoder, remoteID string) int {
+	db, err := server.accountEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer server.accountEngine.Return(db)
+	for {
+		var records []*ContainerRecord
+		if err := decoder.Decode(&records); err == io.EOF {
+			return http.StatusAccepted
+		} else if err != nil {
+			srv.GetLogger(request).Error("Error reading streamed records.",
+				zap.String("db.RingHash", db.RingHash()),
+				zap.Error(err))
+			return http.StatusBadRequest
+		}
+		if err := db.MergeItems(records, remoteID); err != nil {
+			srv.GetLogger(request).Error("Error merging records.",
+				zap.String("db.RingHash", db.RingHash()),
+				zap.Error(err))
+			return http.StatusInternalServerError
+		}
+	}
+}
+
 func (server *AccountServer) replicateMergeSyncs(request *http.Request, vars map[string]string, records []*SyncRecord) int {
 	db, err := server.accountEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
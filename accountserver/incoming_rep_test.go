@@ -372,6 +372,53 @@ func TestServerReplicateCompleteRsync(t *testing.T) {
 	require.Equal(t, "3", rsp.Header().Get("X-Account-Container-Count"))
 }
 
+func TestServerReplicateStreamItems(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.CanonicalTimestamp(100))
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusCreated, rsp.Status)
+
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s%s", "changeme", "a", "changeme")
+	accountHash := fmt.Sprintf("%032x", h.Sum(nil))
+
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	require.Nil(t, encoder.Encode([]interface{}{"stream_items", common.UUID()}))
+	require.Nil(t, encoder.Encode([]ContainerRecord{
+		{Rowid: 1, Name: "c1", PutTimestamp: common.CanonicalTimestamp(101), ObjectCount: 1, BytesUsed: 10},
+	}))
+	require.Nil(t, encoder.Encode([]ContainerRecord{
+		{Rowid: 2, Name: "c2", PutTimestamp: common.CanonicalTimestamp(102), ObjectCount: 2, BytesUsed: 20},
+	}))
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("REPLICATE", "/device/1/"+accountHash, body)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusAccepted, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("HEAD", "/device/1/a", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, "2", rsp.Header().Get("X-Account-Container-Count"))
+	require.Equal(t, "30", rsp.Header().Get("X-Account-Bytes-Used"))
+
+	// a stream cut off partway through a page is rejected.
+	msg := `["stream_items", "abcdef"]` + "\n" + `[{"name": "c3", "put_timestamp": "0000000103.00000"`
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("REPLICATE", "/device/1/"+accountHash, strings.NewReader(msg))
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusBadRequest, rsp.Status)
+}
+
 func TestServerReplicateBadOp(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
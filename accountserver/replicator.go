@@ -21,6 +21,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -40,7 +41,9 @@ import (
 
 var (
 	errDeviceNotMounted = errors.New("Remove drive was unmounted")
-	deviceLockupTimeout = time.Hour
+	// errStreamUnsupported means the remote server rejected a stream_items request, probably because it predates it.
+	errStreamUnsupported = errors.New("Remote doesn't support streaming items")
+	deviceLockupTimeout  = time.Hour
 	// GetRing is a local pointer to the hummingbird function, for overriding in tests.
 	GetRing = ring.GetRing
 )
@@ -62,6 +65,8 @@ type Replicator struct {
 	client         *http.Client
 	runningDevices map[string]*replicationDevice
 	reclaimAge     int64
+	// bandwidth caps the bytes per second sent to other servers, shared by all of the replicator's devices.
+	bandwidth *common.BandwidthLimiter
 }
 
 type statUpdate struct {
@@ -75,6 +80,7 @@ type replicationDevice struct {
 		sendReplicationMessage(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 		sync(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error)
 		rsync(dev *ring.Device, c ReplicableAccount, part uint64, op string) error
+		streamItems(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
 		usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
 		chooseReplicationStrategy(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string
 		replicateDatabaseToDevice(dev *ring.Device, c ReplicableAccount, part uint64) error
@@ -96,6 +102,7 @@ func (rd *replicationDevice) sendReplicationMessage(dev *ring.Device, part uint6
 	if err != nil {
 		return 0, nil, err
 	}
+	rd.r.bandwidth.Wait(len(body))
 	req, err := http.NewRequest("REPLICATE", fmt.Sprintf("http://%s:%d/%s/%d/%s",
 		dev.ReplicationIp, dev.ReplicationPort, dev.Device, part, ringHash), bytes.NewBuffer(body))
 	if err != nil {
@@ -140,7 +147,7 @@ func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableAccount, part u
 		return fmt.Errorf("Error opening databae: %v", err)
 	}
 	defer release()
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/tmp/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device, tmpFilename), fp)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/tmp/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device, tmpFilename), rd.r.bandwidth.Reader(fp))
 	if err != nil {
 		return fmt.Errorf("creating request: %v", err)
 	}
@@ -160,6 +167,73 @@ func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableAccount, part u
 	return nil
 }
 
+// streamItems sends the remote every container record after point in a single stream_items request, so a remote that
+// is far behind is caught up without sending it the whole database. It returns errStreamUnsupported if the remote
+// doesn't know the stream_items op.
+func (rd *replicationDevice) streamItems(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+	syncTable, err := c.SyncTable()
+	if err != nil {
+		return fmt.Errorf("Error getting sync table: %v", err)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeItemStream(pw, c, localID, point, int(rd.r.perUsync)))
+	}()
+	req, err := http.NewRequest("REPLICATE", fmt.Sprintf("http://%s:%d/%s/%d/%s",
+		dev.ReplicationIp, dev.ReplicationPort, dev.Device, part, c.RingHash()), rd.r.bandwidth.Reader(pr))
+	if err != nil {
+		pr.Close()
+		<-done
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.Cancel = rd.cancel
+	resp, err := rd.r.client.Do(req)
+	// the writer may still be blocked on the pipe if the remote stopped reading early.
+	pr.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("streaming items to %s/%s: %v", dev.ReplicationIp, dev.Device, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return errStreamUnsupported
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status code %d streaming items to %s/%s", resp.StatusCode, dev.ReplicationIp, dev.Device)
+	}
+	status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), "merge_syncs", syncTable)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("Invalid status code from merge_syncs: %d", status)
+	}
+	return nil
+}
+
+// writeItemStream writes a stream_items request body: the replication message, then pages of container records after
+// point until there are none left.
+func writeItemStream(w io.Writer, c ReplicableAccount, localID string, point int64, pageSize int) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode([]interface{}{"stream_items", localID}); err != nil {
+		return err
+	}
+	for {
+		records, err := c.ItemsSince(point, pageSize)
+		if err != nil {
+			return fmt.Errorf("getting container records from %s: %v", c.RingHash(), err)
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		if err := encoder.Encode(records); err != nil {
+			return err
+		}
+		point = records[len(records)-1].Rowid
+	}
+}
+
 func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
 	objects, err := c.ItemsSince(point, int(rd.r.perUsync))
 	if err != nil {
@@ -229,13 +303,26 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 		rd.r.logger.Debug("Not replicating anything.",
 			zap.String("strategy", strategy),
 			zap.String("RingHash", c.RingHash()))
-	case "complete_rsync", "rsync_then_merge":
+	case "complete_rsync":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
 			zap.String("ReplicationIp", dev.ReplicationIp),
 			zap.String("Device", dev.Device),
 			zap.String("strategy", strategy))
 		return rd.i.rsync(dev, c, part, strategy)
+	case "rsync_then_merge":
+		rd.r.logger.Debug("Replicating ringhash",
+			zap.String("RingHash", c.RingHash()),
+			zap.String("ReplicationIp", dev.ReplicationIp),
+			zap.String("Device", dev.Device),
+			zap.String("strategy", strategy))
+		// the remote already has most of the rows, so only send it the ones it's missing.
+		err := rd.i.streamItems(dev, c, part, info.ID, remoteInfo.Point)
+		if err == errStreamUnsupported {
+			rd.i.incrementStat("stream_fallback")
+			return rd.i.rsync(dev, c, part, strategy)
+		}
+		return err
 	case "diff":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
@@ -299,11 +386,16 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 }
 
 func (rd *replicationDevice) findAccountDbs(devicePath string, results chan string) {
+	findAccountDbs(rd.r.logger, devicePath, rd.cancel, results)
+}
+
+// findAccountDbs sends the paths of the account databases on a device to results, closing it when done.
+func findAccountDbs(logger srv.LowLevelLogger, devicePath string, cancel chan struct{}, results chan string) {
 	defer close(results)
 	accountsDir := filepath.Join(devicePath, "accounts")
 	partitions, err := filepath.Glob(filepath.Join(accountsDir, "[0-9]*"))
 	if err != nil {
-		rd.r.logger.Error("Error getting partitions.",
+		logger.Error("Error getting partitions.",
 			zap.String("accountsDir", accountsDir),
 			zap.Error(err))
 		return
@@ -311,7 +403,7 @@ func (rd *replicationDevice) findAccountDbs(devicePath string, results chan stri
 	for _, part := range partitions {
 		suffixes, err := filepath.Glob(filepath.Join(part, "[a-f0-9][a-f0-9][a-f0-9]"))
 		if err != nil {
-			rd.r.logger.Error("Error getting suffixes.",
+			logger.Error("Error getting suffixes.",
 				zap.String("part", part),
 				zap.Error(err))
 			return
@@ -319,7 +411,7 @@ func (rd *replicationDevice) findAccountDbs(devicePath string, results chan stri
 		for _, suff := range suffixes {
 			hashes, err := filepath.Glob(filepath.Join(suff, "????????????????????????????????"))
 			if err != nil {
-				rd.r.logger.Error("Error getting hashes",
+				logger.Error("Error getting hashes",
 					zap.String("suff", suff),
 					zap.Error(err))
 				return
@@ -329,7 +421,7 @@ func (rd *replicationDevice) findAccountDbs(devicePath string, results chan stri
 				if fs.Exists(dbFile) {
 					select {
 					case results <- dbFile:
-					case <-rd.cancel:
+					case <-cancel:
 						return
 					}
 				}
@@ -396,29 +488,31 @@ func newReplicationDevice(dev *ring.Device, r *Replicator) *replicationDevice {
 		deviceStarted: time.Now(),
 		dev:           dev,
 		stats: map[string]int64{
-			"attempted":             0,
-			"success":               0,
-			"failure":               0,
-			"no_change":             0,
-			"hashmatch":             0,
-			"rsync":                 0,
-			"diff":                  0,
-			"remove":                0,
-			"empty":                 0,
-			"remote_merge":          0,
-			"diff_capped":           0,
-			"lifetime_attempted":    0,
-			"lifetime_success":      0,
-			"lifetime_failure":      0,
-			"lifetime_no_change":    0,
-			"lifetime_hashmatch":    0,
-			"lifetime_rsync":        0,
-			"lifetime_diff":         0,
-			"lifetime_remove":       0,
-			"lifetime_empty":        0,
-			"lifetime_remote_merge": 0,
-			"lifetime_diff_capped":  0,
-			"lifetime_passes":       0,
+			"attempted":                0,
+			"success":                  0,
+			"failure":                  0,
+			"no_change":                0,
+			"hashmatch":                0,
+			"rsync":                    0,
+			"diff":                     0,
+			"remove":                   0,
+			"empty":                    0,
+			"remote_merge":             0,
+			"diff_capped":              0,
+			"stream_fallback":          0,
+			"lifetime_attempted":       0,
+			"lifetime_success":         0,
+			"lifetime_failure":         0,
+			"lifetime_no_change":       0,
+			"lifetime_hashmatch":       0,
+			"lifetime_rsync":           0,
+			"lifetime_diff":            0,
+			"lifetime_remove":          0,
+			"lifetime_empty":           0,
+			"lifetime_remote_merge":    0,
+			"lifetime_diff_capped":     0,
+			"lifetime_stream_fallback": 0,
+			"lifetime_passes":          0,
 		},
 	}
 	rd.i = rd
@@ -595,6 +689,7 @@ func GetReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv
 		deviceRoot:     serverconf.GetDefault("account-replicator", "devices", "/srv/node"),
 		serverPort:     int(serverconf.GetInt("account-replicator", "bind_port", 6000)),
 		reclaimAge:     serverconf.GetInt("account-replicator", "reclaim_age", 604800),
+		bandwidth:      common.NewBandwidthLimiter(serverconf.GetInt("account-replicator", "max_bandwidth", 0)),
 		logger:         logger,
 		concurrencySem: make(chan struct{}, concurrency),
 		Ring:           ring,
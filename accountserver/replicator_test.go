@@ -46,6 +46,7 @@ type patchableReplicationDevice struct {
 	_sendReplicationMessage    func(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 	_sync                      func(dev *ring.Device, part uint64, ringHash string, info *AccountInfo) (*AccountInfo, error)
 	_rsync                     func(dev *ring.Device, c ReplicableAccount, part uint64, op string) error
+	_streamItems               func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
 	_usync                     func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error
 	_chooseReplicationStrategy func(localInfo, remoteInfo *AccountInfo, usyncThreshold int64) string
 	_replicateDatabaseToDevice func(dev *ring.Device, c ReplicableAccount, part uint64) error
@@ -72,6 +73,12 @@ func (d *patchableReplicationDevice) rsync(dev *ring.Device, c ReplicableAccount
 	}
 	return d.rd.rsync(dev, c, part, op)
 }
+func (d *patchableReplicationDevice) streamItems(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+	if d._streamItems != nil {
+		return d._streamItems(dev, c, part, localID, point)
+	}
+	return d.rd.streamItems(dev, c, part, localID, point)
+}
 func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
 	if d._usync != nil {
 		return d._usync(dev, c, part, localID, point)
@@ -172,6 +179,9 @@ func (f fakeDatabase) Delete(timestamp string) error {
 func (f fakeDatabase) ListContainers(limit int, marker string, endMarker string, prefix string, delimiter string, reverse bool) ([]interface{}, error) {
 	return nil, errors.New("")
 }
+func (f fakeDatabase) IterContainers(limit int, marker string, endMarker string, prefix string, delimiter string, reverse bool, emit func(entry interface{}) error) error {
+	return errors.New("")
+}
 func (f fakeDatabase) GetMetadata() (map[string]string, error) {
 	return nil, errors.New("")
 }
@@ -338,6 +348,56 @@ func TestReplicatorUsync(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestReplicatorStreamItems(t *testing.T) {
+	var names []string
+	var ops []string
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var args []interface{}
+		require.Nil(t, decoder.Decode(&args))
+		ops = append(ops, args[0].(string))
+		if args[0] == "stream_items" {
+			require.Equal(t, "12345", args[1])
+			for {
+				var records []*ContainerRecord
+				err := decoder.Decode(&records)
+				if err == io.EOF {
+					break
+				}
+				require.Nil(t, err)
+				require.Equal(t, 1, len(records))
+				names = append(names, records[0].Name)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1, maxUsyncs: 1})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c", "d"}))
+	items, err := c.ItemsSince(-1, 1)
+	require.Nil(t, err)
+	// the stream isn't capped like usync, and starts after the remote's point.
+	require.Nil(t, rd.streamItems(dev, c, 1, "12345", items[0].Rowid))
+	require.Equal(t, []string{"b", "c", "d"}, names)
+	require.Equal(t, []string{"stream_items", "merge_syncs"}, ops)
+}
+
+func TestReplicatorStreamItemsUnsupported(t *testing.T) {
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
+	require.Equal(t, errStreamUnsupported, rd.streamItems(dev, c, 1, "12345", -1))
+}
+
 func TestReplicatorChooseReplicationStrategy(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
 	require.Equal(t, "complete_rsync", rd.chooseReplicationStrategy(&AccountInfo{}, nil, 100))
@@ -392,6 +452,21 @@ func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
 	require.False(t, usyncCalled)
 	require.False(t, rsyncCalled)
+
+	// rsync_then_merge streams the missing rows, falling back to rsync for remotes that can't take a stream.
+	streamErr := error(nil)
+	streamCalled := false
+	rd._streamItems = func(dev *ring.Device, c ReplicableAccount, part uint64, localID string, point int64) error {
+		streamCalled = true
+		return streamErr
+	}
+	currentMethod = "rsync_then_merge"
+	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
+	require.True(t, streamCalled)
+	require.False(t, rsyncCalled)
+	streamErr = errStreamUnsupported
+	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
+	require.True(t, rsyncCalled)
 }
 
 func TestFindAccounts(t *testing.T) {
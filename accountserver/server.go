@@ -16,8 +16,6 @@
 package accountserver
 
 import (
-	"encoding/json"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"net"
@@ -32,7 +30,9 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 )
@@ -53,6 +53,11 @@ type AccountServer struct {
 	updateClient     *http.Client
 	autoCreatePrefix string
 	policyList       conf.PolicyList
+	metrics          *metrics.Registry
+	requestDurations *metrics.Histogram
+	tracer           *tracing.Tracer
+	// usageScans limits each device to one usage report at a time, as each crawls every account database on it.
+	usageScans *common.KeyedLimit
 }
 
 func formatTimestamp(ts string) (string, error) {
@@ -71,6 +76,7 @@ func formatTimestamp(ts string) (string, error) {
 }
 
 func (server *AccountServer) Finalize() {
+	server.tracer.Close()
 }
 
 // AccountGetHandler handles GET and HEAD requests for an account.
@@ -149,7 +155,7 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 				prefix = fmt.Sprintf("X-Account-Storage-Policy-%d-", policyStat.StoragePolicyIndex)
 			}
 			headers.Set(prefix+"Container-Count", fmt.Sprintf("%d", policyStat.ContainerCount))
-			headers.Set(prefix+"Object-Count", fmt.Sprintf("%d", policyStat.ContainerCount))
+			headers.Set(prefix+"Object-Count", fmt.Sprintf("%d", policyStat.ObjectCount))
 			headers.Set(prefix+"Bytes-Used", fmt.Sprintf("%d", policyStat.BytesUsed))
 		}
 	}
@@ -159,78 +165,53 @@ func (server *AccountServer) AccountGetHandler(writer http.ResponseWriter, reque
 		return
 	}
 	limit, _ := strconv.ParseInt(request.FormValue("limit"), 10, 64)
-	if limit > 10000 {
+	if limit > srv.ListingLimitMax(request) {
 		srv.StandardResponse(writer, http.StatusPreconditionFailed)
 		return
 	} else if limit <= 0 {
-		limit = 10000
+		limit = srv.MaxListingLimit
 	}
 	marker := request.Form.Get("marker")
 	delimiter := request.Form.Get("delimiter")
 	endMarker := request.Form.Get("end_marker")
 	prefix := request.Form.Get("prefix")
 	reverse := common.LooksTrue(request.Form.Get("reverse"))
-	containers, err := db.ListContainers(int(limit), marker, endMarker, prefix, delimiter, reverse)
-	if err != nil {
-		srv.GetLogger(request).Error("Unable to list containers.", zap.Error(err))
-		srv.StandardResponse(writer, http.StatusInternalServerError)
+	format := srv.ListingFormat(request)
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
 		return
 	}
-	format := request.Form.Get("format")
-	if format == "" { /* TODO: real accept parsing */
-		accept := request.Header.Get("Accept")
-		if strings.Contains(accept, "application/json") {
-			format = "json"
-		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
-			format = "xml"
-		} else {
-			format = "text"
+	listing := srv.NewListingWriter(writer, format, "account", vars["account"], listingEntryName)
+	err = db.IterContainers(int(limit), marker, endMarker, prefix, delimiter, reverse, func(entry interface{}) error {
+		if cr, ok := entry.(*ContainerListingRecord); ok {
+			cr.StoragePolicy = policyName(server.policyList, cr.StoragePolicyIndex)
 		}
+		return listing.Write(entry)
+	})
+	if err == nil {
+		err = listing.Close()
 	}
-	if format == "text" {
-		response := ""
-		for _, obj := range containers {
-			if or, ok := obj.(*ContainerListingRecord); ok {
-				response += or.Name + "\n"
-			} else if sr, ok := obj.(*SubdirListingRecord); ok {
-				response += sr.Name + "\n"
-			}
-		}
-		if len(response) > 0 {
-			headers.Set("Content-Length", strconv.Itoa(len(response)))
-			writer.WriteHeader(200)
-			writer.Write([]byte(response))
-		} else {
-			headers.Set("Content-Length", "0")
-			writer.WriteHeader(204)
-			writer.Write([]byte(""))
-		}
-	} else if format == "json" {
-		output, err := json.Marshal(containers)
-		if err != nil {
-			srv.StandardResponse(writer, http.StatusInternalServerError)
-			return
-		}
-		headers.Set("Content-Type", "application/json; charset=utf-8")
-		headers.Set("Content-Length", strconv.Itoa(len(output)))
-		writer.WriteHeader(200)
-		writer.Write(output)
-	} else if format == "xml" {
-		type Account struct {
-			XMLName    xml.Name `xml:"account"`
-			Name       string   `xml:"name,attr"`
-			Containers []interface{}
-		}
-		container := &Account{Name: vars["account"], Containers: containers}
-		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
-		output, _ := xml.Marshal(container)
-		headers.Set("Content-Length", strconv.Itoa(len(output)+39))
-		writer.WriteHeader(200)
-		writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"))
-		writer.Write(output)
+	if err != nil && !listing.Started() {
+		srv.GetLogger(request).Error("Unable to list containers.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+	} else if err != nil {
+		srv.GetLogger(request).Error("Unable to finish listing containers.", zap.Error(err))
+		// the listing's already been sent as a success, so cut it off rather than let it look complete.
+		panic(http.ErrAbortHandler)
 	}
 }
 
+// listingEntryName returns the name of a container listing entry, for text listings.
+func listingEntryName(entry interface{}) string {
+	switch e := entry.(type) {
+	case *ContainerListingRecord:
+		return e.Name
+	case *SubdirListingRecord:
+		return e.Name
+	}
+	return ""
+}
+
 // AccountPutHandler handles PUT requests for an account.
 func (server *AccountServer) AccountPutHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
@@ -417,7 +398,15 @@ func (server *AccountServer) LogRequest(next http.Handler) http.Handler {
 		start := time.Now()
 		logr := server.logger.With(zap.String("txn", request.Header.Get("X-Trans-Id")))
 		request = srv.SetLogger(request, logr)
+		span := server.tracer.StartFromHeader("account-server "+request.Method, request.Header)
+		span.SetAttribute("txn", request.Header.Get("X-Trans-Id"))
+		span.SetAttribute("path", request.URL.Path)
+		request = request.WithContext(tracing.ContextWithSpan(request.Context(), span))
 		next.ServeHTTP(newWriter, request)
+		span.SetAttribute("status", strconv.Itoa(newWriter.Status))
+		span.Finish()
+		server.requestDurations.Observe(time.Since(start).Seconds(), request.Method, strconv.Itoa(newWriter.Status),
+			request.Header.Get("X-Backend-Storage-Policy-Index"))
 		forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 		lvl, _ := server.logLevel.MarshalText()
 		if (request.Method != "REPLICATE" && request.Method != "REPCONN") || strings.ToUpper(string(lvl)) == "DEBUG" {
@@ -483,16 +472,26 @@ func (server *AccountServer) updateDeviceLocks(seconds int64) {
 	}
 }
 
+// newMetrics sets up the server's metrics registry and request duration histogram.
+func (server *AccountServer) newMetrics() {
+	server.metrics, server.requestDurations = metrics.NewServerRegistry()
+	server.metrics.NewKeyedGaugeFunc("hummingbird_device_requests_in_use", "Requests currently holding each device.",
+		"device", server.diskInUse.InUse)
+}
+
 // GetHandler returns the server's http handler - it sets up routes and instantiates middleware.
 func (server *AccountServer) GetHandler(config conf.Config) http.Handler {
+	server.newMetrics()
 	commonHandlers := alice.New(server.LogRequest, middleware.RecoverHandler, middleware.ValidateRequest, server.AcquireDevice)
 	router := srv.NewRouter()
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
+	router.Get("/metrics", commonHandlers.Then(server.metrics))
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/recon/:method", commonHandlers.ThenFunc(server.ReconHandler))
+	router.Get("/usage/:device", commonHandlers.ThenFunc(server.AccountUsageHandler))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Put("/:device/tmp/:filename", commonHandlers.ThenFunc(server.TmpUploadHandler))
@@ -520,6 +519,7 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	server.driveRoot = serverconf.GetDefault("app:account-server", "devices", "/srv/node")
 	server.checkMounts = serverconf.GetBool("app:account-server", "mount_check", true)
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:account-server", "disk_limit", 25, 10000))
+	server.usageScans = common.NewKeyedLimit(1, 0)
 	bindIP = serverconf.GetDefault("app:account-server", "bind_ip", "0.0.0.0")
 	bindPort = int(serverconf.GetInt("app:account-server", "bind_port", 6000))
 
@@ -529,6 +529,9 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	if server.logger, err = srv.SetupLogger("account-server", &server.logLevel, flags); err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	if server.tracer, err = tracing.NewTracerFromConfig(serverconf, "app:account-server", "account-server", server.logger); err != nil {
+		return "", 0, nil, nil, err
+	}
 	server.accountEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
 	connTimeout := time.Duration(serverconf.GetFloat("app:account-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:account-server", "node_timeout", 10.0) * float64(time.Second))
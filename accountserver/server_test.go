@@ -16,6 +16,7 @@
 package accountserver
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -48,6 +49,7 @@ func makeTestServer() (http.Handler, func(), error) {
 		updateClient:     http.DefaultClient,
 		accountEngine:    newLRUEngine(dir, "changeme", "changeme", 32),
 		diskInUse:        common.NewKeyedLimit(2, 2),
+		usageScans:       common.NewKeyedLimit(1, 0),
 		autoCreatePrefix: ".",
 	}
 	cleanup := func() {
@@ -347,3 +349,34 @@ func TestAccountAutoCreateOnPut(t *testing.T) {
 	handler.ServeHTTP(rsp, req)
 	require.Equal(t, 204, rsp.Status)
 }
+
+func TestAccountListingAborted(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Put-Timestamp", "100000000.00002")
+	req.Header.Set("X-Delete-Timestamp", "0")
+	req.Header.Set("X-Object-Count", "0")
+	req.Header.Set("X-Bytes-Used", "0")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	// a listing that fails once it's been started as a 200 cuts the connection, rather than looking complete.
+	rsp = test.MakeCaptureResponse()
+	rsp.WriteError = errors.New("connection reset")
+	req, err = http.NewRequest("GET", "/device/1/a?format=json", nil)
+	require.Nil(t, err)
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() { handler.ServeHTTP(rsp, req) })
+	require.Equal(t, 200, rsp.Status)
+}
@@ -36,6 +36,7 @@ import (
 
 	"github.com/mattn/go-sqlite3"
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/dbauditor"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/pickle"
 )
@@ -97,6 +98,8 @@ type sqliteAccount struct {
 	infoCache           atomic.Value
 	policyStatsCache    atomic.Value
 	ringhash            string
+	// readOnly is set for a database opened just to be looked at, which leaves pending updates unmerged.
+	readOnly bool
 }
 
 var _ Account = &sqliteAccount{}
@@ -114,7 +117,7 @@ func (db *sqliteAccount) connect() error {
 	dbConn.SetMaxOpenConns(maxOpenConns)
 	dbConn.SetMaxIdleConns(maxIdleConns)
 	if db.hasDeletedNameIndex, err = schemaMigrate(dbConn); err != nil {
-		db.Close()
+		dbConn.Close()
 		return fmt.Errorf("Error migrating database: %v", err)
 	}
 	db.DB = dbConn
@@ -345,15 +348,32 @@ func indexAfter(s, sep string, after int) int {
 	return index + after
 }
 
-// ListContainers implements object listings.
+// listingBatchSize is how many rows a listing reads from the database at a time. Entries are handed out between
+// reads, so a slow client never holds the database open.
+const listingBatchSize = 1000
+
+// ListContainers implements container listings.
 func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker string, prefix string, delimiter string,
 	reverse bool) ([]interface{}, error) {
-	if err := db.connect(); err != nil {
+	results := []interface{}{}
+	if err := db.IterContainers(limit, marker, endMarker, prefix, delimiter, reverse, func(entry interface{}) error {
+		results = append(results, entry)
+		return nil
+	}); err != nil {
 		return nil, err
 	}
+	return results, nil
+}
+
+// IterContainers passes the entries of a container listing to emit, one at a time.
+func (db *sqliteAccount) IterContainers(limit int, marker string, endMarker string, prefix string, delimiter string,
+	reverse bool, emit func(entry interface{}) error) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
 	var point, pointDirection, queryTail, queryStart string
 
-	queryStart = "SELECT name, object_count, bytes_used, put_timestamp FROM container WHERE "
+	queryStart = "SELECT name, object_count, bytes_used, put_timestamp, storage_policy_index FROM container WHERE "
 	if reverse {
 		marker, endMarker = endMarker, marker
 		queryTail = "ORDER BY name DESC LIMIT ?"
@@ -363,12 +383,14 @@ func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker stri
 		pointDirection = "name > ?"
 	}
 
-	results := []interface{}{}
+	batch := make([]interface{}, 0, listingBatchSize)
 	queryArgs := make([]interface{}, 8)
 	wheres := make([]string, 8)
+	emitted := 0
 	gotResults := true
 
-	for len(results) < limit && gotResults {
+	// fetch reads the next batch of up to count entries, returning how many rows it looked at.
+	fetch := func(count int) (int, error) {
 		if db.hasDeletedNameIndex {
 			wheres = append(wheres[:0], "deleted = 0")
 		} else {
@@ -392,20 +414,21 @@ func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker stri
 			queryArgs = append(queryArgs, point)
 		}
 		rows, err := db.Query(queryStart+" "+strings.Join(wheres, " AND ")+" "+queryTail,
-			append(queryArgs, limit-len(results))...)
+			append(queryArgs, count)...)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
 		defer rows.Close()
-		gotResults = false
-		for rows.Next() && len(results) < limit {
+		seen := 0
+		for rows.Next() && len(batch) < count {
 			gotResults = true
+			seen++
 			record := &ContainerListingRecord{}
-			if err := rows.Scan(&record.Name, &record.Count, &record.Bytes, &record.LastModified); err != nil {
-				return nil, err
+			if err := rows.Scan(&record.Name, &record.Count, &record.Bytes, &record.LastModified, &record.StoragePolicyIndex); err != nil {
+				return seen, err
 			}
 			if f, err := strconv.ParseFloat(record.LastModified, 64); err != nil {
-				return nil, err
+				return seen, err
 			} else {
 				whole, nans := math.Modf(f)
 				record.LastModified = time.Unix(int64(whole), int64(nans*1.0e9)).Format("2006-01-02T15:04:05.000000")
@@ -421,22 +444,38 @@ func (db *sqliteAccount) ListContainers(limit int, marker string, endMarker stri
 						point = dirName + "\xFF"
 					}
 					if dirName != marker {
-						results = append(results, &SubdirListingRecord{Name2: dirName, Name: dirName})
+						batch = append(batch, &SubdirListingRecord{Name2: dirName, Name: dirName})
 					}
 					break
 				}
 			}
-			results = append(results, record)
+			batch = append(batch, record)
 		}
-		if err := rows.Err(); err != nil {
-			return nil, err
+		return seen, rows.Err()
+	}
+
+	for emitted < limit && gotResults {
+		gotResults = false
+		count := limit - emitted
+		if count > listingBatchSize {
+			count = listingBatchSize
+		}
+		batch = batch[:0]
+		seen, err := fetch(count)
+		if err != nil {
+			return err
 		}
-		rows.Close()
-		if delimiter == "" {
+		for _, entry := range batch {
+			if err := emit(entry); err != nil {
+				return err
+			}
+		}
+		emitted += len(batch)
+		if delimiter == "" && seen < count {
 			break
 		}
 	}
-	return results, nil
+	return nil
 }
 
 // NewID sets the account's ID to a new, random string.
@@ -837,6 +876,9 @@ func int64MaybeStringified(i interface{}) (int64, bool) {
 }
 
 func (db *sqliteAccount) flush() error {
+	if db.readOnly {
+		return nil
+	}
 	lock, err := fs.LockPath(filepath.Dir(db.accountFile), 10*time.Second)
 	if err != nil {
 		return err
@@ -975,6 +1017,56 @@ func sqliteCreateAccount(accountFile string, account string, putTimestamp string
 	return nil
 }
 
+// IntegrityCheck runs sqlite's integrity check on the database, returning a dbauditor.Failure listing any problems found
+// or if the file is corrupt.  It opens the file read-only, so a broken database isn't migrated first.
+func (db *sqliteAccount) IntegrityCheck() error {
+	dbConn, err := sqliteOpenReadOnly(db.accountFile)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+	rows, err := dbConn.Query("PRAGMA integrity_check")
+	if err != nil {
+		return integrityError(err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return integrityError(err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return integrityError(err)
+	}
+	if len(problems) > 0 {
+		return &dbauditor.Failure{Err: fmt.Errorf("Integrity check failed: %s", strings.Join(problems, "; "))}
+	}
+	return nil
+}
+
+// integrityError makes a dbauditor.Failure of an sqlite error saying the database is corrupt, leaving others, like the
+// database being locked, to be retried.
+func integrityError(err error) error {
+	if e, ok := err.(sqlite3.Error); ok && (e.Code == sqlite3.ErrCorrupt || e.Code == sqlite3.ErrNotADB) {
+		return &dbauditor.Failure{Err: err}
+	}
+	return err
+}
+
+// sqliteOpenReadOnly opens a account database read-only, without migrating its schema.
+func sqliteOpenReadOnly(accountFile string) (*sql.DB, error) {
+	dbConn, err := sql.Open("sqlite3_account", "file:"+accountFile+"?psow=1&mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open: %v", err)
+	}
+	return dbConn, nil
+}
+
 func sqliteOpenAccount(accountFile string) (ReplicableAccount, error) {
 	if !fs.Exists(accountFile) {
 		return nil, ErrorNoSuchAccount
@@ -986,3 +1078,55 @@ func sqliteOpenAccount(accountFile string) (ReplicableAccount, error) {
 	}
 	return db, nil
 }
+
+// DatabaseReport describes an account database file, for "hummingbird db-info".
+type DatabaseReport struct {
+	Info          *AccountInfo
+	PolicyStats   []*PolicyStat
+	SyncPoints    []*SyncRecord
+	ContainerRows int64
+	DeletedRows   int64
+}
+
+// InspectDatabase opens the account database at accountFile and reports its info, per-policy stats, incoming sync
+// points and container row counts.  The file's opened read-only and isn't migrated, so it's left as it was found;
+// updates still in its pending file aren't counted.
+func InspectDatabase(accountFile string) (*DatabaseReport, error) {
+	if !fs.Exists(accountFile) {
+		return nil, ErrorNoSuchAccount
+	}
+	db := &sqliteAccount{accountFile: accountFile, readOnly: true}
+	dbConn, err := sqliteOpenReadOnly(accountFile)
+	if err != nil {
+		return nil, err
+	}
+	db.DB = dbConn
+	defer db.Close()
+	report := &DatabaseReport{}
+	if report.Info, err = db.GetInfo(); err != nil {
+		return nil, err
+	}
+	if report.PolicyStats, err = db.PolicyStats(); err != nil {
+		return nil, err
+	}
+	if report.SyncPoints, err = db.SyncTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT deleted, COUNT(*) FROM container GROUP BY deleted")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deleted, count int64
+		if err := rows.Scan(&deleted, &count); err != nil {
+			return nil, err
+		}
+		if deleted == 0 {
+			report.ContainerRows += count
+		} else {
+			report.DeletedRows += count
+		}
+	}
+	return report, rows.Err()
+}
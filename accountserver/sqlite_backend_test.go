@@ -369,3 +369,26 @@ func TestPolicyStats(t *testing.T) {
 		t.Fatal(polstat2.BytesUsed)
 	}
 }
+
+func TestInspectDatabase(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
+	require.Nil(t, db.MergeItems([]*ContainerRecord{{Name: "b", PutTimestamp: "200000000.00001", DeleteTimestamp: "200000000.00002", Deleted: 1}}, ""))
+	require.Nil(t, db.MergeSyncTable([]*SyncRecord{{SyncPoint: 2, RemoteID: "remote"}}))
+	report, err := InspectDatabase(dbFile)
+	require.Nil(t, err)
+	require.Equal(t, "a", report.Info.Account)
+	require.Equal(t, int64(2), report.Info.ContainerCount)
+	require.Equal(t, int64(2), report.ContainerRows)
+	require.Equal(t, int64(1), report.DeletedRows)
+	require.Equal(t, 1, len(report.PolicyStats))
+	syncPoints := map[string]int64{}
+	for _, p := range report.SyncPoints {
+		syncPoints[p.RemoteID] = p.SyncPoint
+	}
+	require.Equal(t, map[string]int64{"remote": 2, report.Info.ID: report.Info.MaxRow}, syncPoints)
+	_, err = InspectDatabase(dbFile + ".missing")
+	require.Equal(t, ErrorNoSuchAccount, err)
+}
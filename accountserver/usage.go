@@ -0,0 +1,218 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// PolicyUsage is an account's usage of one storage policy.
+type PolicyUsage struct {
+	Policy             string `json:"policy"`
+	StoragePolicyIndex int    `json:"storage_policy_index"`
+	ContainerCount     int64  `json:"container_count"`
+	ObjectCount        int64  `json:"object_count"`
+	BytesUsed          int64  `json:"bytes_used"`
+}
+
+// AccountUsage is an account's usage, in total and by storage policy, as reported by one of its databases.
+type AccountUsage struct {
+	Account        string         `json:"account"`
+	PutTimestamp   string         `json:"put_timestamp"`
+	ContainerCount int64          `json:"container_count"`
+	ObjectCount    int64          `json:"object_count"`
+	BytesUsed      int64          `json:"bytes_used"`
+	Policies       []*PolicyUsage `json:"policies"`
+}
+
+// policyName returns the name of the storage policy with the given index, or the index itself if it isn't configured.
+func policyName(policies conf.PolicyList, index int) string {
+	if policy := policies[index]; policy != nil {
+		return policy.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// getAccountUsage reads an account's usage from its database, returning nil for deleted accounts.
+func getAccountUsage(db Account, policies conf.PolicyList) (*AccountUsage, error) {
+	if deleted, err := db.IsDeleted(); err != nil {
+		return nil, err
+	} else if deleted {
+		return nil, nil
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	stats, err := db.PolicyStats()
+	if err != nil {
+		return nil, err
+	}
+	usage := &AccountUsage{
+		Account:        info.Account,
+		PutTimestamp:   info.PutTimestamp,
+		ContainerCount: info.ContainerCount,
+		ObjectCount:    info.ObjectCount,
+		BytesUsed:      info.BytesUsed,
+		Policies:       make([]*PolicyUsage, 0, len(stats)),
+	}
+	for _, stat := range stats {
+		usage.Policies = append(usage.Policies, &PolicyUsage{
+			Policy:             policyName(policies, stat.StoragePolicyIndex),
+			StoragePolicyIndex: stat.StoragePolicyIndex,
+			ContainerCount:     stat.ContainerCount,
+			ObjectCount:        stat.ObjectCount,
+			BytesUsed:          stat.BytesUsed,
+		})
+	}
+	return usage, nil
+}
+
+// deviceUsage returns the usage of every live account on a device whose name starts with prefix.
+func deviceUsage(logger srv.LowLevelLogger, devicePath, prefix string, policies conf.PolicyList) []*AccountUsage {
+	cancel := make(chan struct{})
+	defer close(cancel)
+	results := make(chan string, 100)
+	go findAccountDbs(logger, devicePath, cancel, results)
+	usages := []*AccountUsage{}
+	for dbFile := range results {
+		db, err := sqliteOpenAccount(dbFile)
+		if err != nil {
+			logger.Error("Unable to open account database", zap.String("dbFile", dbFile), zap.Error(err))
+			continue
+		}
+		usage, err := getAccountUsage(db, policies)
+		db.Close()
+		if err == ErrorNoSuchAccount {
+			continue
+		} else if err != nil {
+			logger.Error("Unable to read account usage", zap.String("dbFile", dbFile), zap.Error(err))
+		} else if usage != nil && strings.HasPrefix(usage.Account, prefix) {
+			usages = append(usages, usage)
+		}
+	}
+	return usages
+}
+
+// AccountUsageHandler handles GET /usage/:device, listing the usage of the device's accounts whose names start with
+// the prefix query parameter.  It's unavailable while another report on the device is still being put together.
+func (server *AccountServer) AccountUsageHandler(writer http.ResponseWriter, request *http.Request) {
+	vars := srv.GetVars(request)
+	if server.usageScans.Acquire(vars["device"], false) != 0 {
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	defer server.usageScans.Release(vars["device"])
+	usages := deviceUsage(srv.GetLogger(request), filepath.Join(server.driveRoot, vars["device"]),
+		request.URL.Query().Get("prefix"), server.policyList)
+	output, err := json.Marshal(usages)
+	if err != nil {
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
+
+// preferUsage returns whether a replica's report of an account's usage should be used over another's. The most recently
+// created account wins, then the replica reporting the most bytes, as the one least likely to have missed updates.
+func preferUsage(a, b *AccountUsage) bool {
+	if a.PutTimestamp != b.PutTimestamp {
+		return a.PutTimestamp > b.PutTimestamp
+	}
+	if a.BytesUsed != b.BytesUsed {
+		return a.BytesUsed > b.BytesUsed
+	}
+	return a.ObjectCount > b.ObjectCount
+}
+
+// GatherUsage asks every device in the account ring for the usage of its accounts whose names start with prefix. It
+// returns each account's usage once, sorted by account name, along with the devices that couldn't report.
+func GatherUsage(client *http.Client, accountRing ring.Ring, prefix string, concurrency int) ([]*AccountUsage, []string) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	accounts := map[string]*AccountUsage{}
+	failed := []string{}
+	for _, dev := range accountRing.AllDevices() {
+		if dev.Ip == "" || dev.Device == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(dev ring.Device) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			name := fmt.Sprintf("%s:%d/%s", dev.Ip, dev.Port, dev.Device)
+			usages, err := getDeviceUsage(client, &dev, prefix)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				failed = append(failed, name)
+				return
+			}
+			for _, usage := range usages {
+				if existing := accounts[usage.Account]; existing == nil || preferUsage(usage, existing) {
+					accounts[usage.Account] = usage
+				}
+			}
+		}(dev)
+	}
+	wg.Wait()
+	usages := make([]*AccountUsage, 0, len(accounts))
+	for _, usage := range accounts {
+		usages = append(usages, usage)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Account < usages[j].Account })
+	sort.Strings(failed)
+	return usages, failed
+}
+
+// getDeviceUsage fetches a device's account usage from its account server.
+func getDeviceUsage(client *http.Client, dev *ring.Device, prefix string) ([]*AccountUsage, error) {
+	resp, err := client.Get(fmt.Sprintf("http://%s:%d/usage/%s?prefix=%s", dev.Ip, dev.Port, dev.Device,
+		url.QueryEscape(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("usage request returned %d", resp.StatusCode)
+	}
+	var usages []*AccountUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usages); err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
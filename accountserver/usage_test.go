@@ -0,0 +1,189 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package accountserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestPolicyName(t *testing.T) {
+	policies := conf.PolicyList{0: &conf.Policy{Index: 0, Name: "gold"}}
+	require.Equal(t, "gold", policyName(policies, 0))
+	require.Equal(t, "3", policyName(policies, 3))
+	require.Equal(t, "0", policyName(nil, 0))
+}
+
+func TestAccountUsageHandler(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	for _, account := range []string{"AUTH_a", "AUTH_b", "other"} {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/"+account, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", "100000000.00001")
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+		for i, policy := range []string{"0", "1", "1"} {
+			rsp := test.MakeCaptureResponse()
+			req, err := http.NewRequest("PUT", "/device/1/"+account+"/c"+strconv.Itoa(i), nil)
+			require.Nil(t, err)
+			req.Header.Set("X-Put-Timestamp", common.GetTimestamp())
+			req.Header.Set("X-Object-Count", "2")
+			req.Header.Set("X-Bytes-Used", "100")
+			req.Header.Set("X-Backend-Storage-Policy-Index", policy)
+			handler.ServeHTTP(rsp, req)
+			require.Equal(t, 201, rsp.Status)
+		}
+	}
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("GET", "/usage/device?prefix=AUTH_", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var usages []*AccountUsage
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &usages))
+	require.Equal(t, 2, len(usages))
+	for _, usage := range usages {
+		require.Contains(t, []string{"AUTH_a", "AUTH_b"}, usage.Account)
+		require.Equal(t, int64(3), usage.ContainerCount)
+		require.Equal(t, int64(6), usage.ObjectCount)
+		require.Equal(t, int64(300), usage.BytesUsed)
+		require.Equal(t, 2, len(usage.Policies))
+		for _, policy := range usage.Policies {
+			if policy.StoragePolicyIndex == 0 {
+				require.Equal(t, &PolicyUsage{Policy: "0", ContainerCount: 1, ObjectCount: 2, BytesUsed: 100}, policy)
+			} else {
+				require.Equal(t, &PolicyUsage{Policy: "1", StoragePolicyIndex: 1, ContainerCount: 2, ObjectCount: 4,
+					BytesUsed: 200}, policy)
+			}
+		}
+	}
+
+	// the JSON listing names each container's policy.
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("GET", "/device/1/AUTH_a?format=json", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 200, rsp.Status)
+	var listing []map[string]interface{}
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &listing))
+	require.Equal(t, 3, len(listing))
+	require.Equal(t, "0", listing[0]["storage_policy"])
+	require.Equal(t, "1", listing[1]["storage_policy"])
+}
+
+func TestAccountUsageHandlerBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sda"), 0777))
+	server := &AccountServer{driveRoot: dir, usageScans: common.NewKeyedLimit(1, 0)}
+	get := func() int {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("GET", "/usage/sda?prefix=AUTH_", nil)
+		require.Nil(t, err)
+		req = srv.SetVars(req, map[string]string{"device": "sda"})
+		req = srv.SetLogger(req, zap.NewNop())
+		server.AccountUsageHandler(rsp, req)
+		return rsp.Status
+	}
+	// a device only puts together one usage report at a time.
+	require.Equal(t, 0, int(server.usageScans.Acquire("sda", false)))
+	require.Equal(t, 503, get())
+	server.usageScans.Release("sda")
+	require.Equal(t, 200, get())
+}
+
+func TestPreferUsage(t *testing.T) {
+	old := &AccountUsage{PutTimestamp: "0000000001.00000", BytesUsed: 500}
+	recreated := &AccountUsage{PutTimestamp: "0000000002.00000", BytesUsed: 10}
+	require.True(t, preferUsage(recreated, old))
+	require.False(t, preferUsage(old, recreated))
+	behind := &AccountUsage{PutTimestamp: "0000000002.00000", BytesUsed: 5}
+	require.True(t, preferUsage(recreated, behind))
+	require.False(t, preferUsage(behind, recreated))
+}
+
+// usageRing is a ring whose devices are all the given hosts.
+type usageRing struct {
+	test.FakeRing
+	devs []ring.Device
+}
+
+func (r *usageRing) AllDevices() []ring.Device {
+	return r.devs
+}
+
+func TestGatherUsage(t *testing.T) {
+	replies := map[string][]*AccountUsage{
+		"sda": {
+			{Account: "AUTH_a", PutTimestamp: "0000000001.00000", BytesUsed: 100},
+			{Account: "AUTH_b", PutTimestamp: "0000000001.00000", BytesUsed: 7},
+		},
+		"sdb": {
+			{Account: "AUTH_a", PutTimestamp: "0000000001.00000", BytesUsed: 90},
+		},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "AUTH_", r.URL.Query().Get("prefix"))
+		usages, ok := replies[r.URL.Path[len("/usage/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusInsufficientStorage)
+			return
+		}
+		json.NewEncoder(w).Encode(usages)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	r := &usageRing{devs: []ring.Device{
+		{Id: 0, Device: "sda", Ip: host, Port: port},
+		{Id: 1, Device: "sdb", Ip: host, Port: port},
+		{Id: 2, Device: "sdc", Ip: host, Port: port},
+		{Id: 3},
+	}}
+	usages, failed := GatherUsage(http.DefaultClient, r, "AUTH_", 2)
+	require.Equal(t, []string{host + ":" + portStr + "/sdc"}, failed)
+	require.Equal(t, 2, len(usages))
+	require.Equal(t, "AUTH_a", usages[0].Account)
+	require.Equal(t, int64(100), usages[0].BytesUsed)
+	require.Equal(t, "AUTH_b", usages[1].Account)
+	require.Equal(t, int64(7), usages[1].BytesUsed)
+}
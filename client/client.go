@@ -78,6 +78,8 @@ type ObjectRecord struct {
 
 // Client is an API interface to CloudFiles.
 type Client interface {
+	// GetURL returns the storage URL requests are sent to, which ends with the account.
+	GetURL() string
 	PutAccount(headers map[string]string) *http.Response
 	PostAccount(headers map[string]string) *http.Response
 	// GetAccount reads the body of the response and converts it into a
@@ -117,7 +117,17 @@ waiting:
 	return chosenResponse
 }
 
-func (c *ProxyDirectClient) firstResponse(reqs ...*http.Request) (resp *http.Response) {
+func (c *ProxyDirectClient) firstResponse(reqs ...*http.Request) *http.Response {
+	return c.firstGoodResponse(true, reqs...)
+}
+
+// firstStreamingResponse is firstResponse for listings, whose bodies are passed along as they arrive instead of being
+// read into memory, however large they are.
+func (c *ProxyDirectClient) firstStreamingResponse(reqs ...*http.Request) *http.Response {
+	return c.firstGoodResponse(false, reqs...)
+}
+
+func (c *ProxyDirectClient) firstGoodResponse(stub bool, reqs ...*http.Request) (resp *http.Response) {
 	success := make(chan *http.Response)
 	returned := make(chan struct{})
 	defer close(returned)
@@ -140,7 +150,9 @@ func (c *ProxyDirectClient) firstResponse(reqs ...*http.Request) (resp *http.Res
 		select {
 		case resp = <-success:
 			if resp != nil && (resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable) {
-				resp = StubResponse(resp)
+				if stub {
+					resp = StubResponse(resp)
+				}
 				resp.Header.Set("Accept-Ranges", "bytes")
 				if etag := resp.Header.Get("Etag"); etag != "" {
 					resp.Header.Set("Etag", strings.Trim(etag, "\""))
@@ -165,6 +177,12 @@ func NewProxyClient(pdc *ProxyDirectClient, mc ring.MemcacheRing, lc map[string]
 	return &proxyClient{pdc: pdc, mc: mc, lc: lc}
 }
 
+// ContainerListingGenerationKey is the memcache key holding the generation the proxy's cached listings of a container
+// are stored under. Deleting it invalidates every cached listing of the container, whatever its query parameters.
+func ContainerListingGenerationKey(account string, container string) string {
+	return fmt.Sprintf("container_listing/%s/%s", account, container)
+}
+
 func (c *proxyClient) invalidateContainerInfo(account string, container string) {
 	key := fmt.Sprintf("container/%s/%s", account, container)
 	if c.lc != nil {
@@ -173,6 +191,13 @@ func (c *proxyClient) invalidateContainerInfo(account string, container string)
 	if c.mc != nil {
 		c.mc.Delete(key)
 	}
+	c.invalidateContainerListings(account, container)
+}
+
+func (c *proxyClient) invalidateContainerListings(account string, container string) {
+	if c.mc != nil {
+		c.mc.Delete(ContainerListingGenerationKey(account, container))
+	}
 }
 
 func (c *proxyClient) PutAccount(account string, headers http.Header) *http.Response {
@@ -212,9 +237,11 @@ func (c *proxyClient) DeleteContainer(account string, container string, headers
 	return c.pdc.DeleteContainer(account, container, headers)
 }
 func (c *proxyClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	defer c.invalidateContainerListings(account, container)
 	return c.pdc.PutObject(account, container, obj, headers, src, c.mc, c.lc)
 }
 func (c *proxyClient) PostObject(account string, container string, obj string, headers http.Header) *http.Response {
+	defer c.invalidateContainerListings(account, container)
 	return c.pdc.PostObject(account, container, obj, headers, c.mc, c.lc)
 }
 func (c *proxyClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
@@ -224,6 +251,7 @@ func (c *proxyClient) HeadObject(account string, container string, obj string, h
 	return c.pdc.HeadObject(account, container, obj, headers, c.mc, c.lc)
 }
 func (c *proxyClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	defer c.invalidateContainerListings(account, container)
 	return c.pdc.DeleteObject(account, container, obj, headers, c.mc, c.lc)
 }
 func (c *proxyClient) ObjectRingFor(account string, container string) (ring.Ring, *http.Response) {
@@ -271,7 +299,7 @@ func (c *ProxyDirectClient) GetAccount(account string, options map[string]string
 		}
 		reqs = append(reqs, req)
 	}
-	return c.firstResponse(reqs...)
+	return c.firstStreamingResponse(reqs...)
 }
 
 func (c *ProxyDirectClient) HeadAccount(account string, headers http.Header) *http.Response {
@@ -381,7 +409,7 @@ func (c *ProxyDirectClient) GetContainer(account string, container string, optio
 		}
 		reqs = append(reqs, req)
 	}
-	return c.firstResponse(reqs...)
+	return c.firstStreamingResponse(reqs...)
 }
 
 // NilContainerInfo is useful for testing.
@@ -563,7 +591,82 @@ func newObjectClient(proxyDirectClient *ProxyDirectClient, account string, conta
 	if err != nil {
 		return &erroringObjectClient{body: fmt.Sprintf("Could not load object ring for policy %d.", ci.StoragePolicyIndex)}
 	}
-	return &standardObjectClient{proxyDirectClient: proxyDirectClient, account: account, container: container, policy: ci.StoragePolicyIndex, objectRing: objectRing}
+	oc := &standardObjectClient{proxyDirectClient: proxyDirectClient, account: account, container: container, policy: ci.StoragePolicyIndex, objectRing: objectRing}
+	target, err := strconv.Atoi(ci.SysMetadata[conf.PolicyMigrationSysmeta])
+	if err != nil || target == ci.StoragePolicyIndex {
+		return oc
+	}
+	targetRing, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, target)
+	if err != nil {
+		return &erroringObjectClient{body: fmt.Sprintf("Could not load object ring for policy %d.", target)}
+	}
+	return &migratingObjectClient{
+		from: oc,
+		to:   &standardObjectClient{proxyDirectClient: proxyDirectClient, account: account, container: container, policy: target, objectRing: targetRing},
+	}
+}
+
+// migratingObjectClient handles the objects of a container being migrated to another storage policy. New objects go
+// to the new policy, and reads fall back to the old one for objects the migrator hasn't gotten to yet.
+type migratingObjectClient struct {
+	from proxyObjectClient
+	to   proxyObjectClient
+}
+
+func (oc *migratingObjectClient) putObject(obj string, headers http.Header, src io.Reader) *http.Response {
+	return oc.to.putObject(obj, headers, src)
+}
+
+func (oc *migratingObjectClient) postObject(obj string, headers http.Header) *http.Response {
+	resp := oc.to.postObject(obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.postObject(obj, headers)
+}
+
+func (oc *migratingObjectClient) getObject(obj string, headers http.Header) *http.Response {
+	resp := oc.to.getObject(obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.getObject(obj, headers)
+}
+
+func (oc *migratingObjectClient) grepObject(obj string, search string) *http.Response {
+	resp := oc.to.grepObject(obj, search)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.grepObject(obj, search)
+}
+
+func (oc *migratingObjectClient) headObject(obj string, headers http.Header) *http.Response {
+	resp := oc.to.headObject(obj, headers)
+	if resp.StatusCode != http.StatusNotFound {
+		return resp
+	}
+	resp.Body.Close()
+	return oc.from.headObject(obj, headers)
+}
+
+// deleteObject deletes the object from both policies, so a read can't fall back to a copy the migrator hasn't moved.
+func (oc *migratingObjectClient) deleteObject(obj string, headers http.Header) *http.Response {
+	fromResp := oc.from.deleteObject(obj, headers)
+	resp := oc.to.deleteObject(obj, headers)
+	if resp.StatusCode == http.StatusNotFound && fromResp.StatusCode/100 == 2 {
+		resp.Body.Close()
+		return fromResp
+	}
+	fromResp.Body.Close()
+	return resp
+}
+
+func (oc *migratingObjectClient) ring() (ring.Ring, *http.Response) {
+	return oc.to.ring()
 }
 
 func (oc *standardObjectClient) putObject(obj string, headers http.Header, src io.Reader) *http.Response {
@@ -728,6 +831,10 @@ type directClient struct {
 
 var _ Client = &directClient{}
 
+func (c *directClient) GetURL() string {
+	return "/v1/" + common.Urlencode(c.account)
+}
+
 func (c *directClient) PutAccount(headers map[string]string) *http.Response {
 	return c.pc.PutAccount(c.account, common.Map2Headers(headers))
 }
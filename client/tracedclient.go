@@ -0,0 +1,138 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/tracing"
+)
+
+// tracedProxyClient records a span for each backend call and passes the
+// trace on to the storage servers in the traceparent header.
+type tracedProxyClient struct {
+	ProxyClient
+	span *tracing.Span
+}
+
+var _ ProxyClient = &tracedProxyClient{}
+
+// NewTracedProxyClient wraps c so its calls are traced as children of span.
+// Wrapping an already traced client replaces its parent span rather than nesting.
+func NewTracedProxyClient(c ProxyClient, span *tracing.Span) ProxyClient {
+	if t, ok := c.(*tracedProxyClient); ok {
+		c = t.ProxyClient
+	}
+	if span == nil {
+		return c
+	}
+	return &tracedProxyClient{ProxyClient: c, span: span}
+}
+
+// start begins a span for a backend call and returns a copy of headers carrying it.
+// GET spans end when the response headers arrive, not when the body has been read.
+func (c *tracedProxyClient) start(name string, path string, headers http.Header) (*tracing.Span, http.Header) {
+	span := c.span.Child(name)
+	span.SetAttribute("path", path)
+	traced := make(http.Header, len(headers)+1)
+	for k, v := range headers {
+		traced[k] = v
+	}
+	span.Inject(traced)
+	return span, traced
+}
+
+func (c *tracedProxyClient) finish(span *tracing.Span, resp *http.Response) *http.Response {
+	if resp != nil {
+		span.SetAttribute("status", strconv.Itoa(resp.StatusCode))
+	}
+	span.Finish()
+	return resp
+}
+
+func (c *tracedProxyClient) PutAccount(account string, headers http.Header) *http.Response {
+	span, headers := c.start("PUT account", account, headers)
+	return c.finish(span, c.ProxyClient.PutAccount(account, headers))
+}
+
+func (c *tracedProxyClient) PostAccount(account string, headers http.Header) *http.Response {
+	span, headers := c.start("POST account", account, headers)
+	return c.finish(span, c.ProxyClient.PostAccount(account, headers))
+}
+
+func (c *tracedProxyClient) GetAccount(account string, options map[string]string, headers http.Header) *http.Response {
+	span, headers := c.start("GET account", account, headers)
+	return c.finish(span, c.ProxyClient.GetAccount(account, options, headers))
+}
+
+func (c *tracedProxyClient) HeadAccount(account string, headers http.Header) *http.Response {
+	span, headers := c.start("HEAD account", account, headers)
+	return c.finish(span, c.ProxyClient.HeadAccount(account, headers))
+}
+
+func (c *tracedProxyClient) DeleteAccount(account string, headers http.Header) *http.Response {
+	span, headers := c.start("DELETE account", account, headers)
+	return c.finish(span, c.ProxyClient.DeleteAccount(account, headers))
+}
+
+func (c *tracedProxyClient) PutContainer(account string, container string, headers http.Header) *http.Response {
+	span, headers := c.start("PUT container", account+"/"+container, headers)
+	return c.finish(span, c.ProxyClient.PutContainer(account, container, headers))
+}
+
+func (c *tracedProxyClient) PostContainer(account string, container string, headers http.Header) *http.Response {
+	span, headers := c.start("POST container", account+"/"+container, headers)
+	return c.finish(span, c.ProxyClient.PostContainer(account, container, headers))
+}
+
+func (c *tracedProxyClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	span, headers := c.start("GET container", account+"/"+container, headers)
+	return c.finish(span, c.ProxyClient.GetContainer(account, container, options, headers))
+}
+
+func (c *tracedProxyClient) GetContainerInfo(account string, container string) *ContainerInfo {
+	span := c.span.Child("container info")
+	span.SetAttribute("path", account+"/"+container)
+	defer span.Finish()
+	return c.ProxyClient.GetContainerInfo(account, container)
+}
+
+func (c *tracedProxyClient) HeadContainer(account string, container string, headers http.Header) *http.Response {
+	span, headers := c.start("HEAD container", account+"/"+container, headers)
+	return c.finish(span, c.ProxyClient.HeadContainer(account, container, headers))
+}
+
+func (c *tracedProxyClient) DeleteContainer(account string, container string, headers http.Header) *http.Response {
+	span, headers := c.start("DELETE container", account+"/"+container, headers)
+	return c.finish(span, c.ProxyClient.DeleteContainer(account, container, headers))
+}
+
+func (c *tracedProxyClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	span, headers := c.start("PUT object", account+"/"+container+"/"+obj, headers)
+	return c.finish(span, c.ProxyClient.PutObject(account, container, obj, headers, src))
+}
+
+func (c *tracedProxyClient) PostObject(account string, container string, obj string, headers http.Header) *http.Response {
+	span, headers := c.start("POST object", account+"/"+container+"/"+obj, headers)
+	return c.finish(span, c.ProxyClient.PostObject(account, container, obj, headers))
+}
+
+func (c *tracedProxyClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	span, headers := c.start("GET object", account+"/"+container+"/"+obj, headers)
+	return c.finish(span, c.ProxyClient.GetObject(account, container, obj, headers))
+}
+
+func (c *tracedProxyClient) HeadObject(account string, container string, obj string, headers http.Header) *http.Response {
+	span, headers := c.start("HEAD object", account+"/"+container+"/"+obj, headers)
+	return c.finish(span, c.ProxyClient.HeadObject(account, container, obj, headers))
+}
+
+func (c *tracedProxyClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	span, headers := c.start("DELETE object", account+"/"+container+"/"+obj, headers)
+	return c.finish(span, c.ProxyClient.DeleteObject(account, container, obj, headers))
+}
+
+func (c *tracedProxyClient) ObjectRingFor(account string, container string) (ring.Ring, *http.Response) {
+	return c.ProxyClient.ObjectRingFor(account, container)
+}
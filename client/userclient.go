@@ -61,6 +61,10 @@ func (c *userClient) doRequest(method string, path string, body io.Reader, heade
 	return c.do(req)
 }
 
+func (c *userClient) GetURL() string {
+	return c.ServiceURL
+}
+
 func (c *userClient) PutAccount(headers map[string]string) *http.Response {
 	return c.doRequest("PUT", "", nil, headers)
 }
@@ -177,7 +181,7 @@ func (c *userClient) authenticatev1() *http.Response {
 	}
 	c.ServiceURL = resp.Header.Get("X-Storage-Url")
 	c.AuthToken = resp.Header.Get("X-Auth-Token")
-	if c.ServiceURL == "" || c.AuthToken != "" {
+	if c.ServiceURL == "" || c.AuthToken == "" {
 		resp.Body.Close()
 		return ResponseStub(http.StatusInternalServerError, "Response did not have X-Storage-Url or X-Auth-Token headers.")
 	}
@@ -32,10 +32,12 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/containerserver"
 	"github.com/troubling/hummingbird/objectserver"
 	"github.com/troubling/hummingbird/proxyserver"
+	"github.com/troubling/hummingbird/tools"
 )
 
 const (
@@ -197,7 +199,7 @@ func processControlCommand(serverCommand func(name string, args ...string) error
 	}
 
 	switch flag.Arg(1) {
-	case "proxy", "object", "object-replicator", "object-auditor", "container", "container-replicator", "account", "account-replicator":
+	case "proxy", "object", "object-replicator", "object-auditor", "container", "container-replicator", "container-sharder", "container-auditor", "container-reconciler", "container-migrator", "account", "account-replicator", "account-auditor":
 		if err := serverCommand(flag.Arg(1), flag.Args()[2:]...); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
@@ -214,7 +216,8 @@ func processControlCommand(serverCommand func(name string, args ...string) error
 	case "all":
 		exc := 0
 		for _, server := range []string{"proxy", "object", "object-replicator", "object-auditor",
-			"container", "container-replicator", "account", "account-replicator"} {
+			"container", "container-replicator", "container-sharder", "container-auditor", "container-reconciler",
+			"container-migrator", "account", "account-replicator", "account-auditor"} {
 			if err := serverCommand(server); err != nil {
 				fmt.Fprintln(os.Stderr, server, ":", err)
 				exc = 1
@@ -297,6 +300,50 @@ func main() {
 		containerReplicatorFlags.PrintDefaults()
 	}
 
+	containerSharderFlags := flag.NewFlagSet("container sharder", flag.ExitOnError)
+	containerSharderFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerSharderFlags.String("l", "stdout", "Log location")
+	containerSharderFlags.String("e", "stderr", "Error log location")
+	containerSharderFlags.Bool("once", false, "Run one pass of the sharder")
+	containerSharderFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-sharder [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container sharder")
+		containerSharderFlags.PrintDefaults()
+	}
+
+	containerAuditorFlags := flag.NewFlagSet("container auditor", flag.ExitOnError)
+	containerAuditorFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerAuditorFlags.String("l", "stdout", "Log location")
+	containerAuditorFlags.String("e", "stderr", "Error log location")
+	containerAuditorFlags.Bool("once", false, "Run one pass of the auditor")
+	containerAuditorFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-auditor [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container auditor")
+		containerAuditorFlags.PrintDefaults()
+	}
+
+	containerReconcilerFlags := flag.NewFlagSet("container reconciler", flag.ExitOnError)
+	containerReconcilerFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerReconcilerFlags.String("l", "stdout", "Log location")
+	containerReconcilerFlags.String("e", "stderr", "Error log location")
+	containerReconcilerFlags.Bool("once", false, "Run one pass of the reconciler")
+	containerReconcilerFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-reconciler [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container reconciler")
+		containerReconcilerFlags.PrintDefaults()
+	}
+
+	containerMigratorFlags := flag.NewFlagSet("container migrator", flag.ExitOnError)
+	containerMigratorFlags.String("c", findConfig("container"), "Config file/directory to use")
+	containerMigratorFlags.String("l", "stdout", "Log location")
+	containerMigratorFlags.String("e", "stderr", "Error log location")
+	containerMigratorFlags.Bool("once", false, "Run one pass of the migrator")
+	containerMigratorFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird container-migrator [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run container migrator")
+		containerMigratorFlags.PrintDefaults()
+	}
+
 	accountFlags := flag.NewFlagSet("account server", flag.ExitOnError)
 	accountFlags.String("c", findConfig("account"), "Config file/directory to use")
 	accountFlags.String("l", "stdout", "Log location")
@@ -318,6 +365,17 @@ func main() {
 		accountReplicatorFlags.PrintDefaults()
 	}
 
+	accountAuditorFlags := flag.NewFlagSet("account auditor", flag.ExitOnError)
+	accountAuditorFlags.String("c", findConfig("account"), "Config file/directory to use")
+	accountAuditorFlags.String("l", "stdout", "Log location")
+	accountAuditorFlags.String("e", "stderr", "Error log location")
+	accountAuditorFlags.Bool("once", false, "Run one pass of the auditor")
+	accountAuditorFlags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "hummingbird account-auditor [ARGS]")
+		fmt.Fprintln(os.Stderr, "  Run account auditor")
+		accountAuditorFlags.PrintDefaults()
+	}
+
 	/* main flag parser, which doesn't do much */
 
 	flag.Usage = func() {
@@ -340,14 +398,42 @@ func main() {
 		fmt.Fprintln(os.Stderr)
 		proxyFlags.Usage()
 		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird ring [builder file] [command] [args]")
+		fmt.Fprintln(os.Stderr, "  Create, rebalance and write rings; run with no arguments for the commands")
+		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "hummingbird moveparts [old ring.gz]")
 		fmt.Fprintln(os.Stderr, "  Prioritize replication for moving partitions after a ring change")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "hummingbird restoredevice [ip] [device-name]")
 		fmt.Fprintln(os.Stderr, "  Reconstruct a device from its peers")
 		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird drive-replace [-p policy] [-state FILE] [ip] [device-name]")
+		fmt.Fprintln(os.Stderr, "  Rebuild a replaced device from its peers, reporting progress and verifying the result; rerun to resume")
+		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "hummingbird rescueparts [partnum1,partnum2,...]")
 		fmt.Fprintln(os.Stderr, "  Will send requests to all the object nodes to try to fully replicate given partitions if they have them.")
+		fmt.Fprintln(os.Stderr, "  moveparts, restoredevice and rescueparts also take -dry-run, -jobs-per-second, -bandwidth, -state and -retries")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird dispersion [populate|report] [-c CONFIG] [-json]")
+		fmt.Fprintln(os.Stderr, "  Populate, then report on, containers and objects spread across the rings")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird recon [-type object|container|account] [-json] [check ...]")
+		fmt.Fprintln(os.Stderr, "  Query every server in the ring for recon data and summarize it")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird get-nodes [policy] ACCOUNT[/CONTAINER[/OBJECT]]")
+		fmt.Fprintln(os.Stderr, "  Show the partition, primary and handoff nodes and on-disk paths for an item")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird object-info OBJECT_FILE")
+		fmt.Fprintln(os.Stderr, "  Show an object file's metadata and verify its ETag")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird db-info DB_FILE")
+		fmt.Fprintln(os.Stderr, "  Show an account or container database's info, metadata, sync points and row counts")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird quarantine [-devices DIR] list|inspect ITEM|restore ITEM|purge")
+		fmt.Fprintln(os.Stderr, "  List, inspect, restore or purge quarantined objects and databases on local devices")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "hummingbird usage-report [-prefix PREFIX] [-format csv|json]")
+		fmt.Fprintln(os.Stderr, "  Crawl the account servers and report every account's usage by storage policy")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "hummingbird bench CONFIG")
 		fmt.Fprintln(os.Stderr, "  Run bench tool")
@@ -391,12 +477,27 @@ func main() {
 	case "container-replicator":
 		containerReplicatorFlags.Parse(flag.Args()[1:])
 		srv.RunDaemon(containerserver.GetReplicator, containerReplicatorFlags)
+	case "container-sharder":
+		containerSharderFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(containerserver.GetSharder, containerSharderFlags)
+	case "container-auditor":
+		containerAuditorFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(containerserver.GetAuditor, containerAuditorFlags)
+	case "container-reconciler":
+		containerReconcilerFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(containerserver.GetReconciler, containerReconcilerFlags)
+	case "container-migrator":
+		containerMigratorFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(containerserver.GetMigrator, containerMigratorFlags)
 	case "account":
 		accountFlags.Parse(flag.Args()[1:])
 		srv.RunServers(accountserver.GetServer, accountFlags)
 	case "account-replicator":
 		accountReplicatorFlags.Parse(flag.Args()[1:])
 		srv.RunDaemon(accountserver.GetReplicator, accountReplicatorFlags)
+	case "account-auditor":
+		accountAuditorFlags.Parse(flag.Args()[1:])
+		srv.RunDaemon(accountserver.GetAuditor, accountAuditorFlags)
 	case "object":
 		objectFlags.Parse(flag.Args()[1:])
 		srv.RunServers(objectserver.GetServer, objectFlags)
@@ -416,12 +517,30 @@ func main() {
 		bench.RunCGBench(flag.Args()[1:])
 	case "thrash":
 		bench.RunThrash(flag.Args()[1:])
+	case "ring":
+		ring.BuilderCommand(flag.Args()[1:])
 	case "moveparts":
 		objectserver.MoveParts(flag.Args()[1:])
 	case "restoredevice":
 		objectserver.RestoreDevice(flag.Args()[1:])
+	case "drive-replace":
+		objectserver.DriveReplace(flag.Args()[1:])
 	case "rescueparts":
 		objectserver.RescueParts(flag.Args()[1:])
+	case "dispersion":
+		tools.Dispersion(flag.Args()[1:])
+	case "recon":
+		tools.Recon(flag.Args()[1:])
+	case "get-nodes":
+		tools.GetNodes(flag.Args()[1:])
+	case "object-info":
+		tools.ObjectInfo(flag.Args()[1:])
+	case "db-info":
+		tools.DBInfo(flag.Args()[1:])
+	case "quarantine":
+		tools.Quarantine(flag.Args()[1:])
+	case "usage-report":
+		tools.UsageReport(flag.Args()[1:])
 	default:
 		flag.Usage()
 	}
@@ -0,0 +1,75 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter paces the bytes sent through it so that, taken together, they average no more than a set number
+// of bytes per second. A nil *BandwidthLimiter doesn't limit anything.
+type BandwidthLimiter struct {
+	lock           sync.Mutex
+	bytesPerSecond int64
+	// paidUntil is when the bytes sent so far will have been paid for at the limit.
+	paidUntil time.Time
+}
+
+// NewBandwidthLimiter returns a limiter for bytesPerSecond, or nil if bytesPerSecond isn't positive.
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &BandwidthLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// Wait accounts for n bytes sent and blocks until the limit allows sending more.
+func (b *BandwidthLimiter) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	now := time.Now()
+	if b.paidUntil.Before(now) {
+		// idle time doesn't bank credit for a later burst.
+		b.paidUntil = now
+	}
+	b.paidUntil = b.paidUntil.Add(time.Duration(float64(n) / float64(b.bytesPerSecond) * float64(time.Second)))
+	delay := b.paidUntil.Sub(now)
+	b.lock.Unlock()
+	time.Sleep(delay)
+}
+
+type bandwidthReader struct {
+	r io.Reader
+	b *BandwidthLimiter
+}
+
+func (br *bandwidthReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.b.Wait(n)
+	return n, err
+}
+
+// Reader returns a reader that reads from r at no more than the limiter's rate.
+func (b *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &bandwidthReader{r: r, b: b}
+}
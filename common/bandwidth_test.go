@@ -0,0 +1,72 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilBandwidthLimiter(t *testing.T) {
+	require.Nil(t, NewBandwidthLimiter(0))
+	require.Nil(t, NewBandwidthLimiter(-1))
+	var b *BandwidthLimiter
+	r := bytes.NewReader([]byte("data"))
+	require.True(t, b.Reader(r) == r)
+	start := time.Now()
+	b.Wait(1 << 30)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestBandwidthLimiterReader(t *testing.T) {
+	b := NewBandwidthLimiter(10000)
+	start := time.Now()
+	data, err := ioutil.ReadAll(b.Reader(bytes.NewReader(make([]byte, 2000))))
+	require.Nil(t, err)
+	require.Equal(t, 2000, len(data))
+	elapsed := time.Since(start)
+	require.True(t, elapsed >= 190*time.Millisecond, elapsed.String())
+	require.True(t, elapsed < 2*time.Second, elapsed.String())
+}
+
+func TestBandwidthLimiterShared(t *testing.T) {
+	b := NewBandwidthLimiter(10000)
+	start := time.Now()
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			ioutil.ReadAll(b.Reader(bytes.NewReader(make([]byte, 1000))))
+			done <- struct{}{}
+		}()
+	}
+	<-done
+	<-done
+	elapsed := time.Since(start)
+	require.True(t, elapsed >= 190*time.Millisecond, elapsed.String())
+}
+
+func TestBandwidthLimiterNoIdleCredit(t *testing.T) {
+	b := NewBandwidthLimiter(10000)
+	b.Wait(100)
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	b.Wait(1000)
+	require.True(t, time.Since(start) >= 90*time.Millisecond)
+}
@@ -32,6 +32,10 @@ type Policy struct {
 
 type PolicyList map[int]*Policy
 
+// PolicyMigrationSysmeta is the container sysmeta, less its X-Container-Sysmeta- prefix, holding the index of the
+// storage policy a container's objects are being migrated to.
+const PolicyMigrationSysmeta = "Policy-Migration"
+
 func (p PolicyList) Default() int {
 	for _, v := range p {
 		if v.Default {
@@ -0,0 +1,231 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package dbauditor audits the account and container servers' databases.
+package dbauditor
+
+import (
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/middleware"
+	"go.uber.org/zap"
+)
+
+// Auditor is a daemon which checks every account or container database on the server for corruption and misplacement,
+// quarantining any that fail.  The account and container servers supply how to find and open their databases.
+type Auditor struct {
+	// Type is "account" or "container", naming the auditor's logs and recon cache entries.
+	Type           string
+	CheckMounts    bool
+	DeviceRoot     string
+	HashPathPrefix string
+	HashPathSuffix string
+	Logger         srv.LowLevelLogger
+	Ring           ring.Ring
+	// PerSecond limits how many databases are audited a second, if it's positive.
+	PerSecond      int64
+	Interval       time.Duration
+	LogTime        time.Duration
+	ReconCachePath string
+	// FindDatabases sends the path of every database on a device to results, closing it when done.
+	FindDatabases func(logger srv.LowLevelLogger, devicePath string, cancel chan struct{}, results chan string)
+	// OpenDatabase checks a database's integrity, returning the account and container it's for; the container is empty
+	// for an account database.  It returns a Failure if the database is corrupt.
+	OpenDatabase func(dbFile string) (account, container string, err error)
+	// Missing is the error OpenDatabase returns for a database that's since been removed, which isn't a failure.
+	Missing error
+	// Cancel stops a pass's walk of a device when closed.
+	Cancel      chan struct{}
+	passStart   time.Time
+	reportStart time.Time
+	audited     int64
+	passes      int64
+	failures    int64
+}
+
+// Failure is an audit failure, which gets the database quarantined: the database is corrupt or misplaced.
+// OpenDatabase returns one for a corrupt database; any other error, like the database being locked, leaves the database
+// to be audited again later.
+type Failure struct {
+	Err error
+}
+
+func (f *Failure) Error() string {
+	return f.Err.Error()
+}
+
+// rateLimitSleep long enough to achieve the target rate limit.
+func rateLimitSleep(startTime time.Time, done int64, rate int64) {
+	shouldHaveDone := int64(time.Since(startTime)/time.Second) * rate
+	if done > shouldHaveDone {
+		time.Sleep(time.Second * time.Duration((done-shouldHaveDone)/rate))
+	}
+}
+
+// QuarantineDatabase moves a database's hash directory into its device's quarantined directory.
+func QuarantineDatabase(dbFile string) error {
+	hashDir := filepath.Dir(dbFile)
+	//                    type dir     partition    suffix
+	typeDir := filepath.Dir(filepath.Dir(filepath.Dir(hashDir)))
+	quarantineDir := filepath.Join(filepath.Dir(typeDir), "quarantined", filepath.Base(typeDir))
+	if err := os.MkdirAll(quarantineDir, 0755); err != nil {
+		return err
+	}
+	destDir := filepath.Join(quarantineDir, filepath.Base(hashDir)+"-"+common.UUID())
+	if err := os.Rename(hashDir, destDir); err != nil {
+		return err
+	}
+	// the directory's mtime is when it was quarantined, for purging old quarantines.
+	now := time.Now()
+	return os.Chtimes(destDir, now, now)
+}
+
+// Hash returns the hash directory name of an account or container database.
+func (a *Auditor) Hash(account, container string) string {
+	path := "/" + account
+	if container != "" {
+		path += "/" + container
+	}
+	return fmt.Sprintf("%032x", md5.Sum([]byte(a.HashPathPrefix+path+a.HashPathSuffix)))
+}
+
+// auditDatabase checks a database's integrity and that it's in the partition and hash directory its name hashes to.
+func (a *Auditor) auditDatabase(dbFile string) error {
+	account, container, err := a.OpenDatabase(dbFile)
+	if err != nil {
+		return err
+	}
+	name := "/" + account
+	if container != "" {
+		name += "/" + container
+	}
+	hashDir := filepath.Dir(dbFile)
+	suffixDir := filepath.Dir(hashDir)
+	hash := a.Hash(account, container)
+	if filepath.Base(hashDir) != hash || filepath.Base(suffixDir) != hash[29:32] {
+		return &Failure{Err: fmt.Errorf("Database for %s should be in hash directory %s", name, hash)}
+	}
+	partition := strconv.FormatUint(a.Ring.GetPartition(account, container, ""), 10)
+	if filepath.Base(filepath.Dir(suffixDir)) != partition {
+		return &Failure{Err: fmt.Errorf("Database for %s should be in partition %s", name, partition)}
+	}
+	return nil
+}
+
+// auditDevice audits every database on a device.
+func (a *Auditor) auditDevice(devicePath string) {
+	defer srv.LogPanics(a.Logger, "PANIC WHILE AUDITING DEVICE")
+	if mount, err := fs.IsMount(devicePath); a.CheckMounts && (err != nil || !mount) {
+		a.Logger.Error("Skipping unmounted device", zap.String("devicePath", devicePath))
+		return
+	}
+	results := make(chan string, 100)
+	go a.FindDatabases(a.Logger, devicePath, a.Cancel, results)
+	var retries []string
+	for dbFile := range results {
+		a.audited++
+		if a.PerSecond > 0 {
+			rateLimitSleep(a.passStart, a.audited, a.PerSecond)
+		}
+		if err := a.audit(dbFile); err != nil {
+			retries = append(retries, dbFile)
+		}
+		if time.Since(a.reportStart) > a.LogTime {
+			a.statsReport()
+		}
+	}
+	// databases that couldn't be checked, say because they were busy, get another try once the rest are done.
+	for _, dbFile := range retries {
+		if err := a.audit(dbFile); err != nil {
+			a.Logger.Error("Unable to audit database, leaving it for the next pass", zap.String("dbFile", dbFile),
+				zap.Error(err))
+		}
+	}
+}
+
+// audit audits a database, quarantining it if it fails.  It returns any error that kept the database from being
+// checked.
+func (a *Auditor) audit(dbFile string) error {
+	err := a.auditDatabase(dbFile)
+	if failure, ok := err.(*Failure); ok {
+		a.failures++
+		a.Logger.Error("Failed audit and is being quarantined", zap.String("dbFile", dbFile), zap.Error(failure))
+		if err := QuarantineDatabase(dbFile); err != nil {
+			a.Logger.Error("Error quarantining database", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+		return nil
+	} else if err == nil {
+		a.passes++
+	} else if a.Missing == nil || err != a.Missing {
+		return err
+	}
+	return nil
+}
+
+// statsReport logs the audits since the last report and writes them to the recon cache.
+func (a *Auditor) statsReport() {
+	a.Logger.Info(strings.Title(a.Type)+" audit stats",
+		zap.String("since", a.reportStart.Format(time.ANSIC)),
+		zap.Int64("passed", a.passes),
+		zap.Int64("failed", a.failures))
+	middleware.DumpReconCache(a.ReconCachePath, a.Type, map[string]interface{}{
+		a.Type + "_audits_since":  float64(a.reportStart.UnixNano()) / float64(time.Second),
+		a.Type + "_audits_passed": a.passes,
+		a.Type + "_audits_failed": a.failures,
+	})
+	a.reportStart = time.Now()
+	a.passes = 0
+	a.failures = 0
+}
+
+// Run runs a pass of the auditor once.
+func (a *Auditor) Run() {
+	a.passStart = time.Now()
+	a.reportStart = a.passStart
+	a.audited = 0
+	a.Logger.Info("Begin "+a.Type+" audit", zap.String("deviceRoot", a.DeviceRoot))
+	devices, err := fs.ReadDirNames(a.DeviceRoot)
+	if err != nil {
+		a.Logger.Error("Unable to list devices", zap.String("deviceRoot", a.DeviceRoot), zap.Error(err))
+		return
+	}
+	for _, dev := range devices {
+		a.auditDevice(filepath.Join(a.DeviceRoot, dev))
+	}
+	a.statsReport()
+	elapsed := time.Since(a.passStart).Seconds()
+	a.Logger.Info(strings.Title(a.Type)+" audit pass completed", zap.Int64("audited", a.audited),
+		zap.Float64("seconds", elapsed))
+	middleware.DumpReconCache(a.ReconCachePath, a.Type,
+		map[string]interface{}{a.Type + "_auditor_pass_completed": elapsed})
+}
+
+// RunForever runs the auditor in a forever-loop.
+func (a *Auditor) RunForever() {
+	for {
+		a.Run()
+		time.Sleep(a.Interval)
+	}
+}
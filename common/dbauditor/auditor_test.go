@@ -0,0 +1,123 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package dbauditor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func TestQuarantineDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "sda", "containers", "1", "abc", "fffabc", "fffabc.db")
+	require.Nil(t, os.MkdirAll(filepath.Dir(dbFile), 0755))
+	require.Nil(t, ioutil.WriteFile(dbFile, []byte("not a database"), 0644))
+	require.Nil(t, QuarantineDatabase(dbFile))
+	require.False(t, fs.Exists(filepath.Dir(dbFile)))
+	quarantined, err := filepath.Glob(filepath.Join(dir, "sda", "quarantined", "containers", "fffabc-*", "fffabc.db"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(quarantined))
+}
+
+func TestHash(t *testing.T) {
+	a := &Auditor{HashPathPrefix: "prefix", HashPathSuffix: "suffix"}
+	require.Equal(t, "39479f47b417fa7427db00ac1352bc50", a.Hash("a", ""))
+	require.Equal(t, "d90fc4f300a0781e90e8aa3924568b13", a.Hash("a", "c"))
+}
+
+func TestAuditorRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	errMissing := errors.New("missing")
+	lockedOpens := 0
+	// each database's file holds its account and container, or "corrupt", "locked" or "missing".
+	a := &Auditor{Type: "container", DeviceRoot: dir, Logger: zap.NewNop(), Ring: &test.FakeRing{},
+		ReconCachePath: dir, LogTime: time.Hour, Missing: errMissing,
+		FindDatabases: func(logger srv.LowLevelLogger, devicePath string, cancel chan struct{}, results chan string) {
+			defer close(results)
+			dbFiles, _ := filepath.Glob(filepath.Join(devicePath, "containers", "*", "*", "*", "*.db"))
+			for _, dbFile := range dbFiles {
+				results <- dbFile
+			}
+		},
+		OpenDatabase: func(dbFile string) (string, string, error) {
+			data, err := ioutil.ReadFile(dbFile)
+			if err != nil {
+				return "", "", err
+			}
+			switch string(data) {
+			case "corrupt":
+				return "", "", &Failure{Err: errors.New("not a database")}
+			case "locked":
+				lockedOpens++
+				return "", "", errors.New("database is locked")
+			case "missing":
+				return "", "", errMissing
+			}
+			parts := strings.SplitN(string(data), "/", 2)
+			return parts[0], parts[1], nil
+		},
+	}
+	write := func(partition, account, container, contents string) string {
+		hash := a.Hash(account, container)
+		dbFile := filepath.Join(dir, "sda", "containers", partition, hash[29:32], hash, hash+".db")
+		require.Nil(t, os.MkdirAll(filepath.Dir(dbFile), 0755))
+		require.Nil(t, ioutil.WriteFile(dbFile, []byte(contents), 0644))
+		return dbFile
+	}
+	// a database in the right place, one in the wrong partition, one in the wrong hash directory, a corrupt one, one
+	// that's busy and one that's gone.
+	good := write("0", "a", "c", "a/c")
+	misplaced := write("5", "a", "c2", "a/c2")
+	misnamed := write("0", "a", "c3", "a/c4")
+	corrupt := write("0", "a", "c5", "corrupt")
+	missing := write("0", "a", "c6", "missing")
+	locked := write("0", "a", "c7", "locked")
+
+	a.Run()
+	require.True(t, fs.Exists(good))
+	require.False(t, fs.Exists(misplaced))
+	require.False(t, fs.Exists(misnamed))
+	require.False(t, fs.Exists(corrupt))
+	require.True(t, fs.Exists(missing))
+	require.True(t, fs.Exists(locked))
+	require.Equal(t, 2, lockedOpens)
+	quarantined, err := filepath.Glob(filepath.Join(dir, "sda", "quarantined", "containers", "*", "*.db"))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(quarantined))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "container.recon"))
+	require.Nil(t, err)
+	var recon map[string]interface{}
+	require.Nil(t, json.Unmarshal(data, &recon))
+	require.Equal(t, float64(1), recon["container_audits_passed"])
+	require.Equal(t, float64(3), recon["container_audits_failed"])
+	require.NotNil(t, recon["container_auditor_pass_completed"])
+}
@@ -0,0 +1,396 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package metrics keeps counters, gauges and histograms and serves them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType is the Content-Type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram upper bounds, in seconds, suited to request latencies.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Registry holds a set of metrics and writes them out when scraped.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []collector
+	names   map[string]bool
+	// prepare are called at the start of every scrape, before any metric is collected.
+	prepare []func()
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+func (r *Registry) register(name string, c collector) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, c)
+}
+
+// OnCollect registers fn to be called at the start of every scrape, so func metrics sharing an expensive source can
+// read it once per scrape rather than once each.
+func (r *Registry) OnCollect(fn func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.prepare = append(r.prepare, fn)
+}
+
+// Write writes every metric in the registry in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]collector{}, r.metrics...)
+	prepare := append([]func(){}, r.prepare...)
+	r.lock.Unlock()
+	for _, fn := range prepare {
+		fn()
+	}
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// ServeHTTP serves the registry's metrics.
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", ContentType)
+	writer.WriteHeader(http.StatusOK)
+	if request.Method != "HEAD" {
+		r.Write(writer)
+	}
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatLabels renders label pairs as {a="1",b="2"}, or nothing if there are none.
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series is a single value of a labelled metric.
+type series struct {
+	labels []string
+	value  float64
+}
+
+// vector is the state shared by counters and gauges.
+type vector struct {
+	desc
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func (v *vector) get(values []string) *series {
+	v.checkLabels(values)
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vector) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.writeHeader(w)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	vector
+}
+
+// NewCounter registers a counter, labelled by the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vector{desc: desc{name, help, "counter", labels}, series: map[string]*series{}}}
+	r.register(name, c)
+	return c
+}
+
+// Add adds delta, which must not be negative, to the counter with the given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.name))
+	}
+	c.lock.Lock()
+	c.get(labelValues).value += delta
+	c.lock.Unlock()
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	vector
+}
+
+// NewGauge registers a gauge, labelled by the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vector{desc: desc{name, help, "gauge", labels}, series: map[string]*series{}}}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the gauge with the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	g.get(labelValues).value = value
+	g.lock.Unlock()
+}
+
+// Add adds delta to the gauge with the given label values.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.lock.Lock()
+	g.get(labelValues).value += delta
+	g.lock.Unlock()
+}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds, labelled by the given label names.
+// A +Inf bucket is always added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	for _, label := range labels {
+		if label == "le" {
+			panic(fmt.Sprintf("histogram %s cannot use label le", name))
+		}
+	}
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+	h := &Histogram{desc: desc{name, help, "histogram", labels}, buckets: bounds, series: map[string]*histogramSeries{}}
+	r.register(name, h)
+	return h
+}
+
+// Observe records value in the histogram with the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	names := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		values := append(append([]string{}, s.labels...), "")
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+// funcMetric is a counter or gauge whose values are collected when scraped.
+type funcMetric struct {
+	desc
+	collect func(emit func(value float64, labelValues ...string))
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	var lines []string
+	f.collect(func(value float64, labelValues ...string) {
+		f.checkLabels(labelValues)
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", f.name, formatLabels(f.labels, labelValues), formatValue(value)))
+	})
+	sort.Strings(lines)
+	f.writeHeader(w)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
+
+// NewGaugeFunc registers a gauge whose values are gathered by calling collect on every scrape.
+// collect calls emit once per series.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(name, &funcMetric{desc{name, help, "gauge", labels}, collect})
+}
+
+// NewCounterFunc registers a counter whose values are gathered by calling collect on every scrape.
+// collect calls emit once per series.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(name, &funcMetric{desc{name, help, "counter", labels}, collect})
+}
+
+// NewKeyedGaugeFunc registers a gauge with a single label, whose values are
+// read from the map snapshot returns on every scrape.
+func (r *Registry) NewKeyedGaugeFunc(name, help, label string, snapshot func() map[string]int64) {
+	r.NewGaugeFunc(name, help, []string{label}, func(emit func(float64, ...string)) {
+		for key, value := range snapshot() {
+			emit(float64(value), key)
+		}
+	})
+}
+
+// RegisterRuntime adds gauges describing the Go runtime: the same figures
+// common.CollectRuntimeMetrics sends to statsd.
+func (r *Registry) RegisterRuntime() {
+	start := float64(time.Now().UnixNano()) / float64(time.Second)
+	r.NewGaugeFunc("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", nil,
+		func(emit func(float64, ...string)) { emit(start) })
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", nil,
+		func(emit func(float64, ...string)) { emit(float64(runtime.NumGoroutine())) })
+	memstat := func(read func(*runtime.MemStats) float64) func(func(float64, ...string)) {
+		return func(emit func(float64, ...string)) {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			emit(read(&m))
+		}
+	}
+	r.NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.Alloc) }))
+	r.NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.Sys) }))
+	r.NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }))
+	r.NewCounterFunc("go_memstats_mallocs_total", "Total number of mallocs.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.Mallocs) }))
+	r.NewCounterFunc("go_memstats_frees_total", "Total number of frees.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.Frees) }))
+	r.NewCounterFunc("go_gc_cycles_total", "Number of completed GC cycles.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.NumGC) }))
+	r.NewCounterFunc("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", nil,
+		memstat(func(m *runtime.MemStats) float64 { return float64(m.PauseTotalNs) / float64(time.Second) }))
+}
+
+// NewRequestHistogram registers the request latency histogram every server
+// observes from its LogRequest wrapper, labelled by method, status and storage policy index.
+func (r *Registry) NewRequestHistogram() *Histogram {
+	return r.NewHistogram("hummingbird_request_duration_seconds", "Time taken to answer requests, in seconds.",
+		DefaultBuckets, "method", "status", "policy")
+}
+
+// NewServerRegistry returns a registry with the runtime gauges and the request
+// histogram already registered.
+func NewServerRegistry() (*Registry, *Histogram) {
+	r := NewRegistry()
+	r.RegisterRuntime()
+	return r, r.NewRequestHistogram()
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountersAndGauges(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests seen.", "method")
+	c.Inc("GET")
+	c.Add(2, "GET")
+	c.Inc("PUT")
+	g := r.NewGauge("temperature", "How \"hot\".\nVery.")
+	g.Set(20.5)
+	g.Add(-0.5)
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+	require.Equal(t, `# HELP requests_total Requests seen.
+# TYPE requests_total counter
+requests_total{method="GET"} 3
+requests_total{method="PUT"} 1
+# HELP temperature How "hot".\nVery.
+# TYPE temperature gauge
+temperature 20
+`, out.String())
+	require.Panics(t, func() { c.Add(-1, "GET") })
+	require.Panics(t, func() { c.Inc() })
+	require.Panics(t, func() { r.NewGauge("temperature", "again") })
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "path")
+	h.Observe(0.05, `a"b`)
+	h.Observe(0.1, `a"b`)
+	h.Observe(0.5, `a"b`)
+	h.Observe(7, `a"b`)
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+	require.Equal(t, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="a\"b",le="0.1"} 2
+latency_seconds_bucket{path="a\"b",le="1"} 3
+latency_seconds_bucket{path="a\"b",le="+Inf"} 4
+latency_seconds_sum{path="a\"b"} 7.65
+latency_seconds_count{path="a\"b"} 4
+`, out.String())
+	require.Panics(t, func() { r.NewHistogram("bad", "Bad.", nil, "le") })
+}
+
+func TestFuncMetricsAndServe(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("in_use", "In use.", []string{"device"}, func(emit func(float64, ...string)) {
+		emit(2, "sdb")
+		emit(1, "sda")
+	})
+	r.RegisterRuntime()
+	h := r.NewRequestHistogram()
+	h.Observe(0.2, "GET", "200", "0")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	require.True(t, strings.Contains(body, "in_use{device=\"sda\"} 1\nin_use{device=\"sdb\"} 2\n"))
+	require.Contains(t, body, "# TYPE go_goroutines gauge\n")
+	require.Contains(t, body, "# TYPE go_gc_cycles_total counter\n")
+	require.Contains(t, body, `hummingbird_request_duration_seconds_bucket{method="GET",status="200",policy="0",le="0.25"} 1`)
+	require.Contains(t, body, `hummingbird_request_duration_seconds_count{method="GET",status="200",policy="0"} 1`)
+}
+
+func TestOnCollect(t *testing.T) {
+	r := NewRegistry()
+	reads := 0
+	var value float64
+	r.OnCollect(func() {
+		reads++
+		value = float64(reads)
+	})
+	for _, name := range []string{"a", "b"} {
+		r.NewGaugeFunc(name, "From the shared read.", nil, func(emit func(float64, ...string)) {
+			emit(value)
+		})
+	}
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+	require.Equal(t, 1, reads)
+	require.Contains(t, out.String(), "a 1\n")
+	require.Contains(t, out.String(), "b 1\n")
+	out.Reset()
+	require.Nil(t, r.Write(out))
+	require.Equal(t, 2, reads)
+	require.Contains(t, out.String(), "b 2\n")
+}
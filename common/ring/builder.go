@@ -0,0 +1,779 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BuilderDevice is a device in a RingBuilder, along with how many partition replicas are assigned to it.
+type BuilderDevice struct {
+	Device
+	Parts   int  `json:"parts"`
+	Removed bool `json:"removed,omitempty"`
+}
+
+// RingBuilder holds everything needed to (re)build a ring.  Builders are saved as JSON, and are the source of truth a
+// ring file is written from.
+type RingBuilder struct {
+	PartPower    uint    `json:"part_power"`
+	Replicas     float64 `json:"replicas"`
+	MinPartHours int     `json:"min_part_hours"`
+	Version      int     `json:"version"`
+	// BuildTimestamp is the unix time of the last rebalance, written into ring headers.
+	BuildTimestamp   int64            `json:"build_timestamp,omitempty"`
+	Devs             []*BuilderDevice `json:"devs"`
+	Replica2Part2Dev [][]int          `json:"replica2part2dev,omitempty"`
+	// LastPartMoves is the unix time each partition last had a replica reassigned.
+	LastPartMoves []int64 `json:"last_part_moves,omitempty"`
+}
+
+// NewRingBuilder returns an empty builder for a ring of 2^partPower partitions.
+func NewRingBuilder(partPower uint, replicas float64, minPartHours int) (*RingBuilder, error) {
+	if partPower < 1 || partPower > 32 {
+		return nil, errors.New("part power must be between 1 and 32")
+	}
+	if replicas < 1 {
+		return nil, errors.New("replicas must be at least 1")
+	}
+	if minPartHours < 0 {
+		return nil, errors.New("min_part_hours must not be negative")
+	}
+	return &RingBuilder{PartPower: partPower, Replicas: replicas, MinPartHours: minPartHours, Devs: []*BuilderDevice{}}, nil
+}
+
+// LoadRingBuilder reads a builder saved with Save.
+func LoadRingBuilder(path string) (*RingBuilder, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &RingBuilder{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("invalid builder file %s: %v", path, err)
+	}
+	return b, nil
+}
+
+// Save writes the builder to path, replacing any existing file atomically.
+func (b *RingBuilder) Save(path string) error {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	fp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+	if err := write(fp); err != nil {
+		return err
+	}
+	if err := fp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), path)
+}
+
+func (b *RingBuilder) partitionCount() int {
+	return 1 << b.PartPower
+}
+
+// replicaRows is the number of rows in Replica2Part2Dev; a fractional replica count adds a partial last row.
+func (b *RingBuilder) replicaRows() int {
+	return int(math.Ceil(b.Replicas))
+}
+
+// rowLength is the number of partitions replica covers.
+func (b *RingBuilder) rowLength(replica int) int {
+	if float64(replica+1) <= b.Replicas {
+		return b.partitionCount()
+	}
+	return int(float64(b.partitionCount()) * (b.Replicas - float64(replica)))
+}
+
+// assignmentCount is the total number of partition replicas in the ring.
+func (b *RingBuilder) assignmentCount() int {
+	count := 0
+	for replica := 0; replica < b.replicaRows(); replica++ {
+		count += b.rowLength(replica)
+	}
+	return count
+}
+
+// SetReplicas changes the replica count; partitions are added to or dropped from replicas on the next Rebalance.
+func (b *RingBuilder) SetReplicas(replicas float64) error {
+	if replicas < 1 {
+		return errors.New("replicas must be at least 1")
+	}
+	b.Replicas = replicas
+	return nil
+}
+
+// AddDevice adds dev to the builder, giving it the next device id, and returns that id.  The device doesn't receive
+// any partitions until the next Rebalance.
+func (b *RingBuilder) AddDevice(dev Device) (int, error) {
+	if dev.Ip == "" || dev.Port <= 0 || dev.Device == "" {
+		return -1, errors.New("devices need an ip, port and name")
+	}
+	if dev.Weight < 0 {
+		return -1, errors.New("weight must not be negative")
+	}
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed && d.Ip == dev.Ip && d.Port == dev.Port && d.Device.Device == dev.Device {
+			return -1, fmt.Errorf("device %d already uses %s:%d/%s", d.Id, dev.Ip, dev.Port, dev.Device)
+		}
+	}
+	if dev.ReplicationIp == "" {
+		dev.ReplicationIp = dev.Ip
+	}
+	if dev.ReplicationPort == 0 {
+		dev.ReplicationPort = dev.Port
+	}
+	dev.Id = len(b.Devs)
+	b.Devs = append(b.Devs, &BuilderDevice{Device: dev})
+	return dev.Id, nil
+}
+
+func (b *RingBuilder) activeDevice(id int) (*BuilderDevice, error) {
+	if id < 0 || id >= len(b.Devs) || b.Devs[id] == nil || b.Devs[id].Removed {
+		return nil, fmt.Errorf("no device %d", id)
+	}
+	return b.Devs[id], nil
+}
+
+// RemoveDevice marks a device for removal; its partitions are reassigned by the next Rebalance regardless of
+// min_part_hours, since the data is presumably gone.
+func (b *RingBuilder) RemoveDevice(id int) error {
+	dev, err := b.activeDevice(id)
+	if err != nil {
+		return err
+	}
+	dev.Removed = true
+	dev.Weight = 0
+	return nil
+}
+
+// SetWeight changes a device's weight, to take effect on the next Rebalance.
+func (b *RingBuilder) SetWeight(id int, weight float64) error {
+	if weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	dev, err := b.activeDevice(id)
+	if err != nil {
+		return err
+	}
+	dev.Weight = weight
+	return nil
+}
+
+// SearchDevices returns the devices matching a search value in the swift-ring-builder format
+// d<id>r<region>z<zone>-<ip>:<port>R<replication ip>:<replication port>/<device>_<meta>, where every part is optional.
+func (b *RingBuilder) SearchDevices(value string) ([]*BuilderDevice, error) {
+	match, err := parseSearchValue(value)
+	if err != nil {
+		return nil, err
+	}
+	devs := []*BuilderDevice{}
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed && match(&d.Device) {
+			devs = append(devs, d)
+		}
+	}
+	return devs, nil
+}
+
+// parseDeviceString parses the r<region>z<zone>-<ip>:<port>[R<ip>:<port>]/<device>[_<meta>] form used to add devices.
+func parseDeviceString(value string) (Device, error) {
+	fields, err := splitSearchValue(value)
+	if err != nil {
+		return Device{}, err
+	}
+	for _, required := range []string{"r", "z", "-", ":", "/"} {
+		if _, ok := fields[required]; !ok {
+			return Device{}, fmt.Errorf("invalid device %q: expected r<region>z<zone>-<ip>:<port>/<device>", value)
+		}
+	}
+	dev := Device{Ip: fields["-"], Device: fields["/"], Meta: fields["_"], ReplicationIp: fields["R"]}
+	if dev.Region, err = strconv.Atoi(fields["r"]); err != nil {
+		return dev, fmt.Errorf("invalid region %q", fields["r"])
+	}
+	if dev.Zone, err = strconv.Atoi(fields["z"]); err != nil {
+		return dev, fmt.Errorf("invalid zone %q", fields["z"])
+	}
+	if dev.Port, err = strconv.Atoi(fields[":"]); err != nil {
+		return dev, fmt.Errorf("invalid port %q", fields[":"])
+	}
+	if rp, ok := fields["R:"]; ok {
+		if dev.ReplicationPort, err = strconv.Atoi(rp); err != nil {
+			return dev, fmt.Errorf("invalid replication port %q", rp)
+		}
+	}
+	return dev, nil
+}
+
+// splitSearchValue breaks a device string into its parts, keyed by the character that introduces each one.  The
+// replication port is keyed "R:".
+func splitSearchValue(value string) (map[string]string, error) {
+	fields := map[string]string{}
+	rest := value
+	if strings.HasPrefix(rest, "d") {
+		i := 1
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		fields["d"], rest = rest[1:i], rest[i:]
+	}
+	for _, key := range []string{"r", "z"} {
+		if strings.HasPrefix(rest, key) {
+			i := 1
+			for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+				i++
+			}
+			fields[key], rest = rest[1:i], rest[i:]
+		}
+	}
+	take := func(prefix string, stop string) (string, bool) {
+		if !strings.HasPrefix(rest, prefix) {
+			return "", false
+		}
+		rest = rest[len(prefix):]
+		i := strings.IndexAny(rest, stop)
+		if i < 0 {
+			i = len(rest)
+		}
+		v := rest[:i]
+		rest = rest[i:]
+		return v, true
+	}
+	if strings.HasPrefix(rest, "-[") {
+		// IPv6 addresses are bracketed so their colons aren't mistaken for the port
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid device %q: unterminated [", value)
+		}
+		fields["-"], rest = rest[2:end], rest[end+1:]
+	} else if v, ok := take("-", ":R/_"); ok {
+		fields["-"] = v
+	}
+	if v, ok := take(":", "R/_"); ok {
+		fields[":"] = v
+	}
+	if strings.HasPrefix(rest, "R[") {
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid device %q: unterminated [", value)
+		}
+		fields["R"], rest = rest[2:end], rest[end+1:]
+	} else if v, ok := take("R", ":/_"); ok {
+		fields["R"] = v
+	}
+	if v, ok := take(":", "/_"); ok {
+		fields["R:"] = v
+	}
+	if v, ok := take("/", "_"); ok {
+		fields["/"] = v
+	}
+	if strings.HasPrefix(rest, "_") {
+		fields["_"], rest = rest[1:], ""
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid device %q: unexpected %q", value, rest)
+	}
+	return fields, nil
+}
+
+func parseSearchValue(value string) (func(d *Device) bool, error) {
+	fields, err := splitSearchValue(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid search value %q", value)
+	}
+	ints := map[string]int{}
+	for _, key := range []string{"d", "r", "z", ":", "R:"} {
+		if v, ok := fields[key]; ok {
+			if ints[key], err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid search value %q", value)
+			}
+		}
+	}
+	return func(d *Device) bool {
+		checks := map[string]bool{
+			"d": d.Id == ints["d"], "r": d.Region == ints["r"], "z": d.Zone == ints["z"],
+			"-": d.Ip == fields["-"], ":": d.Port == ints[":"], "R": d.ReplicationIp == fields["R"],
+			"R:": d.ReplicationPort == ints["R:"], "/": d.Device == fields["/"], "_": d.Meta == fields["_"],
+		}
+		for key := range fields {
+			if !checks[key] {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// tier identifies a failure domain: a region, a zone within a region, or a server within a zone.
+type tier struct {
+	level        int
+	region, zone int
+	ip           string
+	port         int
+}
+
+const tierLevels = 3
+
+func deviceTiers(d *Device) [tierLevels]tier {
+	return [tierLevels]tier{
+		{level: 0, region: d.Region},
+		{level: 1, region: d.Region, zone: d.Zone},
+		{level: 2, region: d.Region, zone: d.Zone, ip: d.Ip, port: d.Port},
+	}
+}
+
+// rebalancer tracks how far each device and tier is from the number of partition replicas its weight calls for.
+type rebalancer struct {
+	b          *RingBuilder
+	active     []*BuilderDevice
+	wanted     map[int]float64
+	tierWanted map[tier]float64
+	tierParts  map[tier]int
+}
+
+func (rb *rebalancer) unassign(replica, part int) {
+	dev := rb.b.Devs[rb.b.Replica2Part2Dev[replica][part]]
+	rb.b.Replica2Part2Dev[replica][part] = -1
+	if dev == nil {
+		return
+	}
+	dev.Parts--
+	for _, t := range deviceTiers(&dev.Device) {
+		rb.tierParts[t]--
+	}
+}
+
+func (rb *rebalancer) assign(replica, part int, dev *BuilderDevice) {
+	rb.b.Replica2Part2Dev[replica][part] = dev.Id
+	dev.Parts++
+	for _, t := range deviceTiers(&dev.Device) {
+		rb.tierParts[t]++
+	}
+}
+
+// choose picks the device for a replica of part.  At each tier, from regions down to servers, we prefer failure
+// domains that still want more partitions, then ones holding the fewest replicas of this partition; then the device
+// furthest below its share.
+func (rb *rebalancer) choose(part int) *BuilderDevice {
+	var others []*Device
+	for _, row := range rb.b.Replica2Part2Dev {
+		if part < len(row) && row[part] >= 0 {
+			others = append(others, &rb.b.Devs[row[part]].Device)
+		}
+	}
+	var best *BuilderDevice
+	var bestKey [2*tierLevels + 1]float64
+	for _, dev := range rb.active {
+		used := false
+		for _, o := range others {
+			used = used || o.Id == dev.Id
+		}
+		if used {
+			continue
+		}
+		var key [2*tierLevels + 1]float64
+		for i, t := range deviceTiers(&dev.Device) {
+			need := rb.tierWanted[t] - float64(rb.tierParts[t])
+			if need > -math.Max(1, rb.tierWanted[t]/100) {
+				key[2*i] = 0
+			} else {
+				key[2*i] = 1
+			}
+			for _, o := range others {
+				if deviceTiers(o)[i] == t {
+					key[2*i+1]++
+				}
+			}
+		}
+		key[2*tierLevels] = float64(dev.Parts) - rb.wanted[dev.Id]
+		if best == nil || lessKey(key[:], bestKey[:]) {
+			best, bestKey = dev, key
+		}
+	}
+	return best
+}
+
+func lessKey(a, b []float64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Rebalance assigns every partition replica to a device, moving as few as it can to bring devices to their weighted
+// share, and never moving a partition again within min_part_hours of its last move unless its device was removed.
+// It returns the number of partition replicas that were assigned.
+func (b *RingBuilder) Rebalance(seed int64, now time.Time) (int, error) {
+	parts := b.partitionCount()
+	rb := &rebalancer{b: b, wanted: map[int]float64{}, tierWanted: map[tier]float64{}, tierParts: map[tier]int{}}
+	totalWeight := 0.0
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed && d.Weight > 0 {
+			rb.active = append(rb.active, d)
+			totalWeight += d.Weight
+		}
+	}
+	if len(rb.active) < b.replicaRows() {
+		return 0, fmt.Errorf("%g replicas need at least %d devices with weight", b.Replicas, b.replicaRows())
+	}
+	for _, d := range rb.active {
+		rb.wanted[d.Id] = d.Weight / totalWeight * float64(b.assignmentCount())
+		for _, t := range deviceTiers(&d.Device) {
+			rb.tierWanted[t] += rb.wanted[d.Id]
+		}
+	}
+	if b.Replica2Part2Dev == nil {
+		b.LastPartMoves = make([]int64, parts)
+	}
+	// grow or shrink the replica rows to match the replica count; dropped assignments just disappear, and new ones
+	// are placed below along with everything else that's unassigned
+	if len(b.Replica2Part2Dev) > b.replicaRows() {
+		b.Replica2Part2Dev = b.Replica2Part2Dev[:b.replicaRows()]
+	}
+	for len(b.Replica2Part2Dev) < b.replicaRows() {
+		b.Replica2Part2Dev = append(b.Replica2Part2Dev, nil)
+	}
+	for replica, row := range b.Replica2Part2Dev {
+		if length := b.rowLength(replica); len(row) > length {
+			b.Replica2Part2Dev[replica] = row[:length]
+		} else {
+			for len(row) < length {
+				row = append(row, -1)
+			}
+			b.Replica2Part2Dev[replica] = row
+		}
+	}
+	for _, d := range b.Devs {
+		if d != nil {
+			d.Parts = 0
+		}
+	}
+	for _, row := range b.Replica2Part2Dev {
+		for _, id := range row {
+			if id >= 0 && b.Devs[id] != nil {
+				b.Devs[id].Parts++
+				for _, t := range deviceTiers(&b.Devs[id].Device) {
+					rb.tierParts[t]++
+				}
+			}
+		}
+	}
+
+	moved := make([]bool, parts)
+	movable := func(part int) bool {
+		return !moved[part] && now.Unix()-b.LastPartMoves[part] >= int64(b.MinPartHours)*3600
+	}
+	// partitions on removed devices, or doubled up on a device, have to move
+	for part := 0; part < parts; part++ {
+		seen := map[int]bool{}
+		for replica, row := range b.Replica2Part2Dev {
+			if part >= len(row) {
+				continue
+			}
+			if id := row[part]; id >= 0 {
+				if b.Devs[id] == nil || b.Devs[id].Removed || seen[id] {
+					rb.unassign(replica, part)
+					moved[part] = true
+				}
+				seen[id] = true
+			}
+		}
+	}
+	// then shed partitions from devices holding more than their share, preferring partitions with other replicas in
+	// the same failure domain
+	rnd := rand.New(rand.NewSource(seed))
+	type assignment struct{ replica, part, shared int }
+	byDev := map[int][]assignment{}
+	for replica, row := range b.Replica2Part2Dev {
+		for part, id := range row {
+			if id >= 0 && b.Devs[id].Parts > int(math.Ceil(rb.wanted[id])) {
+				shared := 0
+				for r, other := range b.Replica2Part2Dev {
+					if r != replica && part < len(other) && other[part] >= 0 && deviceTiers(&b.Devs[other[part]].Device)[1] == deviceTiers(&b.Devs[id].Device)[1] {
+						shared++
+					}
+				}
+				byDev[id] = append(byDev[id], assignment{replica, part, shared})
+			}
+		}
+	}
+	ids := make([]int, 0, len(byDev))
+	for id := range byDev {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		candidates := byDev[id]
+		rnd.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].shared > candidates[j].shared })
+		for _, c := range candidates {
+			if b.Devs[id].Parts <= int(math.Ceil(rb.wanted[id])) {
+				break
+			}
+			if movable(c.part) {
+				rb.unassign(c.replica, c.part)
+				moved[c.part] = true
+			}
+		}
+	}
+
+	var unassigned []assignment
+	for replica, row := range b.Replica2Part2Dev {
+		for part, id := range row {
+			if id < 0 {
+				unassigned = append(unassigned, assignment{replica: replica, part: part})
+			}
+		}
+	}
+	rnd.Shuffle(len(unassigned), func(i, j int) { unassigned[i], unassigned[j] = unassigned[j], unassigned[i] })
+	sort.SliceStable(unassigned, func(i, j int) bool { return unassigned[i].replica < unassigned[j].replica })
+	for _, a := range unassigned {
+		dev := rb.choose(a.part)
+		if dev == nil {
+			return 0, fmt.Errorf("unable to place replica %d of partition %d", a.replica, a.part)
+		}
+		rb.assign(a.replica, a.part, dev)
+		b.LastPartMoves[a.part] = now.Unix()
+	}
+	for i, d := range b.Devs {
+		if d != nil && d.Removed {
+			b.Devs[i] = nil
+		}
+	}
+	b.Version++
+	b.BuildTimestamp = now.Unix()
+	return len(unassigned), nil
+}
+
+// Balance returns the largest percentage any device is over or under its weighted share of partition replicas.
+func (b *RingBuilder) Balance() float64 {
+	totalWeight := 0.0
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed {
+			totalWeight += d.Weight
+		}
+	}
+	balance := 0.0
+	for _, d := range b.Devs {
+		if d == nil || d.Removed || d.Weight == 0 || totalWeight == 0 {
+			continue
+		}
+		wanted := d.Weight / totalWeight * float64(b.assignmentCount())
+		balance = math.Max(balance, math.Abs(100*(float64(d.Parts)-wanted)/wanted))
+	}
+	return balance
+}
+
+// DispersionReport describes how well the replicas of each partition are spread across failure domains.
+type DispersionReport struct {
+	Partitions int `json:"partitions"`
+	// Tiers counts, for each of "region", "zone", "server" and "device", the partitions with more replicas in a single
+	// failure domain at that tier than an even spread would put there.
+	Tiers map[string]int `json:"tiers"`
+	// Dispersion is the percentage of partitions that are over-concentrated at any tier.
+	Dispersion float64 `json:"dispersion"`
+}
+
+// Dispersion reports how well partitions are spread across the builder's failure domains.
+func (b *RingBuilder) Dispersion() *DispersionReport {
+	names := [tierLevels + 1]string{"region", "zone", "server", "device"}
+	domains := [tierLevels + 1]map[tier]bool{{}, {}, {}, {}}
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed && d.Weight > 0 {
+			for i, t := range deviceTiers(&d.Device) {
+				domains[i][t] = true
+			}
+			domains[tierLevels][tier{level: tierLevels, port: d.Id}] = true
+		}
+	}
+	report := &DispersionReport{Partitions: b.partitionCount(), Tiers: map[string]int{}}
+	for _, name := range names {
+		report.Tiers[name] = 0
+	}
+	if len(b.Replica2Part2Dev) == 0 {
+		return report
+	}
+	bad := 0
+	for part := 0; part < b.partitionCount(); part++ {
+		partBad := false
+		for level := range names {
+			if len(domains[level]) == 0 {
+				continue
+			}
+			limit := int(math.Ceil(float64(b.replicaRows()) / float64(len(domains[level]))))
+			counts := map[tier]int{}
+			over := false
+			for _, row := range b.Replica2Part2Dev {
+				if part >= len(row) || row[part] < 0 || b.Devs[row[part]] == nil {
+					continue
+				}
+				var t tier
+				if level == tierLevels {
+					t = tier{level: tierLevels, port: row[part]}
+				} else {
+					t = deviceTiers(&b.Devs[row[part]].Device)[level]
+				}
+				counts[t]++
+				over = over || counts[t] > limit
+			}
+			if over {
+				report.Tiers[names[level]]++
+				partBad = true
+			}
+		}
+		if partBad {
+			bad++
+		}
+	}
+	report.Dispersion = 100 * float64(bad) / float64(report.Partitions)
+	return report
+}
+
+// WriteRing writes the ring in the gzipped R1NG format LoadRing reads.  It uses version 1, which every release can
+// load, unless the ring needs version 2 for a fractional replica count or device ids over 65535.
+func (b *RingBuilder) WriteRing(w io.Writer) error {
+	return b.WriteRingFormat(w, 0, 0)
+}
+
+// WriteRingFormat writes the ring in the given format version, 1 or 2, with device ids of devIdBytes bytes, 2 or 4.
+// Either may be 0 to pick the smallest that fits the ring.
+func (b *RingBuilder) WriteRingFormat(w io.Writer, format, devIdBytes int) error {
+	if len(b.Replica2Part2Dev) != b.replicaRows() {
+		return errors.New("the builder needs to be rebalanced before writing a ring")
+	}
+	devs := make([]*Device, len(b.Devs))
+	maxId := 0
+	for i, d := range b.Devs {
+		if d != nil && !d.Removed {
+			devs[i] = &d.Device
+			maxId = d.Id
+		}
+	}
+	if devIdBytes == 0 {
+		devIdBytes = 2
+		if maxId > math.MaxUint16 {
+			devIdBytes = 4
+		}
+	}
+	if format == 0 {
+		format = 1
+		if devIdBytes != 2 || b.Replicas != math.Floor(b.Replicas) {
+			format = 2
+		}
+	}
+	switch {
+	case format != 1 && format != 2:
+		return fmt.Errorf("unknown ring format %d", format)
+	case devIdBytes != 2 && devIdBytes != 4:
+		return fmt.Errorf("device ids must be 2 or 4 bytes, not %d", devIdBytes)
+	case format == 1 && devIdBytes != 2:
+		return errors.New("ring format 1 only supports 2 byte device ids")
+	case format == 1 && b.Replicas != math.Floor(b.Replicas):
+		return errors.New("ring format 1 doesn't support fractional replica counts")
+	case devIdBytes == 2 && maxId > math.MaxUint16:
+		return fmt.Errorf("device id %d is too large for 2 byte device ids", maxId)
+	}
+	header := map[string]interface{}{
+		"devs":            devs,
+		"replica_count":   b.Replicas,
+		"part_shift":      32 - b.PartPower,
+		"version":         b.Version,
+		"build_timestamp": b.BuildTimestamp,
+	}
+	if format == 2 {
+		header["dev_id_bytes"] = devIdBytes
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	gz.Write([]byte("R1NG"))
+	binary.Write(gz, binary.BigEndian, uint16(format))
+	binary.Write(gz, binary.BigEndian, uint32(len(data)))
+	gz.Write(data)
+	for _, row := range b.Replica2Part2Dev {
+		for _, id := range row {
+			if id < 0 || devs[id] == nil {
+				return errors.New("the builder needs to be rebalanced before writing a ring")
+			}
+		}
+		if format == 2 {
+			binary.Write(gz, binary.BigEndian, uint32(len(row)))
+		}
+		var part2dev interface{}
+		if devIdBytes == 4 {
+			wide := make([]uint32, len(row))
+			for part, id := range row {
+				wide[part] = uint32(id)
+			}
+			part2dev = wide
+		} else {
+			narrow := make([]uint16, len(row))
+			for part, id := range row {
+				narrow[part] = uint16(id)
+			}
+			part2dev = narrow
+		}
+		if err := binary.Write(gz, binary.LittleEndian, part2dev); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// WriteRingFile writes the ring to path, replacing any existing file atomically so running servers never load a
+// partial ring.
+func (b *RingBuilder) WriteRingFile(path string) error {
+	return writeFileAtomic(path, b.WriteRing)
+}
@@ -0,0 +1,327 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBuilder returns a rebalanced builder with the given number of zones of servers with two devices each.
+func newTestBuilder(t *testing.T, zones, serversPerZone int) *RingBuilder {
+	b, err := NewRingBuilder(8, 3, 1)
+	require.Nil(t, err)
+	for z := 0; z < zones; z++ {
+		for s := 0; s < serversPerZone; s++ {
+			for _, dev := range []string{"sda", "sdb"} {
+				_, err := b.AddDevice(Device{Region: 1, Zone: z, Ip: fmt.Sprintf("10.0.%d.%d", z, s), Port: 6000, Device: dev, Weight: 100})
+				require.Nil(t, err)
+			}
+		}
+	}
+	_, err = b.Rebalance(1, time.Now())
+	require.Nil(t, err)
+	return b
+}
+
+func checkAssignments(t *testing.T, b *RingBuilder) {
+	counts := map[int]int{}
+	for part := 0; part < b.partitionCount(); part++ {
+		seen := map[int]bool{}
+		for _, row := range b.Replica2Part2Dev {
+			if part >= len(row) {
+				continue
+			}
+			require.True(t, row[part] >= 0, "partition %d unassigned", part)
+			require.NotNil(t, b.Devs[row[part]])
+			require.False(t, seen[row[part]], "partition %d has two replicas on device %d", part, row[part])
+			seen[row[part]] = true
+			counts[row[part]]++
+		}
+	}
+	for _, d := range b.Devs {
+		if d != nil {
+			require.Equal(t, counts[d.Id], d.Parts)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	b := newTestBuilder(t, 3, 2)
+	checkAssignments(t, b)
+	require.True(t, b.Balance() < 2, "balance %f", b.Balance())
+	require.Equal(t, 0.0, b.Dispersion().Dispersion)
+	require.Equal(t, 1, b.Version)
+
+	// a rebalance with nothing changed moves nothing
+	moved, err := b.Rebalance(2, time.Now().Add(2*time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 0, moved)
+}
+
+func TestRebalanceWeights(t *testing.T) {
+	b, err := NewRingBuilder(10, 2, 0)
+	require.Nil(t, err)
+	for i, weight := range []float64{100, 100, 200, 400} {
+		_, err := b.AddDevice(Device{Region: 1, Zone: i, Ip: "10.0.0.1", Port: 6000 + i, Device: "sda", Weight: weight})
+		require.Nil(t, err)
+	}
+	_, err = b.Rebalance(1, time.Now())
+	require.Nil(t, err)
+	checkAssignments(t, b)
+	require.True(t, b.Balance() < 2, "balance %f", b.Balance())
+	require.InDelta(t, 2048*4/8, b.Devs[3].Parts, 20)
+}
+
+func TestRebalanceMinPartHours(t *testing.T) {
+	b := newTestBuilder(t, 3, 2)
+	now := time.Now()
+	id, err := b.AddDevice(Device{Region: 1, Zone: 3, Ip: "10.0.3.0", Port: 6000, Device: "sda", Weight: 100})
+	require.Nil(t, err)
+
+	// everything moved in the first rebalance, so nothing can move again for an hour
+	moved, err := b.Rebalance(2, now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 0, moved)
+	require.Equal(t, 0, b.Devs[id].Parts)
+
+	moved, err = b.Rebalance(2, now.Add(2*time.Hour))
+	require.Nil(t, err)
+	require.True(t, moved > 0)
+	checkAssignments(t, b)
+	require.True(t, b.Devs[id].Parts > 0)
+	// only one replica of a partition moves per rebalance
+	for part := 0; part < b.partitionCount(); part++ {
+		require.True(t, b.LastPartMoves[part] <= now.Add(2*time.Hour).Unix())
+	}
+}
+
+func TestRebalanceRemove(t *testing.T) {
+	b := newTestBuilder(t, 3, 2)
+	require.Nil(t, b.RemoveDevice(0))
+	require.NotNil(t, b.RemoveDevice(0))
+	// partitions on removed devices move even within min_part_hours
+	moved, err := b.Rebalance(2, time.Now())
+	require.Nil(t, err)
+	require.True(t, moved > 0)
+	require.Nil(t, b.Devs[0])
+	checkAssignments(t, b)
+	require.True(t, b.Balance() < 2, "balance %f", b.Balance())
+	// zone 0 no longer has the weight for a replica of every partition, so some partitions have to double up on a zone
+	require.Equal(t, 0, b.Dispersion().Tiers["region"])
+	require.True(t, b.Dispersion().Tiers["zone"] > 0)
+}
+
+func TestRebalanceNotEnoughDevices(t *testing.T) {
+	b, err := NewRingBuilder(4, 3, 1)
+	require.Nil(t, err)
+	_, err = b.AddDevice(Device{Ip: "10.0.0.1", Port: 6000, Device: "sda", Weight: 1})
+	require.Nil(t, err)
+	_, err = b.Rebalance(1, time.Now())
+	require.NotNil(t, err)
+	var buf bytes.Buffer
+	require.NotNil(t, b.WriteRing(&buf))
+}
+
+func TestBuilderSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := newTestBuilder(t, 2, 2)
+	path := filepath.Join(dir, "object.builder")
+	require.Nil(t, b.Save(path))
+	loaded, err := LoadRingBuilder(path)
+	require.Nil(t, err)
+	require.Equal(t, b, loaded)
+}
+
+func TestBuilderWriteRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := newTestBuilder(t, 3, 1)
+	require.Nil(t, b.RemoveDevice(1))
+	_, err = b.Rebalance(2, time.Now())
+	require.Nil(t, err)
+	path := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.WriteRingFile(path))
+
+	r, err := LoadRing(path, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, uint64(3), r.ReplicaCount())
+	require.Equal(t, uint64(256), r.PartitionCount())
+	require.Equal(t, 6, len(r.AllDevices()))
+	for part := 0; part < 256; part++ {
+		nodes := r.GetNodesInOrder(uint64(part))
+		require.Equal(t, 3, len(nodes))
+		for replica, node := range nodes {
+			require.Equal(t, b.Replica2Part2Dev[replica][part], node.Id)
+			require.Equal(t, b.Devs[node.Id].Ip, node.Ip)
+		}
+	}
+}
+
+func TestBuilderFractionalReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := newTestBuilder(t, 3, 2)
+	require.Nil(t, b.SetReplicas(2.5))
+	_, err = b.Rebalance(2, time.Now().Add(2*time.Hour))
+	require.Nil(t, err)
+	checkAssignments(t, b)
+	require.Equal(t, 128, len(b.Replica2Part2Dev[2]))
+	// about 53 partitions per device, so a partition either way is nearly 2%
+	require.True(t, b.Balance() < 5, "balance %f", b.Balance())
+
+	// version 1 can't hold half a replica, so the default is version 2
+	var buf bytes.Buffer
+	require.NotNil(t, b.WriteRingFormat(&buf, 1, 0))
+	path := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.WriteRingFile(path))
+	info, err := ReadRingInfo(path)
+	require.Nil(t, err)
+	require.Equal(t, &RingInfo{FormatVersion: 2, Version: b.Version, BuildTimestamp: b.BuildTimestamp, ReplicaCount: 2.5,
+		PartPower: 8, DevIdBytes: 2}, info)
+	r, err := LoadRing(path, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(r.GetNodesInOrder(127)))
+	require.Equal(t, 2, len(r.GetNodesInOrder(128)))
+
+	// and back down to whole replicas
+	require.Nil(t, b.SetReplicas(2))
+	require.NotNil(t, b.SetReplicas(0.5))
+	_, err = b.Rebalance(3, time.Now().Add(4*time.Hour))
+	require.Nil(t, err)
+	checkAssignments(t, b)
+	require.Equal(t, 2, len(b.Replica2Part2Dev))
+}
+
+func TestBuilderWriteRingFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b := newTestBuilder(t, 3, 1)
+	path := filepath.Join(dir, "object.ring.gz")
+	for _, test := range []struct{ format, devIdBytes, expectedFormat, expectedBytes int }{
+		{0, 0, 1, 2},
+		{2, 0, 2, 2},
+		{0, 4, 2, 4},
+		{2, 4, 2, 4},
+	} {
+		require.Nil(t, writeFileAtomic(path, func(w io.Writer) error {
+			return b.WriteRingFormat(w, test.format, test.devIdBytes)
+		}))
+		info, err := ReadRingInfo(path)
+		require.Nil(t, err)
+		require.Equal(t, test.expectedFormat, info.FormatVersion)
+		require.Equal(t, test.expectedBytes, info.DevIdBytes)
+		require.Equal(t, 1, info.Version)
+		// a new path each time, since loaded rings are cached by path
+		ringPath := filepath.Join(dir, fmt.Sprintf("%d-%d.ring.gz", test.format, test.devIdBytes))
+		require.Nil(t, os.Rename(path, ringPath))
+		r, err := LoadRing(ringPath, "prefix", "suffix")
+		require.Nil(t, err)
+		for part := 0; part < 256; part++ {
+			for replica, node := range r.GetNodesInOrder(uint64(part)) {
+				require.Equal(t, b.Replica2Part2Dev[replica][part], node.Id)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	require.NotNil(t, b.WriteRingFormat(&buf, 1, 4))
+	require.NotNil(t, b.WriteRingFormat(&buf, 3, 0))
+	require.NotNil(t, b.WriteRingFormat(&buf, 2, 3))
+}
+
+func TestParseDeviceString(t *testing.T) {
+	dev, err := parseDeviceString("r1z2-10.0.0.1:6010R10.1.0.1:6020/sdb1_ssd")
+	require.Nil(t, err)
+	require.Equal(t, Device{Region: 1, Zone: 2, Ip: "10.0.0.1", Port: 6010, ReplicationIp: "10.1.0.1", ReplicationPort: 6020,
+		Device: "sdb1", Meta: "ssd"}, dev)
+	dev, err = parseDeviceString("r1z1-[::1]:6010/sda")
+	require.Nil(t, err)
+	require.Equal(t, "::1", dev.Ip)
+	require.Equal(t, 6010, dev.Port)
+	for _, bad := range []string{"z1-10.0.0.1:6010/sda", "r1z1-10.0.0.1/sda", "r1z1-10.0.0.1:port/sda", "r1z1-10.0.0.1:6010"} {
+		_, err = parseDeviceString(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestSearchDevices(t *testing.T) {
+	b := newTestBuilder(t, 3, 2)
+	for search, expected := range map[string]int{
+		"d3":                1,
+		"z1":                4,
+		"r1z1-10.0.1.1":     2,
+		"-10.0.1.1:6000":    2,
+		"/sda":              6,
+		"r1z2-10.0.2.0/sdb": 1,
+		"r2":                0,
+	} {
+		devs, err := b.SearchDevices(search)
+		require.Nil(t, err, search)
+		require.Equal(t, expected, len(devs), search)
+	}
+	_, err := b.SearchDevices("")
+	require.NotNil(t, err)
+	_, err = b.SearchDevices("dx")
+	require.NotNil(t, err)
+}
+
+func TestBuilderCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "object.builder")
+	b, err := NewRingBuilder(6, 2, 0)
+	require.Nil(t, err)
+	out := &bytes.Buffer{}
+	run := func(command string, args ...string) error {
+		_, err := runBuilderCommand(path, b, command, args, out)
+		return err
+	}
+	require.Nil(t, run("add", "r1z1-10.0.0.1:6000/sda", "100"))
+	require.Nil(t, run("add", "r1z2-10.0.0.2:6000/sda", "100"))
+	require.Nil(t, run("add", "r1z3-10.0.0.3:6000/sda", "100"))
+	require.NotNil(t, run("add", "r1z3-10.0.0.3:6000/sda", "100"))
+	require.NotNil(t, run("add", "r1z3-10.0.0.4:6000/sda", "heavy"))
+	require.Nil(t, run("rebalance", "-seed", "1"))
+	require.Nil(t, run("set_weight", "z3", "50"))
+	require.Equal(t, 50.0, b.Devs[2].Weight)
+	require.Nil(t, run("remove", "-10.0.0.2"))
+	require.NotNil(t, run("remove", "-10.0.0.9"))
+	require.Nil(t, run("rebalance"))
+	require.Nil(t, run("write_ring"))
+	require.NotNil(t, run("write_ring", "-format", "1", "-dev_id_bytes", "4"))
+	require.Nil(t, run("set_replicas", "2.25"))
+	require.NotNil(t, run("set_replicas", "many"))
+	_, err = os.Stat(filepath.Join(dir, "object.ring.gz"))
+	require.Nil(t, err)
+	out.Reset()
+	require.Nil(t, run("dispersion", "-json"))
+	require.Contains(t, out.String(), `"partitions":64`)
+	require.NotNil(t, run("frobnicate"))
+}
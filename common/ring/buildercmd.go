@@ -0,0 +1,255 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package ring
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func builderUsage() {
+	fmt.Fprintln(os.Stderr, "USAGE: hummingbird ring <builder file> [command] [args]")
+	fmt.Fprintln(os.Stderr, "  Commands:")
+	fmt.Fprintln(os.Stderr, "    (none)                                    -- show the builder's devices and balance")
+	fmt.Fprintln(os.Stderr, "    create <part_power> <replicas> <min_part_hours>")
+	fmt.Fprintln(os.Stderr, "    add r<region>z<zone>-<ip>:<port>[R<ip>:<port>]/<device>[_<meta>] <weight>")
+	fmt.Fprintln(os.Stderr, "    remove <search value>")
+	fmt.Fprintln(os.Stderr, "    set_weight <search value> <weight>")
+	fmt.Fprintln(os.Stderr, "    set_replicas <replicas>")
+	fmt.Fprintln(os.Stderr, "    rebalance [-seed N]")
+	fmt.Fprintln(os.Stderr, "    write_ring [-format 1|2] [-dev_id_bytes 2|4] -- write <builder name>.ring.gz")
+	fmt.Fprintln(os.Stderr, "    dispersion [-json]")
+	fmt.Fprintln(os.Stderr, "  Search values look like d<id>r<region>z<zone>-<ip>:<port>/<device>_<meta>, with every part optional.")
+}
+
+// ringFileName returns the ring file a builder file writes, e.g. object.ring.gz for object.builder.
+func ringFileName(builderPath string) string {
+	return strings.TrimSuffix(builderPath, ".builder") + ".ring.gz"
+}
+
+func printBuilder(w io.Writer, path string, b *RingBuilder) {
+	regions, zones, devs := map[tier]bool{}, map[tier]bool{}, 0
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed {
+			t := deviceTiers(&d.Device)
+			regions[t[0]], zones[t[1]] = true, true
+			devs++
+		}
+	}
+	fmt.Fprintf(w, "%s, build version %d\n", path, b.Version)
+	fmt.Fprintf(w, "%d partitions, %g replicas, %d regions, %d zones, %d devices, %.02f balance, %.02f dispersion\n",
+		b.partitionCount(), b.Replicas, len(regions), len(zones), devs, b.Balance(), b.Dispersion().Dispersion)
+	fmt.Fprintf(w, "The minimum number of hours before a partition can be reassigned is %d\n", b.MinPartHours)
+	fmt.Fprintf(w, "Devices: %5s %6s %5s %15s %6s %15s %6s %10s %8s %10s %8s %s\n", "id", "region", "zone", "ip address",
+		"port", "replication ip", "port", "name", "weight", "partitions", "balance", "meta")
+	totalWeight := 0.0
+	for _, d := range b.Devs {
+		if d != nil && !d.Removed {
+			totalWeight += d.Weight
+		}
+	}
+	for _, d := range b.Devs {
+		if d == nil {
+			continue
+		}
+		balance := 0.0
+		if d.Weight > 0 && totalWeight > 0 {
+			wanted := d.Weight / totalWeight * float64(b.assignmentCount())
+			balance = 100 * (float64(d.Parts) - wanted) / wanted
+		}
+		meta := d.Meta
+		if d.Removed {
+			meta = strings.TrimSpace(meta + " (pending removal)")
+		}
+		fmt.Fprintf(w, "         %5d %6d %5d %15s %6d %15s %6d %10s %8.02f %10d %8.02f %s\n", d.Id, d.Region, d.Zone, d.Ip,
+			d.Port, d.ReplicationIp, d.ReplicationPort, d.Device.Device, d.Weight, d.Parts, balance, meta)
+	}
+}
+
+// runBuilderCommand runs one builder command, returning whether the builder needs to be saved.
+func runBuilderCommand(path string, b *RingBuilder, command string, args []string, out io.Writer) (bool, error) {
+	switch command {
+	case "add":
+		if len(args) != 2 {
+			return false, errors.New("add needs a device and a weight")
+		}
+		dev, err := parseDeviceString(args[0])
+		if err != nil {
+			return false, err
+		}
+		if dev.Weight, err = strconv.ParseFloat(args[1], 64); err != nil {
+			return false, fmt.Errorf("invalid weight %q", args[1])
+		}
+		id, err := b.AddDevice(dev)
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "Device %s with %s weight got id %d\n", args[0], args[1], id)
+		return true, nil
+	case "remove", "set_weight":
+		if (command == "remove" && len(args) != 1) || (command == "set_weight" && len(args) != 2) {
+			return false, fmt.Errorf("%s needs a search value", command)
+		}
+		devs, err := b.SearchDevices(args[0])
+		if err != nil {
+			return false, err
+		}
+		if len(devs) == 0 {
+			return false, fmt.Errorf("no devices match %q", args[0])
+		}
+		for _, d := range devs {
+			if command == "remove" {
+				err = b.RemoveDevice(d.Id)
+				fmt.Fprintf(out, "Device d%d marked for removal; rebalance to reassign its partitions\n", d.Id)
+			} else {
+				var weight float64
+				if weight, err = strconv.ParseFloat(args[1], 64); err != nil {
+					return false, fmt.Errorf("invalid weight %q", args[1])
+				}
+				err = b.SetWeight(d.Id, weight)
+				fmt.Fprintf(out, "Device d%d weight set to %s\n", d.Id, args[1])
+			}
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case "set_replicas":
+		if len(args) != 1 {
+			return false, errors.New("set_replicas needs a replica count")
+		}
+		replicas, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid replica count %q", args[0])
+		}
+		if err := b.SetReplicas(replicas); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "Replica count set to %g; rebalance to apply it\n", replicas)
+		return true, nil
+	case "rebalance":
+		flags := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+		seed := flags.Int64("seed", time.Now().UnixNano(), "random seed, for repeatable rebalances")
+		if err := flags.Parse(args); err != nil {
+			return false, err
+		}
+		moved, err := b.Rebalance(*seed, time.Now())
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "Reassigned %d partition replicas. Balance is now %.02f, dispersion is now %.02f\n",
+			moved, b.Balance(), b.Dispersion().Dispersion)
+		return true, nil
+	case "write_ring":
+		flags := flag.NewFlagSet("write_ring", flag.ContinueOnError)
+		format := flags.Int("format", 0, "ring format version; by default 1 unless the ring needs 2")
+		devIdBytes := flags.Int("dev_id_bytes", 0, "bytes per device id in format 2 rings; by default the smallest that fits")
+		if err := flags.Parse(args); err != nil {
+			return false, err
+		}
+		err := writeFileAtomic(ringFileName(path), func(w io.Writer) error {
+			return b.WriteRingFormat(w, *format, *devIdBytes)
+		})
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(out, "Wrote %s\n", ringFileName(path))
+		return false, nil
+	case "dispersion":
+		flags := flag.NewFlagSet("dispersion", flag.ContinueOnError)
+		asJSON := flags.Bool("json", false, "output JSON")
+		if err := flags.Parse(args); err != nil {
+			return false, err
+		}
+		report := b.Dispersion()
+		if *asJSON {
+			data, err := json.Marshal(report)
+			if err != nil {
+				return false, err
+			}
+			fmt.Fprintln(out, string(data))
+			return false, nil
+		}
+		fmt.Fprintf(out, "Dispersion is %.02f%% of %d partitions\n", report.Dispersion, report.Partitions)
+		for _, name := range []string{"region", "zone", "server", "device"} {
+			fmt.Fprintf(out, "  %d partitions have too many replicas in one %s\n", report.Tiers[name], name)
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown command %q", command)
+}
+
+// BuilderCommand implements "hummingbird ring", which creates and manages ring builder files and writes rings from them.
+func BuilderCommand(args []string) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		builderUsage()
+		os.Exit(1)
+	}
+	path := args[0]
+	if len(args) > 1 && args[1] == "create" {
+		if len(args) != 5 {
+			builderUsage()
+			os.Exit(1)
+		}
+		partPower, err1 := strconv.ParseUint(args[2], 10, 32)
+		replicas, err2 := strconv.ParseFloat(args[3], 64)
+		minPartHours, err3 := strconv.Atoi(args[4])
+		if err1 != nil || err2 != nil || err3 != nil {
+			fmt.Fprintln(os.Stderr, "create needs numeric part_power, replicas and min_part_hours")
+			os.Exit(1)
+		}
+		if _, err := os.Stat(path); err == nil {
+			fmt.Fprintln(os.Stderr, path, "already exists")
+			os.Exit(1)
+		}
+		b, err := NewRingBuilder(uint(partPower), replicas, minPartHours)
+		if err == nil {
+			err = b.Save(path)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to create builder:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	b, err := LoadRingBuilder(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load builder:", err)
+		os.Exit(1)
+	}
+	if len(args) == 1 {
+		printBuilder(os.Stdout, path, b)
+		return
+	}
+	save, err := runBuilderCommand(path, b, args[1], args[2:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if save {
+		if err := b.Save(path); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save builder:", err)
+			os.Exit(1)
+		}
+	}
+}
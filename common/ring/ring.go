@@ -16,6 +16,7 @@
 package ring
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/binary"
@@ -23,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -65,13 +67,28 @@ type Device struct {
 }
 
 type ringData struct {
-	Devs                                []Device `json:"devs"`
-	ReplicaCount                        int      `json:"replica_count"`
-	PartShift                           uint64   `json:"part_shift"`
-	replica2part2devId                  [][]uint16
+	Devs           []Device `json:"devs"`
+	ReplicaCount   float64  `json:"replica_count"`
+	PartShift      uint64   `json:"part_shift"`
+	Version        int      `json:"version"`
+	BuildTimestamp int64    `json:"build_timestamp"`
+	DevIdBytes     int      `json:"dev_id_bytes"`
+	formatVersion  uint16
+	// with a fractional replica count, the last row only covers some of the partitions
+	replica2part2devId                  [][]uint32
 	regionCount, zoneCount, ipPortCount int
 }
 
+// RingInfo is the metadata from a ring file's header.
+type RingInfo struct {
+	FormatVersion  int     `json:"format_version"`
+	Version        int     `json:"version"`
+	BuildTimestamp int64   `json:"build_timestamp"`
+	ReplicaCount   float64 `json:"replica_count"`
+	PartPower      uint64  `json:"part_power"`
+	DevIdBytes     int     `json:"dev_id_bytes"`
+}
+
 type hashRing struct {
 	data   atomic.Value
 	path   string
@@ -120,8 +137,10 @@ func (r *hashRing) GetNodesInOrder(partition uint64) (response []*Device) {
 	if partition >= uint64(len(d.replica2part2devId[0])) {
 		return nil
 	}
-	for i := 0; i < d.ReplicaCount; i++ {
-		response = append(response, &d.Devs[d.replica2part2devId[i][partition]])
+	for _, part2devId := range d.replica2part2devId {
+		if partition < uint64(len(part2devId)) {
+			response = append(response, &d.Devs[part2devId[partition]])
+		}
 	}
 	return response
 }
@@ -132,8 +151,11 @@ func (r *hashRing) GetJobNodes(partition uint64, localDevice int) (response []*D
 	if partition >= uint64(len(d.replica2part2devId[0])) {
 		return nil, false
 	}
-	for i := 0; i < d.ReplicaCount; i++ {
-		dev := &d.Devs[d.replica2part2devId[i][partition]]
+	for _, part2devId := range d.replica2part2devId {
+		if partition >= uint64(len(part2devId)) {
+			continue
+		}
+		dev := &d.Devs[part2devId[partition]]
 		if dev.Id == localDevice {
 			handoff = false
 		} else {
@@ -199,6 +221,89 @@ func (r *hashRing) PartitionCount() (cnt uint64) {
 	return uint64(len(d.replica2part2devId[0]))
 }
 
+// readRingHeader reads the magic string, format version and JSON metadata at the start of a ring file.
+func readRingHeader(r io.Reader) (*ringData, error) {
+	magicBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, magicBuf); err != nil || string(magicBuf) != "R1NG" {
+		return nil, errors.New("Bad magic string")
+	}
+	var ringVersion uint16
+	if err := binary.Read(r, binary.BigEndian, &ringVersion); err != nil {
+		return nil, err
+	}
+	if ringVersion != 1 && ringVersion != 2 {
+		return nil, fmt.Errorf("Unknown ring version %d", ringVersion)
+	}
+	var json_len uint32
+	if err := binary.Read(r, binary.BigEndian, &json_len); err != nil {
+		return nil, err
+	}
+	jsonBuf := make([]byte, json_len)
+	if _, err := io.ReadFull(r, jsonBuf); err != nil {
+		return nil, err
+	}
+	data := &ringData{formatVersion: ringVersion}
+	if err := json.Unmarshal(jsonBuf, data); err != nil {
+		return nil, err
+	}
+	if data.PartShift > 31 {
+		return nil, fmt.Errorf("Invalid part shift %d", data.PartShift)
+	}
+	if data.DevIdBytes == 0 || ringVersion == 1 {
+		data.DevIdBytes = 2
+	}
+	if data.DevIdBytes != 2 && data.DevIdBytes != 4 {
+		return nil, fmt.Errorf("Unsupported device id width %d", data.DevIdBytes)
+	}
+	return data, nil
+}
+
+// readPart2DevIds reads one replica's partition to device id table.  Version 1 rings have tables of 16 bit ids, the
+// last of which runs to the end of the file and may be short if the ring has a fractional replica count; version 2
+// rings prefix each table with its length and store ids of DevIdBytes bytes each.
+func (data *ringData) readPart2DevIds(r io.Reader, partitionCount int, last bool) ([]uint32, error) {
+	count := uint32(partitionCount)
+	if data.formatVersion >= 2 {
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+		if count > uint32(partitionCount) {
+			return nil, fmt.Errorf("Replica table has %d entries for %d partitions", count, partitionCount)
+		}
+	} else if last {
+		buf := make([]byte, partitionCount*2)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if n%2 != 0 {
+			return nil, errors.New("Replica table ends mid device id")
+		}
+		count = uint32(n / 2)
+		r = bytes.NewReader(buf[:n])
+	}
+	part2dev := make([]uint32, count)
+	if data.DevIdBytes == 4 {
+		if err := binary.Read(r, binary.LittleEndian, part2dev); err != nil {
+			return nil, err
+		}
+	} else {
+		narrow := make([]uint16, count)
+		if err := binary.Read(r, binary.LittleEndian, narrow); err != nil {
+			return nil, err
+		}
+		for i, id := range narrow {
+			part2dev[i] = uint32(id)
+		}
+	}
+	for _, id := range part2dev {
+		if int(id) >= len(data.Devs) {
+			return nil, fmt.Errorf("Replica table refers to unknown device %d", id)
+		}
+	}
+	return part2dev, nil
+}
+
 func (r *hashRing) reload() error {
 	fi, err := os.Stat(r.path)
 	if err != nil {
@@ -211,34 +316,31 @@ func (r *hashRing) reload() error {
 	if err != nil {
 		return err
 	}
+	defer fp.Close()
 	gz, err := gzip.NewReader(fp)
 	if err != nil {
 		return err
 	}
-	magicBuf := make([]byte, 4)
-	io.ReadFull(gz, magicBuf)
-	if string(magicBuf) != "R1NG" {
-		return errors.New("Bad magic string")
-	}
-	var ringVersion uint16
-	binary.Read(gz, binary.BigEndian, &ringVersion)
-	if ringVersion != 1 {
-		return fmt.Errorf("Unknown ring version %d", ringVersion)
-	}
-	var json_len uint32
-	binary.Read(gz, binary.BigEndian, &json_len)
-	jsonBuf := make([]byte, json_len)
-	io.ReadFull(gz, jsonBuf)
-	data := &ringData{}
-	if err := json.Unmarshal(jsonBuf, data); err != nil {
+	data, err := readRingHeader(gz)
+	if err != nil {
 		return err
 	}
 	partitionCount := 1 << (32 - data.PartShift)
-	for i := 0; i < data.ReplicaCount; i++ {
-		part2dev := make([]uint16, partitionCount)
-		binary.Read(gz, binary.LittleEndian, &part2dev)
+	replicas := int(math.Ceil(data.ReplicaCount))
+	for i := 0; i < replicas; i++ {
+		part2dev, err := data.readPart2DevIds(gz, partitionCount, i == replicas-1)
+		if err != nil {
+			return err
+		}
 		data.replica2part2devId = append(data.replica2part2devId, part2dev)
 	}
+	if len(data.replica2part2devId) == 0 || len(data.replica2part2devId[0]) != partitionCount {
+		return errors.New("Ring has no complete replica")
+	}
+	if data.formatVersion == 1 {
+		// version 1 headers count the replica tables; the short last one makes for the fraction.
+		data.ReplicaCount = float64(replicas-1) + float64(len(data.replica2part2devId[replicas-1]))/float64(partitionCount)
+	}
 	regionCount := make(map[int]bool)
 	zoneCount := make(map[regionZone]bool)
 	ipPortCount := make(map[ipPort]bool)
@@ -255,6 +357,31 @@ func (r *hashRing) reload() error {
 	return nil
 }
 
+// ReadRingInfo returns the metadata from the header of the ring file at path, without loading the whole ring.
+func ReadRingInfo(path string) (*RingInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	gz, err := gzip.NewReader(fp)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readRingHeader(gz)
+	if err != nil {
+		return nil, err
+	}
+	return &RingInfo{
+		FormatVersion:  int(data.formatVersion),
+		Version:        data.Version,
+		BuildTimestamp: data.BuildTimestamp,
+		ReplicaCount:   data.ReplicaCount,
+		PartPower:      32 - data.PartShift,
+		DevIdBytes:     data.DevIdBytes,
+	}, nil
+}
+
 func (r *hashRing) reloader() error {
 	for {
 		time.Sleep(reloadTime)
@@ -277,7 +404,9 @@ func (m *hashMoreNodes) initialize() {
 	m.sameZones = make(map[regionZone]bool)
 	m.sameIpPorts = make(map[ipPort]bool)
 	for _, mp := range d.replica2part2devId {
-		m.addDevice(&d.Devs[mp[m.partition]])
+		if m.partition < uint64(len(mp)) {
+			m.addDevice(&d.Devs[mp[m.partition]])
+		}
 	}
 	hash := md5.New()
 	hash.Write([]byte(strconv.FormatUint(m.partition, 10)))
@@ -77,7 +77,7 @@ func TestLoadRing(t *testing.T) {
 	require.True(t, ok)
 	require.NotNil(t, ring)
 	require.Equal(t, 4, len(ring.getData().Devs))
-	require.Equal(t, 2, ring.getData().ReplicaCount)
+	require.Equal(t, 2.0, ring.getData().ReplicaCount)
 	require.Equal(t, uint64(29), ring.getData().PartShift)
 }
 
@@ -155,7 +155,7 @@ func TestRingReload(t *testing.T) {
 	os.Chtimes(fp.Name(), time.Now(), time.Now().Add(time.Second))
 	ring.reload()
 	require.Equal(t, 5, len(ring.getData().Devs))
-	require.Equal(t, 3, ring.getData().ReplicaCount)
+	require.Equal(t, 3.0, ring.getData().ReplicaCount)
 	require.Equal(t, uint64(30), ring.getData().PartShift)
 }
 
@@ -169,3 +169,116 @@ func TestCounts(t *testing.T) {
 	require.Equal(t, uint64(2), r.ReplicaCount())
 	require.Equal(t, uint64(8), r.PartitionCount())
 }
+
+// writeAV2Ring writes a version 2 ring with 4 byte device ids and a partial last replica.
+func writeAV2Ring(w io.Writer, deviceCount int, replicaCount float64, partShift uint) error {
+	gzw := gzip.NewWriter(w)
+	devs := []Device{}
+	for i := 0; i < deviceCount; i++ {
+		ip := fmt.Sprintf("127.0.%d.%d", i/256%256, i%256)
+		devs = append(devs, Device{Id: i, Device: "sda", Ip: ip, Port: 1234 + i/65536, ReplicationIp: ip, ReplicationPort: 1234, Weight: 1})
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"devs":            devs,
+		"replica_count":   replicaCount,
+		"part_shift":      partShift,
+		"version":         7,
+		"build_timestamp": 1500000000,
+		"dev_id_bytes":    4,
+	})
+	if err != nil {
+		return err
+	}
+	gzw.Write([]byte{'R', '1', 'N', 'G'})
+	binary.Write(gzw, binary.BigEndian, uint16(2))
+	binary.Write(gzw, binary.BigEndian, uint32(len(data)))
+	gzw.Write(data)
+	partitionCount := 1 << (32 - partShift)
+	for i := 0; float64(i) < replicaCount; i++ {
+		count := partitionCount
+		if float64(i+1) > replicaCount {
+			count = int(float64(partitionCount) * (replicaCount - float64(i)))
+		}
+		binary.Write(gzw, binary.BigEndian, uint32(count))
+		part2dev := make([]uint32, count)
+		for j := range part2dev {
+			part2dev[j] = uint32(len(devs) - 1 - (j+i)%len(devs))
+		}
+		binary.Write(gzw, binary.LittleEndian, part2dev)
+	}
+	return gzw.Close()
+}
+
+func TestLoadRingV2(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer fp.Close()
+	defer os.RemoveAll(fp.Name())
+	require.Nil(t, writeAV2Ring(fp, 70000, 2.5, 28))
+	r, err := LoadRing(fp.Name(), "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, uint64(16), r.PartitionCount())
+	require.Equal(t, uint64(3), r.ReplicaCount())
+	// device ids past 65535 survive
+	require.Equal(t, 69999, r.GetNodesInOrder(0)[0].Id)
+	// the half replica covers only the first half of the partitions
+	require.Equal(t, 3, len(r.GetNodesInOrder(7)))
+	require.Equal(t, 2, len(r.GetNodesInOrder(8)))
+	require.Equal(t, 69998, r.GetNodesInOrder(0)[1].Id)
+	nodes, handoff := r.GetJobNodes(8, 69991)
+	require.Equal(t, 1, len(nodes))
+	require.False(t, handoff)
+
+	info, err := ReadRingInfo(fp.Name())
+	require.Nil(t, err)
+	require.Equal(t, &RingInfo{FormatVersion: 2, Version: 7, BuildTimestamp: 1500000000, ReplicaCount: 2.5, PartPower: 4, DevIdBytes: 4}, info)
+}
+
+func TestLoadRingV1Fractional(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer fp.Close()
+	defer os.RemoveAll(fp.Name())
+	// swift writes a ring with 2.5 replicas as 3 tables, the last covering half the partitions.
+	gzw := gzip.NewWriter(fp)
+	devs := []Device{}
+	for i := 0; i < 4; i++ {
+		ip := fmt.Sprintf("127.0.0.%d", i)
+		devs = append(devs, Device{Id: i, Device: "sda", Ip: ip, Port: 1234, ReplicationIp: ip, ReplicationPort: 1234, Weight: 1})
+	}
+	data, err := json.Marshal(map[string]interface{}{"devs": devs, "replica_count": 3, "part_shift": 28})
+	require.Nil(t, err)
+	gzw.Write([]byte{'R', '1', 'N', 'G'})
+	binary.Write(gzw, binary.BigEndian, uint16(1))
+	binary.Write(gzw, binary.BigEndian, uint32(len(data)))
+	gzw.Write(data)
+	for i, count := range []int{16, 16, 8} {
+		part2dev := make([]uint16, count)
+		for j := range part2dev {
+			part2dev[j] = uint16((j + i) % len(devs))
+		}
+		binary.Write(gzw, binary.LittleEndian, part2dev)
+	}
+	require.Nil(t, gzw.Close())
+
+	r, err := LoadRing(fp.Name(), "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, uint64(16), r.PartitionCount())
+	require.Equal(t, uint64(3), r.ReplicaCount())
+	require.Equal(t, 2.5, r.(*hashRing).getData().ReplicaCount)
+	require.Equal(t, 3, len(r.GetNodesInOrder(7)))
+	require.Equal(t, 2, len(r.GetNodesInOrder(8)))
+}
+
+func TestLoadRingBadVersion(t *testing.T) {
+	fp, err := ioutil.TempFile("", "")
+	require.Nil(t, err)
+	defer fp.Close()
+	defer os.RemoveAll(fp.Name())
+	gzw := gzip.NewWriter(fp)
+	gzw.Write([]byte{'R', '1', 'N', 'G'})
+	binary.Write(gzw, binary.BigEndian, uint16(3))
+	require.Nil(t, gzw.Close())
+	_, err = LoadRing(fp.Name(), "prefix", "suffix")
+	require.NotNil(t, err)
+}
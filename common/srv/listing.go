@@ -0,0 +1,236 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package srv
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Listing formats, as named by a listing's format query parameter.
+const (
+	ListingText   = "text"
+	ListingJSON   = "json"
+	ListingNDJSON = "ndjson"
+	ListingXML    = "xml"
+)
+
+// MaxListingLimit is the most entries an account or container listing may ask for.
+const MaxListingLimit = 10000
+
+// ListingLimitHeader is the backend header a proxy uses to let a trusted request, such as a reseller admin's, ask for
+// more than MaxListingLimit entries. Its value is the request's new maximum.
+const ListingLimitHeader = "X-Backend-Listing-Limit"
+
+// ListingLimitMax returns the most entries a listing request may ask for.
+func ListingLimitMax(request *http.Request) int64 {
+	if max, err := strconv.ParseInt(request.Header.Get(ListingLimitHeader), 10, 64); err == nil && max > MaxListingLimit {
+		return max
+	}
+	return MaxListingLimit
+}
+
+// listingContentTypes are the content types listings can be served as, in order of preference when a client doesn't
+// mind which it gets.
+var listingContentTypes = []struct {
+	contentType string
+	format      string
+}{
+	{"text/plain", ListingText},
+	{"application/json", ListingJSON},
+	{"application/x-ndjson", ListingNDJSON},
+	{"application/xml", ListingXML},
+	{"text/xml", ListingXML},
+}
+
+// ListingFormat returns the format a listing request asked for with its format query parameter or, failing that, its
+// Accept header. It returns "" if the Accept header doesn't allow any of the listing formats.
+func ListingFormat(request *http.Request) string {
+	if format := strings.ToLower(request.FormValue("format")); format != "" {
+		switch format {
+		case ListingJSON, ListingNDJSON, ListingXML:
+			return format
+		}
+		return ListingText
+	}
+	accept := request.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return ListingText
+	}
+	format, best := "", 0.0
+	for _, offer := range listingContentTypes {
+		if q := acceptQuality(accept, offer.contentType); q > best {
+			format, best = offer.format, q
+		}
+	}
+	return format
+}
+
+// acceptQuality returns the q-value an Accept header gives a content type, taken from the most specific media range
+// that matches it; 0 means the content type isn't acceptable.
+func acceptQuality(accept, contentType string) float64 {
+	mainType := contentType[:strings.Index(contentType, "/")]
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		rangeType := strings.ToLower(strings.TrimSpace(params[0]))
+		var s int
+		switch rangeType {
+		case contentType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*", "*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil && v >= 0 && v <= 1 {
+					q = v
+				}
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// ListingContentType returns the Content-Type a listing in the given format is served as.
+func ListingContentType(format string) string {
+	switch format {
+	case ListingJSON:
+		return "application/json; charset=utf-8"
+	case ListingNDJSON:
+		return "application/x-ndjson; charset=utf-8"
+	case ListingXML:
+		return "application/xml; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// ListingWriter streams an account or container listing to a client an entry at a time, so listings of any size can
+// be served without holding them in memory. Nothing is sent until the first entry is written, so a listing that fails
+// before then can still get an error response.
+type ListingWriter struct {
+	writer    http.ResponseWriter
+	buf       *bufio.Writer
+	format    string
+	root      string
+	name      string
+	entryName func(entry interface{}) string
+	count     int
+}
+
+// NewListingWriter returns a ListingWriter for a listing in the given format. Xml listings are wrapped in a root
+// element with a name attribute, and text listings are made up of the entries' names, as given by entryName.
+func NewListingWriter(writer http.ResponseWriter, format, root, name string, entryName func(entry interface{}) string) *ListingWriter {
+	return &ListingWriter{writer: writer, format: format, root: root, name: name, entryName: entryName}
+}
+
+// Started returns whether any of the listing has been sent.
+func (w *ListingWriter) Started() bool {
+	return w.buf != nil
+}
+
+func (w *ListingWriter) start() error {
+	w.writer.Header().Set("Content-Type", ListingContentType(w.format))
+	w.writer.Header().Del("Content-Length")
+	w.writer.WriteHeader(http.StatusOK)
+	w.buf = bufio.NewWriterSize(w.writer, 64*1024)
+	switch w.format {
+	case ListingJSON:
+		_, err := w.buf.WriteString("[")
+		return err
+	case ListingXML:
+		if _, err := w.buf.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<" + w.root + " name=\""); err != nil {
+			return err
+		}
+		if err := xml.EscapeText(w.buf, []byte(w.name)); err != nil {
+			return err
+		}
+		_, err := w.buf.WriteString("\">")
+		return err
+	}
+	return nil
+}
+
+// Write sends an entry of the listing.
+func (w *ListingWriter) Write(entry interface{}) error {
+	if w.buf == nil {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	w.count++
+	var output []byte
+	var err error
+	switch w.format {
+	case ListingJSON:
+		if output, err = json.Marshal(entry); err == nil && w.count > 1 {
+			output = append([]byte(","), output...)
+		}
+	case ListingNDJSON:
+		if output, err = json.Marshal(entry); err == nil {
+			output = append(output, '\n')
+		}
+	case ListingXML:
+		output, err = xml.Marshal(entry)
+	default:
+		output = []byte(w.entryName(entry) + "\n")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.buf.Write(output)
+	return err
+}
+
+// Close finishes the listing. An empty listing is answered with a 204 in the line-based formats, and an empty
+// document in the others.
+func (w *ListingWriter) Close() error {
+	if w.buf == nil {
+		if w.format == ListingText || w.format == ListingNDJSON {
+			w.writer.Header().Set("Content-Type", ListingContentType(w.format))
+			w.writer.Header().Set("Content-Length", "0")
+			w.writer.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	switch w.format {
+	case ListingJSON:
+		if _, err := w.buf.WriteString("]"); err != nil {
+			return err
+		}
+	case ListingXML:
+		if _, err := w.buf.WriteString("</" + w.root + ">"); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
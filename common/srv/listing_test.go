@@ -0,0 +1,118 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package srv
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListingFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query, accept, expected string
+	}{
+		{"", "", ListingText},
+		{"format=json", "", ListingJSON},
+		{"format=XML", "", ListingXML},
+		{"format=ndjson", "", ListingNDJSON},
+		{"format=bogus", "application/json", ListingText},
+		{"format=json", "image/png", ListingJSON},
+		{"", "application/json", ListingJSON},
+		{"", "application/x-ndjson", ListingNDJSON},
+		{"", "text/xml", ListingXML},
+		{"", "*/*", ListingText},
+		{"", "application/*", ListingJSON},
+		{"", "application/json;q=0.5, application/xml", ListingXML},
+		{"", "text/*;q=0.1, application/json;q=0.2", ListingJSON},
+		{"", "application/*;q=0.9, application/json;q=0", ListingNDJSON},
+		{"", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", ListingXML},
+		{"", "image/png", ""},
+		{"", "application/json;q=0", ""},
+	} {
+		request := httptest.NewRequest("GET", "/a/c?"+tc.query, nil)
+		if tc.accept != "" {
+			request.Header.Set("Accept", tc.accept)
+		}
+		require.Equal(t, tc.expected, ListingFormat(request), "%+v", tc)
+	}
+}
+
+func TestListingLimitMax(t *testing.T) {
+	request := httptest.NewRequest("GET", "/a/c", nil)
+	require.Equal(t, int64(MaxListingLimit), ListingLimitMax(request))
+	request.Header.Set(ListingLimitHeader, "100")
+	require.Equal(t, int64(MaxListingLimit), ListingLimitMax(request))
+	request.Header.Set(ListingLimitHeader, "1000000")
+	require.Equal(t, int64(1000000), ListingLimitMax(request))
+}
+
+type testEntry struct {
+	XMLName xml.Name `xml:"object" json:"-"`
+	Name    string   `xml:"name" json:"name"`
+}
+
+func writeTestListing(format string, names ...string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	w := NewListingWriter(rec, format, "container", "c&d", func(entry interface{}) string {
+		return entry.(*testEntry).Name
+	})
+	for _, name := range names {
+		if err := w.Write(&testEntry{Name: name}); err != nil {
+			panic(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return rec
+}
+
+func TestListingWriter(t *testing.T) {
+	rec := writeTestListing(ListingText, "a", "b")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, "a\nb\n", rec.Body.String())
+
+	rec = writeTestListing(ListingJSON, "a", "b")
+	require.Equal(t, "application/json; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, `[{"name":"a"},{"name":"b"}]`, rec.Body.String())
+
+	rec = writeTestListing(ListingNDJSON, "a", "b")
+	require.Equal(t, "application/x-ndjson; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, "{\"name\":\"a\"}\n{\"name\":\"b\"}\n", rec.Body.String())
+
+	rec = writeTestListing(ListingXML, "a")
+	require.Equal(t, "application/xml; charset=utf-8", rec.Header().Get("Content-Type"))
+	require.Equal(t, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c&amp;d\"><object><name>a</name></object></container>", rec.Body.String())
+}
+
+func TestListingWriterEmpty(t *testing.T) {
+	rec := writeTestListing(ListingText)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, "", rec.Body.String())
+	rec = writeTestListing(ListingNDJSON)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = writeTestListing(ListingJSON)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "[]", rec.Body.String())
+	rec = writeTestListing(ListingXML)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c&amp;d\"></container>", rec.Body.String())
+}
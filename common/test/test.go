@@ -17,6 +17,7 @@ package test
 
 import (
 	"bytes"
+	"encoding/json"
 	"net/http"
 
 	"github.com/troubling/hummingbird/common/ring"
@@ -28,6 +29,8 @@ type CaptureResponse struct {
 	Status int
 	header http.Header
 	Body   *bytes.Buffer
+	// WriteError, if set, fails every write to the body, like a client that's gone away.
+	WriteError error
 }
 
 func (w *CaptureResponse) WriteHeader(status int) {
@@ -39,6 +42,9 @@ func (w *CaptureResponse) Header() http.Header {
 }
 
 func (w *CaptureResponse) Write(b []byte) (int, error) {
+	if w.WriteError != nil {
+		return 0, w.WriteError
+	}
 	return w.Body.Write(b)
 }
 
@@ -191,6 +197,54 @@ func (mr *FakeMemcacheRing) SetMulti(serverKey string, values map[string]interfa
 	return nil
 }
 
+// MemoryMemcacheRing is a MemcacheRing that actually remembers what was stored in it.
+type MemoryMemcacheRing struct {
+	values map[string][]byte
+}
+
+func NewMemoryMemcacheRing() *MemoryMemcacheRing {
+	return &MemoryMemcacheRing{values: map[string][]byte{}}
+}
+
+func (mc *MemoryMemcacheRing) Decr(key string, delta int64, timeout int) (int64, error) {
+	return 0, nil
+}
+
+func (mc *MemoryMemcacheRing) Incr(key string, delta int64, timeout int) (int64, error) {
+	return 0, nil
+}
+
+func (mc *MemoryMemcacheRing) Delete(key string) error {
+	delete(mc.values, key)
+	return nil
+}
+
+func (mc *MemoryMemcacheRing) Get(key string) (interface{}, error) {
+	var v interface{}
+	return v, mc.GetStructured(key, &v)
+}
+
+func (mc *MemoryMemcacheRing) GetStructured(key string, val interface{}) error {
+	if v, ok := mc.values[key]; ok {
+		return json.Unmarshal(v, val)
+	}
+	return ring.CacheMiss
+}
+
+func (mc *MemoryMemcacheRing) GetMulti(serverKey string, keys []string) (map[string]interface{}, error) {
+	return nil, nil
+}
+
+func (mc *MemoryMemcacheRing) Set(key string, value interface{}, timeout int) error {
+	v, err := json.Marshal(value)
+	mc.values[key] = v
+	return err
+}
+
+func (mc *MemoryMemcacheRing) SetMulti(serverKey string, values map[string]interface{}, timeout int) error {
+	return nil
+}
+
 type MockResponseWriter struct{}
 
 func (m MockResponseWriter) Header() (h http.Header) {
@@ -0,0 +1,294 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// Sink receives finished spans. Export must not block for long; it's called
+// on the request path.
+type Sink interface {
+	Export(span *SpanData)
+	Close() error
+}
+
+// SinkConstructor builds a Sink from the trace_* settings of a config section. Sinks log their export failures to the
+// logger.
+type SinkConstructor func(config conf.Section, logger srv.LowLevelLogger) (Sink, error)
+
+var sinks = map[string]SinkConstructor{}
+
+// RegisterSink makes a sink available to trace_sink under the given name.
+func RegisterSink(name string, constructor SinkConstructor) {
+	sinks[name] = constructor
+}
+
+func init() {
+	RegisterSink("file", newFileSinkFromConfig)
+	RegisterSink("otlp", newOTLPSinkFromConfig)
+}
+
+// FileSink writes each span as a line of JSON.
+type FileSink struct {
+	lock    sync.Mutex
+	closer  io.Closer
+	encoder *json.Encoder
+}
+
+// NewFileSink writes spans to w.
+func NewFileSink(w io.Writer) *FileSink {
+	s := &FileSink{encoder: json.NewEncoder(w)}
+	if c, ok := w.(io.Closer); ok {
+		s.closer = c
+	}
+	return s
+}
+
+func newFileSinkFromConfig(config conf.Section, logger srv.LowLevelLogger) (Sink, error) {
+	path := config.GetDefault("trace_file", "/var/log/hummingbird/traces.json")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileSink(f), nil
+}
+
+func (s *FileSink) Export(span *SpanData) {
+	s.lock.Lock()
+	s.encoder.Encode(span)
+	s.lock.Unlock()
+}
+
+// Close closes the sink's writer, if it's closeable, once any export in progress is done.
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 8192
+	otlpFlushInterval = 5 * time.Second
+)
+
+// OTLPSink batches spans and posts them to an OpenTelemetry collector's
+// OTLP/HTTP JSON endpoint. Spans are dropped rather than queued without
+// bound if the collector can't keep up.
+type OTLPSink struct {
+	endpoint string
+	client   *http.Client
+	queue    chan *SpanData
+	stop     chan struct{}
+	done     chan struct{}
+	closing  sync.Once
+	logger   srv.LowLevelLogger
+}
+
+// NewOTLPSink starts a sink posting to endpoint, e.g. http://127.0.0.1:4318/v1/traces, logging failed posts to logger.
+func NewOTLPSink(endpoint string, client *http.Client, logger srv.LowLevelLogger) *OTLPSink {
+	s := &OTLPSink{endpoint: endpoint, client: client, queue: make(chan *SpanData, otlpQueueSize),
+		stop: make(chan struct{}), done: make(chan struct{}), logger: logger}
+	go s.run()
+	return s
+}
+
+func newOTLPSinkFromConfig(config conf.Section, logger srv.LowLevelLogger) (Sink, error) {
+	endpoint := config.GetDefault("trace_otlp_endpoint", "http://127.0.0.1:4318/v1/traces")
+	return NewOTLPSink(endpoint, &http.Client{Timeout: 10 * time.Second}, logger), nil
+}
+
+// Export queues a span to be sent.  Spans finishing after the sink is closed, such as those of requests still in
+// flight at shutdown, are dropped.
+func (s *OTLPSink) Export(span *SpanData) {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+	select {
+	case s.queue <- span:
+	default:
+	}
+}
+
+// Close sends any queued spans and stops the sink.
+func (s *OTLPSink) Close() error {
+	s.closing.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+func (s *OTLPSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []*SpanData
+	for {
+		select {
+		case <-s.stop:
+			for {
+				select {
+				case span := <-s.queue:
+					batch = append(batch, span)
+					if len(batch) >= otlpBatchSize {
+						s.send(batch)
+						batch = nil
+					}
+				default:
+					s.send(batch)
+					return
+				}
+			}
+		case span := <-s.queue:
+			batch = append(batch, span)
+			if len(batch) >= otlpBatchSize {
+				s.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			s.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send posts a batch of spans, logging them as dropped if the collector doesn't take them.
+func (s *OTLPSink) send(batch []*SpanData) {
+	if err := s.post(batch); err != nil {
+		s.logger.Error("Unable to send spans to collector", zap.String("endpoint", s.endpoint),
+			zap.Int("dropped", len(batch)), zap.Error(err))
+	}
+}
+
+func (s *OTLPSink) post(batch []*SpanData) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		out[i].Key = k
+		out[i].Value.StringValue = attrs[k]
+	}
+	return out
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpRequest groups spans by service into an ExportTraceServiceRequest.
+func otlpRequest(batch []*SpanData) *otlpExportRequest {
+	byService := map[string][]otlpSpan{}
+	var services []string
+	for _, span := range batch {
+		if _, ok := byService[span.Service]; !ok {
+			services = append(services, span.Service)
+		}
+		byService[span.Service] = append(byService[span.Service], otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		})
+	}
+	req := &otlpExportRequest{}
+	for _, service := range services {
+		rs := otlpResourceSpans{}
+		rs.Resource.Attributes = otlpAttributes(map[string]string{"service.name": service})
+		ss := otlpScopeSpans{Spans: byService[service]}
+		ss.Scope.Name = "hummingbird"
+		rs.ScopeSpans = []otlpScopeSpans{ss}
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+	}
+	return req
+}
@@ -0,0 +1,282 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+// Package tracing records timed spans of work for a request, carries the
+// trace between servers in W3C traceparent headers, and exports finished
+// spans to a pluggable Sink.
+//
+// A nil *Tracer and a nil *Span are both valid and do nothing, so code can
+// trace unconditionally and tracing costs nothing when it's turned off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+)
+
+// TraceparentHeader is the W3C Trace Context header used to propagate traces.
+const TraceparentHeader = "Traceparent"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Traceparent renders the span context as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a traceparent header value.
+func ParseTraceparent(value string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent trace id %q", parts[1])
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent span id %q", parts[2])
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid traceparent flags %q", parts[3])
+	}
+	if sc.TraceID == (TraceID{}) || sc.SpanID == (SpanID{}) {
+		return sc, fmt.Errorf("invalid traceparent %q", value)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Span is a timed piece of work within a trace.
+type Span struct {
+	tracer     *Tracer
+	lock       sync.Mutex
+	name       string
+	context    SpanContext
+	parent     SpanID
+	start      time.Time
+	finished   bool
+	attributes map[string]string
+}
+
+// SpanData is a finished span, as handed to a Sink.
+type SpanData struct {
+	Service    string            `json:"service"`
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   float64           `json:"duration"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Context returns the span's context; the zero SpanContext for a nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute annotates the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.attributes[key] = value
+	s.lock.Unlock()
+}
+
+// Child starts a new span beneath s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(name, s.context.TraceID, s.context.SpanID, s.context.Sampled)
+}
+
+// Inject sets the traceparent header so the receiver's spans become children of s.
+func (s *Span) Inject(header http.Header) {
+	if s == nil || header == nil {
+		return
+	}
+	header.Set(TraceparentHeader, s.context.Traceparent())
+}
+
+// Finish ends the span and exports it if it was sampled. Finishing twice does nothing.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	data := &SpanData{
+		Service:  s.tracer.service,
+		Name:     s.name,
+		TraceID:  s.context.TraceID.String(),
+		SpanID:   s.context.SpanID.String(),
+		Start:    s.start,
+		End:      end,
+		Duration: end.Sub(s.start).Seconds(),
+	}
+	if len(s.attributes) > 0 {
+		data.Attributes = make(map[string]string, len(s.attributes))
+		for k, v := range s.attributes {
+			data.Attributes[k] = v
+		}
+	}
+	s.lock.Unlock()
+	if s.parent != (SpanID{}) {
+		data.ParentID = s.parent.String()
+	}
+	if s.context.Sampled {
+		s.tracer.sink.Export(data)
+	}
+}
+
+// Tracer starts spans for one service and hands them to its Sink when they finish.
+type Tracer struct {
+	service    string
+	sink       Sink
+	sampleRate float64
+}
+
+// NewTracer returns a Tracer that samples new traces at sampleRate (0 to 1).
+// Traces continued from a traceparent header keep the caller's sampling decision.
+func NewTracer(service string, sink Sink, sampleRate float64) *Tracer {
+	return &Tracer{service: service, sink: sink, sampleRate: sampleRate}
+}
+
+func (t *Tracer) newSpan(name string, traceID TraceID, parent SpanID, sampled bool) *Span {
+	s := &Span{tracer: t, name: name, parent: parent, start: time.Now(), attributes: map[string]string{}}
+	s.context.TraceID = traceID
+	s.context.Sampled = sampled
+	rand.Read(s.context.SpanID[:])
+	return s
+}
+
+// StartSpan starts the root span of a new trace.
+func (t *Tracer) StartSpan(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	var traceID TraceID
+	rand.Read(traceID[:])
+	var sample [8]byte
+	rand.Read(sample[:])
+	// the top 53 bits make a uniform float in [0, 1), so small sample rates aren't rounded to 1/256ths.
+	return t.newSpan(name, traceID, SpanID{}, float64(binary.BigEndian.Uint64(sample[:])>>11)/(1<<53) < t.sampleRate)
+}
+
+// StartFromHeader continues the trace from the request's traceparent header,
+// or starts a new trace if there isn't a valid one.
+func (t *Tracer) StartFromHeader(name string, header http.Header) *Span {
+	if t == nil {
+		return nil
+	}
+	if sc, err := ParseTraceparent(header.Get(TraceparentHeader)); err == nil {
+		return t.newSpan(name, sc.TraceID, sc.SpanID, sc.Sampled)
+	}
+	return t.StartSpan(name)
+}
+
+// Close flushes and closes the tracer's sink.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	return t.sink.Close()
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying span.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// SpanFromContext returns the span carried by ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	if span, ok := ctx.Value(contextKey{}).(*Span); ok {
+		return span
+	}
+	return nil
+}
+
+// StartChild starts a child of the span carried by ctx; nil if there isn't one.
+func StartChild(ctx context.Context, name string) *Span {
+	return SpanFromContext(ctx).Child(name)
+}
+
+// NewTracerFromConfig builds a tracer from the trace_* settings in the given
+// config section, with the sink logging its failures to logger. It returns a
+// nil tracer, which traces nothing, unless trace_sink is set.
+//
+//	trace_sink = file | otlp | <any registered sink>
+//	trace_sample_rate = 1.0
+//	trace_file = /var/log/hummingbird/traces.json  (file)
+//	trace_otlp_endpoint = http://127.0.0.1:4318/v1/traces  (otlp)
+func NewTracerFromConfig(config conf.Config, section string, service string, logger srv.LowLevelLogger) (*Tracer, error) {
+	sinkName := config.GetDefault(section, "trace_sink", "")
+	if sinkName == "" || sinkName == "none" {
+		return nil, nil
+	}
+	constructor, ok := sinks[sinkName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown trace_sink %q", sinkName)
+	}
+	sink, err := constructor(config.GetSection(section), logger)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up trace_sink %q: %v", sinkName, err)
+	}
+	return NewTracer(service, sink, config.GetFloat(section, "trace_sample_rate", 1.0)), nil
+}
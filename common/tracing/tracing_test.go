@@ -0,0 +1,224 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// memorySink keeps exported spans for inspection.
+type memorySink struct {
+	lock  sync.Mutex
+	spans []*SpanData
+}
+
+func (s *memorySink) Export(span *SpanData) {
+	s.lock.Lock()
+	s.spans = append(s.spans, span)
+	s.lock.Unlock()
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func TestTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Nil(t, err)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	require.True(t, sc.Sampled)
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+	// later versions may add fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	require.Nil(t, err)
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+	} {
+		_, err = ParseTraceparent(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	sink := &memorySink{}
+	tracer := NewTracer("proxy-server", sink, 1)
+	root := tracer.StartSpan("GET")
+	root.SetAttribute("path", "/v1/a")
+	ctx := ContextWithSpan(context.Background(), root)
+	child := StartChild(ctx, "HEAD container")
+	header := http.Header{}
+	child.Inject(header)
+
+	remote := NewTracer("object-server", sink, 0).StartFromHeader("GET", header)
+	remote.Finish()
+	child.Finish()
+	root.Finish()
+	root.Finish()
+
+	require.Equal(t, 3, len(sink.spans))
+	server, client, top := sink.spans[0], sink.spans[1], sink.spans[2]
+	require.Equal(t, "object-server", server.Service)
+	require.Equal(t, top.TraceID, server.TraceID)
+	require.Equal(t, client.SpanID, server.ParentID)
+	require.Equal(t, top.SpanID, client.ParentID)
+	require.Equal(t, "", top.ParentID)
+	require.Equal(t, map[string]string{"path": "/v1/a"}, top.Attributes)
+	require.True(t, top.Duration >= 0)
+
+	// unsampled traces propagate but aren't exported
+	unsampled := NewTracer("proxy-server", sink, 0).StartSpan("GET")
+	header = http.Header{}
+	unsampled.Inject(header)
+	require.True(t, strings.HasSuffix(header.Get(TraceparentHeader), "-00"))
+	NewTracer("object-server", sink, 1).StartFromHeader("GET", header).Finish()
+	unsampled.Finish()
+	require.Equal(t, 3, len(sink.spans))
+}
+
+func TestNilTracing(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.StartFromHeader("GET", http.Header{})
+	require.Nil(t, span)
+	span.SetAttribute("a", "b")
+	span.Inject(http.Header{})
+	require.Nil(t, span.Child("child"))
+	span.Finish()
+	require.Nil(t, StartChild(context.Background(), "nothing"))
+	require.Nil(t, tracer.Close())
+}
+
+func TestFileSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	tracer := NewTracer("account-server", NewFileSink(out), 1)
+	tracer.StartSpan("one").Finish()
+	tracer.StartSpan("two").Finish()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Equal(t, 2, len(lines))
+	var span SpanData
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &span))
+	require.Equal(t, "two", span.Name)
+	require.Equal(t, "account-server", span.Service)
+}
+
+func TestOTLPSink(t *testing.T) {
+	var lock sync.Mutex
+	var received []otlpExportRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpExportRequest
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		lock.Lock()
+		received = append(received, req)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+	sink := NewOTLPSink(collector.URL, http.DefaultClient, zap.NewNop())
+	root := NewTracer("proxy-server", sink, 1).StartSpan("PUT")
+	root.SetAttribute("txn", "tx123")
+	child := root.Child("PUT object")
+	child.Finish()
+	root.Finish()
+	require.Nil(t, sink.Close())
+
+	require.Equal(t, 1, len(received))
+	spans := received[0].ResourceSpans[0].ScopeSpans[0].Spans
+	require.Equal(t, "service.name", received[0].ResourceSpans[0].Resource.Attributes[0].Key)
+	require.Equal(t, "proxy-server", received[0].ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	require.Equal(t, 2, len(spans))
+	require.Equal(t, "PUT object", spans[0].Name)
+	require.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	require.Equal(t, "txn", spans[1].Attributes[0].Key)
+
+	// a span finishing after shutdown is dropped.
+	late := NewTracer("proxy-server", sink, 1).StartSpan("GET")
+	late.Finish()
+	require.Nil(t, sink.Close())
+	require.Equal(t, 1, len(received))
+}
+
+func TestOTLPSinkLogsFailures(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	obs, logs := observer.New(zap.InfoLevel)
+	sink := NewOTLPSink(collector.URL, http.DefaultClient, zap.New(obs))
+	NewTracer("proxy-server", sink, 1).StartSpan("GET").Finish()
+	require.Nil(t, sink.Close())
+	require.Equal(t, 1, logs.FilterMessage("Unable to send spans to collector").Len())
+	require.EqualValues(t, 1, logs.All()[0].ContextMap()["dropped"])
+}
+
+func TestSampleRate(t *testing.T) {
+	sink := &memorySink{}
+	tracer := NewTracer("proxy-server", sink, 0.002)
+	sampled := 0
+	for i := 0; i < 100000; i++ {
+		if tracer.StartSpan("GET").Context().Sampled {
+			sampled++
+		}
+	}
+	// a rate below 1/256 isn't rounded up to it.
+	require.True(t, sampled > 100 && sampled < 300, "sampled %d", sampled)
+	tracer = NewTracer("proxy-server", sink, 0)
+	require.False(t, tracer.StartSpan("GET").Context().Sampled)
+}
+
+func TestNewTracerFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	config, err := conf.StringConfig("[app:object-server]\n")
+	require.Nil(t, err)
+	tracer, err := NewTracerFromConfig(config, "app:object-server", "object-server", zap.NewNop())
+	require.Nil(t, err)
+	require.Nil(t, tracer)
+
+	config, err = conf.StringConfig("[app:object-server]\ntrace_sink=carrier_pigeon\n")
+	require.Nil(t, err)
+	_, err = NewTracerFromConfig(config, "app:object-server", "object-server", zap.NewNop())
+	require.NotNil(t, err)
+
+	path := filepath.Join(dir, "traces.json")
+	config, err = conf.StringConfig("[app:object-server]\ntrace_sink=file\ntrace_file=" + path + "\n")
+	require.Nil(t, err)
+	tracer, err = NewTracerFromConfig(config, "app:object-server", "object-server", zap.NewNop())
+	require.Nil(t, err)
+	tracer.StartSpan("GET").Finish()
+	require.Nil(t, tracer.Close())
+	data, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"service":"object-server"`)
+}
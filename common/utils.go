@@ -353,6 +353,17 @@ func (k *KeyedLimit) Keys() []string {
 	return keys
 }
 
+// InUse returns a snapshot of the number of requests in use for each key.
+func (k *KeyedLimit) InUse() map[string]int64 {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	inUse := make(map[string]int64, len(k.inUse))
+	for key, v := range k.inUse {
+		inUse[key] = v
+	}
+	return inUse
+}
+
 func (k *KeyedLimit) MarshalJSON() ([]byte, error) {
 	k.lock.Lock()
 	data, err := json.Marshal(k.inUse)
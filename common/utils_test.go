@@ -323,3 +323,16 @@ func TestSliceFromCSV(t *testing.T) {
 		}
 	}
 }
+
+func TestKeyedLimitInUse(t *testing.T) {
+	k := NewKeyedLimit(2, 10)
+	require.Equal(t, int64(0), k.Acquire("sda", false))
+	require.Equal(t, int64(0), k.Acquire("sda", false))
+	require.Equal(t, int64(0), k.Acquire("sdb", false))
+	k.Release("sdb")
+	inUse := k.InUse()
+	require.Equal(t, map[string]int64{"sda": 2, "sdb": 0}, inUse)
+	// a snapshot, not the live map
+	k.Release("sda")
+	require.Equal(t, int64(2), inUse["sda"])
+}
@@ -0,0 +1,105 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/dbauditor"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// integrityChecker is a container that can check its database file for corruption.
+type integrityChecker interface {
+	IntegrityCheck() error
+}
+
+// auditContainer opens a container database and checks its integrity, returning the account and container it's for.
+func auditContainer(engine ContainerEngine, dbFile string) (string, string, error) {
+	c, err := engine.OpenFile(dbFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer c.Close()
+	if db, ok := c.(integrityChecker); ok {
+		if err := db.IntegrityCheck(); err != nil {
+			return "", "", err
+		}
+	}
+	info, err := c.GetInfo()
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to get container info: %v", err)
+	}
+	return info.Account, info.Container, nil
+}
+
+// newAuditor returns a container auditor, which checks every container database on the server for corruption and
+// misplacement, quarantining any that fail.
+func newAuditor(engine ContainerEngine) *dbauditor.Auditor {
+	return &dbauditor.Auditor{
+		Type:          "container",
+		FindDatabases: findContainerDbs,
+		OpenDatabase: func(dbFile string) (string, string, error) {
+			return auditContainer(engine, dbFile)
+		},
+		Missing: ErrorNoSuchContainer,
+		Cancel:  make(chan struct{}),
+	}
+}
+
+// GetAuditor uses the config settings and command-line flags to configure and return a container auditor daemon struct.
+func GetAuditor(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv.LowLevelLogger, error) {
+	if !serverconf.HasSection("container-auditor") {
+		return nil, nil, fmt.Errorf("Unable to find container-auditor config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	ring, err := GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading container ring")
+	}
+	logLevelString := serverconf.GetDefault("container-auditor", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger("container-auditor", &logLevel, flags); err != nil {
+		return nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	deviceRoot := serverconf.GetDefault("container-auditor", "devices", "/srv/node")
+	engine, err := getContainerEngine(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	a := newAuditor(engine)
+	a.CheckMounts = serverconf.GetBool("container-auditor", "mount_check", true)
+	a.DeviceRoot = deviceRoot
+	a.HashPathPrefix = hashPathPrefix
+	a.HashPathSuffix = hashPathSuffix
+	a.PerSecond = serverconf.GetInt("container-auditor", "containers_per_second", 200)
+	a.Interval = time.Duration(serverconf.GetInt("container-auditor", "interval", 1800)) * time.Second
+	a.LogTime = time.Duration(serverconf.GetInt("container-auditor", "log_time", 3600)) * time.Second
+	a.ReconCachePath = serverconf.GetDefault("container-auditor", "recon_cache_path", "/var/cache/swift")
+	a.Logger = logger
+	a.Ring = ring
+	return a, logger, nil
+}
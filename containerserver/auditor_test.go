@@ -0,0 +1,48 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/dbauditor"
+)
+
+func TestAuditContainer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	engine := newLRUEngine(sqliteBackend, dir, "", "", 32)
+	good := filepath.Join(dir, "good.db")
+	require.Nil(t, sqliteCreateContainer(good, "a", "c", "100000000.00000", nil, 0))
+	account, container, err := auditContainer(engine, good)
+	require.Nil(t, err)
+	require.Equal(t, "a", account)
+	require.Equal(t, "c", container)
+
+	corrupt := filepath.Join(dir, "corrupt.db")
+	require.Nil(t, ioutil.WriteFile(corrupt, []byte("not a database"), 0644))
+	_, _, err = auditContainer(engine, corrupt)
+	require.IsType(t, &dbauditor.Failure{}, err)
+
+	_, _, err = auditContainer(engine, filepath.Join(dir, "missing.db"))
+	require.Equal(t, ErrorNoSuchContainer, err)
+	require.Equal(t, ErrorNoSuchContainer, newAuditor(engine).Missing)
+}
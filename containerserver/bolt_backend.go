@@ -0,0 +1,1076 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/dbauditor"
+	"github.com/troubling/hummingbird/common/fs"
+)
+
+// The bolt engine stores each container in a bolt database file, a B+tree of ordered keys.  Object records are keyed
+// by storage policy and name, so listings are cursor walks, with a second bucket indexing them by row id for
+// replication.  Object updates are written in batches, coalescing concurrent PUTs and DELETEs into one transaction.
+// Sharding isn't supported.
+
+const (
+	// bolt holds an exclusive lock on an open database file, so an idle database is closed to let other processes
+	// have it, and opening one waits a while for the lock.
+	boltIdleTimeout = time.Second
+	boltLockTimeout = 25 * time.Second
+)
+
+var (
+	boltInfoBucket       = []byte("container_info")
+	boltObjectBucket     = []byte("object")
+	boltRowBucket        = []byte("object_row")
+	boltPolicyStatBucket = []byte("policy_stat")
+	boltSyncBucket       = []byte("incoming_sync")
+	boltInfoKey          = []byte("info")
+)
+
+var boltBackend = &containerBackend{
+	open:           boltOpenContainer,
+	create:         boltCreateContainer,
+	createExisting: boltCreateExistingContainer,
+}
+
+func init() {
+	RegisterContainerEngine("bolt", func(serverconf conf.Config, deviceRoot, hashPathPrefix, hashPathSuffix string) (ContainerEngine, error) {
+		return newLRUEngine(boltBackend, deviceRoot, hashPathPrefix, hashPathSuffix, 32), nil
+	})
+}
+
+// boltInfo is a bolt container database's container_info record.
+type boltInfo struct {
+	Account                 string `json:"account"`
+	Container               string `json:"container"`
+	CreatedAt               string `json:"created_at"`
+	PutTimestamp            string `json:"put_timestamp"`
+	DeleteTimestamp         string `json:"delete_timestamp"`
+	StatusChangedAt         string `json:"status_changed_at"`
+	ReportedPutTimestamp    string `json:"reported_put_timestamp"`
+	ReportedDeleteTimestamp string `json:"reported_delete_timestamp"`
+	ReportedObjectCount     int64  `json:"reported_object_count"`
+	ReportedBytesUsed       int64  `json:"reported_bytes_used"`
+	Hash                    string `json:"hash"`
+	ID                      string `json:"id"`
+	XContainerSyncPoint1    int64  `json:"x_container_sync_point1"`
+	XContainerSyncPoint2    int64  `json:"x_container_sync_point2"`
+	StoragePolicyIndex      int    `json:"storage_policy_index"`
+	Metadata                string `json:"metadata"`
+	ReconcilerSyncPoint     int64  `json:"reconciler_sync_point"`
+}
+
+// boltObject is an object record in a bolt container database, which is keyed by its storage policy and name.
+type boltObject struct {
+	Rowid       int64  `json:"rowid"`
+	CreatedAt   string `json:"created_at"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+	Deleted     int    `json:"deleted"`
+	Metadata    string `json:"metadata,omitempty"`
+}
+
+type boltPolicyStat struct {
+	ObjectCount int64 `json:"object_count"`
+	BytesUsed   int64 `json:"bytes_used"`
+}
+
+func boltPolicyKey(policyIndex int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(policyIndex))
+	return key
+}
+
+func boltObjectKey(policyIndex int, name string) []byte {
+	return append(boltPolicyKey(policyIndex), name...)
+}
+
+func boltRowKey(rowid int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(rowid))
+	return key
+}
+
+func boltGetInfo(tx *bolt.Tx) (*boltInfo, error) {
+	info := &boltInfo{}
+	if err := json.Unmarshal(tx.Bucket(boltInfoBucket).Get(boltInfoKey), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func boltPutInfo(tx *bolt.Tx, info *boltInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltInfoBucket).Put(boltInfoKey, b)
+}
+
+func boltGetPolicyStat(tx *bolt.Tx, policyIndex int) (*boltPolicyStat, error) {
+	stat := &boltPolicyStat{}
+	if v := tx.Bucket(boltPolicyStatBucket).Get(boltPolicyKey(policyIndex)); v != nil {
+		if err := json.Unmarshal(v, stat); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+func boltAddPolicyStat(tx *bolt.Tx, policyIndex int, objectCount, bytesUsed int64) error {
+	stat, err := boltGetPolicyStat(tx, policyIndex)
+	if err != nil {
+		return err
+	}
+	stat.ObjectCount += objectCount
+	stat.BytesUsed += bytesUsed
+	b, err := json.Marshal(stat)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltPolicyStatBucket).Put(boltPolicyKey(policyIndex), b)
+}
+
+// boltMaxRow returns the largest row id ever given to an object record, or -1 if there hasn't been one.
+func boltMaxRow(tx *bolt.Tx) int64 {
+	if seq := tx.Bucket(boltRowBucket).Sequence(); seq > 0 {
+		return int64(seq)
+	}
+	return -1
+}
+
+func boltGetSyncPoint(tx *bolt.Tx, remoteID string) int64 {
+	if v := tx.Bucket(boltSyncBucket).Get([]byte(remoteID)); v != nil {
+		if point, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return point
+		}
+	}
+	return -1
+}
+
+func boltPutSyncPoint(tx *bolt.Tx, remoteID string, point int64) error {
+	return tx.Bucket(boltSyncBucket).Put([]byte(remoteID), []byte(strconv.FormatInt(point, 10)))
+}
+
+// boltDeleteObject removes an object record, updating the policy stats and container hash.
+func boltDeleteObject(tx *bolt.Tx, info *boltInfo, key []byte, obj *boltObject) error {
+	if err := tx.Bucket(boltObjectBucket).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltRowBucket).Delete(boltRowKey(obj.Rowid)); err != nil {
+		return err
+	}
+	policyIndex := int(binary.BigEndian.Uint32(key))
+	if err := boltAddPolicyStat(tx, policyIndex, -int64(1-obj.Deleted), -obj.Size); err != nil {
+		return err
+	}
+	info.Hash = chexor(info.Hash, string(key[4:]), obj.CreatedAt)
+	return nil
+}
+
+// boltInsertObject adds an object record with a new row id, updating the policy stats and container hash.
+func boltInsertObject(tx *bolt.Tx, info *boltInfo, record *ObjectRecord) error {
+	rows := tx.Bucket(boltRowBucket)
+	seq, err := rows.NextSequence()
+	if err != nil {
+		return err
+	}
+	obj := &boltObject{Rowid: int64(seq), CreatedAt: record.CreatedAt, Size: record.Size,
+		ContentType: record.ContentType, ETag: record.ETag, Deleted: record.Deleted, Metadata: record.Metadata}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	key := boltObjectKey(record.StoragePolicyIndex, record.Name)
+	if err := tx.Bucket(boltObjectBucket).Put(key, b); err != nil {
+		return err
+	}
+	if err := rows.Put(boltRowKey(obj.Rowid), key); err != nil {
+		return err
+	}
+	if err := boltAddPolicyStat(tx, record.StoragePolicyIndex, int64(1-obj.Deleted), obj.Size); err != nil {
+		return err
+	}
+	info.Hash = chexor(info.Hash, record.Name, record.CreatedAt)
+	return nil
+}
+
+// boltMergeItems merges object records into the database, replacing any older records for the same objects.
+func boltMergeItems(tx *bolt.Tx, records []*ObjectRecord, remoteID string) error {
+	info, err := boltGetInfo(tx)
+	if err != nil {
+		return err
+	}
+	var maxRowid int64 = -1
+	var keys []string
+	newest := make(map[string]*ObjectRecord)
+	for _, record := range records {
+		if record.Rowid > maxRowid {
+			maxRowid = record.Rowid
+		}
+		key := string(boltObjectKey(record.StoragePolicyIndex, record.Name))
+		if alreadyIn, ok := newest[key]; !ok {
+			keys = append(keys, key)
+			newest[key] = record
+		} else if record.CreatedAt > alreadyIn.CreatedAt {
+			newest[key] = record
+		}
+	}
+	objects := tx.Bucket(boltObjectBucket)
+	for _, key := range keys {
+		record := newest[key]
+		if v := objects.Get([]byte(key)); v != nil {
+			current := &boltObject{}
+			if err := json.Unmarshal(v, current); err != nil {
+				return err
+			}
+			if current.CreatedAt >= record.CreatedAt {
+				continue
+			}
+			if err := boltDeleteObject(tx, info, []byte(key), current); err != nil {
+				return err
+			}
+		}
+		if err := boltInsertObject(tx, info, record); err != nil {
+			return err
+		}
+	}
+	if remoteID != "" && maxRowid > -1 {
+		if err := boltPutSyncPoint(tx, remoteID, maxRowid); err != nil {
+			return err
+		}
+	}
+	return boltPutInfo(tx, info)
+}
+
+// boltListObjects calls each with up to count undeleted object records in a storage policy that pass the filter, in
+// order or in reverse, whose names start with prefix and are after lower, before upper and past point.
+func boltListObjects(c *bolt.Cursor, policyIndex int, lower, upper, prefix, point string, reverse bool, count int,
+	filter *ListingFilter, each func(*ObjectListingRecord) bool) error {
+	prefixEnd := prefix + "\xFF"
+	inRange := func(name string) bool {
+		return (prefix == "" || (name >= prefix && name <= prefixEnd)) && (lower == "" || name > lower) &&
+			(upper == "" || name < upper) && (point == "" || (reverse && name < point) || (!reverse && name > point))
+	}
+	var k, v []byte
+	if reverse {
+		// start at the lowest of the upper bounds and walk backwards.
+		seek := boltPolicyKey(policyIndex + 1)
+		for _, bound := range []string{upper, point, prefixEnd} {
+			if bound != "" && bound != "\xFF" && bytesCompare(boltObjectKey(policyIndex, bound), seek) < 0 {
+				seek = boltObjectKey(policyIndex, bound)
+			}
+		}
+		if k, v = c.Seek(seek); k == nil {
+			k, v = c.Last()
+		}
+	} else {
+		start := prefix
+		for _, bound := range []string{lower, point} {
+			if bound > start {
+				start = bound
+			}
+		}
+		k, v = c.Seek(boltObjectKey(policyIndex, start))
+	}
+	seen := 0
+	for ; k != nil && seen < count; k, v = next(c, reverse) {
+		keyPolicy := int(binary.BigEndian.Uint32(k))
+		if keyPolicy != policyIndex {
+			if reverse && keyPolicy > policyIndex {
+				continue
+			}
+			break
+		}
+		name := string(k[4:])
+		if reverse {
+			if (lower != "" && name <= lower) || (prefix != "" && name < prefix) {
+				break
+			}
+		} else if (upper != "" && name >= upper) || (prefix != "" && name > prefixEnd) {
+			break
+		}
+		if !inRange(name) {
+			continue
+		}
+		obj := &boltObject{}
+		if err := json.Unmarshal(v, obj); err != nil {
+			return err
+		}
+		if obj.Deleted != 0 {
+			continue
+		}
+		record := &ObjectListingRecord{Name: name, LastModified: obj.CreatedAt, Size: obj.Size,
+			ContentType: obj.ContentType, ETag: obj.ETag}
+		if !filter.matches(record) {
+			continue
+		}
+		if filter != nil && filter.IncludeMeta {
+			var err error
+			if record.Metadata, err = decodeObjectMeta(obj.Metadata); err != nil {
+				return err
+			}
+		}
+		seen++
+		if !each(record) {
+			break
+		}
+	}
+	return nil
+}
+
+func next(c *bolt.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+func bytesCompare(a, b []byte) int {
+	return strings.Compare(string(a), string(b))
+}
+
+// boltContainer is a container stored in a bolt database file.
+type boltContainer struct {
+	lock          sync.Mutex
+	db            *bolt.DB
+	users         int
+	lastUsed      time.Time
+	idleTimer     *time.Timer
+	containerFile string
+	infoCache     atomic.Value
+	ringhash      string
+}
+
+var _ ReplicableContainer = &boltContainer{}
+var _ ReconcilableContainer = &boltContainer{}
+
+// acquire returns the open database, opening it if it isn't.
+func (c *boltContainer) acquire() (*bolt.DB, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.db == nil {
+		db, err := bolt.Open(c.containerFile, 0644, &bolt.Options{Timeout: boltLockTimeout})
+		if err == bolt.ErrInvalid || err == bolt.ErrVersionMismatch || err == bolt.ErrChecksum {
+			return nil, &dbauditor.Failure{Err: fmt.Errorf("Failed to open: %v", err)}
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to open: %v", err)
+		}
+		c.db = db
+	}
+	c.users++
+	return c.db, nil
+}
+
+// release gives the database back, closing it once it's been idle for boltIdleTimeout.
+func (c *boltContainer) release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.users--
+	c.lastUsed = time.Now()
+	if c.users == 0 && c.idleTimer == nil {
+		c.idleTimer = time.AfterFunc(boltIdleTimeout, c.closeIdle)
+	}
+}
+
+func (c *boltContainer) closeIdle() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.idleTimer = nil
+	if c.db == nil || c.users > 0 {
+		return
+	}
+	if idle := time.Since(c.lastUsed); idle < boltIdleTimeout {
+		c.idleTimer = time.AfterFunc(boltIdleTimeout-idle, c.closeIdle)
+		return
+	}
+	c.db.Close()
+	c.db = nil
+}
+
+func (c *boltContainer) view(fn func(tx *bolt.Tx) error) error {
+	db, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	return db.View(fn)
+}
+
+func (c *boltContainer) update(fn func(tx *bolt.Tx) error) error {
+	db, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	defer c.invalidateCache()
+	return db.Update(fn)
+}
+
+// batch is update for small, idempotent changes, which concurrent callers' share transactions.
+func (c *boltContainer) batch(fn func(tx *bolt.Tx) error) error {
+	db, err := c.acquire()
+	if err != nil {
+		return err
+	}
+	defer c.release()
+	defer c.invalidateCache()
+	return db.Batch(fn)
+}
+
+func (c *boltContainer) invalidateCache() {
+	c.infoCache.Store(&ContainerInfo{invalid: true})
+}
+
+// GetInfo returns the container's information as a ContainerInfo struct.
+func (c *boltContainer) GetInfo() (*ContainerInfo, error) {
+	if info, ok := c.infoCache.Load().(*ContainerInfo); ok && !info.invalid && time.Since(info.updated) < infoCacheTimeout {
+		return info, nil
+	}
+	info := &ContainerInfo{updated: time.Now()}
+	if err := c.view(func(tx *bolt.Tx) error {
+		bi, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		stat, err := boltGetPolicyStat(tx, bi.StoragePolicyIndex)
+		if err != nil {
+			return err
+		}
+		info.Account = bi.Account
+		info.Container = bi.Container
+		info.CreatedAt = bi.CreatedAt
+		info.PutTimestamp = bi.PutTimestamp
+		info.DeleteTimestamp = bi.DeleteTimestamp
+		info.StatusChangedAt = bi.StatusChangedAt
+		info.ObjectCount = stat.ObjectCount
+		info.BytesUsed = stat.BytesUsed
+		info.ReportedPutTimestamp = bi.ReportedPutTimestamp
+		info.ReportedDeleteTimestamp = bi.ReportedDeleteTimestamp
+		info.ReportedObjectCount = bi.ReportedObjectCount
+		info.ReportedBytesUsed = bi.ReportedBytesUsed
+		info.Hash = bi.Hash
+		info.ID = bi.ID
+		info.XContainerSyncPoint1 = strconv.FormatInt(bi.XContainerSyncPoint1, 10)
+		info.XContainerSyncPoint2 = strconv.FormatInt(bi.XContainerSyncPoint2, 10)
+		info.StoragePolicyIndex = bi.StoragePolicyIndex
+		info.RawMetadata = bi.Metadata
+		info.MaxRow = boltMaxRow(tx)
+		if info.RawMetadata == "" {
+			info.Metadata = make(map[string][]string)
+		} else if err := json.Unmarshal([]byte(info.RawMetadata), &info.Metadata); err != nil {
+			return err
+		}
+		// while the container's being migrated, its objects are split between the two policies.
+		if target := migrationTarget(info); target >= 0 {
+			targetStat, err := boltGetPolicyStat(tx, target)
+			if err != nil {
+				return err
+			}
+			info.ObjectCount += targetStat.ObjectCount
+			info.BytesUsed += targetStat.BytesUsed
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	c.infoCache.Store(info)
+	return info, nil
+}
+
+// IsDeleted returns true if the container is deleted - if its delete timestamp is later than its put timestamp.
+func (c *boltContainer) IsDeleted() (bool, error) {
+	info, err := c.GetInfo()
+	if err != nil {
+		return false, err
+	}
+	return info.DeleteTimestamp > info.PutTimestamp, nil
+}
+
+// Delete sets the container's deleted timestamp and tombstones any metadata older than that timestamp.
+func (c *boltContainer) Delete(timestamp string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		var metadata map[string][]string
+		if err := json.Unmarshal([]byte(info.Metadata), &metadata); err != nil {
+			return err
+		}
+		for key, value := range metadata {
+			if value[1] < timestamp {
+				metadata[key] = []string{"", timestamp}
+			}
+		}
+		serializedMetadata, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		info.DeleteTimestamp = timestamp
+		info.Metadata = string(serializedMetadata)
+		return boltPutInfo(tx, info)
+	})
+}
+
+// MergeItems merges ObjectRecords into the container.  If a remote id is provided (incoming replication), the incoming_sync table is updated.
+func (c *boltContainer) MergeItems(records []*ObjectRecord, remoteID string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return boltMergeItems(tx, records, remoteID)
+	})
+}
+
+// ListObjects implements object listings.
+func (c *boltContainer) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string,
+	path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter) ([]interface{}, error) {
+	return collectListing(func(emit func(entry interface{}) error) error {
+		return c.IterObjects(limit, marker, endMarker, prefix, delimiter, path, reverse, storagePolicyIndex, filter, emit)
+	})
+}
+
+// IterObjects passes the entries of an object listing to emit, one at a time. Each batch of the listing is read in its
+// own transaction.
+func (c *boltContainer) IterObjects(limit int, marker string, endMarker string, prefix string, delimiter string,
+	path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter, emit func(entry interface{}) error) error {
+	return listObjects(limit, marker, endMarker, prefix, delimiter, path, reverse,
+		func(lower, upper, prefix, point string, count int, each func(*ObjectListingRecord) bool) error {
+			return c.view(func(tx *bolt.Tx) error {
+				return boltListObjects(tx.Bucket(boltObjectBucket).Cursor(), storagePolicyIndex, lower, upper, prefix,
+					point, reverse, count, filter, each)
+			})
+		}, emit)
+}
+
+// NewID sets the container's ID to a new, random string.
+func (c *boltContainer) NewID() error {
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		if err := boltPutSyncPoint(tx, info.ID, boltMaxRow(tx)); err != nil {
+			return err
+		}
+		info.ID = common.UUID()
+		return boltPutInfo(tx, info)
+	})
+}
+
+// boltItemsSince returns up to count object records with a row id greater than start that match.
+func (c *boltContainer) itemsSince(start int64, count int, match func(info *boltInfo, record *ObjectRecord) bool) ([]*ObjectRecord, error) {
+	records := []*ObjectRecord{}
+	err := c.view(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		if start < 0 {
+			start = 0
+		}
+		objects := tx.Bucket(boltObjectBucket)
+		cursor := tx.Bucket(boltRowBucket).Cursor()
+		for k, key := cursor.Seek(boltRowKey(start + 1)); k != nil && len(records) < count; k, key = cursor.Next() {
+			obj := &boltObject{}
+			if err := json.Unmarshal(objects.Get(key), obj); err != nil {
+				return err
+			}
+			r := &ObjectRecord{Rowid: obj.Rowid, Name: string(key[4:]), CreatedAt: obj.CreatedAt, Size: obj.Size,
+				ContentType: obj.ContentType, ETag: obj.ETag, Deleted: obj.Deleted,
+				StoragePolicyIndex: int(binary.BigEndian.Uint32(key)), Metadata: obj.Metadata}
+			if match == nil || match(info, r) {
+				records = append(records, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ItemsSince returns (count) object records with a rowid greater than (start).
+func (c *boltContainer) ItemsSince(start int64, count int) ([]*ObjectRecord, error) {
+	return c.itemsSince(start, count, nil)
+}
+
+// GetMetadata returns the current container metadata as a simple map[string]string, i.e. it leaves out tombstones and timestamps.
+func (c *boltContainer) GetMetadata() (map[string]string, error) {
+	info, err := c.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string)
+	for key, value := range info.Metadata {
+		if value[0] != "" {
+			metadata[key] = value[0]
+		}
+	}
+	return metadata, nil
+}
+
+// UpdateMetadata merges the current container metadata with new incoming metadata.
+func (c *boltContainer) UpdateMetadata(newMetadata map[string][]string, timestamp string) error {
+	if len(newMetadata) == 0 {
+		return nil
+	}
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		var existingMetadata map[string][]string
+		if info.Metadata == "" {
+			existingMetadata = map[string][]string{}
+		} else if err := json.Unmarshal([]byte(info.Metadata), &existingMetadata); err != nil {
+			return err
+		}
+		if info.Metadata, err = mergeMetas(existingMetadata, newMetadata, info.DeleteTimestamp); err != nil {
+			return err
+		}
+		if timestamp > info.PutTimestamp {
+			info.PutTimestamp = timestamp
+		}
+		return boltPutInfo(tx, info)
+	})
+}
+
+// MergeSyncTable updates the container's current incoming_sync table records.
+func (c *boltContainer) MergeSyncTable(records []*SyncRecord) error {
+	return c.update(func(tx *bolt.Tx) error {
+		for _, record := range records {
+			if err := boltPutSyncPoint(tx, record.RemoteID, record.SyncPoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CleanupTombstones removes any expired tombstoned objects or metadata.
+func (c *boltContainer) CleanupTombstones(reclaimAge int64) error {
+	now := float64(time.Now().UnixNano()) / 1000000000.0
+	reclaimTimestamp := common.CanonicalTimestamp(now - float64(reclaimAge))
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		var expiredObjects []*boltObject
+		if err := tx.Bucket(boltObjectBucket).ForEach(func(k, v []byte) error {
+			obj := &boltObject{}
+			if err := json.Unmarshal(v, obj); err != nil {
+				return err
+			}
+			if obj.Deleted == 1 && obj.CreatedAt < reclaimTimestamp {
+				expired = append(expired, append([]byte{}, k...))
+				expiredObjects = append(expiredObjects, obj)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for i, key := range expired {
+			if err := boltDeleteObject(tx, info, key, expiredObjects[i]); err != nil {
+				return err
+			}
+		}
+		var metadata map[string][]string
+		if info.Metadata == "" {
+			metadata = map[string][]string{}
+		} else if err := json.Unmarshal([]byte(info.Metadata), &metadata); err != nil {
+			return err
+		}
+		for k, v := range metadata {
+			if v[0] == "" {
+				if ts, err := common.GetEpochFromTimestamp(v[1]); err != nil || ts < reclaimTimestamp {
+					delete(metadata, k)
+				}
+			}
+		}
+		mb, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		info.Metadata = string(mb)
+		return boltPutInfo(tx, info)
+	})
+}
+
+// SyncTable returns the container's current incoming_sync table, and also includes the current container's id and max row as an entry.
+func (c *boltContainer) SyncTable() ([]*SyncRecord, error) {
+	records := []*SyncRecord{}
+	err := c.view(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltSyncBucket).ForEach(func(k, v []byte) error {
+			if string(k) == info.ID {
+				return nil
+			}
+			point, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			records = append(records, &SyncRecord{SyncPoint: point, RemoteID: string(k)})
+			return nil
+		}); err != nil {
+			return err
+		}
+		records = append(records, &SyncRecord{SyncPoint: boltMaxRow(tx), RemoteID: info.ID})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// SyncRemoteData compares a remote container's info to the local info and updates any necessary replication bookkeeping, returning the current container's info.
+func (c *boltContainer) SyncRemoteData(maxRow int64, hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string) (*ContainerInfo, error) {
+	var localPoint int64
+	if err := c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		var lm, rm map[string][]string
+		if err := json.Unmarshal([]byte(metadata), &rm); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(info.Metadata), &lm); err != nil {
+			return err
+		}
+		if createdAt < info.CreatedAt {
+			info.CreatedAt = createdAt
+		}
+		if putTimestamp > info.PutTimestamp {
+			info.PutTimestamp = putTimestamp
+		}
+		if deleteTimestamp > info.DeleteTimestamp {
+			info.DeleteTimestamp = deleteTimestamp
+		}
+		if info.Metadata, err = mergeMetas(lm, rm, info.DeleteTimestamp); err != nil {
+			return err
+		}
+		localPoint = boltGetSyncPoint(tx, id)
+		if info.Hash == hash && maxRow > localPoint {
+			localPoint = maxRow
+			if err := boltPutSyncPoint(tx, id, localPoint); err != nil {
+				return err
+			}
+		}
+		return boltPutInfo(tx, info)
+	}); err != nil {
+		return nil, err
+	}
+	info, err := c.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+	info.Point = localPoint
+	return info, nil
+}
+
+// CheckSyncLink makes sure the database's container sync symlink exists or doesn't exist, as in accordance with the existence of the X-Container-Sync-To header.
+func (c *boltContainer) CheckSyncLink() error {
+	metadata, err := c.GetMetadata()
+	if err != nil {
+		return err
+	}
+	return checkSyncLink(c.containerFile, metadata)
+}
+
+// OpenDatabaseFile writes a consistent copy of the database to an unlinked temp file and opens it for reading, so it
+// can be uploaded to a remote server.
+func (c *boltContainer) OpenDatabaseFile() (*os.File, func(), error) {
+	fp, err := ioutil.TempFile(filepath.Dir(c.containerFile), ".copy")
+	if err != nil {
+		return nil, nil, err
+	}
+	os.Remove(fp.Name())
+	if err := c.view(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(fp)
+		return err
+	}); err != nil {
+		fp.Close()
+		return nil, nil, fmt.Errorf("Error copying database %s: %v", c.containerFile, err)
+	}
+	if _, err := fp.Seek(0, 0); err != nil {
+		fp.Close()
+		return nil, nil, err
+	}
+	return fp, func() { fp.Close() }, nil
+}
+
+// ID returns the container's ring hash as a unique identifier for it.
+func (c *boltContainer) ID() string {
+	return c.ringhash
+}
+
+// RingHash returns the container's ring hash as a string.
+func (c *boltContainer) RingHash() string {
+	return c.ringhash
+}
+
+// PutObject adds an object to the container, batched with any other concurrent object updates.
+func (c *boltContainer) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int, metadata map[string]string) error {
+	record := &ObjectRecord{Name: name, CreatedAt: timestamp, Size: size, ContentType: contentType, ETag: etag,
+		StoragePolicyIndex: storagePolicyIndex, Metadata: encodeObjectMeta(metadata)}
+	return c.batch(func(tx *bolt.Tx) error {
+		return boltMergeItems(tx, []*ObjectRecord{record}, "")
+	})
+}
+
+// DeleteObject removes an object from the container, batched with any other concurrent object updates.
+func (c *boltContainer) DeleteObject(name string, timestamp string, storagePolicyIndex int) error {
+	record := &ObjectRecord{Name: name, CreatedAt: timestamp, Deleted: 1, StoragePolicyIndex: storagePolicyIndex}
+	return c.batch(func(tx *bolt.Tx) error {
+		return boltMergeItems(tx, []*ObjectRecord{record}, "")
+	})
+}
+
+// Close closes the underlying bolt database.
+func (c *boltContainer) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	if c.db != nil {
+		err := c.db.Close()
+		c.db = nil
+		return err
+	}
+	return nil
+}
+
+// IntegrityCheck runs bolt's consistency check on the database, returning a dbauditor.Failure listing any problems found
+// or if the file is corrupt.
+func (c *boltContainer) IntegrityCheck() error {
+	return c.view(func(tx *bolt.Tx) error {
+		var problems []string
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		for _, bucket := range [][]byte{boltInfoBucket, boltObjectBucket, boltRowBucket, boltPolicyStatBucket, boltSyncBucket} {
+			if tx.Bucket(bucket) == nil {
+				problems = append(problems, fmt.Sprintf("missing bucket %s", bucket))
+			}
+		}
+		if len(problems) > 0 {
+			return &dbauditor.Failure{Err: fmt.Errorf("Integrity check failed: %s", strings.Join(problems, "; "))}
+		}
+		return nil
+	})
+}
+
+// SetStoragePolicyIndex moves the container to another storage policy, after which its object records in other
+// policies are misplaced.
+func (c *boltContainer) SetStoragePolicyIndex(policyIndex int, timestamp string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		info.StoragePolicyIndex = policyIndex
+		if timestamp > info.StatusChangedAt {
+			info.StatusChangedAt = timestamp
+		}
+		info.ReconcilerSyncPoint = -1
+		if err := boltAddPolicyStat(tx, policyIndex, 0, 0); err != nil {
+			return err
+		}
+		return boltPutInfo(tx, info)
+	})
+}
+
+// MisplacedSince returns up to count object records with a row id greater than start that aren't in the container's
+// storage policy.
+func (c *boltContainer) MisplacedSince(start int64, count int) ([]*ObjectRecord, error) {
+	return c.itemsSince(start, count, func(info *boltInfo, record *ObjectRecord) bool {
+		return record.StoragePolicyIndex != info.StoragePolicyIndex
+	})
+}
+
+// ReconcilerPoint returns the row id up to which misplaced object records have been queued for the reconciler.
+func (c *boltContainer) ReconcilerPoint() (int64, error) {
+	var point int64
+	err := c.view(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		point = info.ReconcilerSyncPoint
+		return nil
+	})
+	return point, err
+}
+
+// SetReconcilerPoint records the row id up to which misplaced object records have been queued for the reconciler.
+func (c *boltContainer) SetReconcilerPoint(point int64) error {
+	return c.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		info.ReconcilerSyncPoint = point
+		return boltPutInfo(tx, info)
+	})
+}
+
+func boltCreateExistingContainer(c Container, putTimestamp string, newMetadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, error) {
+	bc, ok := c.(*boltContainer)
+	if !ok {
+		return false, errors.New("Unable to work with non-boltContainer")
+	}
+	created := false
+	err := bc.update(func(tx *bolt.Tx) error {
+		info, err := boltGetInfo(tx)
+		if err != nil {
+			return err
+		}
+		if info.DeleteTimestamp <= info.PutTimestamp { // not deleted
+			if policyIndex < 0 {
+				policyIndex = info.StoragePolicyIndex
+			} else if info.StoragePolicyIndex != policyIndex {
+				return ErrorPolicyConflict
+			}
+		} else { // deleted
+			if policyIndex < 0 {
+				policyIndex = defaultPolicyIndex
+			}
+		}
+		var existingMetadata map[string][]string
+		if info.Metadata == "" {
+			existingMetadata = make(map[string][]string)
+		} else if err := json.Unmarshal([]byte(info.Metadata), &existingMetadata); err != nil {
+			return err
+		}
+		metastr, err := mergeMetas(existingMetadata, newMetadata, info.DeleteTimestamp)
+		if err != nil {
+			return err
+		}
+		created = info.DeleteTimestamp > info.PutTimestamp && putTimestamp > info.DeleteTimestamp
+		info.PutTimestamp = putTimestamp
+		info.StoragePolicyIndex = policyIndex
+		info.Metadata = metastr
+		if err := boltAddPolicyStat(tx, policyIndex, 0, 0); err != nil {
+			return err
+		}
+		return boltPutInfo(tx, info)
+	})
+	if err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+func boltCreateContainer(containerFile string, account string, container string, putTimestamp string,
+	metadata map[string][]string, policyIndex int) error {
+	var serializedMetadata []byte
+	var err error
+
+	if fs.Exists(containerFile) {
+		return errors.New("Container exists!")
+	}
+	if metadata == nil {
+		serializedMetadata = []byte("{}")
+	} else if serializedMetadata, err = json.Marshal(metadata); err != nil {
+		return err
+	}
+	hashDir := filepath.Dir(containerFile)
+	if err := os.MkdirAll(hashDir, 0755); err != nil {
+		return err
+	}
+	tfp, err := ioutil.TempFile(hashDir, ".newdb")
+	if err != nil {
+		return err
+	}
+	tempFile := tfp.Name()
+	tfp.Close()
+	db, err := bolt.Open(tempFile, 0644, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltInfoBucket, boltObjectBucket, boltRowBucket, boltPolicyStatBucket, boltSyncBucket} {
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+		if err := boltAddPolicyStat(tx, policyIndex, 0, 0); err != nil {
+			return err
+		}
+		return boltPutInfo(tx, &boltInfo{
+			Account:                 account,
+			Container:               container,
+			CreatedAt:               common.GetTimestamp(),
+			PutTimestamp:            putTimestamp,
+			DeleteTimestamp:         "0",
+			StatusChangedAt:         putTimestamp,
+			ReportedPutTimestamp:    "0",
+			ReportedDeleteTimestamp: "0",
+			Hash:                    "00000000000000000000000000000000",
+			ID:                      common.UUID(),
+			XContainerSyncPoint1:    -1,
+			XContainerSyncPoint2:    -1,
+			StoragePolicyIndex:      policyIndex,
+			Metadata:                string(serializedMetadata),
+			ReconcilerSyncPoint:     -1,
+		})
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return os.Rename(tempFile, containerFile)
+}
+
+func boltOpenContainer(containerFile string) (ReplicableContainer, error) {
+	if !fs.Exists(containerFile) {
+		return nil, ErrorNoSuchContainer
+	}
+	return &boltContainer{
+		containerFile: containerFile,
+		ringhash:      filepath.Base(filepath.Dir(containerFile)),
+	}, nil
+}
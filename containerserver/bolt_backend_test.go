@@ -0,0 +1,484 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/dbauditor"
+)
+
+func createTestBoltDatabase(timestamp string) (*boltContainer, string, func(), error) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, "", nil, err
+	}
+	dbFile := filepath.Join(dir, "device", "containers", "1", "000", "db", "db.db")
+	if err := boltCreateContainer(dbFile, "a", "c", timestamp, nil, 0); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+	db, err := boltOpenContainer(dbFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	return db.(*boltContainer), dbFile, cleanup, nil
+}
+
+func BenchmarkBoltMergeItems(b *testing.B) {
+	db, _, cleanup, _ := createTestBoltDatabase("200000000.00000")
+	recs := make([]*ObjectRecord, 10000)
+	for i := 0; i < b.N; i++ {
+		for i := 0; i < 10000; i++ {
+			recs[i] = &ObjectRecord{Name: common.UUID(), CreatedAt: "20000000.00001", Deleted: 1}
+		}
+		db.MergeItems(recs, "")
+		db.MergeItems(recs, "")
+	}
+	cleanup()
+}
+
+func BenchmarkBoltContainerListings(b *testing.B) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	if err != nil {
+		panic("NON-NIL ERROR")
+	}
+	defer cleanup()
+	names := make([]string, 8192)
+	for i := range names {
+		names[i] = common.UUID()
+	}
+	if err := mergeItemsByName(db, names); err != nil {
+		panic("NON-NIL ERROR")
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, nil)
+		if err != nil {
+			panic("NON-NIL ERROR")
+		}
+		if records == nil {
+			panic("NIL RECORDS")
+		}
+	}
+}
+
+func listingNames(records []interface{}) []string {
+	names := []string{}
+	for _, record := range records {
+		switch r := record.(type) {
+		case *ObjectListingRecord:
+			names = append(names, r.Name)
+		case *SubdirListingRecord:
+			names = append(names, r.Name)
+		}
+	}
+	return names
+}
+
+func TestFindContainerEngine(t *testing.T) {
+	for _, name := range []string{"sqlite", "bolt"} {
+		ctor, err := FindContainerEngine(name)
+		require.Nil(t, err)
+		require.NotNil(t, ctor)
+	}
+	_, err := FindContainerEngine("nope")
+	require.NotNil(t, err)
+
+	serverconf, err := conf.StringConfig("[app:container-server]\nengine=bolt\n")
+	require.Nil(t, err)
+	engine, err := getContainerEngine(serverconf, "/srv/node", "", "")
+	require.Nil(t, err)
+	require.Equal(t, boltBackend, engine.(*lruEngine).backend)
+	serverconf, err = conf.StringConfig("[app:container-server]\nengine=nope\n")
+	require.Nil(t, err)
+	_, err = getContainerEngine(serverconf, "/srv/node", "", "")
+	require.NotNil(t, err)
+}
+
+func TestBoltCreateAndGetInfo(t *testing.T) {
+	db, dbFile, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.NotNil(t, boltCreateContainer(dbFile, "a", "c", "100000000.00000", nil, 0))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, "a", info.Account)
+	require.Equal(t, "c", info.Container)
+	require.Equal(t, "100000000.00000", info.PutTimestamp)
+	require.Equal(t, "0", info.DeleteTimestamp)
+	require.Equal(t, "-1", info.XContainerSyncPoint1)
+	require.Equal(t, int64(-1), info.MaxRow)
+	require.Equal(t, "db", db.RingHash())
+	_, err = boltOpenContainer(dbFile + ".nope")
+	require.Equal(t, ErrorNoSuchContainer, err)
+}
+
+func TestBoltPutDeleteObject(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("o1", "100000001.00000", 10, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("o2", "100000001.00000", 5, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.ObjectCount)
+	require.Equal(t, int64(15), info.BytesUsed)
+	require.Equal(t, int64(2), info.MaxRow)
+
+	// older updates are ignored.
+	require.Nil(t, db.DeleteObject("o1", "100000000.50000", 0))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(2), info.ObjectCount)
+
+	require.Nil(t, db.DeleteObject("o1", "100000002.00000", 0))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, int64(1), info.ObjectCount)
+	require.Equal(t, int64(5), info.BytesUsed)
+	require.Equal(t, int64(3), info.MaxRow)
+	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"o2"}, listingNames(records))
+}
+
+func TestBoltHashMatchesSqlite(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("1000.0001")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e", "f", "g", "h"}))
+	info, err := db.SyncRemoteData(10, "ae856a680962e8afedde3f2d657ed5b4", "your friend", "1000.0001", "1000.0001", "", "{}")
+	require.Nil(t, err)
+	require.Equal(t, "ae856a680962e8afedde3f2d657ed5b4", info.Hash)
+	require.Equal(t, int64(8), info.MaxRow)
+	require.Equal(t, int64(10), info.Point)
+
+	info, err = db.SyncRemoteData(20, "11111111111111111111111111111111", "your friend", "1000.0001", "1000.0001", "2000.0002", "{}")
+	require.Nil(t, err)
+	require.Equal(t, int64(10), info.Point)
+	deleted, err := db.IsDeleted()
+	require.Nil(t, err)
+	require.True(t, deleted)
+}
+
+func TestBoltListings(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a1", "a2", "A3", "b1", "B2", "a10", "b10", "zz",
+		"US-TX-A", "US-TX-B", "US-OK-A", "US-OK-B", "US-UT-A"}))
+	require.Nil(t, db.MergeItems([]*ObjectRecord{
+		{Name: "a5", CreatedAt: "10000000.00001", StoragePolicyIndex: 1},
+		{Name: "a6", CreatedAt: "10000000.00001", Deleted: 1},
+	}, ""))
+	for _, tc := range []struct {
+		limit                                int
+		marker, endMarker, prefix, delimiter string
+		reverse                              bool
+		expected                             []string
+	}{
+		{10000, "", "", "a", "", false, []string{"a1", "a10", "a2"}},
+		{10000, "", "", "a", "", true, []string{"a2", "a10", "a1"}},
+		{2, "", "", "a", "", false, []string{"a1", "a10"}},
+		{10000, "", "", "b10", "", false, []string{"b10"}},
+		{10000, "a1", "b1", "", "", false, []string{"a10", "a2"}},
+		{10000, "b1", "a1", "", "", true, []string{"a2", "a10"}},
+		{10000, "", "", "US-", "-", false, []string{"US-OK-", "US-TX-", "US-UT-"}},
+		{10000, "", "", "US-", "-", true, []string{"US-UT-", "US-TX-", "US-OK-"}},
+		{10000, "", "", "", "-", false, []string{"A3", "B2", "US-", "a1", "a10", "a2", "b1", "b10", "zz"}},
+		{3, "", "", "", "", true, []string{"zz", "b10", "b1"}},
+		{10000, "", "", "z", "", true, []string{"zz"}},
+		{10000, "", "", "zzz", "", true, []string{}},
+	} {
+		records, err := db.ListObjects(tc.limit, tc.marker, tc.endMarker, tc.prefix, tc.delimiter, nil, tc.reverse, 0, nil)
+		require.Nil(t, err)
+		require.Equal(t, tc.expected, listingNames(records), "%+v", tc)
+	}
+	records, err := db.ListObjects(10000, "", "", "", "", nil, true, 1, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a5"}, listingNames(records))
+}
+
+func TestBoltIterObjectsBatches(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	names := []string{}
+	for i := 0; i < listingBatchSize*2+10; i++ {
+		names = append(names, fmt.Sprintf("obj%05d", i))
+	}
+	names = append(names, "dir/1", "dir/2")
+	require.Nil(t, mergeItemsByName(db, names))
+
+	var listed []string
+	require.Nil(t, db.IterObjects(listingBatchSize*3, "", "", "", "", nil, false, 0, nil, func(entry interface{}) error {
+		listed = append(listed, entry.(*ObjectListingRecord).Name)
+		return nil
+	}))
+	require.Equal(t, listingBatchSize*2+12, len(listed))
+	require.Equal(t, "dir/1", listed[0])
+	require.Equal(t, fmt.Sprintf("obj%05d", listingBatchSize*2+9), listed[len(listed)-1])
+
+	records, err := db.ListObjects(listingBatchSize+5, "", "", "", "/", nil, false, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, listingBatchSize+5, len(records))
+	require.Equal(t, "dir/", listingNames(records)[0])
+	require.Equal(t, fmt.Sprintf("obj%05d", listingBatchSize+3), listingNames(records)[listingBatchSize+4])
+
+	records, err = db.ListObjects(listingBatchSize+5, "", "", "", "", nil, true, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, listingBatchSize+5, len(records))
+	require.Equal(t, fmt.Sprintf("obj%05d", listingBatchSize*2+9), listingNames(records)[0])
+
+	stop := errors.New("stop")
+	seen := 0
+	require.Equal(t, stop, db.IterObjects(listingBatchSize*3, "", "", "", "", nil, false, 0, nil, func(entry interface{}) error {
+		seen++
+		if seen == 3 {
+			return stop
+		}
+		return nil
+	}))
+	require.Equal(t, 3, seen)
+}
+
+func TestBoltListingsPaths(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"dir1/", "dir1/file2", "dir1/subdir1/", "dir1/subdir1/file3", "file1"}))
+	path := "dir1"
+	records, err := db.ListObjects(10000, "", "", "", "", &path, false, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"dir1/file2", "dir1/subdir1/"}, listingNames(records))
+}
+
+func TestBoltItemsSinceAndSyncTable(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d"}))
+	records, err := db.ItemsSince(-1, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "a", records[0].Name)
+	require.Equal(t, int64(1), records[0].Rowid)
+	records, err = db.ItemsSince(2, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(records))
+	require.Equal(t, "c", records[0].Name)
+
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Rowid: 7, Name: "e", CreatedAt: "10000000.00001"}}, "remote"))
+	require.Nil(t, db.MergeSyncTable([]*SyncRecord{{RemoteID: "other", SyncPoint: 3}}))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	syncs, err := db.SyncTable()
+	require.Nil(t, err)
+	points := map[string]int64{}
+	for _, s := range syncs {
+		points[s.RemoteID] = s.SyncPoint
+	}
+	require.Equal(t, map[string]int64{"remote": 7, "other": 3, info.ID: 5}, points)
+
+	require.Nil(t, db.NewID())
+	newInfo, err := db.GetInfo()
+	require.Nil(t, err)
+	require.NotEqual(t, info.ID, newInfo.ID)
+}
+
+func TestBoltMetadataAndTombstones(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "a", CreatedAt: "10000000.00000"}}, ""))
+	require.Nil(t, db.UpdateMetadata(map[string][]string{
+		"X-Container-Meta-Old-Value": {"", "10000000.00000"},
+		"X-Container-Meta-Value":     {"hi", "200000001.00000"},
+	}, "200000001.00000"))
+	meta, err := db.GetMetadata()
+	require.Nil(t, err)
+	require.Equal(t, map[string]string{"X-Container-Meta-Value": "hi"}, meta)
+	require.Nil(t, db.MergeItems([]*ObjectRecord{{Name: "a", CreatedAt: "10000001.00000", Deleted: 1}}, ""))
+	require.Nil(t, db.CleanupTombstones(0))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	_, ok := info.Metadata["X-Container-Meta-Old-Value"]
+	require.False(t, ok)
+	require.Equal(t, "200000001.00000", info.PutTimestamp)
+	records, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+
+	require.Nil(t, db.Delete("200000002.00000"))
+	deleted, err := db.IsDeleted()
+	require.Nil(t, err)
+	require.True(t, deleted)
+	meta, err = db.GetMetadata()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(meta))
+}
+
+func TestBoltCreateExisting(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	created, err := boltCreateExistingContainer(db, "200000001.00000", nil, 1, 0)
+	require.Equal(t, ErrorPolicyConflict, err)
+	require.False(t, created)
+	created, err = boltCreateExistingContainer(db, "200000001.00000", nil, -1, 1)
+	require.Nil(t, err)
+	require.False(t, created)
+	require.Nil(t, db.Delete("200000002.00000"))
+	created, err = boltCreateExistingContainer(db, "200000003.00000", nil, -1, 1)
+	require.Nil(t, err)
+	require.True(t, created)
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 1, info.StoragePolicyIndex)
+}
+
+func TestBoltOpenDatabaseFile(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b"}))
+	fp, release, err := db.OpenDatabaseFile()
+	require.Nil(t, err)
+	defer release()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	copyFile := filepath.Join(dir, "copy.db")
+	data, err := ioutil.ReadAll(fp)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(copyFile, data, 0644))
+	c, err := boltOpenContainer(copyFile)
+	require.Nil(t, err)
+	defer c.Close()
+	records, err := c.ListObjects(10000, "", "", "", "", nil, false, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"a", "b"}, listingNames(records))
+	require.Nil(t, c.(*boltContainer).IntegrityCheck())
+}
+
+func TestBoltIntegrityCheckCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	corrupt := filepath.Join(dir, "corrupt.db")
+	require.Nil(t, ioutil.WriteFile(corrupt, make([]byte, 8192), 0644))
+	c, err := boltOpenContainer(corrupt)
+	require.Nil(t, err)
+	defer c.Close()
+	require.IsType(t, &dbauditor.Failure{}, c.(*boltContainer).IntegrityCheck())
+}
+
+func TestBoltIdleClose(t *testing.T) {
+	db, dbFile, cleanup, err := createTestBoltDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a"}))
+	db.lock.Lock()
+	require.NotNil(t, db.db)
+	db.lock.Unlock()
+	// the file is locked while the database is open.
+	_, err = bolt.Open(dbFile, 0644, &bolt.Options{Timeout: 10 * time.Millisecond})
+	require.NotNil(t, err)
+	time.Sleep(boltIdleTimeout + 200*time.Millisecond)
+	db.lock.Lock()
+	require.Nil(t, db.db)
+	db.lock.Unlock()
+	other, err := bolt.Open(dbFile, 0644, &bolt.Options{Timeout: 10 * time.Millisecond})
+	require.Nil(t, err)
+	other.Close()
+}
+
+func TestBoltReconcilable(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("1000000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("o1", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("o2", "1000000002.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	records, err := db.MisplacedSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "o2", records[0].Name)
+	require.Nil(t, db.SetReconcilerPoint(records[0].Rowid))
+	point, err := db.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, records[0].Rowid, point)
+
+	require.Nil(t, db.SetStoragePolicyIndex(1, "1000000003.00000"))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 1, info.StoragePolicyIndex)
+	require.Equal(t, int64(1), info.ObjectCount)
+	point, err = db.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), point)
+	records, err = db.MisplacedSince(point, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "o1", records[0].Name)
+}
+
+func TestBoltListingFilter(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("d/a", "1500000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0,
+		map[string]string{"X-Object-Meta-Color": "red"}))
+	require.Nil(t, db.PutObject("d/b", "1500000002.00000", 100, "image/png", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("e/c", "1500000003.00000", 10, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	minBytes := int64(50)
+	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, &ListingFilter{MinBytes: &minBytes})
+	require.Nil(t, err)
+	require.Equal(t, []string{"d/b"}, listingNames(records))
+	// subdirs only appear for matching objects.
+	records, err = db.ListObjects(10000, "", "", "", "/", nil, false, 0, &ListingFilter{ContentType: "image/*"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"d/"}, listingNames(records))
+	records, err = db.ListObjects(1, "", "", "", "", nil, true, 0, &ListingFilter{ContentType: "text/plain", IncludeMeta: true})
+	require.Nil(t, err)
+	require.Equal(t, []string{"e/c"}, listingNames(records))
+	records, err = db.ListObjects(10000, "", "", "", "", nil, false, 0,
+		&ListingFilter{ModifiedSince: "1500000002.00000", IncludeMeta: true})
+	require.Nil(t, err)
+	require.Equal(t, []string{"e/c"}, listingNames(records))
+	records, err = db.ListObjects(10000, "", "", "d/", "", nil, false, 0, &ListingFilter{IncludeMeta: true})
+	require.Nil(t, err)
+	require.Equal(t, ObjectListingMeta{"X-Object-Meta-Color": "red"}, records[0].(*ObjectListingRecord).Metadata)
+	require.Nil(t, records[1].(*ObjectListingRecord).Metadata)
+	items, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, `{"X-Object-Meta-Color":"red"}`, items[0].Metadata)
+}
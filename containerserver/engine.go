@@ -18,13 +18,18 @@ package containerserver
 import (
 	"container/list"
 	"crypto/md5"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
 )
 
@@ -74,6 +79,68 @@ type ObjectListingRecord struct {
 	Size         int64    `xml:"bytes" json:"bytes"`
 	ContentType  string   `xml:"content_type" json:"content_type"`
 	ETag         string   `xml:"hash" json:"hash"`
+	// Metadata is the object's X-Object-Meta-* headers, included when the listing asks for them.
+	Metadata ObjectListingMeta `xml:"meta,omitempty" json:"meta,omitempty"`
+}
+
+// ObjectListingMeta is an object's metadata in a listing.  It is serialized in xml as one meta element per header.
+type ObjectListingMeta map[string]string
+
+// MarshalXML writes the metadata as <meta name="X-Object-Meta-Name">value</meta> elements, in order.
+func (m ObjectListingMeta) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		elem := xml.StartElement{Name: start.Name, Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: key}}}
+		if err := e.EncodeElement(m[key], elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListingFilter narrows an object listing to the records matching all of its set fields.
+type ListingFilter struct {
+	// IncludeMeta includes each object's metadata in the listing.
+	IncludeMeta bool
+	// ModifiedSince is a timestamp that matching objects were created after.
+	ModifiedSince string
+	// ContentType is a media type to match, ignoring any parameters, or a type followed by "/*" to match any subtype.
+	ContentType string
+	// MinBytes and MaxBytes bound matching objects' sizes, inclusively.
+	MinBytes *int64
+	MaxBytes *int64
+}
+
+// matchesContentType returns true if a content type, which may have parameters, matches the filter's.
+func (f *ListingFilter) matchesContentType(contentType string) bool {
+	if strings.HasSuffix(f.ContentType, "/*") {
+		return strings.HasPrefix(contentType, strings.TrimSuffix(f.ContentType, "*"))
+	}
+	return contentType == f.ContentType || strings.HasPrefix(contentType, f.ContentType+";")
+}
+
+// matches returns true if an object listing record, as stored in the database, passes the filter.
+func (f *ListingFilter) matches(record *ObjectListingRecord) bool {
+	if f == nil {
+		return true
+	}
+	if f.ModifiedSince != "" && record.LastModified <= f.ModifiedSince {
+		return false
+	}
+	if f.ContentType != "" && !f.matchesContentType(record.ContentType) {
+		return false
+	}
+	if f.MinBytes != nil && record.Size < *f.MinBytes {
+		return false
+	}
+	if f.MaxBytes != nil && record.Size > *f.MaxBytes {
+		return false
+	}
+	return true
 }
 
 // SubdirListingRecord is the struct used for serializing subdirs in json and xml container listings.
@@ -93,6 +160,28 @@ type ObjectRecord struct {
 	ETag               string `json:"etag"`
 	Deleted            int    `json:"deleted"`
 	StoragePolicyIndex int    `json:"storage_policy_index"`
+	Metadata           string `json:"metadata,omitempty"`
+}
+
+// encodeObjectMeta serializes an object's metadata for storing in its object record.
+func encodeObjectMeta(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return ""
+	}
+	serialized, _ := json.Marshal(metadata)
+	return string(serialized)
+}
+
+// decodeObjectMeta parses metadata stored in an object record.
+func decodeObjectMeta(metadata string) (ObjectListingMeta, error) {
+	if metadata == "" {
+		return nil, nil
+	}
+	var meta ObjectListingMeta
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
 }
 
 // SyncRecord represents a row in the incoming_sync table.  It is used by replication.
@@ -109,14 +198,17 @@ type Container interface {
 	IsDeleted() (bool, error)
 	// Delete deletes the container.
 	Delete(timestamp string) error
-	// ListObjects lists the container's object entries.
-	ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error)
+	// ListObjects lists the container's object entries, narrowed by filter if it isn't nil.
+	ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter) ([]interface{}, error)
+	// IterObjects passes the entries ListObjects would return to emit one at a time, reading them from the database in
+	// batches so listings of any size can be streamed. It stops with the first error emit returns.
+	IterObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter, emit func(entry interface{}) error) error
 	// GetMetadata returns the container's current metadata.
 	GetMetadata() (map[string]string, error)
 	// UpdateMetadata applies updates to the container's metadata.
 	UpdateMetadata(updates map[string][]string, timestamp string) error
-	// PutObject adds a new object to the container.
-	PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error
+	// PutObject adds a new object to the container, along with its X-Object-Meta-* metadata.
+	PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int, metadata map[string]string) error
 	// DeleteObject deletes an object from the container.
 	DeleteObject(name string, timestamp string, storagePolicyIndex int) error
 	// ID returns a unique identifier for the container.
@@ -164,6 +256,9 @@ type ContainerEngine interface {
 	// GetByHash returns a replicable database given its hash.  This will probably move from this interface once we
 	// have replicator->replicator communication.
 	GetByHash(device, hash, partition string) (c ReplicableContainer, err error)
+	// OpenFile opens a container database file directly, without caching it.  It's used by the daemons and for
+	// incoming replicated databases, and the caller must Close the container.
+	OpenFile(containerFile string) (c ReplicableContainer, err error)
 	// Invalidate removes a container from the cache entirely.  This will probably also move, since it's only used by replication.
 	Invalidate(c Container)
 
@@ -171,8 +266,60 @@ type ContainerEngine interface {
 	OpenCount() (count int)
 }
 
-// My attempts at making this lruEngine reusable have not been successful, so for now it's sqlite-specific and not exported.
+// ContainerEngineConstructor is a function that, given configs and the server's device root and hash path prefix and
+// suffix, returns a ContainerEngine.
+type ContainerEngineConstructor func(serverconf conf.Config, deviceRoot, hashPathPrefix, hashPathSuffix string) (ContainerEngine, error)
+
+type containerEngineFactoryEntry struct {
+	name        string
+	constructor ContainerEngineConstructor
+}
+
+var containerEngineFactories = []containerEngineFactoryEntry{}
+
+// RegisterContainerEngine lets you tell hummingbird about a new container engine.
+func RegisterContainerEngine(name string, newEngine ContainerEngineConstructor) {
+	for i, e := range containerEngineFactories {
+		if e.name == name {
+			containerEngineFactories[i].constructor = newEngine
+			return
+		}
+	}
+	containerEngineFactories = append(containerEngineFactories, containerEngineFactoryEntry{name, newEngine})
+}
+
+// FindContainerEngine returns the registered container engine with the given name.
+func FindContainerEngine(name string) (ContainerEngineConstructor, error) {
+	for _, e := range containerEngineFactories {
+		if e.name == name {
+			return e.constructor, nil
+		}
+	}
+	return nil, errors.New("Not found")
+}
+
+// getContainerEngine returns the container engine named by the container server's engine setting.  The daemons use
+// the server's setting too, since they work on the same database files.
+func getContainerEngine(serverconf conf.Config, deviceRoot, hashPathPrefix, hashPathSuffix string) (ContainerEngine, error) {
+	name := serverconf.GetDefault("app:container-server", "engine", "sqlite")
+	constructor, err := FindContainerEngine(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find container engine %q", name)
+	}
+	return constructor(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+}
+
+// containerBackend is the database format an lruEngine opens and creates containers with.
+type containerBackend struct {
+	open           func(containerFile string) (ReplicableContainer, error)
+	create         func(containerFile, account, container, putTimestamp string, metadata map[string][]string, policyIndex int) error
+	createExisting func(c Container, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, error)
+}
+
+// lruEngine is a ContainerEngine that keeps recently used containers open, for any backend that stores a container as
+// a database file in its hash directory.
 type lruEngine struct {
+	backend        *containerBackend
 	deviceRoot     string
 	hashPathPrefix string
 	hashPathSuffix string
@@ -236,7 +383,7 @@ func (l *lruEngine) getbypath(containerFile string) (c Container, err error) {
 		l.used.MoveToBack(e.elem)
 		return e.c, nil
 	}
-	if c, err = sqliteOpenContainer(containerFile); err != nil {
+	if c, err = l.backend.open(containerFile); err != nil {
 		return nil, err
 	}
 	l.add(c)
@@ -258,12 +405,12 @@ func (l *lruEngine) Create(vars map[string]string, putTimestamp string, metadata
 		if policyIndex < 0 {
 			policyIndex = defaultPolicyIndex
 		}
-		err = sqliteCreateContainer(containerFile, vars["account"], vars["container"], putTimestamp, metadata, policyIndex)
+		err = l.backend.create(containerFile, vars["account"], vars["container"], putTimestamp, metadata, policyIndex)
 		if err == nil {
 			c, err = l.Get(vars)
 		}
 	} else {
-		created, err = sqliteCreateExistingContainer(c, putTimestamp, metadata, policyIndex, defaultPolicyIndex)
+		created, err = l.backend.createExisting(c, putTimestamp, metadata, policyIndex, defaultPolicyIndex)
 		if err != nil {
 			l.Return(c)
 			c = nil
@@ -297,6 +444,11 @@ func (l *lruEngine) GetByHash(device, hash, partition string) (ReplicableContain
 	return rc, nil
 }
 
+// OpenFile opens a database file without caching it.
+func (l *lruEngine) OpenFile(containerFile string) (ReplicableContainer, error) {
+	return l.backend.open(containerFile)
+}
+
 // Invalidate removes any cached backend connections to the database.
 func (l *lruEngine) Invalidate(c Container) {
 	defer c.Close()
@@ -317,8 +469,9 @@ func (l *lruEngine) Close() {
 	l.used = l.used.Init()
 }
 
-func newLRUEngine(deviceRoot, hashPathPrefix, hashPathSuffix string, containerCount int) *lruEngine {
+func newLRUEngine(backend *containerBackend, deviceRoot, hashPathPrefix, hashPathSuffix string, containerCount int) *lruEngine {
 	return &lruEngine{
+		backend:        backend,
 		deviceRoot:     deviceRoot,
 		hashPathPrefix: hashPathPrefix,
 		hashPathSuffix: hashPathSuffix,
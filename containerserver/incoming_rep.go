@@ -130,6 +130,14 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 			status := server.replicateMergeItems(request, vars, records, remoteID)
 			srv.StandardResponse(writer, status)
 		}
+	case "stream_items":
+		var remoteID string
+		if err := extractArgs(&remoteID); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateStreamItems(request, vars, decoder, remoteID)
+			srv.StandardResponse(writer, status)
+		}
 	case "merge_syncs":
 		var records []*SyncRecord
 		if err := extractArgs(&records); err != nil {
@@ -138,6 +146,14 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 			status := server.replicateMergeSyncs(request, vars, records)
 			srv.StandardResponse(writer, status)
 		}
+	case "merge_shard_ranges":
+		var ranges []*ShardRange
+		if err := extractArgs(&ranges); err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+		} else {
+			status := server.replicateMergeShardRanges(request, vars, ranges)
+			srv.StandardResponse(writer, status)
+		}
 	case "sync":
 		var maxRow int64
 		var hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string
@@ -158,7 +174,7 @@ func (server *ContainerServer) ContainerReplicateHandler(writer http.ResponseWri
 func (server *ContainerServer) replicateRsyncThenMerge(request *http.Request, vars map[string]string, tmpFileName string) int {
 	containerFile := filepath.Join(server.driveRoot, vars["device"], "containers", vars["partition"], vars["hash"][29:32], vars["hash"], vars["hash"]+".db")
 	tmpContainerFile := filepath.Join(server.driveRoot, vars["device"], "tmp", tmpFileName)
-	tmpDb, err := sqliteOpenContainer(tmpContainerFile)
+	tmpDb, err := server.containerEngine.OpenFile(tmpContainerFile)
 	if err != nil {
 		return http.StatusNotFound
 	}
@@ -203,7 +219,7 @@ func (server *ContainerServer) replicateCompleteRsync(request *http.Request, var
 	if !fs.Exists(tmpContainerFile) || fs.Exists(containerFile) {
 		return http.StatusNotFound
 	}
-	tmpDb, err := sqliteOpenContainer(tmpContainerFile)
+	tmpDb, err := server.containerEngine.OpenFile(tmpContainerFile)
 	if err != nil {
 		return http.StatusNotFound
 	}
@@ -231,6 +247,33 @@ func (server *ContainerServer) replicateMergeItems(request *http.Request, vars m
 	return http.StatusAccepted
 }
 
+// replicateStreamItems merges the pages of object records that follow a stream_items message, one page at a time so the
+// sync point with the remote advances as the stream goes.
+func (server *ContainerServer) replicateStreamItems(request *http.Request, vars map[string]string, decoder *json.Decoder, remoteID string) int {
+	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer server.containerEngine.Return(db)
+	for {
+		var records []*ObjectRecord
+		if err := decoder.Decode(&records); err == io.EOF {
+			return http.StatusAccepted
+		} else if err != nil {
+			srv.GetLogger(request).Error("Error reading streamed records.",
+				zap.String("RingHash", db.RingHash()),
+				zap.Error(err))
+			return http.StatusBadRequest
+		}
+		if err := db.MergeItems(records, remoteID); err != nil {
+			srv.GetLogger(request).Error("Error merging records",
+				zap.String("RingHash", db.RingHash()),
+				zap.Error(err))
+			return http.StatusInternalServerError
+		}
+	}
+}
+
 func (server *ContainerServer) replicateMergeSyncs(request *http.Request, vars map[string]string, records []*SyncRecord) int {
 	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
@@ -246,6 +289,25 @@ func (server *ContainerServer) replicateMergeSyncs(request *http.Request, vars m
 	return http.StatusAccepted
 }
 
+func (server *ContainerServer) replicateMergeShardRanges(request *http.Request, vars map[string]string, ranges []*ShardRange) int {
+	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
+	if err != nil {
+		return http.StatusNotFound
+	}
+	defer server.containerEngine.Return(db)
+	sdb, ok := db.(ShardableContainer)
+	if !ok {
+		return http.StatusNotImplemented
+	}
+	if err := sdb.MergeShardRanges(ranges); err != nil {
+		srv.GetLogger(request).Error("Error merging shard ranges.",
+			zap.String("RingHash", db.RingHash()),
+			zap.Error(err))
+		return http.StatusInternalServerError
+	}
+	return http.StatusAccepted
+}
+
 func (server *ContainerServer) replicateSync(request *http.Request, vars map[string]string, maxRow int64, hash, id, createdAt, putTimestamp, deleteTimestamp, metadata string) (int, []byte) {
 	db, err := server.containerEngine.GetByHash(vars["device"], vars["hash"], vars["partition"])
 	if err != nil {
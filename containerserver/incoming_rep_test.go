@@ -377,6 +377,71 @@ func TestServerReplicateCompleteRsync(t *testing.T) {
 	require.Equal(t, "3", rsp.Header().Get("X-Container-Object-Count"))
 }
 
+func TestServerReplicateStreamItems(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", common.CanonicalTimestamp(100))
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusCreated, rsp.Status)
+
+	h := md5.New()
+	fmt.Fprintf(h, "%s/%s/%s%s", "changeme", "a", "c", "changeme")
+	containerHash := fmt.Sprintf("%032x", h.Sum(nil))
+
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	require.Nil(t, encoder.Encode([]interface{}{"stream_items", common.UUID()}))
+	require.Nil(t, encoder.Encode([]ObjectRecord{
+		{Rowid: 1, Name: "o1", CreatedAt: common.CanonicalTimestamp(101), Size: 10, ContentType: "text/plain",
+			ETag: "ffffffffffffffffffffffffffffffff"},
+	}))
+	require.Nil(t, encoder.Encode([]ObjectRecord{
+		{Rowid: 2, Name: "o2", CreatedAt: common.CanonicalTimestamp(102), Size: 20, ContentType: "text/plain",
+			ETag: "ffffffffffffffffffffffffffffffff"},
+		{Rowid: 3, Name: "o3", CreatedAt: common.CanonicalTimestamp(103), Size: 30, ContentType: "text/plain",
+			ETag: "ffffffffffffffffffffffffffffffff"},
+	}))
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("REPLICATE", "/device/1/"+containerHash, body)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusAccepted, rsp.Status)
+
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("HEAD", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, "3", rsp.Header().Get("X-Container-Object-Count"))
+	require.Equal(t, "60", rsp.Header().Get("X-Container-Bytes-Used"))
+
+	// a stream cut off partway through a page is rejected.
+	msg := `["stream_items", "abcdef"]` + "\n" + `[{"name": "o4", "created_at": "0000000104.00000"`
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("REPLICATE", "/device/1/"+containerHash, strings.NewReader(msg))
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusBadRequest, rsp.Status)
+}
+
+func TestServerReplicateStreamItemsNotFound(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	body := `["stream_items", "abcdef"]` + "\n" + `[]`
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("REPLICATE", "/device/1/ffffffffffffffffffffffffffffffff", strings.NewReader(body))
+	require.Nil(t, err)
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, http.StatusNotFound, rsp.Status)
+}
+
 func TestServerReplicateBadOp(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
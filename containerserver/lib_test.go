@@ -76,7 +76,7 @@ func makeTestServer() (http.Handler, func(), error) {
 		logger:           zap.NewNop(),
 		checkMounts:      false,
 		updateClient:     http.DefaultClient,
-		containerEngine:  newLRUEngine(dir, "changeme", "changeme", 32),
+		containerEngine:  newLRUEngine(sqliteBackend, dir, "changeme", "changeme", 32),
 		diskInUse:        common.NewKeyedLimit(2, 2),
 		autoCreatePrefix: ".",
 	}
@@ -102,7 +102,7 @@ func makeTestServer2() (*ContainerServer, http.Handler, func(), error) {
 		logger:          zap.NewNop(),
 		checkMounts:     false,
 		updateClient:    http.DefaultClient,
-		containerEngine: newLRUEngine(dir, "changeme", "changeme", 32),
+		containerEngine: newLRUEngine(sqliteBackend, dir, "changeme", "changeme", 32),
 		diskInUse:       common.NewKeyedLimit(2, 2),
 	}
 	cleanup := func() {
@@ -122,9 +122,12 @@ func (f fakeDatabase) IsDeleted() (bool, error) {
 func (f fakeDatabase) Delete(timestamp string) error {
 	return errors.New("")
 }
-func (f fakeDatabase) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
+func (f fakeDatabase) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter) ([]interface{}, error) {
 	return nil, errors.New("")
 }
+func (f fakeDatabase) IterObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter, emit func(entry interface{}) error) error {
+	return errors.New("")
+}
 func (f fakeDatabase) GetMetadata() (map[string]string, error) {
 	return nil, errors.New("")
 }
@@ -167,7 +170,7 @@ func (f fakeDatabase) CleanupTombstones(reclaimAge int64) error {
 func (f fakeDatabase) CheckSyncLink() error {
 	return errors.New("")
 }
-func (f fakeDatabase) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error {
+func (f fakeDatabase) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int, metadata map[string]string) error {
 	return errors.New("")
 }
 func (f fakeDatabase) DeleteObject(name string, timestamp string, storagePolicyIndex int) error {
@@ -186,6 +189,9 @@ func (fakeContainerEngine) Get(vars map[string]string) (c Container, err error)
 func (fakeContainerEngine) GetByHash(device, hash, partition string) (c ReplicableContainer, err error) {
 	return nil, errors.New("")
 }
+func (fakeContainerEngine) OpenFile(containerFile string) (c ReplicableContainer, err error) {
+	return nil, errors.New("")
+}
 func (fakeContainerEngine) Create(vars map[string]string, putTimestamp string, metadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, Container, error) {
 	return false, nil, errors.New("")
 }
@@ -0,0 +1,379 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// policyMigrationKey is the container metadata key marking a container for migration to another storage policy.
+const policyMigrationKey = "X-Container-Sysmeta-" + conf.PolicyMigrationSysmeta
+
+// policyMigration returns the storage policy the container is marked for migration to, if it is.
+func policyMigration(info *ContainerInfo) (int, bool) {
+	value, ok := info.Metadata[policyMigrationKey]
+	if !ok || len(value) == 0 {
+		return 0, false
+	}
+	target, err := strconv.Atoi(value[0])
+	if err != nil {
+		return 0, false
+	}
+	return target, true
+}
+
+// migrationTarget returns the storage policy the container's objects are being migrated to, or -1 if they aren't.
+func migrationTarget(info *ContainerInfo) int {
+	if target, ok := policyMigration(info); ok && target != info.StoragePolicyIndex {
+		return target
+	}
+	return -1
+}
+
+// migratingListing pages through a container's listing in one of the storage policies it's being migrated between.
+type migratingListing struct {
+	list    func(marker string) ([]interface{}, error)
+	page    int
+	entries []interface{}
+	marker  string
+	done    bool
+}
+
+// next returns the listing's next entry without consuming it, or nil once the listing is exhausted.
+func (l *migratingListing) next() (interface{}, error) {
+	if len(l.entries) == 0 && !l.done {
+		entries, err := l.list(l.marker)
+		if err != nil {
+			return nil, err
+		}
+		l.entries, l.done = entries, len(entries) < l.page
+		if len(entries) > 0 {
+			l.marker = listingEntryName(entries[len(entries)-1])
+		}
+	}
+	if len(l.entries) == 0 {
+		return nil, nil
+	}
+	return l.entries[0], nil
+}
+
+// iterMigratingObjects passes the entries of a listing of a container being migrated between storage policies to
+// emit, merging its listings in both policies a page at a time.  An object in both is listed as it is in the policy
+// it's moving to.
+func iterMigratingObjects(db Container, limit int, marker string, endMarker string, prefix string, delimiter string,
+	path *string, reverse bool, from, to int, filter *ListingFilter, emit func(entry interface{}) error) error {
+	page := limit
+	if page > listingBatchSize {
+		page = listingBatchSize
+	}
+	listing := func(policyIndex int) *migratingListing {
+		l := &migratingListing{page: page, marker: marker}
+		// each page picks up after the last entry of the one before, in either direction.
+		l.list = func(after string) ([]interface{}, error) {
+			return db.ListObjects(page, after, endMarker, prefix, delimiter, path, reverse, policyIndex, filter)
+		}
+		return l
+	}
+	fromListing, toListing := listing(from), listing(to)
+	for count := 0; count < limit; count++ {
+		fromEntry, err := fromListing.next()
+		if err != nil {
+			return err
+		}
+		toEntry, err := toListing.next()
+		if err != nil {
+			return err
+		}
+		var entry interface{}
+		if fromEntry == nil && toEntry == nil {
+			return nil
+		} else if fromEntry == nil {
+			entry, toListing.entries = toEntry, toListing.entries[1:]
+		} else if toEntry == nil {
+			entry, fromListing.entries = fromEntry, fromListing.entries[1:]
+		} else if fromName, toName := listingEntryName(fromEntry), listingEntryName(toEntry); fromName == toName {
+			entry, fromListing.entries, toListing.entries = toEntry, fromListing.entries[1:], toListing.entries[1:]
+		} else if (fromName < toName) != reverse {
+			entry, fromListing.entries = fromEntry, fromListing.entries[1:]
+		} else {
+			entry, toListing.entries = toEntry, toListing.entries[1:]
+		}
+		if err := emit(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// movePolicy moves a container marked for migration to the policy it's being migrated to; naming the container's
+// current policy is a no-op, and any other is a conflict.  The migrator only lists the first primary's replica, so the
+// old policy's tombstones are skipped by the reconciler only up to this replica's first live object left outside the
+// new policy, which it queues as usual.
+func movePolicy(db Container, policyIndex int, timestamp string) error {
+	rc, ok := db.(ReconcilableContainer)
+	if !ok {
+		return fmt.Errorf("Container can't change storage policy")
+	}
+	info, err := db.GetInfo()
+	if err != nil {
+		return err
+	}
+	if info.StoragePolicyIndex == policyIndex {
+		return nil
+	}
+	if target, ok := policyMigration(info); !ok || target != policyIndex {
+		return ErrorPolicyConflict
+	}
+	if err := rc.SetStoragePolicyIndex(policyIndex, timestamp); err != nil {
+		return err
+	}
+	point, err := rc.ReconcilerPoint()
+	if err != nil {
+		return err
+	}
+	for {
+		records, err := rc.MisplacedSince(point, listingBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Deleted == 0 {
+				return rc.SetReconcilerPoint(point)
+			}
+			point = record.Rowid
+		}
+		if len(records) < listingBatchSize {
+			return rc.SetReconcilerPoint(point)
+		}
+	}
+}
+
+// Migrator is the container migrator daemon, which moves the objects of containers marked for migration to another
+// storage policy.
+//
+// A reseller admin marks a container for migration by POSTing its new policy's name to it as X-Migrate-Storage-Policy.
+// While it's marked, proxies send new objects to the new policy and fall back to the old one for reads, and container
+// listings merge the two policies.  The first primary node for each marked container copies every object left in the
+// old policy to the new one and deletes the old copy, which updates the container's object records as it goes.  Once
+// nothing is left behind, it moves every replica of the container to the new policy and clears the mark.  Objects
+// written to the old policy by proxies that hadn't heard of the migration yet are then misplaced, and are left to the
+// container reconciler.
+type Migrator struct {
+	// Reconciler supplies the machinery for moving objects between policies.
+	Reconciler
+}
+
+// containerRequest sends a POST with the given headers to every replica of a container, returning how many succeeded
+// and how many replicas there are.
+func (m *Migrator) containerRequest(account, container string, headers http.Header) (int, int) {
+	partition := m.Ring.GetPartition(account, container, "")
+	nodes := m.Ring.GetNodes(partition)
+	succeeded, _, _ := sendToNodes(m.client, "POST", nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(account), common.Urlencode(container))
+	}, func(i int) http.Header { return headers }, nil)
+	return succeeded, len(nodes)
+}
+
+// finishMigration moves every replica of a container to the storage policy it's been migrated to, then clears the
+// container's migration mark.  The mark is only cleared once all the replicas have moved, so a replica that didn't
+// can't win the container back for the old policy.
+func (m *Migrator) finishMigration(account, container string, target int) error {
+	moved, replicas := m.containerRequest(account, container, http.Header{
+		"X-Timestamp":                    {common.GetTimestamp()},
+		"X-Backend-Storage-Policy-Index": {strconv.Itoa(target)},
+	})
+	if moved < replicas {
+		return fmt.Errorf("Unable to move all replicas of /%s/%s to policy %d", account, container, target)
+	}
+	cleared, replicas := m.containerRequest(account, container, http.Header{
+		"X-Timestamp":      {common.GetTimestamp()},
+		policyMigrationKey: {""},
+	})
+	if cleared < replicas/2+1 {
+		return fmt.Errorf("Unable to clear the migration of /%s/%s", account, container)
+	}
+	return nil
+}
+
+// migrateDatabase moves the objects of a container marked for migration, if this is its first primary.
+func (m *Migrator) migrateDatabase(dev *ring.Device, dbFile string) error {
+	if first, err := m.isFirstPrimary(dev, dbFile); err != nil || !first {
+		return err
+	}
+	c, err := m.engine.OpenFile(dbFile)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	target, ok := policyMigration(info)
+	if !ok || info.Account == MisplacedObjectsAccount {
+		return nil
+	}
+	if target != info.StoragePolicyIndex {
+		if _, ok := m.objectRings[target]; !ok {
+			return fmt.Errorf("No object ring for policy %d", target)
+		}
+		remaining := 0
+		point := int64(-1)
+		for {
+			records, err := c.ItemsSince(point, 1000)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				break
+			}
+			point = records[len(records)-1].Rowid
+			for _, record := range records {
+				if record.Deleted == 1 || record.StoragePolicyIndex == target {
+					continue
+				}
+				moved, err := m.moveObject(record.StoragePolicyIndex, target, info.Account, info.Container, record.Name,
+					record.CreatedAt, false)
+				if err != nil {
+					m.logger.Error("Error migrating object.",
+						zap.String("account", info.Account),
+						zap.String("container", info.Container),
+						zap.String("object", record.Name),
+						zap.Error(err))
+				}
+				if !moved {
+					remaining++
+				}
+			}
+		}
+		if remaining > 0 {
+			m.logger.Info("Container migration incomplete.",
+				zap.String("account", info.Account),
+				zap.String("container", info.Container),
+				zap.Int("remaining", remaining))
+			return nil
+		}
+	}
+	// the container may have moved on an earlier pass without its mark being cleared; finishing again is harmless.
+	if err := m.finishMigration(info.Account, info.Container, target); err != nil {
+		return err
+	}
+	m.logger.Info("Migrated container.",
+		zap.String("account", info.Account),
+		zap.String("container", info.Container),
+		zap.Int("policy", target))
+	return nil
+}
+
+func (m *Migrator) migrateDevice(dev *ring.Device) {
+	devicePath := filepath.Join(m.deviceRoot, dev.Device)
+	if mount, err := fs.IsMount(devicePath); m.checkMounts && (err != nil || !mount) {
+		m.logger.Error("Device not mounted.", zap.String("devicePath", devicePath))
+		return
+	}
+	results := make(chan string, 100)
+	go findContainerDbs(m.logger, devicePath, m.cancel, results)
+	for dbFile := range results {
+		if err := m.migrateDatabase(dev, dbFile); err != nil {
+			m.logger.Error("Error migrating database.", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+	}
+}
+
+// Run runs a pass of the migrator once.
+func (m *Migrator) Run() {
+	devices, err := m.Ring.LocalDevices(m.serverPort)
+	if err != nil {
+		m.logger.Error("Error getting local devices from ring.", zap.Error(err))
+		return
+	}
+	start := time.Now()
+	for _, dev := range devices {
+		m.migrateDevice(dev)
+	}
+	m.logger.Info("Migrator pass completed.", zap.Float64("seconds", time.Since(start).Seconds()))
+}
+
+// RunForever runs the migrator in a forever-loop.
+func (m *Migrator) RunForever() {
+	for {
+		m.Run()
+		time.Sleep(m.interval)
+	}
+}
+
+// GetMigrator uses the config settings and command-line flags to configure and return a migrator daemon struct.
+func GetMigrator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv.LowLevelLogger, error) {
+	if !serverconf.HasSection("container-migrator") {
+		return nil, nil, fmt.Errorf("Unable to find container-migrator config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	containerRing, err := GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading container ring")
+	}
+	deviceRoot := serverconf.GetDefault("container-migrator", "devices", "/srv/node")
+	engine, err := getContainerEngine(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectRings := map[int]ring.Ring{}
+	for _, policy := range conf.LoadPolicies() {
+		if objectRings[policy.Index], err = GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index); err != nil {
+			return nil, nil, fmt.Errorf("Error loading object ring for policy %d", policy.Index)
+		}
+	}
+	logLevelString := serverconf.GetDefault("container-migrator", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger("container-migrator", &logLevel, flags); err != nil {
+		return nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	return &Migrator{Reconciler{
+		checkMounts: serverconf.GetBool("container-migrator", "mount_check", true),
+		deviceRoot:  deviceRoot,
+		serverPort:  int(serverconf.GetInt("container-migrator", "bind_port", 6000)),
+		interval:    time.Duration(serverconf.GetInt("container-migrator", "interval", 300)) * time.Second,
+		logger:      logger,
+		Ring:        containerRing,
+		objectRings: objectRings,
+		engine:      engine,
+		cancel:      make(chan struct{}),
+		client: &http.Client{
+			Timeout:   time.Minute * 15,
+			Transport: &http.Transport{Dial: (&net.Dialer{Timeout: time.Second}).Dial},
+		},
+	}}, logger, nil
+}
@@ -0,0 +1,245 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"go.uber.org/zap"
+)
+
+func TestMigrationTarget(t *testing.T) {
+	info := &ContainerInfo{StoragePolicyIndex: 0, Metadata: map[string][]string{}}
+	require.Equal(t, -1, migrationTarget(info))
+	info.Metadata[policyMigrationKey] = []string{"", "1000000000.00000"}
+	require.Equal(t, -1, migrationTarget(info))
+	info.Metadata[policyMigrationKey] = []string{"2", "1000000000.00000"}
+	require.Equal(t, 2, migrationTarget(info))
+	info.StoragePolicyIndex = 2
+	require.Equal(t, -1, migrationTarget(info))
+	target, ok := policyMigration(info)
+	require.True(t, ok)
+	require.Equal(t, 2, target)
+}
+
+func TestIterMigratingObjects(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("1000000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("a", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("b", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("d", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("b", "1000000002.00000", 2, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	require.Nil(t, db.PutObject("c", "1000000002.00000", 2, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	list := func(limit int, reverse bool) []interface{} {
+		var entries []interface{}
+		require.Nil(t, iterMigratingObjects(db, limit, "", "", "", "", nil, reverse, 0, 1, nil, func(entry interface{}) error {
+			entries = append(entries, entry)
+			return nil
+		}))
+		return entries
+	}
+	entries := list(10, false)
+	require.Equal(t, []string{"a", "b", "c", "d"}, listingNames(entries))
+	require.Equal(t, int64(2), entries[1].(*ObjectListingRecord).Size)
+	require.Equal(t, []string{"d", "c", "b", "a"}, listingNames(list(10, true)))
+	require.Equal(t, []string{"a", "b"}, listingNames(list(2, false)))
+
+	// longer listings are merged a page at a time.
+	for i := 0; i < listingBatchSize+10; i++ {
+		require.Nil(t, db.PutObject(fmt.Sprintf("e%04d", i), "1000000003.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	}
+	require.Nil(t, db.PutObject("e0500", "1000000004.00000", 2, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	entries = list(listingBatchSize*2, false)
+	require.Equal(t, listingBatchSize+14, len(entries))
+	require.Equal(t, "e0500", listingEntryName(entries[504]))
+	require.Equal(t, int64(2), entries[504].(*ObjectListingRecord).Size)
+	require.Equal(t, "e1009", listingEntryName(entries[len(entries)-1]))
+	entries = list(listingBatchSize*2, true)
+	require.Equal(t, listingBatchSize+14, len(entries))
+	require.Equal(t, "e1009", listingEntryName(entries[0]))
+	require.Equal(t, "a", listingEntryName(entries[len(entries)-1]))
+}
+
+func TestMovePolicy(t *testing.T) {
+	db, _, cleanup, err := createTestBoltDatabase("1000000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("o1", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	require.Nil(t, db.DeleteObject("o2", "1000000002.00000", 0))
+	require.Equal(t, ErrorPolicyConflict, movePolicy(db, 1, "1000000003.00000"))
+
+	require.Nil(t, db.UpdateMetadata(map[string][]string{policyMigrationKey: {"1", "1000000003.00000"}}, "1000000003.00000"))
+	require.Equal(t, ErrorPolicyConflict, movePolicy(db, 2, "1000000004.00000"))
+	require.Nil(t, movePolicy(db, 1, "1000000004.00000"))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 1, info.StoragePolicyIndex)
+	require.Equal(t, int64(1), info.ObjectCount)
+	// the old policy's tombstones aren't queued for the reconciler.
+	point, err := db.ReconcilerPoint()
+	require.Nil(t, err)
+	records, err := db.MisplacedSince(point, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(records))
+	require.Nil(t, movePolicy(db, 1, "1000000005.00000"))
+
+	// a live object the migrator didn't see on this replica is still left for the reconciler.
+	db2, _, cleanup2, err := createTestBoltDatabase("1000000000.00000")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, db2.DeleteObject("o1", "1000000001.00000", 0))
+	require.Nil(t, db2.PutObject("o2", "1000000002.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db2.DeleteObject("o3", "1000000002.00000", 0))
+	require.Nil(t, db2.UpdateMetadata(map[string][]string{policyMigrationKey: {"1", "1000000003.00000"}}, "1000000003.00000"))
+	require.Nil(t, movePolicy(db2, 1, "1000000004.00000"))
+	point, err = db2.ReconcilerPoint()
+	require.Nil(t, err)
+	records, err = db2.MisplacedSince(point, 10)
+	require.Nil(t, err)
+	require.Equal(t, []string{"o2", "o3"}, []string{records[0].Name, records[1].Name})
+}
+
+// migrationServer fakes the object and container servers a migrator talks to, serving every object at the given
+// timestamp and recording the requests made of it.
+type migrationServer struct {
+	sync.Mutex
+	timestamp string
+	requests  []string
+	headers   []http.Header
+}
+
+func (s *migrationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	io.Copy(ioutil.Discard, r.Body)
+	parts := strings.SplitN(r.URL.Path[1:], "/", 5)
+	policy := r.Header.Get("X-Backend-Storage-Policy-Index")
+	s.requests = append(s.requests, r.Method+" "+parts[0]+" "+strings.Join(parts[2:], "/")+" "+policy)
+	s.headers = append(s.headers, r.Header)
+	switch {
+	case len(parts) == 4:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET":
+		w.Header().Set("X-Timestamp", s.timestamp)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Etag", "8d777f385d3dfec8815d20f7496026dc")
+		w.Write([]byte("data"))
+	case r.Method == "PUT":
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *migrationServer) count(prefix string) int {
+	s.Lock()
+	defer s.Unlock()
+	count := 0
+	for _, request := range s.requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+func createMigratingDatabase(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	dbFile := filepath.Join(dir, "sda", "containers", "1", "000", "db", "db.db")
+	require.Nil(t, boltCreateContainer(dbFile, "a", "c", "1000000000.00000", nil, 0))
+	db, err := boltOpenContainer(dbFile)
+	require.Nil(t, err)
+	require.Nil(t, db.PutObject("o1", "1000000001.00000", 4, "text/plain", "8d777f385d3dfec8815d20f7496026dc", 0, nil))
+	require.Nil(t, db.PutObject("o2", "1000000001.00000", 4, "text/plain", "8d777f385d3dfec8815d20f7496026dc", 1, nil))
+	require.Nil(t, db.DeleteObject("o3", "1000000001.00000", 0))
+	require.Nil(t, db.UpdateMetadata(map[string][]string{policyMigrationKey: {"1", "1000000002.00000"}}, "1000000002.00000"))
+	db.Close()
+	return dbFile, func() { os.RemoveAll(dir) }
+}
+
+func TestMigrateDatabase(t *testing.T) {
+	server := &migrationServer{timestamp: "1000000001.00000"}
+	fakeRing, cleanup := testReconcilerRing(t, server)
+	defer cleanup()
+	dbFile, cleanupDb := createMigratingDatabase(t)
+	defer cleanupDb()
+	m := &Migrator{Reconciler{
+		logger:      zap.NewNop(),
+		Ring:        fakeRing,
+		objectRings: map[int]ring.Ring{0: fakeRing, 1: fakeRing},
+		engine:      newLRUEngine(boltBackend, filepath.Dir(dbFile), "", "", 10),
+		client:      http.DefaultClient,
+	}}
+	require.Nil(t, m.migrateDatabase(fakeRing.MockDevices[1], dbFile))
+	require.Equal(t, 0, len(server.requests))
+
+	require.Nil(t, m.migrateDatabase(fakeRing.MockDevices[0], dbFile))
+	// o1 is copied to the new policy and deleted from the old one; o2 is already there and o3 is gone.
+	require.Equal(t, 3, server.count("GET"))
+	for _, dev := range []string{"sda", "sdb", "sdc"} {
+		require.Equal(t, 1, server.count("GET "+dev+" a/c/o1 0"))
+		require.Equal(t, 1, server.count("PUT "+dev+" a/c/o1 1"))
+		require.Equal(t, 1, server.count("DELETE "+dev+" a/c/o1 0"))
+		// then every replica of the container is moved to the new policy and the migration mark is cleared.
+		require.Equal(t, 1, server.count("POST "+dev+" a/c 1"))
+		require.Equal(t, 2, server.count("POST "+dev+" a/c"))
+	}
+	require.Equal(t, 3, server.count("PUT"))
+	require.Equal(t, 3, server.count("DELETE"))
+	for i, request := range server.requests {
+		if strings.HasPrefix(request, "DELETE") {
+			require.Equal(t, "1000000001.00000_0000000000000001", server.headers[i].Get("X-Timestamp"))
+		}
+	}
+	cleared := 0
+	for _, headers := range server.headers {
+		if value, ok := headers[policyMigrationKey]; ok && value[0] == "" {
+			cleared++
+		}
+	}
+	require.Equal(t, 3, cleared)
+}
+
+func TestMigrateDatabaseIncomplete(t *testing.T) {
+	// the old policy's copy of o1 is older than its container record, so it can't be moved yet.
+	server := &migrationServer{timestamp: "1000000000.50000"}
+	fakeRing, cleanup := testReconcilerRing(t, server)
+	defer cleanup()
+	dbFile, cleanupDb := createMigratingDatabase(t)
+	defer cleanupDb()
+	m := &Migrator{Reconciler{
+		logger:      zap.NewNop(),
+		Ring:        fakeRing,
+		objectRings: map[int]ring.Ring{0: fakeRing, 1: fakeRing},
+		engine:      newLRUEngine(boltBackend, filepath.Dir(dbFile), "", "", 10),
+		client:      http.DefaultClient,
+	}}
+	require.Nil(t, m.migrateDatabase(fakeRing.MockDevices[0], dbFile))
+	require.Equal(t, 0, server.count("PUT"))
+	require.Equal(t, 0, server.count("POST"))
+}
@@ -0,0 +1,607 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// MisplacedObjectsAccount is the hidden account the container replicator queues objects stored under the wrong
+// storage policy in, for the reconciler to move.
+const MisplacedObjectsAccount = ".misplaced_objects"
+
+// misplacedContainerDivisor is how many seconds of object timestamps share a queue container.
+const misplacedContainerDivisor = 3600
+
+// ReconcilableContainer is a container that can find object records stored under a storage policy other than its own.
+type ReconcilableContainer interface {
+	ReplicableContainer
+	// SetStoragePolicyIndex moves the container to another storage policy.
+	SetStoragePolicyIndex(policyIndex int, timestamp string) error
+	// MisplacedSince returns up to count object records with a ROWID greater than start that aren't in the
+	// container's storage policy.
+	MisplacedSince(start int64, count int) ([]*ObjectRecord, error)
+	// ReconcilerPoint returns the ROWID up to which misplaced object records have been queued for the reconciler.
+	ReconcilerPoint() (int64, error)
+	// SetReconcilerPoint records the ROWID up to which misplaced object records have been queued for the reconciler.
+	SetReconcilerPoint(point int64) error
+}
+
+// localPolicyWins decides which of two replicas of a container with different storage policies has the right one,
+// the way swift does: a live container beats a deleted one, a recreated container beats one that never was deleted,
+// the latest recreation wins between recreated containers, and the original creation wins otherwise.
+func localPolicyWins(local, remote *ContainerInfo) bool {
+	isDeleted := func(info *ContainerInfo) bool {
+		return info.DeleteTimestamp > info.PutTimestamp && info.ObjectCount == 0
+	}
+	if isDeleted(local) || isDeleted(remote) {
+		if !isDeleted(local) {
+			return true
+		} else if !isDeleted(remote) {
+			return false
+		}
+		return local.StatusChangedAt >= remote.StatusChangedAt
+	}
+	isRecreated := func(info *ContainerInfo) bool {
+		return info.PutTimestamp > info.DeleteTimestamp && info.DeleteTimestamp > "0"
+	}
+	if isRecreated(local) || isRecreated(remote) {
+		if !isRecreated(remote) {
+			return true
+		} else if !isRecreated(local) {
+			return false
+		}
+		return local.StatusChangedAt >= remote.StatusChangedAt
+	}
+	return local.StatusChangedAt <= remote.StatusChangedAt
+}
+
+// misplacedEntry is the name of an object's entry in the misplaced objects queue.
+func misplacedEntry(policyIndex int, account, container, obj string) string {
+	return fmt.Sprintf("%d:/%s/%s/%s", policyIndex, account, container, obj)
+}
+
+// parseMisplacedEntry splits a misplaced objects queue entry into the policy the object is in and its path.
+func parseMisplacedEntry(entry string) (policyIndex int, account, container, obj string, err error) {
+	parts := strings.SplitN(entry, ":/", 2)
+	if len(parts) != 2 {
+		return 0, "", "", "", fmt.Errorf("Invalid misplaced object entry %q", entry)
+	}
+	if policyIndex, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, "", "", "", fmt.Errorf("Invalid policy in misplaced object entry %q", entry)
+	}
+	path := strings.SplitN(parts[1], "/", 3)
+	if len(path) != 3 || path[0] == "" || path[1] == "" || path[2] == "" {
+		return 0, "", "", "", fmt.Errorf("Invalid path in misplaced object entry %q", entry)
+	}
+	return policyIndex, path[0], path[1], path[2], nil
+}
+
+// misplacedContainer returns the queue container for an object timestamp.
+func misplacedContainer(timestamp string) (string, error) {
+	epoch, err := common.GetEpochFromTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+	seconds, err := strconv.ParseFloat(epoch, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(int64(seconds)/misplacedContainerDivisor*misplacedContainerDivisor, 10), nil
+}
+
+// offsetTimestamp returns a timestamp just after the given one, which is used to replace the misplaced copy of an
+// object without losing to or beating any real update.
+func offsetTimestamp(timestamp string) (string, error) {
+	parts := strings.SplitN(timestamp, "_", 2)
+	offset := int64(0)
+	if len(parts) == 2 {
+		var err error
+		if offset, err = strconv.ParseInt(parts[1], 16, 64); err != nil {
+			return "", err
+		}
+	}
+	return common.StandardizeTimestamp(fmt.Sprintf("%s_%x", parts[0], offset+1))
+}
+
+// sendToNodes makes a request of each node, returning how many succeeded along with the responses' status codes and
+// headers.  A failed request has a status of 0.  Callers decide how many successes are enough, usually a quorum.
+func sendToNodes(client *http.Client, method string, nodes []*ring.Device, url func(i int, dev *ring.Device) string, headers func(i int) http.Header, body func() io.Reader) (int, []int, []http.Header) {
+	statuses := make([]int, len(nodes))
+	responseHeaders := make([]http.Header, len(nodes))
+	for i, dev := range nodes {
+		var reader io.Reader
+		if body != nil {
+			reader = body()
+		}
+		req, err := http.NewRequest(method, url(i, dev), reader)
+		if err != nil {
+			continue
+		}
+		for key, values := range headers(i) {
+			req.Header[key] = values
+		}
+		if contentLength := req.Header.Get("Content-Length"); contentLength != "" {
+			req.ContentLength, _ = strconv.ParseInt(contentLength, 10, 64)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		statuses[i] = resp.StatusCode
+		responseHeaders[i] = resp.Header
+	}
+	return successes(statuses), statuses, responseHeaders
+}
+
+// enqueueMisplacedObject adds a misplaced object record to the misplaced objects queue.
+func enqueueMisplacedObject(client *http.Client, containerRing ring.Ring, account, container string, record *ObjectRecord) error {
+	queue, err := misplacedContainer(record.CreatedAt)
+	if err != nil {
+		return err
+	}
+	entry := misplacedEntry(record.StoragePolicyIndex, account, container, record.Name)
+	contentType := "application/x-put"
+	if record.Deleted == 1 {
+		contentType = "application/x-delete"
+	}
+	partition := containerRing.GetPartition(MisplacedObjectsAccount, queue, "")
+	nodes := containerRing.GetNodes(partition)
+	succeeded, _, _ := sendToNodes(client, "PUT", nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(MisplacedObjectsAccount), common.Urlencode(queue), common.Urlencode(entry))
+	}, func(i int) http.Header {
+		return http.Header{
+			"X-Timestamp":    {record.CreatedAt},
+			"X-Size":         {"0"},
+			"X-Content-Type": {contentType},
+			"X-Etag":         {record.CreatedAt},
+		}
+	}, nil)
+	if succeeded < quorum(nodes) {
+		return fmt.Errorf("Unable to queue misplaced object %s", entry)
+	}
+	return nil
+}
+
+func successes(statuses []int) int {
+	count := 0
+	for _, status := range statuses {
+		if status/100 == 2 {
+			count++
+		}
+	}
+	return count
+}
+
+// Reconciler is the container reconciler daemon, which moves objects stored under the wrong storage policy to the
+// right one.
+//
+// When replicas of a container disagree on its storage policy, as when it's deleted and recreated with another policy
+// during a split-brain, the container replicator settles on one and queues the container's object records in other
+// policies in the hidden .misplaced_objects account.  The first primary node for each queue container works through
+// its entries, copying each object to the container's current policy and deleting the misplaced copy.
+type Reconciler struct {
+	checkMounts bool
+	deviceRoot  string
+	logger      srv.LowLevelLogger
+	serverPort  int
+	Ring        ring.Ring
+	objectRings map[int]ring.Ring
+	engine      ContainerEngine
+	client      *http.Client
+	interval    time.Duration
+	cancel      chan struct{}
+}
+
+// containerPolicy returns the storage policy a quorum of the container's replicas agree its objects belong in: the
+// container's own, or the one it's being migrated to.
+func (r *Reconciler) containerPolicy(account, container string) (int, error) {
+	partition := r.Ring.GetPartition(account, container, "")
+	nodes := r.Ring.GetNodes(partition)
+	_, statuses, headers := sendToNodes(r.client, "HEAD", nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(account), common.Urlencode(container))
+	}, func(i int) http.Header { return http.Header{} }, nil)
+	votes := map[int]int{}
+	for i, status := range statuses {
+		if status/100 != 2 {
+			continue
+		}
+		if policy, err := strconv.Atoi(headers[i].Get("X-Backend-Storage-Policy-Index")); err == nil {
+			if target, err := strconv.Atoi(headers[i].Get("X-Container-Sysmeta-" + conf.PolicyMigrationSysmeta)); err == nil {
+				policy = target
+			}
+			votes[policy]++
+			if votes[policy] >= quorum(nodes) {
+				return policy, nil
+			}
+		}
+	}
+	return -1, fmt.Errorf("No quorum on the storage policy of /%s/%s", account, container)
+}
+
+// objectRequest sends a request for an object to the object servers for a storage policy.  The container servers are
+// updated with the object's record in that policy.
+func (r *Reconciler) objectRequest(method string, policy int, account, container, obj string, headers http.Header, body func() io.Reader) ([]int, []http.Header, error) {
+	objectRing, ok := r.objectRings[policy]
+	if !ok {
+		return nil, nil, fmt.Errorf("No object ring for policy %d", policy)
+	}
+	partition := objectRing.GetPartition(account, container, obj)
+	nodes := objectRing.GetNodes(partition)
+	containerPartition := r.Ring.GetPartition(account, container, "")
+	containerNodes := r.Ring.GetNodes(containerPartition)
+	_, statuses, responseHeaders := sendToNodes(r.client, method, nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
+	}, func(i int) http.Header {
+		h := http.Header{}
+		for key, values := range headers {
+			h[key] = values
+		}
+		h.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+		if method != "GET" && method != "HEAD" && i < len(containerNodes) {
+			h.Set("X-Container-Partition", strconv.FormatUint(containerPartition, 10))
+			h.Set("X-Container-Host", fmt.Sprintf("%s:%d", containerNodes[i].Ip, containerNodes[i].Port))
+			h.Set("X-Container-Device", containerNodes[i].Device)
+		}
+		return h
+	}, body)
+	return statuses, responseHeaders, nil
+}
+
+// fetchObject downloads the newest copy of an object in a storage policy to a temporary file, returning its headers.
+// It returns a nil file if no copy was found.
+func (r *Reconciler) fetchObject(policy int, account, container, obj string) (*os.File, http.Header, error) {
+	objectRing, ok := r.objectRings[policy]
+	if !ok {
+		return nil, nil, fmt.Errorf("No object ring for policy %d", policy)
+	}
+	partition := objectRing.GetPartition(account, container, obj)
+	var newest *os.File
+	var newestHeaders http.Header
+	for _, dev := range objectRing.GetNodes(partition) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/%s/%d/%s/%s/%s", dev.Ip, dev.Port, dev.Device,
+			partition, common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj)), nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+		resp, err := r.client.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode/100 != 2 || (newestHeaders != nil && resp.Header.Get("X-Timestamp") <= newestHeaders.Get("X-Timestamp")) {
+			resp.Body.Close()
+			continue
+		}
+		fp, err := ioutil.TempFile("", "reconciler")
+		if err != nil {
+			resp.Body.Close()
+			if newest != nil {
+				newest.Close()
+			}
+			return nil, nil, err
+		}
+		os.Remove(fp.Name())
+		_, err = io.Copy(fp, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			fp.Close()
+			continue
+		}
+		if newest != nil {
+			newest.Close()
+		}
+		newest, newestHeaders = fp, resp.Header
+	}
+	return newest, newestHeaders, nil
+}
+
+// moveObject copies an object from the policy it's misplaced in to the right one, then deletes the misplaced copy.
+// It returns false if the object should be tried again later.
+func (r *Reconciler) moveObject(from, to int, account, container, obj, timestamp string, deleted bool) (bool, error) {
+	objectTimestamp := timestamp
+	if !deleted {
+		fp, headers, err := r.fetchObject(from, account, container, obj)
+		if err != nil {
+			return false, err
+		}
+		if fp == nil {
+			// there's nothing left to move; the misplaced copy may have been moved already or deleted since.
+			return true, nil
+		}
+		defer fp.Close()
+		stat, err := fp.Stat()
+		if err != nil {
+			return false, err
+		}
+		objectTimestamp = headers.Get("X-Timestamp")
+		if objectTimestamp < timestamp {
+			// the object hasn't caught up with its container record yet.
+			return false, nil
+		}
+		putHeaders := http.Header{
+			"X-Timestamp":    {objectTimestamp},
+			"Content-Type":   {headers.Get("Content-Type")},
+			"Content-Length": {strconv.FormatInt(stat.Size(), 10)},
+			"Etag":           {headers.Get("Etag")},
+		}
+		for key := range headers {
+			if strings.HasPrefix(key, "X-Object-Meta-") || key == "X-Delete-At" || key == "Content-Encoding" || key == "Content-Disposition" {
+				putHeaders.Set(key, headers.Get(key))
+			}
+		}
+		statuses, _, err := r.objectRequest("PUT", to, account, container, obj, putHeaders, func() io.Reader {
+			return io.NewSectionReader(fp, 0, stat.Size())
+		})
+		if err != nil {
+			return false, err
+		}
+		stored := 0
+		for _, status := range statuses {
+			// a conflict means there's a newer copy in the right policy already.
+			if status/100 == 2 || status == http.StatusConflict {
+				stored++
+			}
+		}
+		if stored < len(statuses)/2+1 {
+			return false, fmt.Errorf("Unable to store /%s/%s/%s in policy %d", account, container, obj, to)
+		}
+	} else {
+		if cleanup, err := r.isMoveCleanup(to, account, container, obj, timestamp); err != nil {
+			return false, err
+		} else if cleanup {
+			return true, nil
+		}
+		statuses, _, err := r.objectRequest("DELETE", to, account, container, obj, http.Header{"X-Timestamp": {timestamp}}, nil)
+		if err != nil {
+			return false, err
+		}
+		if responded(statuses) < len(statuses)/2+1 {
+			return false, fmt.Errorf("Unable to delete /%s/%s/%s in policy %d", account, container, obj, to)
+		}
+	}
+	deleteTimestamp, err := offsetTimestamp(objectTimestamp)
+	if err != nil {
+		return false, err
+	}
+	statuses, _, err := r.objectRequest("DELETE", from, account, container, obj, http.Header{"X-Timestamp": {deleteTimestamp}}, nil)
+	if err != nil {
+		return false, err
+	}
+	if responded(statuses) < len(statuses)/2+1 {
+		return false, fmt.Errorf("Unable to delete /%s/%s/%s from policy %d", account, container, obj, from)
+	}
+	return true, nil
+}
+
+// isMoveCleanup returns whether a tombstone is the one left behind by moving an object to a storage policy, which is
+// timestamped just after the moved copy, rather than a delete that should be carried over.
+func (r *Reconciler) isMoveCleanup(policy int, account, container, obj, timestamp string) (bool, error) {
+	statuses, headers, err := r.objectRequest("HEAD", policy, account, container, obj, http.Header{}, nil)
+	if err != nil {
+		return false, err
+	}
+	for i, status := range statuses {
+		if status/100 != 2 {
+			continue
+		}
+		if moved, err := offsetTimestamp(headers[i].Get("X-Timestamp")); err == nil && moved == timestamp {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// responded counts the responses that show a request was handled: successes, conflicts with newer data, and not found.
+func responded(statuses []int) int {
+	count := 0
+	for _, status := range statuses {
+		if status/100 == 2 || status == http.StatusConflict || status == http.StatusNotFound {
+			count++
+		}
+	}
+	return count
+}
+
+// reconcileEntry handles a misplaced objects queue entry, returning true if it's done with.
+func (r *Reconciler) reconcileEntry(record *ObjectRecord) (bool, error) {
+	policy, account, container, obj, err := parseMisplacedEntry(record.Name)
+	if err != nil {
+		// there's nothing to be done with a bad entry but drop it.
+		return true, err
+	}
+	correct, err := r.containerPolicy(account, container)
+	if err != nil {
+		return false, err
+	}
+	if correct == policy {
+		return true, nil
+	}
+	moved, err := r.moveObject(policy, correct, account, container, obj, record.CreatedAt, record.ContentType == "application/x-delete")
+	if moved {
+		r.logger.Info("Moved misplaced object.",
+			zap.String("account", account),
+			zap.String("container", container),
+			zap.String("object", obj),
+			zap.Int("from", policy),
+			zap.Int("to", correct))
+	}
+	return moved, err
+}
+
+// isFirstPrimary returns whether the device is the first primary node for the container database's partition.
+func (r *Reconciler) isFirstPrimary(dev *ring.Device, dbFile string) (bool, error) {
+	parts := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dbFile))))
+	part, err := strconv.ParseUint(parts, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("Bad partition: %s", parts)
+	}
+	nodes := r.Ring.GetNodes(part)
+	return len(nodes) > 0 && nodes[0].Id == dev.Id, nil
+}
+
+// reconcileDatabase works through the entries of a misplaced objects queue container, if this is its first primary.
+func (r *Reconciler) reconcileDatabase(dev *ring.Device, dbFile string) error {
+	if first, err := r.isFirstPrimary(dev, dbFile); err != nil || !first {
+		return err
+	}
+	c, err := r.engine.OpenFile(dbFile)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	if info.Account != MisplacedObjectsAccount {
+		return nil
+	}
+	point := int64(-1)
+	for {
+		records, err := c.ItemsSince(point, 1000)
+		if err != nil || len(records) == 0 {
+			return err
+		}
+		point = records[len(records)-1].Rowid
+		for _, record := range records {
+			if record.Deleted == 1 {
+				continue
+			}
+			done, err := r.reconcileEntry(record)
+			if err != nil {
+				r.logger.Error("Error reconciling misplaced object.", zap.String("entry", record.Name), zap.Error(err))
+			}
+			if !done {
+				continue
+			}
+			timestamp, err := offsetTimestamp(record.CreatedAt)
+			if err != nil {
+				return err
+			}
+			if err := c.DeleteObject(record.Name, timestamp, record.StoragePolicyIndex); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Reconciler) reconcileDevice(dev *ring.Device) {
+	devicePath := filepath.Join(r.deviceRoot, dev.Device)
+	if mount, err := fs.IsMount(devicePath); r.checkMounts && (err != nil || !mount) {
+		r.logger.Error("Device not mounted.", zap.String("devicePath", devicePath))
+		return
+	}
+	results := make(chan string, 100)
+	go findContainerDbs(r.logger, devicePath, r.cancel, results)
+	for dbFile := range results {
+		if err := r.reconcileDatabase(dev, dbFile); err != nil {
+			r.logger.Error("Error reconciling database.", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+	}
+}
+
+// Run runs a pass of the reconciler once.
+func (r *Reconciler) Run() {
+	devices, err := r.Ring.LocalDevices(r.serverPort)
+	if err != nil {
+		r.logger.Error("Error getting local devices from ring.", zap.Error(err))
+		return
+	}
+	start := time.Now()
+	for _, dev := range devices {
+		r.reconcileDevice(dev)
+	}
+	r.logger.Info("Reconciler pass completed.", zap.Float64("seconds", time.Since(start).Seconds()))
+}
+
+// RunForever runs the reconciler in a forever-loop.
+func (r *Reconciler) RunForever() {
+	for {
+		r.Run()
+		time.Sleep(r.interval)
+	}
+}
+
+// GetReconciler uses the config settings and command-line flags to configure and return a reconciler daemon struct.
+func GetReconciler(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv.LowLevelLogger, error) {
+	if !serverconf.HasSection("container-reconciler") {
+		return nil, nil, fmt.Errorf("Unable to find container-reconciler config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	containerRing, err := GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading container ring")
+	}
+	deviceRoot := serverconf.GetDefault("container-reconciler", "devices", "/srv/node")
+	engine, err := getContainerEngine(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectRings := map[int]ring.Ring{}
+	for _, policy := range conf.LoadPolicies() {
+		if objectRings[policy.Index], err = GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index); err != nil {
+			return nil, nil, fmt.Errorf("Error loading object ring for policy %d", policy.Index)
+		}
+	}
+	logLevelString := serverconf.GetDefault("container-reconciler", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger("container-reconciler", &logLevel, flags); err != nil {
+		return nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	return &Reconciler{
+		checkMounts: serverconf.GetBool("container-reconciler", "mount_check", true),
+		deviceRoot:  deviceRoot,
+		serverPort:  int(serverconf.GetInt("container-reconciler", "bind_port", 6000)),
+		interval:    time.Duration(serverconf.GetInt("container-reconciler", "interval", 30)) * time.Second,
+		logger:      logger,
+		Ring:        containerRing,
+		objectRings: objectRings,
+		engine:      engine,
+		cancel:      make(chan struct{}),
+		client: &http.Client{
+			Timeout:   time.Minute * 15,
+			Transport: &http.Transport{Dial: (&net.Dialer{Timeout: time.Second}).Dial},
+		},
+	}, logger, nil
+}
@@ -0,0 +1,178 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+)
+
+func TestLocalPolicyWins(t *testing.T) {
+	live := &ContainerInfo{PutTimestamp: "0000000002.00000", DeleteTimestamp: "0", StatusChangedAt: "0000000002.00000"}
+	older := &ContainerInfo{PutTimestamp: "0000000001.00000", DeleteTimestamp: "0", StatusChangedAt: "0000000001.00000"}
+	deleted := &ContainerInfo{PutTimestamp: "0000000001.00000", DeleteTimestamp: "0000000003.00000",
+		StatusChangedAt: "0000000003.00000"}
+	recreated := &ContainerInfo{PutTimestamp: "0000000004.00000", DeleteTimestamp: "0000000003.00000",
+		StatusChangedAt: "0000000004.00000"}
+	laterRecreated := &ContainerInfo{PutTimestamp: "0000000006.00000", DeleteTimestamp: "0000000005.00000",
+		StatusChangedAt: "0000000006.00000"}
+	// the original creation wins between containers that were never deleted.
+	require.True(t, localPolicyWins(older, live))
+	require.False(t, localPolicyWins(live, older))
+	// a live container beats a deleted one.
+	require.True(t, localPolicyWins(live, deleted))
+	require.False(t, localPolicyWins(deleted, live))
+	// a recreated container beats one that never was deleted.
+	require.True(t, localPolicyWins(recreated, older))
+	require.False(t, localPolicyWins(older, recreated))
+	// the latest recreation wins.
+	require.True(t, localPolicyWins(laterRecreated, recreated))
+	require.False(t, localPolicyWins(recreated, laterRecreated))
+}
+
+func TestMisplacedEntry(t *testing.T) {
+	entry := misplacedEntry(2, "a", "c", "o/with/slashes")
+	require.Equal(t, "2:/a/c/o/with/slashes", entry)
+	policy, account, container, obj, err := parseMisplacedEntry(entry)
+	require.Nil(t, err)
+	require.Equal(t, 2, policy)
+	require.Equal(t, "a", account)
+	require.Equal(t, "c", container)
+	require.Equal(t, "o/with/slashes", obj)
+	for _, bad := range []string{"", "2", "x:/a/c/o", "2:/a/c", "2:/a//o", "2:/a/c/"} {
+		_, _, _, _, err := parseMisplacedEntry(bad)
+		require.NotNil(t, err, bad)
+	}
+}
+
+func TestMisplacedContainer(t *testing.T) {
+	queue, err := misplacedContainer("1500003599.12345")
+	require.Nil(t, err)
+	require.Equal(t, "1500001200", queue)
+	queue, err = misplacedContainer("1500004800.00000_0000000000000001")
+	require.Nil(t, err)
+	require.Equal(t, "1500004800", queue)
+	_, err = misplacedContainer("garbage")
+	require.NotNil(t, err)
+}
+
+func TestOffsetTimestamp(t *testing.T) {
+	ts, err := offsetTimestamp("1500000000.00000")
+	require.Nil(t, err)
+	require.Equal(t, "1500000000.00000_0000000000000001", ts)
+	require.True(t, ts > "1500000000.00000")
+	ts, err = offsetTimestamp(ts)
+	require.Nil(t, err)
+	require.Equal(t, "1500000000.00000_0000000000000002", ts)
+	_, err = offsetTimestamp("1500000000.00000_zz")
+	require.NotNil(t, err)
+}
+
+func testReconcilerRing(t *testing.T, handler http.Handler) (*test.FakeRing, func()) {
+	ts := httptest.NewServer(handler)
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+	host, portStr, err := net.SplitHostPort(u.Host)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	fakeRing := &test.FakeRing{}
+	for i := 0; i < 3; i++ {
+		fakeRing.MockDevices = append(fakeRing.MockDevices, &ring.Device{Id: i, Device: "sd" + string('a'+rune(i)),
+			Ip: host, Port: port, ReplicationIp: host, ReplicationPort: port})
+	}
+	return fakeRing, ts.Close
+}
+
+func TestEnqueueMisplacedObject(t *testing.T) {
+	var lock sync.Mutex
+	paths := map[string]http.Header{}
+	fakeRing, cleanup := testReconcilerRing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		require.Equal(t, "PUT", r.Method)
+		paths[r.URL.Path] = r.Header
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer cleanup()
+	record := &ObjectRecord{Name: "o", CreatedAt: "1500003599.12345", Deleted: 1, StoragePolicyIndex: 1}
+	require.Nil(t, enqueueMisplacedObject(http.DefaultClient, fakeRing, "a", "c", record))
+	require.Equal(t, 3, len(paths))
+	for _, dev := range []string{"sda", "sdb", "sdc"} {
+		headers, ok := paths["/"+dev+"/0/.misplaced_objects/1500001200/1:/a/c/o"]
+		require.True(t, ok, dev)
+		require.Equal(t, "1500003599.12345", headers.Get("X-Timestamp"))
+		require.Equal(t, "application/x-delete", headers.Get("X-Content-Type"))
+	}
+}
+
+func TestEnqueueMisplacedObjectNoQuorum(t *testing.T) {
+	var lock sync.Mutex
+	calls := 0
+	fakeRing, cleanup := testReconcilerRing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		if calls > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer cleanup()
+	record := &ObjectRecord{Name: "o", CreatedAt: "1500003599.12345", StoragePolicyIndex: 1}
+	require.NotNil(t, enqueueMisplacedObject(http.DefaultClient, fakeRing, "a", "c", record))
+}
+
+func TestSetStoragePolicyIndex(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("1000000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("o1", "1000000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("o2", "1000000002.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	records, err := db.MisplacedSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "o2", records[0].Name)
+
+	require.Nil(t, db.SetReconcilerPoint(records[0].Rowid))
+	point, err := db.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, records[0].Rowid, point)
+
+	require.Nil(t, db.SetStoragePolicyIndex(1, "1000000003.00000"))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.Equal(t, 1, info.StoragePolicyIndex)
+	require.Equal(t, "1000000003.00000", info.StatusChangedAt)
+	point, err = db.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), point)
+	records, err = db.MisplacedSince(point, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(records))
+	require.Equal(t, "o1", records[0].Name)
+	require.Equal(t, 0, records[0].StoragePolicyIndex)
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -40,7 +41,9 @@ import (
 
 var (
 	errDeviceNotMounted = errors.New("Remove drive was unmounted")
-	deviceLockupTimeout = time.Hour
+	// errStreamUnsupported means the remote server rejected a stream_items request, probably because it predates it.
+	errStreamUnsupported = errors.New("Remote doesn't support streaming items")
+	deviceLockupTimeout  = time.Hour
 	// GetRing is a local pointer to the hummingbird function, for overriding in tests.
 	GetRing = ring.GetRing
 )
@@ -53,6 +56,7 @@ type Replicator struct {
 	logger         srv.LowLevelLogger
 	serverPort     int
 	Ring           ring.Ring
+	engine         ContainerEngine
 	perUsync       int64
 	maxUsyncs      int
 	concurrencySem chan struct{}
@@ -62,6 +66,8 @@ type Replicator struct {
 	client         *http.Client
 	runningDevices map[string]*replicationDevice
 	reclaimAge     int64
+	// bandwidth caps the bytes per second sent to other servers, shared by all of the replicator's devices.
+	bandwidth *common.BandwidthLimiter
 }
 
 type statUpdate struct {
@@ -75,6 +81,7 @@ type replicationDevice struct {
 		sendReplicationMessage(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 		sync(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error)
 		rsync(dev *ring.Device, c ReplicableContainer, part uint64, op string) error
+		streamItems(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
 		usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
 		chooseReplicationStrategy(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string
 		replicateDatabaseToDevice(dev *ring.Device, c ReplicableContainer, part uint64) error
@@ -96,6 +103,7 @@ func (rd *replicationDevice) sendReplicationMessage(dev *ring.Device, part uint6
 	if err != nil {
 		return 0, nil, err
 	}
+	rd.r.bandwidth.Wait(len(body))
 	req, err := http.NewRequest("REPLICATE", fmt.Sprintf("http://%s:%d/%s/%d/%s",
 		dev.ReplicationIp, dev.ReplicationPort, dev.Device, part, ringHash), bytes.NewBuffer(body))
 	if err != nil {
@@ -140,7 +148,7 @@ func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableContainer, part
 		return fmt.Errorf("Error opening databae: %v", err)
 	}
 	defer release()
-	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/tmp/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device, tmpFilename), fp)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/%s/tmp/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device, tmpFilename), rd.r.bandwidth.Reader(fp))
 	if err != nil {
 		return fmt.Errorf("creating request: %v", err)
 	}
@@ -160,6 +168,73 @@ func (rd *replicationDevice) rsync(dev *ring.Device, c ReplicableContainer, part
 	return nil
 }
 
+// streamItems sends the remote every object record after point in a single stream_items request, so a remote that is
+// far behind is caught up without sending it the whole database. It returns errStreamUnsupported if the remote
+// doesn't know the stream_items op.
+func (rd *replicationDevice) streamItems(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+	syncTable, err := c.SyncTable()
+	if err != nil {
+		return fmt.Errorf("Error getting sync table: %v", err)
+	}
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeItemStream(pw, c, localID, point, int(rd.r.perUsync)))
+	}()
+	req, err := http.NewRequest("REPLICATE", fmt.Sprintf("http://%s:%d/%s/%d/%s",
+		dev.ReplicationIp, dev.ReplicationPort, dev.Device, part, c.RingHash()), rd.r.bandwidth.Reader(pr))
+	if err != nil {
+		pr.Close()
+		<-done
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.Cancel = rd.cancel
+	resp, err := rd.r.client.Do(req)
+	// the writer may still be blocked on the pipe if the remote stopped reading early.
+	pr.Close()
+	<-done
+	if err != nil {
+		return fmt.Errorf("streaming items to %s/%s: %v", dev.ReplicationIp, dev.Device, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return errStreamUnsupported
+	} else if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad status code %d streaming items to %s/%s", resp.StatusCode, dev.ReplicationIp, dev.Device)
+	}
+	status, _, err := rd.i.sendReplicationMessage(dev, part, c.RingHash(), "merge_syncs", syncTable)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("Invalid status code from merge_syncs: %d", status)
+	}
+	return nil
+}
+
+// writeItemStream writes a stream_items request body: the replication message, then pages of object records after
+// point until there are none left.
+func writeItemStream(w io.Writer, c ReplicableContainer, localID string, point int64, pageSize int) error {
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode([]interface{}{"stream_items", localID}); err != nil {
+		return err
+	}
+	for {
+		objects, err := c.ItemsSince(point, pageSize)
+		if err != nil {
+			return fmt.Errorf("getting object records from %s: %v", c.RingHash(), err)
+		}
+		if len(objects) == 0 {
+			return nil
+		}
+		if err := encoder.Encode(objects); err != nil {
+			return err
+		}
+		point = objects[len(objects)-1].Rowid
+	}
+}
+
 func (rd *replicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
 	objects, err := c.ItemsSince(point, int(rd.r.perUsync))
 	if err != nil {
@@ -222,6 +297,23 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 	if err != nil {
 		return err
 	}
+	if remoteInfo != nil && remoteInfo.StoragePolicyIndex != info.StoragePolicyIndex {
+		// the replicas disagree on the container's storage policy; the losing replica switches policies and queues its
+		// object records in the old one for the reconciler.
+		rd.i.incrementStat("policy_conflict")
+		if rc, ok := c.(ReconcilableContainer); ok && !localPolicyWins(info, remoteInfo) {
+			rd.r.logger.Info("Changing storage policy to match replica.",
+				zap.String("RingHash", c.RingHash()),
+				zap.Int("from", info.StoragePolicyIndex),
+				zap.Int("to", remoteInfo.StoragePolicyIndex))
+			if err := rc.SetStoragePolicyIndex(remoteInfo.StoragePolicyIndex, remoteInfo.StatusChangedAt); err != nil {
+				return fmt.Errorf("setting storage policy of %s: %v", c.RingHash(), err)
+			}
+			if info, err = c.GetInfo(); err != nil {
+				return fmt.Errorf("getting local info from %s: %v", c.RingHash(), err)
+			}
+		}
+	}
 	strategy := rd.i.chooseReplicationStrategy(info, remoteInfo, rd.r.perUsync*3)
 	rd.i.incrementStat(strategy)
 	switch strategy {
@@ -229,13 +321,26 @@ func (rd *replicationDevice) replicateDatabaseToDevice(dev *ring.Device, c Repli
 		rd.r.logger.Debug("Not replicating anything.",
 			zap.String("strategy", strategy),
 			zap.String("RingHash", c.RingHash()))
-	case "complete_rsync", "rsync_then_merge":
+	case "complete_rsync":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
 			zap.String("ReplicationIp", dev.ReplicationIp),
 			zap.String("Device", dev.Device),
 			zap.String("strategy", strategy))
 		return rd.i.rsync(dev, c, part, strategy)
+	case "rsync_then_merge":
+		rd.r.logger.Debug("Replicating ringhash",
+			zap.String("RingHash", c.RingHash()),
+			zap.String("ReplicationIp", dev.ReplicationIp),
+			zap.String("Device", dev.Device),
+			zap.String("strategy", strategy))
+		// the remote already has most of the rows, so only send it the ones it's missing.
+		err := rd.i.streamItems(dev, c, part, info.ID, remoteInfo.Point)
+		if err == errStreamUnsupported {
+			rd.i.incrementStat("stream_fallback")
+			return rd.i.rsync(dev, c, part, strategy)
+		}
+		return err
 	case "diff":
 		rd.r.logger.Debug("Replicating ringhash",
 			zap.String("RingHash", c.RingHash()),
@@ -256,7 +361,7 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 	}
 	devices, handoff := rd.r.Ring.GetJobNodes(part, rd.dev.Id)
 	moreNodes := rd.r.Ring.GetMoreNodes(part)
-	c, err := sqliteOpenContainer(dbFile)
+	c, err := rd.r.engine.OpenFile(dbFile)
 	if err != nil {
 		return err
 	}
@@ -294,6 +399,9 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 			}
 		}
 	}
+	if err := rd.enqueueMisplaced(c); err != nil {
+		return fmt.Errorf("queueing misplaced objects: %v", err)
+	}
 	if handoff && successes == len(devices) {
 		rd.i.incrementStat("remove")
 		return os.RemoveAll(filepath.Dir(dbFile))
@@ -301,12 +409,60 @@ func (rd *replicationDevice) replicateDatabase(dbFile string) error {
 	return nil
 }
 
+// enqueueMisplaced queues the container's object records that aren't in its storage policy for the reconciler.
+func (rd *replicationDevice) enqueueMisplaced(c ReplicableContainer) error {
+	rc, ok := c.(ReconcilableContainer)
+	if !ok {
+		return nil
+	}
+	info, err := c.GetInfo()
+	if err != nil || info.Account == MisplacedObjectsAccount {
+		return err
+	}
+	point, err := rc.ReconcilerPoint()
+	if err != nil {
+		return err
+	}
+	for {
+		records, err := rc.MisplacedSince(point, int(rd.r.perUsync))
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			// nothing up to the rows there were when we started is misplaced, so later passes needn't scan them again.
+			if point < info.MaxRow {
+				return rc.SetReconcilerPoint(info.MaxRow)
+			}
+			return nil
+		}
+		for _, record := range records {
+			if record.StoragePolicyIndex == migrationTarget(info) {
+				// the container migrator is moving the container's objects to this policy.
+				continue
+			}
+			if err := enqueueMisplacedObject(rd.r.client, rd.r.Ring, info.Account, info.Container, record); err != nil {
+				return err
+			}
+			rd.i.incrementStat("misplaced")
+		}
+		point = records[len(records)-1].Rowid
+		if err := rc.SetReconcilerPoint(point); err != nil {
+			return err
+		}
+	}
+}
+
 func (rd *replicationDevice) findContainerDbs(devicePath string, results chan string) {
+	findContainerDbs(rd.r.logger, devicePath, rd.cancel, results)
+}
+
+// findContainerDbs sends the paths of the container databases on a device to results, closing it when done.
+func findContainerDbs(logger srv.LowLevelLogger, devicePath string, cancel chan struct{}, results chan string) {
 	defer close(results)
 	containersDir := filepath.Join(devicePath, "containers")
 	partitions, err := filepath.Glob(filepath.Join(containersDir, "[0-9]*"))
 	if err != nil {
-		rd.r.logger.Error("Error getting partitions.",
+		logger.Error("Error getting partitions.",
 			zap.String("containersDir", containersDir),
 			zap.Error(err))
 		return
@@ -314,7 +470,7 @@ func (rd *replicationDevice) findContainerDbs(devicePath string, results chan st
 	for _, part := range partitions {
 		suffixes, err := filepath.Glob(filepath.Join(part, "[a-f0-9][a-f0-9][a-f0-9]"))
 		if err != nil {
-			rd.r.logger.Error("Error getting suffixes.",
+			logger.Error("Error getting suffixes.",
 				zap.String("part", part),
 				zap.Error(err))
 			return
@@ -322,7 +478,7 @@ func (rd *replicationDevice) findContainerDbs(devicePath string, results chan st
 		for _, suff := range suffixes {
 			hashes, err := filepath.Glob(filepath.Join(suff, "????????????????????????????????"))
 			if err != nil {
-				rd.r.logger.Error("Error getting hashes",
+				logger.Error("Error getting hashes",
 					zap.String("suff", suff),
 					zap.Error(err))
 				return
@@ -332,7 +488,7 @@ func (rd *replicationDevice) findContainerDbs(devicePath string, results chan st
 				if fs.Exists(dbFile) {
 					select {
 					case results <- dbFile:
-					case <-rd.cancel:
+					case <-cancel:
 						return
 					}
 				}
@@ -399,29 +555,35 @@ func newReplicationDevice(dev *ring.Device, r *Replicator) *replicationDevice {
 		deviceStarted: time.Now(),
 		dev:           dev,
 		stats: map[string]int64{
-			"attempted":             0,
-			"success":               0,
-			"failure":               0,
-			"no_change":             0,
-			"hashmatch":             0,
-			"rsync":                 0,
-			"diff":                  0,
-			"remove":                0,
-			"empty":                 0,
-			"remote_merge":          0,
-			"diff_capped":           0,
-			"lifetime_attempted":    0,
-			"lifetime_success":      0,
-			"lifetime_failure":      0,
-			"lifetime_no_change":    0,
-			"lifetime_hashmatch":    0,
-			"lifetime_rsync":        0,
-			"lifetime_diff":         0,
-			"lifetime_remove":       0,
-			"lifetime_empty":        0,
-			"lifetime_remote_merge": 0,
-			"lifetime_diff_capped":  0,
-			"lifetime_passes":       0,
+			"attempted":                0,
+			"success":                  0,
+			"failure":                  0,
+			"no_change":                0,
+			"hashmatch":                0,
+			"rsync":                    0,
+			"diff":                     0,
+			"remove":                   0,
+			"empty":                    0,
+			"remote_merge":             0,
+			"diff_capped":              0,
+			"policy_conflict":          0,
+			"misplaced":                0,
+			"stream_fallback":          0,
+			"lifetime_attempted":       0,
+			"lifetime_success":         0,
+			"lifetime_failure":         0,
+			"lifetime_no_change":       0,
+			"lifetime_hashmatch":       0,
+			"lifetime_rsync":           0,
+			"lifetime_diff":            0,
+			"lifetime_remove":          0,
+			"lifetime_empty":           0,
+			"lifetime_remote_merge":    0,
+			"lifetime_diff_capped":     0,
+			"lifetime_policy_conflict": 0,
+			"lifetime_misplaced":       0,
+			"lifetime_stream_fallback": 0,
+			"lifetime_passes":          0,
 		},
 	}
 	rd.i = rd
@@ -577,6 +739,11 @@ func GetReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv
 		return nil, nil, fmt.Errorf("Error loading container ring")
 	}
 	concurrency := int(serverconf.GetInt("container-replicator", "concurrency", 4))
+	deviceRoot := serverconf.GetDefault("container-replicator", "devices", "/srv/node")
+	engine, err := getContainerEngine(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	logLevelString := serverconf.GetDefault("container-replicator", "log_level", "INFO")
 	logLevel := zap.NewAtomicLevel()
@@ -595,12 +762,14 @@ func GetReplicator(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv
 		startRun:       make(chan string),
 		reconCachePath: serverconf.GetDefault("container-replicator", "recon_cache_path", "/var/cache/swift"),
 		checkMounts:    serverconf.GetBool("container-replicator", "mount_check", true),
-		deviceRoot:     serverconf.GetDefault("container-replicator", "devices", "/srv/node"),
+		deviceRoot:     deviceRoot,
 		serverPort:     int(serverconf.GetInt("container-replicator", "bind_port", 6000)),
 		reclaimAge:     serverconf.GetInt("container-replicator", "reclaim_age", 604800),
+		bandwidth:      common.NewBandwidthLimiter(serverconf.GetInt("container-replicator", "max_bandwidth", 0)),
 		logger:         logger,
 		concurrencySem: make(chan struct{}, concurrency),
 		Ring:           ring,
+		engine:         engine,
 		client: &http.Client{
 			Timeout:   time.Minute * 15,
 			Transport: &http.Transport{Dial: (&net.Dialer{Timeout: time.Second}).Dial},
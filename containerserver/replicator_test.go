@@ -28,6 +28,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -46,6 +47,7 @@ type patchableReplicationDevice struct {
 	_sendReplicationMessage    func(dev *ring.Device, part uint64, ringHash string, args ...interface{}) (int, []byte, error)
 	_sync                      func(dev *ring.Device, part uint64, ringHash string, info *ContainerInfo) (*ContainerInfo, error)
 	_rsync                     func(dev *ring.Device, c ReplicableContainer, part uint64, op string) error
+	_streamItems               func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
 	_usync                     func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error
 	_chooseReplicationStrategy func(localInfo, remoteInfo *ContainerInfo, usyncThreshold int64) string
 	_replicateDatabaseToDevice func(dev *ring.Device, c ReplicableContainer, part uint64) error
@@ -72,6 +74,12 @@ func (d *patchableReplicationDevice) rsync(dev *ring.Device, c ReplicableContain
 	}
 	return d.rd.rsync(dev, c, part, op)
 }
+func (d *patchableReplicationDevice) streamItems(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+	if d._streamItems != nil {
+		return d._streamItems(dev, c, part, localID, point)
+	}
+	return d.rd.streamItems(dev, c, part, localID, point)
+}
 func (d *patchableReplicationDevice) usync(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
 	if d._usync != nil {
 		return d._usync(dev, c, part, localID, point)
@@ -124,6 +132,9 @@ func newTestReplicationDevice(dev *ring.Device, r *Replicator) *patchableReplica
 	if r.Ring == nil {
 		r.Ring = &test.FakeRing{}
 	}
+	if r.engine == nil {
+		r.engine = newLRUEngine(sqliteBackend, r.deviceRoot, "", "", 32)
+	}
 	if r.concurrencySem == nil {
 		r.concurrencySem = make(chan struct{}, 1)
 	}
@@ -272,6 +283,61 @@ func TestReplicatorUsync(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestReplicatorStreamItems(t *testing.T) {
+	var names []string
+	var ops []string
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var args []interface{}
+		require.Nil(t, decoder.Decode(&args))
+		ops = append(ops, args[0].(string))
+		if args[0] == "stream_items" {
+			require.Equal(t, "12345", args[1])
+			for {
+				var records []*ObjectRecord
+				err := decoder.Decode(&records)
+				if err == io.EOF {
+					break
+				}
+				require.Nil(t, err)
+				require.Equal(t, 1, len(records))
+				names = append(names, records[0].Name)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1, maxUsyncs: 1})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c", "d"}))
+	items, err := c.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(items))
+	var expected []string
+	for _, item := range items[1:] {
+		expected = append(expected, item.Name)
+	}
+	// the stream isn't capped like usync, and starts after the remote's point.
+	require.Nil(t, rd.streamItems(dev, c, 1, "12345", items[0].Rowid))
+	require.Equal(t, expected, names)
+	require.Equal(t, []string{"stream_items", "merge_syncs"}, ops)
+}
+
+func TestReplicatorStreamItemsUnsupported(t *testing.T) {
+	dev, cleanup1 := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 1})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
+	require.Equal(t, errStreamUnsupported, rd.streamItems(dev, c, 1, "12345", -1))
+}
+
 func TestReplicatorChooseReplicationStrategy(t *testing.T) {
 	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient})
 	require.Equal(t, "complete_rsync", rd.chooseReplicationStrategy(&ContainerInfo{}, nil, 100))
@@ -326,6 +392,21 @@ func TestReplicatorReplicateDatabaseToDevice(t *testing.T) {
 	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
 	require.False(t, usyncCalled)
 	require.False(t, rsyncCalled)
+
+	// rsync_then_merge streams the missing rows, falling back to rsync for remotes that can't take a stream.
+	streamErr := error(nil)
+	streamCalled := false
+	rd._streamItems = func(dev *ring.Device, c ReplicableContainer, part uint64, localID string, point int64) error {
+		streamCalled = true
+		return streamErr
+	}
+	currentMethod = "rsync_then_merge"
+	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
+	require.True(t, streamCalled)
+	require.False(t, rsyncCalled)
+	streamErr = errStreamUnsupported
+	require.Nil(t, rd.replicateDatabaseToDevice(&ring.Device{}, c, 1))
+	require.True(t, rsyncCalled)
 }
 
 func TestFindContainers(t *testing.T) {
@@ -725,3 +806,38 @@ func TestSomeDatabaseFailures(t *testing.T) {
 	require.NotNil(t, rd.rsync(&ring.Device{}, fakeDatabase{}, 1, "complete_rsync"))
 	require.NotNil(t, rd.usync(&ring.Device{}, fakeDatabase{}, 1, "123", 3))
 }
+
+func TestReplicatorEnqueueMisplaced(t *testing.T) {
+	var lock sync.Mutex
+	queued := 0
+	fakeRing, cleanup1 := testReconcilerRing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		queued++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer cleanup1()
+	rd := newTestReplicationDevice(&ring.Device{}, &Replicator{client: http.DefaultClient, perUsync: 10, Ring: fakeRing})
+	c, _, cleanup2, err := createTestDatabase("1410586890.28563")
+	require.Nil(t, err)
+	defer cleanup2()
+	// a clean container's scan moves the reconciler point up to its last row, so it isn't scanned again.
+	require.Nil(t, mergeItemsByName(c, []string{"a", "b", "c"}))
+	require.Nil(t, rd.rd.enqueueMisplaced(c))
+	require.Equal(t, 0, queued)
+	info, err := c.GetInfo()
+	require.Nil(t, err)
+	point, err := c.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, info.MaxRow, point)
+
+	// rows added since are still found.
+	require.Nil(t, c.PutObject("d", "1410586891.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 1, nil))
+	require.Nil(t, rd.rd.enqueueMisplaced(c))
+	require.Equal(t, 3, queued)
+	info, err = c.GetInfo()
+	require.Nil(t, err)
+	point, err = c.ReconcilerPoint()
+	require.Nil(t, err)
+	require.Equal(t, info.MaxRow, point)
+}
@@ -128,7 +128,8 @@ const (
 				content_type TEXT,
 				etag TEXT,
 				deleted INTEGER DEFAULT 0,
-				storage_policy_index INTEGER DEFAULT 0
+				storage_policy_index INTEGER DEFAULT 0,
+				metadata TEXT DEFAULT ''
 			);
 		CREATE INDEX ix_object_deleted_name ON object (deleted, name);
 		CREATE TRIGGER object_update BEFORE UPDATE ON object
@@ -172,6 +173,16 @@ const (
 				WHERE ROWID = new.ROWID;
 			END;`
 
+	shardRangeTableScript = `
+		CREATE TABLE shard_range (
+				name TEXT PRIMARY KEY,
+				lower TEXT,
+				upper TEXT,
+				object_count INTEGER DEFAULT 0,
+				bytes_used INTEGER DEFAULT 0,
+				timestamp TEXT DEFAULT '0'
+			);`
+
 	policyMigrateColumns = `account, container, created_at, put_timestamp, delete_timestamp, reported_put_timestamp,
 		reported_object_count, reported_bytes_used, hash, id, status, status_changed_at, metadata,
 		x_container_sync_point1, x_container_sync_point2`
@@ -193,6 +204,8 @@ const (
 
 	metadataMigrateScript = "ALTER TABLE container_stat ADD COLUMN metadata DEFAULT '{}';"
 
+	objectMetadataMigrateScript = "ALTER TABLE object ADD COLUMN metadata TEXT DEFAULT '';"
+
 	pragmaScript = `
 		PRAGMA synchronous = NORMAL;
 		PRAGMA cache_size = -4096;
@@ -206,6 +219,8 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	hasSyncPoints := false
 	hasMetadata := false
 	hasPolicyStat := false
+	hasShardRange := false
+	hasObjectMetadata := false
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -214,7 +229,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 	defer tx.Rollback()
 
 	// We just pull the schema out of sqlite_master and look at it to get the current state of the database.
-	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat')")
+	rows, err := tx.Query("SELECT name, sql FROM sqlite_master WHERE name in ('policy_stat', 'ix_object_deleted_name', 'container_stat', 'shard_range', 'object')")
 	if err != nil {
 		return false, err
 	}
@@ -227,6 +242,10 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			hasPolicyStat = true
 		} else if name == "ix_object_deleted_name" {
 			hasDeletedNameIndex = true
+		} else if name == "shard_range" {
+			hasShardRange = true
+		} else if name == "object" {
+			hasObjectMetadata = strings.Contains(sql, "metadata")
 		} else if name == "container_stat" {
 			hasSyncPoints = strings.Contains(sql, "x_container_sync_point1")
 			hasMetadata = strings.Contains(sql, "metadata")
@@ -239,7 +258,7 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 		return hasDeletedNameIndex, err
 	}
 
-	if hasSyncPoints && hasMetadata && hasPolicyStat {
+	if hasSyncPoints && hasMetadata && hasPolicyStat && hasShardRange && hasObjectMetadata {
 		return hasDeletedNameIndex, nil
 	}
 
@@ -258,5 +277,15 @@ func schemaMigrate(db *sql.DB) (bool, error) {
 			return hasDeletedNameIndex, fmt.Errorf("Performing policy migration: %v", err)
 		}
 	}
+	if !hasShardRange {
+		if _, err = tx.Exec(shardRangeTableScript); err != nil {
+			return hasDeletedNameIndex, fmt.Errorf("Adding shard_range table: %v", err)
+		}
+	}
+	if !hasObjectMetadata {
+		if _, err = tx.Exec(objectMetadataMigrateScript); err != nil {
+			return hasDeletedNameIndex, fmt.Errorf("Adding object metadata column: %v", err)
+		}
+	}
 	return hasDeletedNameIndex, tx.Commit()
 }
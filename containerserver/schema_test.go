@@ -169,6 +169,6 @@ func TestMigrateCruftyDatabase(t *testing.T) {
 			require.True(t, columnNames[column])
 		}
 	}
-	ensureColumnsExist("object", []string{"storage_policy_index"})
+	ensureColumnsExist("object", []string{"storage_policy_index", "metadata"})
 	ensureColumnsExist("container_stat", []string{"metadata", "x_container_sync_point1", "x_container_sync_point2"})
 }
@@ -17,12 +17,12 @@ package containerserver
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	_ "net/http/pprof" // install pprof http handlers
+	"net/url"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -32,7 +32,10 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 )
@@ -61,6 +64,10 @@ type ContainerServer struct {
 	syncRealms       conf.SyncRealmList
 	defaultPolicy    int
 	policyList       conf.PolicyList
+	metrics          *metrics.Registry
+	requestDurations *metrics.Histogram
+	tracer           *tracing.Tracer
+	containerRing    ring.Ring
 }
 
 var saveHeaders = map[string]bool{
@@ -88,6 +95,7 @@ func formatTimestamp(ts string) string {
 }
 
 func (server *ContainerServer) Finalize() {
+	server.tracer.Close()
 }
 
 // ContainerGetHandler handles GET and HEAD requests for a container.
@@ -142,6 +150,18 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 	for key, value := range metadata {
 		headers.Set(key, value)
 	}
+	ranges, err := shardRanges(db)
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		srv.StandardResponse(writer, http.StatusInternalServerError)
+		return
+	}
+	objectCount, bytesUsed := info.ObjectCount, info.BytesUsed
+	if len(ranges) > 0 {
+		// the objects have moved to the shard containers, so report their totals.
+		headers.Set("X-Backend-Sharded", "true")
+		objectCount, bytesUsed = shardUsage(ranges)
+	}
 	if deleted, err := db.IsDeleted(); err != nil {
 		srv.GetLogger(request).Error("Error calling IsDeleted.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -150,8 +170,8 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		srv.StandardResponse(writer, http.StatusNotFound)
 		return
 	} else {
-		headers.Set("X-Container-Object-Count", strconv.FormatInt(info.ObjectCount, 10))
-		headers.Set("X-Container-Bytes-Used", strconv.FormatInt(info.BytesUsed, 10))
+		headers.Set("X-Container-Object-Count", strconv.FormatInt(objectCount, 10))
+		headers.Set("X-Container-Bytes-Used", strconv.FormatInt(bytesUsed, 10))
 		if ts, err := common.GetEpochFromTimestamp(info.CreatedAt); err == nil {
 			headers.Set("X-Timestamp", ts)
 		}
@@ -164,9 +184,23 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		writer.Write([]byte(""))
 		return
 	}
+	if request.Header.Get("X-Backend-Record-Type") == "shard" {
+		output, err := json.Marshal(ranges)
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+		headers.Set("Content-Type", "application/json; charset=utf-8")
+		headers.Set("Content-Length", strconv.Itoa(len(output)))
+		writer.WriteHeader(200)
+		writer.Write(output)
+		return
+	}
 	limit, _ := strconv.ParseInt(request.FormValue("limit"), 10, 64)
-	if limit <= 0 || limit > 10000 {
-		limit = 10000
+	if maxLimit := srv.ListingLimitMax(request); limit <= 0 {
+		limit = srv.MaxListingLimit
+	} else if limit > maxLimit {
+		limit = maxLimit
 	}
 	marker := request.Form.Get("marker")
 	delimiter := request.Form.Get("delimiter")
@@ -181,65 +215,89 @@ func (server *ContainerServer) ContainerGetHandler(writer http.ResponseWriter, r
 		policyIndex = info.StoragePolicyIndex
 	}
 	reverse := common.LooksTrue(request.Form.Get("reverse"))
-	objects, err := db.ListObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex)
+	filter, err := parseListingFilter(request.Form)
 	if err != nil {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := srv.ListingFormat(request)
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
+		return
+	}
+	listing := srv.NewListingWriter(writer, format, "container", vars["container"], listingEntryName)
+	if target := migrationTarget(info); target >= 0 && request.Header.Get("X-Backend-Storage-Policy-Index") == "" {
+		err = iterMigratingObjects(db, int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex, target,
+			filter, listing.Write)
+	} else {
+		err = db.IterObjects(int(limit), marker, endMarker, prefix, delimiter, path, reverse, policyIndex, filter, listing.Write)
+	}
+	if err == nil {
+		err = listing.Close()
+	}
+	if err != nil && !listing.Started() {
 		srv.GetLogger(request).Error("Unable to list objects.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
-		return
+	} else if err != nil {
+		srv.GetLogger(request).Error("Unable to finish listing objects.", zap.Error(err))
+		// the listing's already been sent as a success, so cut it off rather than let it look complete.
+		panic(http.ErrAbortHandler)
 	}
-	format := request.Form.Get("format")
-	if format == "" { /* TODO: real accept parsing */
-		accept := request.Header.Get("Accept")
-		if strings.Contains(accept, "application/json") {
-			format = "json"
-		} else if strings.Contains(accept, "application/xml") || strings.Contains(accept, "text/xml") {
-			format = "xml"
-		} else {
-			format = "text"
+}
+
+// listingEntryName returns the name of an object listing entry, for text listings.
+func listingEntryName(entry interface{}) string {
+	switch e := entry.(type) {
+	case *ObjectListingRecord:
+		return e.Name
+	case *SubdirListingRecord:
+		return e.Name
+	}
+	return ""
+}
+
+// parseListingFilter returns the filter for a container listing's include, modified_since, content_type, min_bytes
+// and max_bytes query parameters, or nil if it has none of them.
+func parseListingFilter(form url.Values) (*ListingFilter, error) {
+	filter := &ListingFilter{}
+	used := false
+	for _, include := range strings.Split(form.Get("include"), ",") {
+		if strings.TrimSpace(include) == "meta" {
+			filter.IncludeMeta = true
+			used = true
 		}
 	}
-	if format == "text" {
-		response := ""
-		for _, obj := range objects {
-			if or, ok := obj.(*ObjectListingRecord); ok {
-				response += or.Name + "\n"
-			} else if sr, ok := obj.(*SubdirListingRecord); ok {
-				response += sr.Name + "\n"
-			}
-		}
-		if len(response) > 0 {
-			headers.Set("Content-Length", strconv.Itoa(len(response)))
-			writer.WriteHeader(200)
-			writer.Write([]byte(response))
-		} else {
-			headers.Set("Content-Length", "0")
-			writer.WriteHeader(204)
-			writer.Write([]byte(""))
-		}
-	} else if format == "json" {
-		output, err := json.Marshal(objects)
+	if v := form.Get("modified_since"); v != "" {
+		since, err := common.ParseDate(v)
 		if err != nil {
-			srv.StandardResponse(writer, http.StatusInternalServerError)
-			return
+			if since, err = time.ParseInLocation("2006-01-02T15:04:05.999999", v, common.GMT); err != nil {
+				return nil, fmt.Errorf("Invalid modified_since: %q", v)
+			}
 		}
-		headers.Set("Content-Type", "application/json; charset=utf-8")
-		headers.Set("Content-Length", strconv.Itoa(len(output)))
-		writer.WriteHeader(200)
-		writer.Write(output)
-	} else if format == "xml" {
-		type Container struct {
-			XMLName xml.Name `xml:"container"`
-			Name    string   `xml:"name,attr"`
-			Objects []interface{}
+		filter.ModifiedSince = common.CanonicalTimestamp(float64(since.UnixNano()) / 1e9)
+		used = true
+	}
+	if v := form.Get("content_type"); v != "" {
+		filter.ContentType = v
+		used = true
+	}
+	for _, bound := range []struct {
+		name  string
+		value **int64
+	}{{"min_bytes", &filter.MinBytes}, {"max_bytes", &filter.MaxBytes}} {
+		if v := form.Get(bound.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid %s: %q", bound.name, v)
+			}
+			*bound.value = &n
+			used = true
 		}
-		container := &Container{Name: vars["container"], Objects: objects}
-		writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
-		output, _ := xml.Marshal(container)
-		headers.Set("Content-Length", strconv.Itoa(len(output)+39))
-		writer.WriteHeader(200)
-		writer.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"))
-		writer.Write(output)
 	}
+	if !used {
+		return nil, nil
+	}
+	return filter, nil
 }
 
 // ContainerPutHandler handles PUT requests for a container.
@@ -281,7 +339,9 @@ func (server *ContainerServer) ContainerPutHandler(writer http.ResponseWriter, r
 	}
 	defer server.containerEngine.Return(db)
 	if info, err := db.GetInfo(); err == nil {
-		server.accountUpdate(writer, request, vars, info, srv.GetLogger(request))
+		if info, err = usageInfo(db, info); err == nil {
+			server.accountUpdate(writer, request, vars, info, srv.GetLogger(request))
+		}
 	}
 	if created {
 		srv.StandardResponse(writer, http.StatusCreated)
@@ -309,6 +369,9 @@ func (server *ContainerServer) ContainerDeleteHandler(writer http.ResponseWriter
 		return
 	}
 	info, err := db.GetInfo()
+	if err == nil {
+		info, err = usageInfo(db, info)
+	}
 	if err != nil {
 		srv.GetLogger(request).Error("Unable to get container info.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -324,6 +387,9 @@ func (server *ContainerServer) ContainerDeleteHandler(writer http.ResponseWriter
 		return
 	}
 	info, err = db.GetInfo()
+	if err == nil {
+		info, err = usageInfo(db, info)
+	}
 	if err == nil {
 		server.accountUpdate(writer, request, vars, info, srv.GetLogger(request))
 	}
@@ -369,6 +435,22 @@ func (server *ContainerServer) ContainerPostHandler(writer http.ResponseWriter,
 		srv.StandardResponse(writer, http.StatusNotFound)
 		return
 	}
+	if policy := request.Header.Get("X-Backend-Storage-Policy-Index"); policy != "" {
+		// the container migrator moves a container to the storage policy it's being migrated to once its objects are.
+		policyIndex, err := strconv.Atoi(policy)
+		if err != nil {
+			srv.StandardResponse(writer, http.StatusBadRequest)
+			return
+		}
+		if err := movePolicy(db, policyIndex, timestamp); err == ErrorPolicyConflict {
+			srv.StandardResponse(writer, http.StatusConflict)
+			return
+		} else if err != nil {
+			srv.GetLogger(request).Error("Unable to move container to new policy.", zap.Error(err))
+			srv.StandardResponse(writer, http.StatusInternalServerError)
+			return
+		}
+	}
 	if err := db.UpdateMetadata(updates, timestamp); err == ErrorInvalidMetadata {
 		srv.StandardResponse(writer, http.StatusBadRequest)
 	} else if err != nil {
@@ -416,7 +498,16 @@ func (server *ContainerServer) ObjPutHandler(writer http.ResponseWriter, request
 		return
 	}
 	defer server.containerEngine.Return(db)
-	if err := db.PutObject(vars["obj"], timestamp, size, contentType, etag, policyIndex); err != nil {
+	if server.redirectToShard(writer, request, db, vars) {
+		return
+	}
+	metadata := make(map[string]string)
+	for key := range request.Header {
+		if strings.HasPrefix(key, "X-Object-Meta-") {
+			metadata[key] = request.Header.Get(key)
+		}
+	}
+	if err := db.PutObject(vars["obj"], timestamp, size, contentType, etag, policyIndex, metadata); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
@@ -454,6 +545,9 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 		return
 	}
 	defer server.containerEngine.Return(db)
+	if server.redirectToShard(writer, request, db, vars) {
+		return
+	}
 	if err := db.DeleteObject(vars["obj"], timestamp, policyIndex); err != nil {
 		srv.GetLogger(request).Error("Error adding object to container.", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
@@ -463,6 +557,38 @@ func (server *ContainerServer) ObjDeleteHandler(writer http.ResponseWriter, requ
 	writer.Write([]byte(""))
 }
 
+// redirectToShard answers an object update for a sharded container with a redirect to the shard container that now
+// holds the object's name, along with where to find it.  It returns false if the container isn't sharded.
+func (server *ContainerServer) redirectToShard(writer http.ResponseWriter, request *http.Request, db Container, vars map[string]string) bool {
+	ranges, err := shardRanges(db)
+	if err != nil {
+		srv.GetLogger(request).Error("Unable to get shard ranges.", zap.Error(err))
+		return false
+	}
+	shard := FindShardRange(ranges, vars["obj"])
+	if shard == nil {
+		return false
+	}
+	account := ShardAccount(vars["account"])
+	headers := writer.Header()
+	headers.Set("Location", fmt.Sprintf("/%s/%s/%s", common.Urlencode(account), common.Urlencode(shard.Name), common.Urlencode(vars["obj"])))
+	headers.Set("X-Backend-Redirect-Account", account)
+	headers.Set("X-Backend-Redirect-Container", shard.Name)
+	if server.containerRing != nil {
+		partition := server.containerRing.GetPartition(account, shard.Name, "")
+		var hosts, devices []string
+		for _, dev := range server.containerRing.GetNodes(partition) {
+			hosts = append(hosts, fmt.Sprintf("%s:%d", dev.Ip, dev.Port))
+			devices = append(devices, dev.Device)
+		}
+		headers.Set("X-Backend-Redirect-Partition", strconv.FormatUint(partition, 10))
+		headers.Set("X-Backend-Redirect-Host", strings.Join(hosts, ","))
+		headers.Set("X-Backend-Redirect-Device", strings.Join(devices, ","))
+	}
+	srv.StandardResponse(writer, http.StatusMovedPermanently)
+	return true
+}
+
 // HealthcheckHandler implements a basic health check, that just returns "OK".
 func (server *ContainerServer) HealthcheckHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Length", "2")
@@ -499,7 +625,15 @@ func (server *ContainerServer) LogRequest(next http.Handler) http.Handler {
 		start := time.Now()
 		logr := server.logger.With(zap.String("txn", request.Header.Get("X-Trans-Id")))
 		request = srv.SetLogger(request, logr)
+		span := server.tracer.StartFromHeader("container-server "+request.Method, request.Header)
+		span.SetAttribute("txn", request.Header.Get("X-Trans-Id"))
+		span.SetAttribute("path", request.URL.Path)
+		request = request.WithContext(tracing.ContextWithSpan(request.Context(), span))
 		next.ServeHTTP(newWriter, request)
+		span.SetAttribute("status", strconv.Itoa(newWriter.Status))
+		span.Finish()
+		server.requestDurations.Observe(time.Since(start).Seconds(), request.Method, strconv.Itoa(newWriter.Status),
+			request.Header.Get("X-Backend-Storage-Policy-Index"))
 		forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 		lvl, _ := server.logLevel.MarshalText()
 		if (request.Method != "REPLICATE" && request.Method != "REPCONN") || strings.ToUpper(string(lvl)) == "DEBUG" {
@@ -565,14 +699,23 @@ func (server *ContainerServer) updateDeviceLocks(seconds int64) {
 	}
 }
 
+// newMetrics sets up the server's metrics registry and request duration histogram.
+func (server *ContainerServer) newMetrics() {
+	server.metrics, server.requestDurations = metrics.NewServerRegistry()
+	server.metrics.NewKeyedGaugeFunc("hummingbird_device_requests_in_use", "Requests currently holding each device.",
+		"device", server.diskInUse.InUse)
+}
+
 // GetHandler returns the server's http handler - it sets up routes and instantiates middleware.
 func (server *ContainerServer) GetHandler(config conf.Config) http.Handler {
+	server.newMetrics()
 	commonHandlers := alice.New(server.LogRequest, middleware.RecoverHandler, middleware.ValidateRequest, server.AcquireDevice)
 	router := srv.NewRouter()
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
+	router.Get("/metrics", commonHandlers.Then(server.metrics))
 	router.Get("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Post("/debug/pprof/:parm", http.DefaultServeMux)
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
@@ -616,10 +759,18 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	}
 
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:container-server", "disk_limit", 25, 10000))
+	if server.tracer, err = tracing.NewTracerFromConfig(serverconf, "app:container-server", "container-server", server.logger); err != nil {
+		return "", 0, nil, nil, err
+	}
 	bindIP = serverconf.GetDefault("app:container-server", "bind_ip", "0.0.0.0")
 	bindPort = int(serverconf.GetInt("app:container-server", "bind_port", 6000))
 
-	server.containerEngine = newLRUEngine(server.driveRoot, server.hashPathPrefix, server.hashPathSuffix, 32)
+	if server.containerEngine, err = getContainerEngine(serverconf, server.driveRoot, server.hashPathPrefix, server.hashPathSuffix); err != nil {
+		return "", 0, nil, nil, err
+	}
+	if server.containerRing, err = GetRing("container", server.hashPathPrefix, server.hashPathSuffix, 0); err != nil {
+		return "", 0, nil, nil, fmt.Errorf("Error loading container ring: %v", err)
+	}
 	connTimeout := time.Duration(serverconf.GetFloat("app:container-server", "conn_timeout", 1.0) * float64(time.Second))
 	nodeTimeout := time.Duration(serverconf.GetFloat("app:container-server", "node_timeout", 10.0) * float64(time.Second))
 	server.updateClient = &http.Client{
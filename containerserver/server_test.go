@@ -17,13 +17,19 @@ package containerserver
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/common/test"
 	"go.uber.org/zap"
 )
@@ -390,6 +396,181 @@ func TestContainerGetTextEmpty(t *testing.T) {
 	require.Equal(t, 204, rsp.Status)
 }
 
+func TestContainerGetListingFormats(t *testing.T) {
+	server, handler, cleanup, err := makeTestServer2()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	get := func(query string, headers map[string]string) *test.CaptureResponse {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("GET", "/device/1/a/c"+query, nil)
+		require.Nil(t, err)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(rsp, req)
+		return rsp
+	}
+
+	rsp = get("?format=json", nil)
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "[]", rsp.Body.String())
+	rsp = get("?format=xml", nil)
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c\"></container>", rsp.Body.String())
+	rsp = get("", map[string]string{"Accept": "application/x-ndjson"})
+	require.Equal(t, 204, rsp.Status)
+
+	names := []string{}
+	for i := 0; i < srv.MaxListingLimit+5; i++ {
+		names = append(names, fmt.Sprintf("o%05d", i))
+	}
+	db, err := server.containerEngine.Get(map[string]string{"device": "device", "partition": "1", "account": "a", "container": "c"})
+	require.Nil(t, err)
+	require.Nil(t, mergeItemsByName(db, names))
+	server.containerEngine.Return(db)
+
+	rsp = get("?limit=2", map[string]string{"Accept": "application/x-ndjson"})
+	require.Equal(t, 200, rsp.Status)
+	require.Equal(t, "application/x-ndjson; charset=utf-8", rsp.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSuffix(rsp.Body.String(), "\n"), "\n")
+	require.Equal(t, 2, len(lines))
+	var record ObjectListingRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+	require.Equal(t, "o00001", record.Name)
+
+	rsp = get("?limit=1", map[string]string{"Accept": "application/json;q=0.5, text/xml"})
+	require.Equal(t, "application/xml; charset=utf-8", rsp.Header().Get("Content-Type"))
+	rsp = get("?limit=1", map[string]string{"Accept": "text/*;q=0.1, application/json;q=0.2"})
+	require.Equal(t, "application/json; charset=utf-8", rsp.Header().Get("Content-Type"))
+	rsp = get("?limit=1", map[string]string{"Accept": "image/png"})
+	require.Equal(t, 406, rsp.Status)
+	rsp = get("?limit=1&format=json", map[string]string{"Accept": "image/png"})
+	require.Equal(t, 200, rsp.Status)
+
+	// listings are capped at the usual limit unless the proxy allows more.
+	rsp = get("?limit=20000", nil)
+	require.Equal(t, srv.MaxListingLimit, strings.Count(rsp.Body.String(), "\n"))
+	rsp = get("?limit=20000&format=json", map[string]string{srv.ListingLimitHeader: "100000"})
+	var records []ObjectListingRecord
+	require.Nil(t, json.Unmarshal(rsp.Body.Bytes(), &records))
+	require.Equal(t, srv.MaxListingLimit+5, len(records))
+}
+
+func TestContainerListingFilters(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	for _, object := range []struct {
+		name, timestamp, contentType, size, color string
+	}{
+		{"a", "1500000001.00000", "text/plain", "1", "red"},
+		{"b", "1500000002.00000", "image/png", "100", ""},
+		{"c", "1500000003.00000", "text/plain;charset=utf-8", "10", "blue"},
+	} {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("PUT", "/device/1/a/c/"+object.name, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", object.timestamp)
+		req.Header.Set("X-Content-Type", object.contentType)
+		req.Header.Set("X-Size", object.size)
+		req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+		if object.color != "" {
+			req.Header.Set("X-Object-Meta-Color", object.color)
+		}
+		handler.ServeHTTP(rsp, req)
+		require.Equal(t, 201, rsp.Status)
+	}
+
+	list := func(query string) (int, string) {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest("GET", "/device/1/a/c?"+query, nil)
+		require.Nil(t, err)
+		handler.ServeHTTP(rsp, req)
+		return rsp.Status, rsp.Body.String()
+	}
+	for query, expected := range map[string]string{
+		"content_type=text/plain":            "a\nc\n",
+		"content_type=image/*":               "b\n",
+		"min_bytes=10":                       "b\nc\n",
+		"max_bytes=10":                       "a\nc\n",
+		"min_bytes=2&max_bytes=99":           "c\n",
+		"modified_since=1500000002":          "c\n",
+		"modified_since=2017-07-14T02:40:01": "b\nc\n",
+		"content_type=text/plain&limit=1":    "a\n",
+	} {
+		status, body := list(query)
+		require.Equal(t, 200, status, query)
+		require.Equal(t, expected, body, query)
+	}
+	status, _ := list("content_type=video/*")
+	require.Equal(t, 204, status)
+	status, _ = list("min_bytes=lots")
+	require.Equal(t, 400, status)
+	status, _ = list("modified_since=yesterday")
+	require.Equal(t, 400, status)
+
+	status, body := list("format=json&include=meta")
+	require.Equal(t, 200, status)
+	var data []ObjectListingRecord
+	require.Nil(t, json.Unmarshal([]byte(body), &data))
+	require.Equal(t, 3, len(data))
+	require.Equal(t, ObjectListingMeta{"X-Object-Meta-Color": "red"}, data[0].Metadata)
+	require.Nil(t, data[1].Metadata)
+	require.Equal(t, ObjectListingMeta{"X-Object-Meta-Color": "blue"}, data[2].Metadata)
+
+	status, body = list("format=json")
+	require.Equal(t, 200, status)
+	require.NotContains(t, body, "meta")
+
+	status, body = list("format=xml&include=meta&content_type=text/plain&max_bytes=5")
+	require.Equal(t, 200, status)
+	require.Contains(t, body, "<object><name>a</name>")
+	require.Contains(t, body, "<meta name=\"X-Object-Meta-Color\">red</meta></object>")
+	require.NotContains(t, body, "<name>c</name>")
+}
+
+func TestParseListingFilter(t *testing.T) {
+	filter, err := parseListingFilter(url.Values{"limit": {"10"}})
+	require.Nil(t, err)
+	require.Nil(t, filter)
+
+	filter, err = parseListingFilter(url.Values{"include": {"foo,meta"}, "modified_since": {"1500000000.5"},
+		"content_type": {"image/*"}, "min_bytes": {"0"}})
+	require.Nil(t, err)
+	require.True(t, filter.IncludeMeta)
+	require.Equal(t, "1500000000.50000", filter.ModifiedSince)
+	require.Equal(t, "image/*", filter.ContentType)
+	require.Equal(t, int64(0), *filter.MinBytes)
+	require.Nil(t, filter.MaxBytes)
+
+	filter, err = parseListingFilter(url.Values{"modified_since": {"Fri, 14 Jul 2017 02:40:00 GMT"}})
+	require.Nil(t, err)
+	require.Equal(t, "1500000000.00000", filter.ModifiedSince)
+	filter, err = parseListingFilter(url.Values{"modified_since": {"2017-07-14T02:40:00.250000"}})
+	require.Nil(t, err)
+	require.Equal(t, "1500000000.25000", filter.ModifiedSince)
+
+	_, err = parseListingFilter(url.Values{"max_bytes": {"-1"}})
+	require.NotNil(t, err)
+}
+
 func TestContainerPutObjectBadRequests(t *testing.T) {
 	handler, cleanup, err := makeTestServer()
 	require.Nil(t, err)
@@ -586,9 +767,11 @@ func TestDiskUsage(t *testing.T) {
 func TestGetServer(t *testing.T) {
 	oldgethash := GetHashPrefixAndSuffix
 	oldgetsync := GetSyncRealms
+	oldgetring := GetRing
 	defer func() {
 		GetHashPrefixAndSuffix = oldgethash
 		GetSyncRealms = oldgetsync
+		GetRing = oldgetring
 	}()
 	GetHashPrefixAndSuffix = func() (string, string, error) {
 		return "changeme", "changeme", nil
@@ -596,6 +779,9 @@ func TestGetServer(t *testing.T) {
 	GetSyncRealms = func() conf.SyncRealmList {
 		return conf.SyncRealmList(map[string]conf.SyncRealm{})
 	}
+	GetRing = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		return &test.FakeRing{}, nil
+	}
 
 	configString := "[app:container-server]\ndevices=whatever\nmount_check=false\nbind_ip=127.0.0.2\nbind_port=1000\nlog_level=INFO\n"
 	conf, err := conf.StringConfig(configString)
@@ -612,6 +798,7 @@ func TestGetServer(t *testing.T) {
 	require.False(t, server.checkMounts)
 	require.NotNil(t, server.updateClient)
 	require.NotNil(t, server.containerEngine)
+	require.NotNil(t, server.containerRing)
 }
 
 func TestContainerAutoCreateOnPut(t *testing.T) {
@@ -727,3 +914,106 @@ func TestContainerVerifySync(t *testing.T) {
 	handler.ServeHTTP(rsp, req)
 	require.Equal(t, 204, rsp.Status)
 }
+
+func TestContainerPolicyMigration(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	request := func(method, path string, headers map[string]string) *test.CaptureResponse {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(rsp, req)
+		return rsp
+	}
+	require.Equal(t, 201, request("PUT", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "0"}).Status)
+	for object, policy := range map[string]string{"1": "0", "2": "1", "3": "0"} {
+		require.Equal(t, 201, request("PUT", "/device/1/a/c/"+object, map[string]string{
+			"X-Content-Type":                 "application/octet-stream",
+			"X-Size":                         "2",
+			"X-Etag":                         "d41d8cd98f00b204e9800998ecf8427e",
+			"X-Backend-Storage-Policy-Index": policy,
+		}).Status)
+	}
+	require.Equal(t, "1\n3\n", request("GET", "/device/1/a/c", nil).Body.String())
+	require.Equal(t, 409, request("POST", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "1"}).Status)
+
+	require.Equal(t, 204, request("POST", "/device/1/a/c", map[string]string{policyMigrationKey: "1"}).Status)
+	require.Equal(t, "1\n2\n3\n", request("GET", "/device/1/a/c", nil).Body.String())
+	// the backend listing of one policy isn't merged.
+	require.Equal(t, "2\n", request("GET", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "1"}).Body.String())
+
+	require.Equal(t, 400, request("POST", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "x"}).Status)
+	require.Equal(t, 204, request("POST", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "1"}).Status)
+	rsp := request("HEAD", "/device/1/a/c", nil)
+	require.Equal(t, "1", rsp.Header().Get("X-Backend-Storage-Policy-Index"))
+	require.Equal(t, "1", rsp.Header().Get("X-Container-Object-Count"))
+	require.Equal(t, "2\n", request("GET", "/device/1/a/c", nil).Body.String())
+}
+
+func TestContainerDeleteMigrating(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	request := func(method, path string, headers map[string]string) *test.CaptureResponse {
+		rsp := test.MakeCaptureResponse()
+		req, err := http.NewRequest(method, path, nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Timestamp", common.GetTimestamp())
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		handler.ServeHTTP(rsp, req)
+		return rsp
+	}
+	require.Equal(t, 201, request("PUT", "/device/1/a/c", map[string]string{"X-Backend-Storage-Policy-Index": "0"}).Status)
+	require.Equal(t, 204, request("POST", "/device/1/a/c", map[string]string{policyMigrationKey: "1"}).Status)
+	// the only object has been migrated to the new policy, leaving nothing in the container's current one.
+	require.Equal(t, 201, request("PUT", "/device/1/a/c/o", map[string]string{
+		"X-Content-Type":                 "application/octet-stream",
+		"X-Size":                         "2",
+		"X-Etag":                         "d41d8cd98f00b204e9800998ecf8427e",
+		"X-Backend-Storage-Policy-Index": "1",
+	}).Status)
+	rsp := request("HEAD", "/device/1/a/c", nil)
+	require.Equal(t, "1", rsp.Header().Get("X-Container-Object-Count"))
+	require.Equal(t, "2", rsp.Header().Get("X-Container-Bytes-Used"))
+	require.Equal(t, 409, request("DELETE", "/device/1/a/c", nil).Status)
+}
+
+func TestContainerListingAborted(t *testing.T) {
+	handler, cleanup, err := makeTestServer()
+	require.Nil(t, err)
+	defer cleanup()
+
+	rsp := test.MakeCaptureResponse()
+	req, err := http.NewRequest("PUT", "/device/1/a/c", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00001")
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+	rsp = test.MakeCaptureResponse()
+	req, err = http.NewRequest("PUT", "/device/1/a/c/o", nil)
+	require.Nil(t, err)
+	req.Header.Set("X-Timestamp", "100000000.00002")
+	req.Header.Set("X-Content-Type", "text/plain")
+	req.Header.Set("X-Size", "0")
+	req.Header.Set("X-Etag", "d41d8cd98f00b204e9800998ecf8427e")
+	handler.ServeHTTP(rsp, req)
+	require.Equal(t, 201, rsp.Status)
+
+	// a listing that fails once it's been started as a 200 cuts the connection, rather than looking complete.
+	rsp = test.MakeCaptureResponse()
+	rsp.WriteError = errors.New("connection reset")
+	req, err = http.NewRequest("GET", "/device/1/a/c?format=json", nil)
+	require.Nil(t, err)
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() { handler.ServeHTTP(rsp, req) })
+	require.Equal(t, 200, rsp.Status)
+}
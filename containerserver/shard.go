@@ -0,0 +1,120 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"fmt"
+)
+
+// ShardAccountPrefix is prepended to an account's name to get the hidden account its shard containers live in.
+const ShardAccountPrefix = ".shards_"
+
+// shardCleaveID is the outgoing_sync remote id that records how far a sharded container's rows have been moved to
+// its shard containers.
+const shardCleaveID = "shard-cleave"
+
+// ShardRange is a shard container holding a sharded container's objects named after Lower, up to and including Upper.
+// An empty Upper has no upper bound.
+type ShardRange struct {
+	Name        string `json:"name"`
+	Lower       string `json:"lower"`
+	Upper       string `json:"upper"`
+	ObjectCount int64  `json:"object_count"`
+	BytesUsed   int64  `json:"bytes_used"`
+	Timestamp   string `json:"timestamp"`
+}
+
+// Includes returns true if the object name belongs in the shard range.
+func (r *ShardRange) Includes(name string) bool {
+	return name > r.Lower && (r.Upper == "" || name <= r.Upper)
+}
+
+// ShardAccount returns the hidden account that holds an account's shard containers.
+func ShardAccount(account string) string {
+	return ShardAccountPrefix + account
+}
+
+// FindShardRange returns the shard range an object name belongs in, or nil if there isn't one.
+func FindShardRange(ranges []*ShardRange, name string) *ShardRange {
+	for _, r := range ranges {
+		if r.Includes(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// makeShardRanges names and bounds the shard containers for a container split at points.
+func makeShardRanges(container, timestamp string, points []string) []*ShardRange {
+	ranges := make([]*ShardRange, 0, len(points)+1)
+	lower := ""
+	for i, upper := range append(points, "") {
+		ranges = append(ranges, &ShardRange{
+			Name:      fmt.Sprintf("%s-%s-%d", container, timestamp, i),
+			Lower:     lower,
+			Upper:     upper,
+			Timestamp: timestamp,
+		})
+		lower = upper
+	}
+	return ranges
+}
+
+// ShardableContainer is a container that can be split into shard containers.
+type ShardableContainer interface {
+	ReplicableContainer
+	// ShardRanges returns the container's shard ranges in name order.  A container with shard ranges is sharded.
+	ShardRanges() ([]*ShardRange, error)
+	// MergeShardRanges adds shard ranges, replacing any existing ones with the same name and an older timestamp.
+	MergeShardRanges(ranges []*ShardRange) error
+	// ShardPoints returns the object names that split the container into shards of rowsPerShard objects.
+	ShardPoints(rowsPerShard int64) ([]string, error)
+	// CleavePoint returns the ROWID up to which object records have been moved to the container's shards.
+	CleavePoint() (int64, error)
+	// CleaveTo removes the object records up to ROWID point, which have been moved to the container's shards, and
+	// records the point.
+	CleaveTo(point int64) error
+}
+
+// shardRanges returns a container's shard ranges, or none if it can't be sharded.
+func shardRanges(c Container) ([]*ShardRange, error) {
+	if sc, ok := c.(ShardableContainer); ok {
+		return sc.ShardRanges()
+	}
+	return nil, nil
+}
+
+// shardUsage returns the total object count and bytes used of a sharded container's shard containers.
+func shardUsage(ranges []*ShardRange) (int64, int64) {
+	var objectCount, bytesUsed int64
+	for _, r := range ranges {
+		objectCount += r.ObjectCount
+		bytesUsed += r.BytesUsed
+	}
+	return objectCount, bytesUsed
+}
+
+// usageInfo returns the container's info with the object count and bytes used it reports.  A sharded container's
+// objects live in its shard containers, so it reports their totals instead of its own.
+func usageInfo(db Container, info *ContainerInfo) (*ContainerInfo, error) {
+	ranges, err := shardRanges(db)
+	if err != nil || len(ranges) == 0 {
+		return info, err
+	}
+	usage := *info
+	usage.ObjectCount, usage.BytesUsed = shardUsage(ranges)
+	return &usage, nil
+}
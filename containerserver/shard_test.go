@@ -0,0 +1,122 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeShardRanges(t *testing.T) {
+	ranges := makeShardRanges("c", "1000.00000", []string{"f", "m"})
+	require.Equal(t, 3, len(ranges))
+	require.Equal(t, "c-1000.00000-0", ranges[0].Name)
+	require.Equal(t, "", ranges[0].Lower)
+	require.Equal(t, "f", ranges[0].Upper)
+	require.Equal(t, "f", ranges[1].Lower)
+	require.Equal(t, "m", ranges[1].Upper)
+	require.Equal(t, "m", ranges[2].Lower)
+	require.Equal(t, "", ranges[2].Upper)
+
+	require.Equal(t, ranges[0], FindShardRange(ranges, "a"))
+	require.Equal(t, ranges[0], FindShardRange(ranges, "f"))
+	require.Equal(t, ranges[1], FindShardRange(ranges, "f0"))
+	require.Equal(t, ranges[2], FindShardRange(ranges, "zzz"))
+	require.Nil(t, FindShardRange(ranges[:2], "zzz"))
+	require.Equal(t, ".shards_a", ShardAccount("a"))
+}
+
+func TestShardPoints(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e"}))
+	points, err := db.ShardPoints(2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"b", "d"}, points)
+}
+
+func TestMergeShardRanges(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	ranges, err := db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ranges))
+	require.Nil(t, db.MergeShardRanges(makeShardRanges("c", "2.00000", []string{"m"})))
+	update := &ShardRange{Name: "c-2.00000-1", Lower: "m", ObjectCount: 5, Timestamp: "3.00000"}
+	stale := &ShardRange{Name: "c-2.00000-0", Upper: "m", ObjectCount: 5, Timestamp: "1.00000"}
+	require.Nil(t, db.MergeShardRanges([]*ShardRange{update, stale}))
+	ranges, err = db.ShardRanges()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ranges))
+	require.EqualValues(t, 0, ranges[0].ObjectCount)
+	require.EqualValues(t, 5, ranges[1].ObjectCount)
+
+	point, err := db.CleavePoint()
+	require.Nil(t, err)
+	require.EqualValues(t, -1, point)
+	require.Nil(t, db.CleaveTo(10))
+	point, err = db.CleavePoint()
+	require.Nil(t, err)
+	require.EqualValues(t, 10, point)
+}
+
+func TestCleaveTo(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
+	items, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Nil(t, db.CleaveTo(items[1].Rowid))
+	// the cleaved rows are gone, along with their share of the container's stats.
+	remaining, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(remaining))
+	require.Equal(t, items[2].Name, remaining[0].Name)
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	require.EqualValues(t, 1, info.ObjectCount)
+	point, err := db.CleavePoint()
+	require.Nil(t, err)
+	require.Equal(t, items[1].Rowid, point)
+}
+
+func TestUsageInfo(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b"}))
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	usage, err := usageInfo(db, info)
+	require.Nil(t, err)
+	require.EqualValues(t, 2, usage.ObjectCount)
+
+	// once it's sharded, the container reports its shards' totals, without changing its own info.
+	ranges := makeShardRanges("c", "2.00000", []string{"m"})
+	ranges[0].ObjectCount, ranges[0].BytesUsed = 3, 30
+	ranges[1].ObjectCount, ranges[1].BytesUsed = 4, 40
+	require.Nil(t, db.MergeShardRanges(ranges))
+	usage, err = usageInfo(db, info)
+	require.Nil(t, err)
+	require.EqualValues(t, 7, usage.ObjectCount)
+	require.EqualValues(t, 70, usage.BytesUsed)
+	require.Equal(t, info.PutTimestamp, usage.PutTimestamp)
+	require.EqualValues(t, 2, info.ObjectCount)
+}
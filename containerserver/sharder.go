@@ -0,0 +1,339 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// Sharder is the container sharder daemon, which splits containers with too many objects into shard containers.
+//
+// Only the first primary node for a container's partition shards it.  Once a container has more than
+// shardThreshold objects, the sharder picks shard ranges of rowsPerShard objects by name, creates a shard container
+// in the account's hidden shard account for each, and moves the container's rows into them, removing each batch from
+// the container once a quorum of the shards' replicas have it.  It then records the shard ranges, which makes the
+// container server redirect object updates to the shards, and pushes them to the container's other replicas, which
+// move their own rows to the shards the same way.  Every later pass moves any rows that have shown up since, such as
+// from replication or updates that raced the sharding, and refreshes the shards' object counts.
+type Sharder struct {
+	checkMounts    bool
+	deviceRoot     string
+	hashPathPrefix string
+	hashPathSuffix string
+	logger         srv.LowLevelLogger
+	serverPort     int
+	Ring           ring.Ring
+	engine         ContainerEngine
+	client         *http.Client
+	shardThreshold int64
+	rowsPerShard   int64
+	interval       time.Duration
+	cancel         chan struct{}
+}
+
+func (s *Sharder) containerHash(account, container string) string {
+	return fmt.Sprintf("%032x", md5.Sum([]byte(s.hashPathPrefix+"/"+account+"/"+container+s.hashPathSuffix)))
+}
+
+// replicateToNodes sends a replication message to each node's copy of a container database, returning how many took
+// it.
+func (s *Sharder) replicateToNodes(nodes []*ring.Device, partition uint64, hash string, args ...interface{}) (int, error) {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return 0, err
+	}
+	succeeded, _, _ := sendToNodes(s.client, "REPLICATE", nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s", dev.ReplicationIp, dev.ReplicationPort, dev.Device, partition, hash)
+	}, func(i int) http.Header { return http.Header{} }, func() io.Reader { return bytes.NewReader(body) })
+	return succeeded, nil
+}
+
+func quorum(nodes []*ring.Device) int {
+	return len(nodes)/2 + 1
+}
+
+// createShard creates a shard range's container on its primary nodes.
+func (s *Sharder) createShard(info *ContainerInfo, r *ShardRange) error {
+	account := ShardAccount(info.Account)
+	partition := s.Ring.GetPartition(account, r.Name, "")
+	nodes := s.Ring.GetNodes(partition)
+	headers := http.Header{
+		"X-Timestamp":                    {r.Timestamp},
+		"X-Backend-Storage-Policy-Index": {strconv.Itoa(info.StoragePolicyIndex)},
+	}
+	succeeded, _, _ := sendToNodes(s.client, "PUT", nodes, func(i int, dev *ring.Device) string {
+		return fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+			common.Urlencode(account), common.Urlencode(r.Name))
+	}, func(i int) http.Header { return headers }, nil)
+	if succeeded < quorum(nodes) {
+		return fmt.Errorf("Unable to create shard container %s/%s", account, r.Name)
+	}
+	return nil
+}
+
+// cleave moves the container's rows added since the last pass into their shard containers, removing them from the
+// container once the shards have them.
+func (s *Sharder) cleave(c ShardableContainer, info *ContainerInfo, ranges []*ShardRange) (int, error) {
+	account := ShardAccount(info.Account)
+	point, err := c.CleavePoint()
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for {
+		records, err := c.ItemsSince(point, 10000)
+		if err != nil {
+			return moved, err
+		}
+		if len(records) == 0 {
+			return moved, nil
+		}
+		byShard := make(map[*ShardRange][]*ObjectRecord)
+		for _, record := range records {
+			if r := FindShardRange(ranges, record.Name); r != nil {
+				byShard[r] = append(byShard[r], record)
+			}
+		}
+		for r, shardRecords := range byShard {
+			partition := s.Ring.GetPartition(account, r.Name, "")
+			nodes := s.Ring.GetNodes(partition)
+			successes, err := s.replicateToNodes(nodes, partition, s.containerHash(account, r.Name), "merge_items", shardRecords, "")
+			if err != nil {
+				return moved, err
+			}
+			if successes < quorum(nodes) {
+				return moved, fmt.Errorf("Unable to move rows to shard container %s/%s", account, r.Name)
+			}
+		}
+		moved += len(records)
+		point = records[len(records)-1].Rowid
+		if err := c.CleaveTo(point); err != nil {
+			return moved, err
+		}
+	}
+}
+
+// updateShardStats refreshes the shard ranges' object counts and bytes used from their containers.
+func (s *Sharder) updateShardStats(info *ContainerInfo, ranges []*ShardRange) {
+	account := ShardAccount(info.Account)
+	for _, r := range ranges {
+		partition := s.Ring.GetPartition(account, r.Name, "")
+		for _, dev := range s.Ring.GetNodes(partition) {
+			url := fmt.Sprintf("http://%s:%d/%s/%d/%s/%s", dev.Ip, dev.Port, dev.Device, partition,
+				common.Urlencode(account), common.Urlencode(r.Name))
+			req, err := http.NewRequest("HEAD", url, nil)
+			if err != nil {
+				continue
+			}
+			resp, err := s.client.Do(req)
+			if err != nil {
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				continue
+			}
+			objectCount, err1 := strconv.ParseInt(resp.Header.Get("X-Container-Object-Count"), 10, 64)
+			bytesUsed, err2 := strconv.ParseInt(resp.Header.Get("X-Container-Bytes-Used"), 10, 64)
+			if err1 == nil && err2 == nil && (objectCount != r.ObjectCount || bytesUsed != r.BytesUsed) {
+				r.ObjectCount = objectCount
+				r.BytesUsed = bytesUsed
+				r.Timestamp = common.GetTimestamp()
+			}
+			break
+		}
+	}
+}
+
+// shardDatabase shards a container database if it's big enough, or keeps an already sharded one's shards up to date.
+func (s *Sharder) shardDatabase(dev *ring.Device, dbFile string) error {
+	parts := filepath.Base(filepath.Dir(filepath.Dir(filepath.Dir(dbFile))))
+	part, err := strconv.ParseUint(parts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Bad partition: %s", parts)
+	}
+	nodes := s.Ring.GetNodes(part)
+	if len(nodes) == 0 {
+		return nil
+	}
+	first := nodes[0].Id == dev.Id
+	rc, err := s.engine.OpenFile(dbFile)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	c, ok := rc.(ShardableContainer)
+	if !ok {
+		return nil
+	}
+	info, err := c.GetInfo()
+	if err != nil {
+		return err
+	}
+	if deleted, err := c.IsDeleted(); err != nil || deleted || strings.HasPrefix(info.Account, ShardAccountPrefix) {
+		return err
+	}
+	ranges, err := c.ShardRanges()
+	if err != nil {
+		return err
+	}
+	if len(ranges) == 0 {
+		if !first || info.ObjectCount < s.shardThreshold {
+			return nil
+		}
+		points, err := c.ShardPoints(s.rowsPerShard)
+		if err != nil || len(points) == 0 {
+			return err
+		}
+		ranges = makeShardRanges(info.Container, common.GetTimestamp(), points)
+		s.logger.Info("Sharding container.",
+			zap.String("account", info.Account),
+			zap.String("container", info.Container),
+			zap.Int64("objects", info.ObjectCount),
+			zap.Int("shards", len(ranges)))
+		for _, r := range ranges {
+			if err := s.createShard(info, r); err != nil {
+				return err
+			}
+		}
+	}
+	moved, err := s.cleave(c, info, ranges)
+	if err != nil {
+		return err
+	}
+	if moved > 0 {
+		s.logger.Debug("Moved rows to shard containers.",
+			zap.String("account", info.Account),
+			zap.String("container", info.Container),
+			zap.Int("rows", moved))
+	}
+	// the other replicas only move their own rows; the first primary keeps the shard ranges up to date.
+	if !first {
+		return nil
+	}
+	s.updateShardStats(info, ranges)
+	if err := c.MergeShardRanges(ranges); err != nil {
+		return err
+	}
+	// every pass pushes the ranges again, so a replica that missed them gets them next time.
+	if pushed, err := s.replicateToNodes(nodes[1:], part, c.RingHash(), "merge_shard_ranges", ranges); err != nil {
+		return err
+	} else if pushed < len(nodes)-1 {
+		return fmt.Errorf("Unable to push shard ranges to %d of %d replicas", len(nodes)-1-pushed, len(nodes)-1)
+	}
+	return nil
+}
+
+func (s *Sharder) shardDevice(dev *ring.Device) {
+	devicePath := filepath.Join(s.deviceRoot, dev.Device)
+	if mount, err := fs.IsMount(devicePath); s.checkMounts && (err != nil || !mount) {
+		s.logger.Error("Device not mounted.", zap.String("devicePath", devicePath))
+		return
+	}
+	results := make(chan string, 100)
+	go findContainerDbs(s.logger, devicePath, s.cancel, results)
+	for dbFile := range results {
+		if err := s.shardDatabase(dev, dbFile); err != nil {
+			s.logger.Error("Error sharding database.", zap.String("dbFile", dbFile), zap.Error(err))
+		}
+	}
+}
+
+// Run runs a pass of the sharder once.
+func (s *Sharder) Run() {
+	devices, err := s.Ring.LocalDevices(s.serverPort)
+	if err != nil {
+		s.logger.Error("Error getting local devices from ring.", zap.Error(err))
+		return
+	}
+	start := time.Now()
+	for _, dev := range devices {
+		s.shardDevice(dev)
+	}
+	s.logger.Info("Sharding pass completed.", zap.Float64("seconds", time.Since(start).Seconds()))
+}
+
+// RunForever runs the sharder in a forever-loop.
+func (s *Sharder) RunForever() {
+	for {
+		s.Run()
+		time.Sleep(s.interval)
+	}
+}
+
+// GetSharder uses the config settings and command-line flags to configure and return a sharder daemon struct.
+func GetSharder(serverconf conf.Config, flags *flag.FlagSet) (srv.Daemon, srv.LowLevelLogger, error) {
+	if !serverconf.HasSection("container-sharder") {
+		return nil, nil, fmt.Errorf("Unable to find container-sharder config section")
+	}
+	hashPathPrefix, hashPathSuffix, err := GetHashPrefixAndSuffix()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to get hash prefix and suffix")
+	}
+	ring, err := GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error loading container ring")
+	}
+	logLevelString := serverconf.GetDefault("container-sharder", "log_level", "INFO")
+	logLevel := zap.NewAtomicLevel()
+	logLevel.UnmarshalText([]byte(strings.ToLower(logLevelString)))
+	var logger srv.LowLevelLogger
+	if logger, err = srv.SetupLogger("container-sharder", &logLevel, flags); err != nil {
+		return nil, nil, fmt.Errorf("Error setting up logger: %v", err)
+	}
+	deviceRoot := serverconf.GetDefault("container-sharder", "devices", "/srv/node")
+	engine, err := getContainerEngine(serverconf, deviceRoot, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	shardThreshold := serverconf.GetInt("container-sharder", "shard_container_threshold", 1000000)
+	return &Sharder{
+		checkMounts:    serverconf.GetBool("container-sharder", "mount_check", true),
+		deviceRoot:     deviceRoot,
+		serverPort:     int(serverconf.GetInt("container-sharder", "bind_port", 6000)),
+		hashPathPrefix: hashPathPrefix,
+		hashPathSuffix: hashPathSuffix,
+		shardThreshold: shardThreshold,
+		rowsPerShard:   serverconf.GetInt("container-sharder", "rows_per_shard", shardThreshold/2),
+		interval:       time.Duration(serverconf.GetInt("container-sharder", "interval", 1800)) * time.Second,
+		logger:         logger,
+		Ring:           ring,
+		engine:         engine,
+		cancel:         make(chan struct{}),
+		client: &http.Client{
+			Timeout:   time.Minute * 15,
+			Transport: &http.Transport{Dial: (&net.Dialer{Timeout: time.Second}).Dial},
+		},
+	}, logger, nil
+}
@@ -0,0 +1,99 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package containerserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestSharderCleave(t *testing.T) {
+	var lock sync.Mutex
+	status := http.StatusAccepted
+	merged := map[string]int{}
+	fakeRing, cleanup := testReconcilerRing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		var args []json.RawMessage
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&args))
+		var records []*ObjectRecord
+		require.Nil(t, json.Unmarshal(args[1], &records))
+		for _, record := range records {
+			merged[record.Name]++
+		}
+		w.WriteHeader(status)
+	}))
+	defer cleanup()
+	s := &Sharder{logger: zap.NewNop(), Ring: fakeRing, client: http.DefaultClient}
+	db, _, cleanupDb, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanupDb()
+	info, err := db.GetInfo()
+	require.Nil(t, err)
+	ranges := makeShardRanges("c", "2.00000", []string{"b"})
+
+	// rows the shards didn't take stay in the container.
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
+	status = http.StatusInternalServerError
+	_, err = s.cleave(db, info, ranges)
+	require.NotNil(t, err)
+	items, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(items))
+
+	// once the shards have them, they're removed.
+	status = http.StatusAccepted
+	merged = map[string]int{}
+	moved, err := s.cleave(db, info, ranges)
+	require.Nil(t, err)
+	require.Equal(t, 3, moved)
+	require.Equal(t, map[string]int{"a": 3, "b": 3, "c": 3}, merged)
+	items, err = db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(items))
+	info, err = db.GetInfo()
+	require.Nil(t, err)
+	require.EqualValues(t, 0, info.ObjectCount)
+}
+
+func TestSharderReplicateToNodes(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	fakeRing, cleanup := testReconcilerRing(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		// only the first replica takes the message.
+		if requests > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		require.Equal(t, "REPLICATE", r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer cleanup()
+	s := &Sharder{logger: zap.NewNop(), Ring: fakeRing, client: http.DefaultClient}
+	nodes := fakeRing.GetNodes(0)
+	pushed, err := s.replicateToNodes(nodes, 0, "hash", "merge_shard_ranges", []*ShardRange{})
+	require.Nil(t, err)
+	require.Equal(t, 1, pushed)
+	require.Equal(t, len(nodes), requests)
+}
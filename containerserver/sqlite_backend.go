@@ -36,6 +36,8 @@ import (
 
 	"github.com/mattn/go-sqlite3"
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/dbauditor"
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/pickle"
 )
@@ -67,7 +69,16 @@ func chexor(old, name, timestamp string) string {
 	return hex.EncodeToString(digest)
 }
 
+var sqliteBackend = &containerBackend{
+	open:           sqliteOpenContainer,
+	create:         sqliteCreateContainer,
+	createExisting: sqliteCreateExistingContainer,
+}
+
 func init() {
+	RegisterContainerEngine("sqlite", func(serverconf conf.Config, deviceRoot, hashPathPrefix, hashPathSuffix string) (ContainerEngine, error) {
+		return newLRUEngine(sqliteBackend, deviceRoot, hashPathPrefix, hashPathSuffix, 32), nil
+	})
 	// register our sql driver with user-defined chexor function
 	sql.Register("sqlite3_hummingbird",
 		&sqlite3.SQLiteDriver{
@@ -96,9 +107,12 @@ type sqliteContainer struct {
 	hasDeletedNameIndex bool
 	infoCache           atomic.Value
 	ringhash            string
+	// readOnly is set for a database opened just to be looked at, which leaves pending updates unmerged.
+	readOnly bool
 }
 
-var _ Container = &sqliteContainer{}
+var _ ShardableContainer = &sqliteContainer{}
+var _ ReconcilableContainer = &sqliteContainer{}
 
 func (db *sqliteContainer) connect() error {
 	db.connectLock.Lock()
@@ -114,7 +128,7 @@ func (db *sqliteContainer) connect() error {
 	dbConn.SetMaxIdleConns(maxIdleConns)
 	hasDeletedNameIndex, err := schemaMigrate(dbConn)
 	if err != nil {
-		db.Close()
+		dbConn.Close()
 		return fmt.Errorf("Error migrating database: %v", err)
 	}
 	db.hasDeletedNameIndex = hasDeletedNameIndex
@@ -155,6 +169,16 @@ func (db *sqliteContainer) GetInfo() (*ContainerInfo, error) {
 	} else if err := json.Unmarshal([]byte(info.RawMetadata), &info.Metadata); err != nil {
 		return nil, err
 	}
+	// while the container's being migrated, its objects are split between the two policies.
+	if target := migrationTarget(info); target >= 0 {
+		var objectCount, bytesUsed int64
+		if err := db.QueryRow("SELECT object_count, bytes_used FROM policy_stat WHERE storage_policy_index = ?",
+			target).Scan(&objectCount, &bytesUsed); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		info.ObjectCount += objectCount
+		info.BytesUsed += bytesUsed
+	}
 	db.infoCache.Store(info)
 	return info, nil
 }
@@ -268,7 +292,7 @@ func (db *sqliteContainer) MergeItems(records []*ObjectRecord, remoteID string)
 	}
 	defer dst.Close()
 
-	ast, err := tx.Prepare("INSERT INTO object (name, created_at, size, content_type, etag, deleted, storage_policy_index) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	ast, err := tx.Prepare("INSERT INTO object (name, created_at, size, content_type, etag, deleted, storage_policy_index, metadata) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -295,7 +319,7 @@ func (db *sqliteContainer) MergeItems(records []*ObjectRecord, remoteID string)
 	}
 
 	for _, record := range toAdd {
-		if _, err := ast.Exec(record.Name, record.CreatedAt, record.Size, record.ContentType, record.ETag, record.Deleted, record.StoragePolicyIndex); err != nil {
+		if _, err := ast.Exec(record.Name, record.CreatedAt, record.Size, record.ContentType, record.ETag, record.Deleted, record.StoragePolicyIndex, record.Metadata); err != nil {
 			return err
 		}
 	}
@@ -333,13 +357,17 @@ func updateRecord(rec *ObjectListingRecord) error {
 	return err
 }
 
-// ListObjects implements object listings.  Path is a string pointer because behavior is different for empty and missing path query parameters.
-func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string,
-	path *string, reverse bool, storagePolicyIndex int) ([]interface{}, error) {
-	if err := db.connect(); err != nil {
-		return nil, err
-	}
-	var point, pointDirection, queryTail, queryStart string
+// listingBatchSize is how many rows a listing reads from the database at a time. Entries are handed out between
+// reads, so a slow client never holds the database open.
+const listingBatchSize = 1000
+
+// listObjects implements object listings on top of fetch, which calls each with undeleted object records whose names
+// start with prefix, are after lower, before upper and past point in the listing's direction, in order, until each
+// returns false or count records have been seen. The listing's entries are passed to emit in order.
+func listObjects(limit int, marker string, endMarker string, prefix string, delimiter string, path *string, reverse bool,
+	fetch func(lower, upper, prefix, point string, count int, each func(*ObjectListingRecord) bool) error,
+	emit func(entry interface{}) error) error {
+	var point string
 
 	if path != nil {
 		if *path != "" {
@@ -349,60 +377,33 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 		delimiter = "/"
 		prefix = *path
 	}
-	if db.hasDeletedNameIndex {
-		queryStart = "SELECT name, created_at, size, content_type, etag FROM object WHERE deleted = 0 AND"
-	} else {
-		queryStart = "SELECT name, created_at, size, content_type, etag FROM object WHERE +deleted = 0 AND"
-	}
 	if reverse {
 		marker, endMarker = endMarker, marker
-		queryTail = "ORDER BY name DESC LIMIT ?"
-		pointDirection = "name < ?"
-	} else {
-		queryTail = "ORDER BY name LIMIT ?"
-		pointDirection = "name > ?"
 	}
 
-	results := []interface{}{}
-	queryArgs := make([]interface{}, 8)
-	wheres := make([]string, 8)
+	batch := make([]interface{}, 0, listingBatchSize)
+	emitted := 0
 	gotResults := true
 
-	for len(results) < limit && gotResults {
-		wheres := append(wheres[:0], "storage_policy_index == ?")
-		queryArgs := append(queryArgs[:0], storagePolicyIndex)
-		if prefix != "" {
-			wheres = append(wheres, "name BETWEEN ? AND ?")
-			queryArgs = append(queryArgs, prefix, prefix+"\xFF")
-		}
-		if marker != "" {
-			wheres = append(wheres, "name > ?")
-			queryArgs = append(queryArgs, marker)
-		}
-		if endMarker != "" {
-			wheres = append(wheres, "name < ?")
-			queryArgs = append(queryArgs, endMarker)
-		}
-		if point != "" {
-			wheres = append(wheres, pointDirection)
-			queryArgs = append(queryArgs, point)
-		}
-		rows, err := db.Query(queryStart+" "+strings.Join(wheres, " AND ")+" "+queryTail,
-			append(queryArgs, limit-len(results))...)
-		if err != nil {
-			return nil, err
-		}
+	for emitted < limit && gotResults {
 		gotResults = false
-		for rows.Next() && len(results) < limit {
-			gotResults = true
-			record := &ObjectListingRecord{}
-			if err := rows.Scan(&record.Name, &record.LastModified, &record.Size, &record.ContentType, &record.ETag); err != nil {
-				return nil, err
+		count := limit - emitted
+		if count > listingBatchSize {
+			count = listingBatchSize
+		}
+		batch = batch[:0]
+		seen := 0
+		var recordErr error
+		err := fetch(marker, endMarker, prefix, point, count, func(record *ObjectListingRecord) bool {
+			if len(batch) >= count {
+				return false
 			}
+			gotResults = true
+			seen++
 			point = record.Name
 			if delimiter != "" {
 				if path != nil && record.Name == *path {
-					continue
+					return true
 				}
 				end := indexAfter(record.Name, delimiter, len(prefix))
 				if end >= 0 && (path == nil || len(record.Name) > end+1) {
@@ -413,27 +414,153 @@ func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker strin
 						point = dirName + "\xFF"
 					}
 					if path == nil && dirName != marker {
-						results = append(results, &SubdirListingRecord{Name2: dirName, Name: dirName})
+						batch = append(batch, &SubdirListingRecord{Name2: dirName, Name: dirName})
 					}
-					break
+					return false
 				}
 			}
-			if err := updateRecord(record); err != nil {
-				return nil, err
+			if recordErr = updateRecord(record); recordErr != nil {
+				return false
 			}
-			results = append(results, record)
+			batch = append(batch, record)
+			return true
+		})
+		if err == nil {
+			err = recordErr
 		}
-		if err := rows.Err(); err != nil {
-			return nil, err
+		if err != nil {
+			return err
 		}
-		rows.Close()
-		if delimiter == "" && path == nil {
+		for _, entry := range batch {
+			if err := emit(entry); err != nil {
+				return err
+			}
+		}
+		emitted += len(batch)
+		if delimiter == "" && path == nil && seen < count {
 			break
 		}
 	}
+	return nil
+}
+
+// collectListing returns all the entries of a listing made by iterate.
+func collectListing(iterate func(emit func(entry interface{}) error) error) ([]interface{}, error) {
+	results := []interface{}{}
+	if err := iterate(func(entry interface{}) error {
+		results = append(results, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
 	return results, nil
 }
 
+// sqlWheres adds the filter's conditions to an object listing query's where clauses and arguments.
+func (f *ListingFilter) sqlWheres(wheres []string, queryArgs []interface{}) ([]string, []interface{}) {
+	if f.ModifiedSince != "" {
+		wheres = append(wheres, "created_at > ?")
+		queryArgs = append(queryArgs, f.ModifiedSince)
+	}
+	if strings.HasSuffix(f.ContentType, "/*") {
+		prefix := strings.TrimSuffix(f.ContentType, "*")
+		wheres = append(wheres, "content_type BETWEEN ? AND ?")
+		queryArgs = append(queryArgs, prefix, prefix+"\xFF")
+	} else if f.ContentType != "" {
+		wheres = append(wheres, "(content_type = ? OR content_type BETWEEN ? AND ?)")
+		queryArgs = append(queryArgs, f.ContentType, f.ContentType+";", f.ContentType+";\xFF")
+	}
+	if f.MinBytes != nil {
+		wheres = append(wheres, "size >= ?")
+		queryArgs = append(queryArgs, *f.MinBytes)
+	}
+	if f.MaxBytes != nil {
+		wheres = append(wheres, "size <= ?")
+		queryArgs = append(queryArgs, *f.MaxBytes)
+	}
+	return wheres, queryArgs
+}
+
+// ListObjects implements object listings.  Path is a string pointer because behavior is different for empty and missing path query parameters.
+func (db *sqliteContainer) ListObjects(limit int, marker string, endMarker string, prefix string, delimiter string,
+	path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter) ([]interface{}, error) {
+	return collectListing(func(emit func(entry interface{}) error) error {
+		return db.IterObjects(limit, marker, endMarker, prefix, delimiter, path, reverse, storagePolicyIndex, filter, emit)
+	})
+}
+
+// IterObjects passes the entries of an object listing to emit, one at a time.
+func (db *sqliteContainer) IterObjects(limit int, marker string, endMarker string, prefix string, delimiter string,
+	path *string, reverse bool, storagePolicyIndex int, filter *ListingFilter, emit func(entry interface{}) error) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	var pointDirection, queryTail, queryStart string
+
+	if db.hasDeletedNameIndex {
+		queryStart = "SELECT name, created_at, size, content_type, etag, metadata FROM object WHERE deleted = 0 AND"
+	} else {
+		queryStart = "SELECT name, created_at, size, content_type, etag, metadata FROM object WHERE +deleted = 0 AND"
+	}
+	if reverse {
+		queryTail = "ORDER BY name DESC LIMIT ?"
+		pointDirection = "name < ?"
+	} else {
+		queryTail = "ORDER BY name LIMIT ?"
+		pointDirection = "name > ?"
+	}
+
+	queryArgs := make([]interface{}, 8)
+	wheres := make([]string, 8)
+
+	return listObjects(limit, marker, endMarker, prefix, delimiter, path, reverse,
+		func(lower, upper, prefix, point string, count int, each func(*ObjectListingRecord) bool) error {
+			wheres := append(wheres[:0], "storage_policy_index == ?")
+			queryArgs := append(queryArgs[:0], storagePolicyIndex)
+			if prefix != "" {
+				wheres = append(wheres, "name BETWEEN ? AND ?")
+				queryArgs = append(queryArgs, prefix, prefix+"\xFF")
+			}
+			if lower != "" {
+				wheres = append(wheres, "name > ?")
+				queryArgs = append(queryArgs, lower)
+			}
+			if upper != "" {
+				wheres = append(wheres, "name < ?")
+				queryArgs = append(queryArgs, upper)
+			}
+			if point != "" {
+				wheres = append(wheres, pointDirection)
+				queryArgs = append(queryArgs, point)
+			}
+			if filter != nil {
+				wheres, queryArgs = filter.sqlWheres(wheres, queryArgs)
+			}
+			rows, err := db.Query(queryStart+" "+strings.Join(wheres, " AND ")+" "+queryTail,
+				append(queryArgs, count)...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			var metadata string
+			for rows.Next() {
+				record := &ObjectListingRecord{}
+				if err := rows.Scan(&record.Name, &record.LastModified, &record.Size, &record.ContentType, &record.ETag, &metadata); err != nil {
+					return err
+				}
+				if filter != nil && filter.IncludeMeta {
+					if record.Metadata, err = decodeObjectMeta(metadata); err != nil {
+						return err
+					}
+				}
+				if !each(record) {
+					break
+				}
+			}
+			return rows.Err()
+		}, emit)
+}
+
 // NewID sets the container's ID to a new, random string.
 func (db *sqliteContainer) NewID() error {
 	if err := db.connect(); err != nil {
@@ -460,14 +587,14 @@ func (db *sqliteContainer) NewID() error {
 func (db *sqliteContainer) ItemsSince(start int64, count int) ([]*ObjectRecord, error) {
 	db.flush()
 	records := []*ObjectRecord{}
-	rows, err := db.Query(`SELECT ROWID, name, created_at, size, content_type, etag, deleted, storage_policy_index
+	rows, err := db.Query(`SELECT ROWID, name, created_at, size, content_type, etag, deleted, storage_policy_index, metadata
 						   FROM object WHERE ROWID > ? ORDER BY ROWID ASC LIMIT ?`, start, count)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
 		r := &ObjectRecord{}
-		if err := rows.Scan(&r.Rowid, &r.Name, &r.CreatedAt, &r.Size, &r.ContentType, &r.ETag, &r.Deleted, &r.StoragePolicyIndex); err != nil {
+		if err := rows.Scan(&r.Rowid, &r.Name, &r.CreatedAt, &r.Size, &r.ContentType, &r.ETag, &r.Deleted, &r.StoragePolicyIndex, &r.Metadata); err != nil {
 			return nil, err
 		}
 		records = append(records, r)
@@ -494,7 +621,9 @@ func (db *sqliteContainer) GetMetadata() (map[string]string, error) {
 	return metadata, nil
 }
 
-func (db *sqliteContainer) mergeMetas(a map[string][]string, b map[string][]string, deleteTimestamp string) (string, error) {
+// mergeMetas merges two sets of container metadata, keeping the newest value of each key and tombstoning any older
+// than deleteTimestamp.
+func mergeMetas(a map[string][]string, b map[string][]string, deleteTimestamp string) (string, error) {
 	newMeta := map[string][]string{}
 	for k, v := range a {
 		newMeta[k] = v
@@ -552,7 +681,7 @@ func (db *sqliteContainer) UpdateMetadata(newMetadata map[string][]string, times
 	} else if err := json.Unmarshal([]byte(metadataValue), &existingMetadata); err != nil {
 		return err
 	}
-	metastr, err := db.mergeMetas(existingMetadata, newMetadata, deleteTimestamp)
+	metastr, err := mergeMetas(existingMetadata, newMetadata, deleteTimestamp)
 	if err != nil {
 		return err
 	}
@@ -685,7 +814,7 @@ func (db *sqliteContainer) SyncRemoteData(maxRow int64, hash, id, createdAt, put
 	if deleteTimestamp > localDeleteTimestamp {
 		localDeleteTimestamp = deleteTimestamp
 	}
-	metastr, err := db.mergeMetas(lm, rm, localDeleteTimestamp)
+	metastr, err := mergeMetas(lm, rm, localDeleteTimestamp)
 	if _, err = tx.Exec(`UPDATE container_info SET created_at=MIN(?, created_at), put_timestamp=MAX(?, put_timestamp),
 	  					 delete_timestamp=MAX(?, delete_timestamp), metadata=?`,
 		createdAt, putTimestamp, deleteTimestamp, metastr); err != nil {
@@ -712,15 +841,12 @@ func (db *sqliteContainer) SyncRemoteData(maxRow int64, hash, id, createdAt, put
 	return info, nil
 }
 
-// CheckSyncLink makes sure the database's container sync symlink exists or doesn't exist, as in accordance with the existence of the X-Container-Sync-To header.
-func (db *sqliteContainer) CheckSyncLink() error {
-	metadata, err := db.GetMetadata()
-	if err != nil {
-		return err
-	}
-	containersDir := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(db.containerFile))))
+// checkSyncLink makes sure a database file's container sync symlink exists or doesn't exist, as in accordance with the
+// existence of the X-Container-Sync-To header.
+func checkSyncLink(containerFile string, metadata map[string]string) error {
+	containersDir := filepath.Dir(filepath.Dir(filepath.Dir(filepath.Dir(containerFile))))
 	deviceDir := filepath.Dir(containersDir)
-	pathFromDataDir, err := filepath.Rel(containersDir, db.containerFile)
+	pathFromDataDir, err := filepath.Rel(containersDir, containerFile)
 	if err != nil {
 		return err
 	}
@@ -732,7 +858,7 @@ func (db *sqliteContainer) CheckSyncLink() error {
 		if err := os.MkdirAll(filepath.Dir(symLoc), 0755); err != nil {
 			return err
 		}
-		return os.Symlink(db.containerFile, symLoc)
+		return os.Symlink(containerFile, symLoc)
 	} else if fs.Exists(symLoc) {
 		for err := error(nil); err == nil; symLoc = filepath.Dir(symLoc) {
 			err = os.Remove(symLoc)
@@ -741,6 +867,15 @@ func (db *sqliteContainer) CheckSyncLink() error {
 	return nil
 }
 
+// CheckSyncLink makes sure the database's container sync symlink exists or doesn't exist, as in accordance with the existence of the X-Container-Sync-To header.
+func (db *sqliteContainer) CheckSyncLink() error {
+	metadata, err := db.GetMetadata()
+	if err != nil {
+		return err
+	}
+	return checkSyncLink(db.containerFile, metadata)
+}
+
 // OpenDatabaseFile blocks updates and opens the underlying database file for reading, so it can be uploaded to a remote server.
 func (db *sqliteContainer) OpenDatabaseFile() (*os.File, func(), error) {
 	if err := db.connect(); err != nil {
@@ -839,6 +974,11 @@ func (db *sqliteContainer) flushAlreadyLocked() error {
 				return fmt.Errorf("Invalid commit pending record")
 			}
 		}
+		if len(record) > 7 {
+			if rec.Metadata, ok = record[7].(string); !ok {
+				return fmt.Errorf("Invalid commit pending record")
+			}
+		}
 		records = append(records, rec)
 	}
 	err = db.MergeItems(records, "")
@@ -849,6 +989,9 @@ func (db *sqliteContainer) flushAlreadyLocked() error {
 }
 
 func (db *sqliteContainer) flush() error {
+	if db.readOnly {
+		return nil
+	}
 	lock, err := fs.LockPath(filepath.Dir(db.containerFile), 10*time.Second)
 	if err != nil {
 		return err
@@ -857,13 +1000,13 @@ func (db *sqliteContainer) flush() error {
 	return db.flushAlreadyLocked()
 }
 
-func (db *sqliteContainer) addObject(name string, timestamp string, size int64, contentType string, etag string, deleted int, storagePolicyIndex int) error {
+func (db *sqliteContainer) addObject(name string, timestamp string, size int64, contentType string, etag string, deleted int, storagePolicyIndex int, metadata string) error {
 	lock, err := fs.LockPath(filepath.Dir(db.containerFile), 10*time.Second)
 	if err != nil {
 		return err
 	}
 	defer lock.Close()
-	tuple := []interface{}{name, timestamp, size, contentType, etag, deleted, storagePolicyIndex}
+	tuple := []interface{}{name, timestamp, size, contentType, etag, deleted, storagePolicyIndex, metadata}
 	file, err := os.OpenFile(db.containerFile+".pending", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
 		return err
@@ -879,13 +1022,13 @@ func (db *sqliteContainer) addObject(name string, timestamp string, size int64,
 }
 
 // PutObject adds an object to the container, by way of pending file.
-func (db *sqliteContainer) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int) error {
-	return db.addObject(name, timestamp, size, contentType, etag, 0, storagePolicyIndex)
+func (db *sqliteContainer) PutObject(name string, timestamp string, size int64, contentType string, etag string, storagePolicyIndex int, metadata map[string]string) error {
+	return db.addObject(name, timestamp, size, contentType, etag, 0, storagePolicyIndex, encodeObjectMeta(metadata))
 }
 
 // DeleteObject removes an object from the container, by way of pending file.
 func (db *sqliteContainer) DeleteObject(name string, timestamp string, storagePolicyIndex int) error {
-	return db.addObject(name, timestamp, 0, "", "", 1, storagePolicyIndex)
+	return db.addObject(name, timestamp, 0, "", "", 1, storagePolicyIndex, "")
 }
 
 // Close closes the underlying sqlite database connection.
@@ -901,6 +1044,175 @@ func (db *sqliteContainer) Close() error {
 	return nil
 }
 
+// ShardRanges returns the container's shard ranges, ordered by name.
+func (db *sqliteContainer) ShardRanges() ([]*ShardRange, error) {
+	if err := db.connect(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT name, lower, upper, object_count, bytes_used, timestamp FROM shard_range ORDER BY lower")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ranges := []*ShardRange{}
+	for rows.Next() {
+		r := &ShardRange{}
+		if err := rows.Scan(&r.Name, &r.Lower, &r.Upper, &r.ObjectCount, &r.BytesUsed, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, rows.Err()
+}
+
+// MergeShardRanges adds shard ranges to the container, replacing existing ranges with the same name and an older timestamp.
+func (db *sqliteContainer) MergeShardRanges(ranges []*ShardRange) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range ranges {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO shard_range (name, lower, upper, object_count, bytes_used, timestamp)
+							  SELECT ?, ?, ?, ?, ?, ?
+							  WHERE NOT EXISTS (SELECT 1 FROM shard_range WHERE name = ? AND timestamp >= ?)`,
+			r.Name, r.Lower, r.Upper, r.ObjectCount, r.BytesUsed, r.Timestamp, r.Name, r.Timestamp); err != nil {
+			return err
+		}
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
+// ShardPoints returns the names of every rowsPerShard'th object, which split the container into shards of that size.
+func (db *sqliteContainer) ShardPoints(rowsPerShard int64) ([]string, error) {
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT name FROM object WHERE deleted = 0 ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []string
+	var name, last string
+	count := int64(0)
+	for rows.Next() {
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if name == last {
+			continue
+		}
+		if count > 0 && count%rowsPerShard == 0 {
+			points = append(points, last)
+		}
+		last = name
+		count++
+	}
+	return points, rows.Err()
+}
+
+// CleavePoint returns the ROWID up to which object records have been moved to the container's shards.
+func (db *sqliteContainer) CleavePoint() (int64, error) {
+	if err := db.connect(); err != nil {
+		return -1, err
+	}
+	var point int64
+	err := db.QueryRow("SELECT IFNULL(MAX(sync_point), -1) FROM outgoing_sync WHERE remote_id = ?", shardCleaveID).Scan(&point)
+	return point, err
+}
+
+// CleaveTo removes the object records up to ROWID point, which have been moved to the container's shards, and records
+// the point.
+func (db *sqliteContainer) CleaveTo(point int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM object WHERE ROWID <= ?", point); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO outgoing_sync (remote_id, sync_point) VALUES (?, ?)", shardCleaveID, point); err != nil {
+		return err
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
+// SetStoragePolicyIndex moves the container to another storage policy, after which its object records in other
+// policies are misplaced.
+func (db *sqliteContainer) SetStoragePolicyIndex(policyIndex int, timestamp string) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE container_info SET storage_policy_index = ?, status_changed_at = MAX(?, status_changed_at),
+						  reconciler_sync_point = -1`, policyIndex, timestamp); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT OR IGNORE INTO policy_stat (storage_policy_index) VALUES (?)", policyIndex); err != nil {
+		return err
+	}
+	defer db.invalidateCache()
+	return tx.Commit()
+}
+
+// MisplacedSince returns up to count object records with a ROWID greater than start that aren't in the container's
+// storage policy.
+func (db *sqliteContainer) MisplacedSince(start int64, count int) ([]*ObjectRecord, error) {
+	if err := db.flush(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT ROWID, name, created_at, size, content_type, etag, deleted, storage_policy_index
+						   FROM object WHERE ROWID > ?
+						   AND storage_policy_index != (SELECT storage_policy_index FROM container_info)
+						   ORDER BY ROWID ASC LIMIT ?`, start, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*ObjectRecord{}
+	for rows.Next() {
+		r := &ObjectRecord{}
+		if err := rows.Scan(&r.Rowid, &r.Name, &r.CreatedAt, &r.Size, &r.ContentType, &r.ETag, &r.Deleted, &r.StoragePolicyIndex); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// ReconcilerPoint returns the ROWID up to which misplaced object records have been queued for the reconciler.
+func (db *sqliteContainer) ReconcilerPoint() (int64, error) {
+	if err := db.connect(); err != nil {
+		return -1, err
+	}
+	var point int64
+	err := db.QueryRow("SELECT reconciler_sync_point FROM container_info").Scan(&point)
+	return point, err
+}
+
+// SetReconcilerPoint records the ROWID up to which misplaced object records have been queued for the reconciler.
+func (db *sqliteContainer) SetReconcilerPoint(point int64) error {
+	if err := db.connect(); err != nil {
+		return err
+	}
+	_, err := db.Exec("UPDATE container_info SET reconciler_sync_point = ?", point)
+	return err
+}
+
 func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadata map[string][]string, policyIndex, defaultPolicyIndex int) (bool, error) {
 	cdb, ok := db.(*sqliteContainer)
 	if !ok {
@@ -937,7 +1249,7 @@ func sqliteCreateExistingContainer(db Container, putTimestamp string, newMetadat
 	} else if err := json.Unmarshal([]byte(cMetadata), &existingMetadata); err != nil {
 		return false, err
 	}
-	metastr, err := cdb.mergeMetas(existingMetadata, newMetadata, cDeleteTimestamp)
+	metastr, err := mergeMetas(existingMetadata, newMetadata, cDeleteTimestamp)
 	if err != nil {
 		return false, err
 	}
@@ -989,7 +1301,7 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	}
 	defer tx.Rollback()
 	if _, err := tx.Exec(objectTableScript + policyStatTableScript + policyStatTriggerScript +
-		containerInfoTableScript + containerStatViewScript + syncTableScript); err != nil {
+		containerInfoTableScript + containerStatViewScript + syncTableScript + shardRangeTableScript); err != nil {
 		return err
 	}
 	if _, err := tx.Exec(`INSERT INTO container_info (account, container, created_at, id, put_timestamp,
@@ -1010,6 +1322,56 @@ func sqliteCreateContainer(containerFile string, account string, container strin
 	return nil
 }
 
+// IntegrityCheck runs sqlite's integrity check on the database, returning a dbauditor.Failure listing any problems found
+// or if the file is corrupt.  It opens the file read-only, so a broken database isn't migrated first.
+func (db *sqliteContainer) IntegrityCheck() error {
+	dbConn, err := sqliteOpenReadOnly(db.containerFile)
+	if err != nil {
+		return err
+	}
+	defer dbConn.Close()
+	rows, err := dbConn.Query("PRAGMA integrity_check")
+	if err != nil {
+		return integrityError(err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return integrityError(err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return integrityError(err)
+	}
+	if len(problems) > 0 {
+		return &dbauditor.Failure{Err: fmt.Errorf("Integrity check failed: %s", strings.Join(problems, "; "))}
+	}
+	return nil
+}
+
+// integrityError makes a dbauditor.Failure of an sqlite error saying the database is corrupt, leaving others, like the
+// database being locked, to be retried.
+func integrityError(err error) error {
+	if e, ok := err.(sqlite3.Error); ok && (e.Code == sqlite3.ErrCorrupt || e.Code == sqlite3.ErrNotADB) {
+		return &dbauditor.Failure{Err: err}
+	}
+	return err
+}
+
+// sqliteOpenReadOnly opens a container database read-only, without migrating its schema.
+func sqliteOpenReadOnly(containerFile string) (*sql.DB, error) {
+	dbConn, err := sql.Open("sqlite3_hummingbird", "file:"+containerFile+"?psow=1&mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open: %v", err)
+	}
+	return dbConn, nil
+}
+
 func sqliteOpenContainer(containerFile string) (ReplicableContainer, error) {
 	if !fs.Exists(containerFile) {
 		return nil, ErrorNoSuchContainer
@@ -1021,3 +1383,51 @@ func sqliteOpenContainer(containerFile string) (ReplicableContainer, error) {
 	}
 	return db, nil
 }
+
+// DatabaseReport describes a container database file, for "hummingbird db-info".
+type DatabaseReport struct {
+	Info        *ContainerInfo
+	SyncPoints  []*SyncRecord
+	ObjectRows  int64
+	DeletedRows int64
+}
+
+// InspectDatabase opens the container database at containerFile and reports its info, incoming sync points and
+// object row counts.  The file's opened read-only and isn't migrated, so it's left as it was found; updates still in
+// its pending file aren't counted.
+func InspectDatabase(containerFile string) (*DatabaseReport, error) {
+	if !fs.Exists(containerFile) {
+		return nil, ErrorNoSuchContainer
+	}
+	db := &sqliteContainer{containerFile: containerFile, readOnly: true}
+	dbConn, err := sqliteOpenReadOnly(containerFile)
+	if err != nil {
+		return nil, err
+	}
+	db.DB = dbConn
+	defer db.Close()
+	report := &DatabaseReport{}
+	if report.Info, err = db.GetInfo(); err != nil {
+		return nil, err
+	}
+	if report.SyncPoints, err = db.SyncTable(); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT deleted, COUNT(*) FROM object GROUP BY deleted")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deleted, count int64
+		if err := rows.Scan(&deleted, &count); err != nil {
+			return nil, err
+		}
+		if deleted == 0 {
+			report.ObjectRows += count
+		} else {
+			report.DeletedRows += count
+		}
+	}
+	return report, rows.Err()
+}
@@ -16,6 +16,7 @@
 package containerserver
 
 import (
+	"encoding/base64"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -26,6 +27,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/pickle"
 )
 
 func BenchmarkMergeItems(b *testing.B) {
@@ -56,7 +58,7 @@ func BenchmarkContainerListings(b *testing.B) {
 	}
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0)
+		records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, nil)
 		if err != nil {
 			panic("NON-NIL ERROR")
 		}
@@ -71,7 +73,7 @@ func TestContainerListings(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
-	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 3, len(records))
 	require.Equal(t, "a", records[0].(*ObjectListingRecord).Name)
@@ -96,7 +98,7 @@ func TestContainerListingsLimit(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
-	records, err := db.ListObjects(2, "", "", "", "", nil, false, 0)
+	records, err := db.ListObjects(2, "", "", "", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "a", records[0].(*ObjectListingRecord).Name)
@@ -108,7 +110,7 @@ func TestContainerListingsPrefixChange(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"b10\u2603"}))
-	records, err := db.ListObjects(10000, "", "", "b10", "", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "b10", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(records))
 }
@@ -118,14 +120,14 @@ func TestContainerListingsPrefix(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a1", "a2", "A3", "b1", "B2", "a10", "b10", "zz"}))
-	records, err := db.ListObjects(10000, "", "", "a", "", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "a", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 3, len(records))
 	require.Equal(t, "a1", records[0].(*ObjectListingRecord).Name)
 	require.Equal(t, "a10", records[1].(*ObjectListingRecord).Name)
 	require.Equal(t, "a2", records[2].(*ObjectListingRecord).Name)
 
-	records, err = db.ListObjects(10000, "", "", "b10", "", nil, false, 0)
+	records, err = db.ListObjects(10000, "", "", "b10", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(records))
 	require.Equal(t, "b10", records[0].(*ObjectListingRecord).Name)
@@ -136,7 +138,7 @@ func TestContainerListingsPrefixLimit(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a1", "b1", "a2", "b2", "a3", "b3"}))
-	records, err := db.ListObjects(2, "", "", "a", "", nil, false, 0)
+	records, err := db.ListObjects(2, "", "", "a", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "a1", records[0].(*ObjectListingRecord).Name)
@@ -148,7 +150,7 @@ func TestContainerListingsPrefixDelim(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"US-TX-A", "US-TX-B", "US-OK-A", "US-OK-B", "US-UT-A"}))
-	records, err := db.ListObjects(10000, "", "", "US-", "-", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "US-", "-", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 3, len(records))
 	require.Equal(t, "US-OK-", records[0].(*SubdirListingRecord).Name)
@@ -161,7 +163,7 @@ func TestContainerLeadingDelimiter(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"US-TX-A", "US-TX-B", "-UK", "-CH"}))
-	records, err := db.ListObjects(10000, "", "", "", "-", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "", "-", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "-", records[0].(*SubdirListingRecord).Name)
@@ -173,7 +175,7 @@ func TestContainerMarkers(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e", "f"}))
-	records, err := db.ListObjects(10000, "b", "e", "", "", nil, false, 0)
+	records, err := db.ListObjects(10000, "b", "e", "", "", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "c", records[0].(*ObjectListingRecord).Name)
@@ -185,7 +187,7 @@ func TestContainerReverse(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
-	records, err := db.ListObjects(10000, "", "", "", "", nil, true, 0)
+	records, err := db.ListObjects(10000, "", "", "", "", nil, true, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 3, len(records))
 	require.Equal(t, "c", records[0].(*ObjectListingRecord).Name)
@@ -198,7 +200,7 @@ func TestContainerReverseMarkers(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c", "d", "e", "f"}))
-	records, err := db.ListObjects(10000, "e", "b", "", "", nil, true, 0)
+	records, err := db.ListObjects(10000, "e", "b", "", "", nil, true, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "d", records[0].(*ObjectListingRecord).Name)
@@ -210,7 +212,7 @@ func TestContainerListingsReversePrefixDelim(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"US-TX-A", "US-TX-B", "US-OK-A", "US-OK-B", "US-UT-A"}))
-	records, err := db.ListObjects(10000, "", "", "US-", "-", nil, true, 0)
+	records, err := db.ListObjects(10000, "", "", "US-", "-", nil, true, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 3, len(records))
 	require.Equal(t, "US-UT-", records[0].(*SubdirListingRecord).Name)
@@ -223,13 +225,13 @@ func TestContainerListingsDelimiterAndPrefix(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"bar", "bazar"}))
-	records, err := db.ListObjects(10000, "", "", "ba", "a", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "ba", "a", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "bar", records[0].(*ObjectListingRecord).Name)
 	require.Equal(t, "baza", records[1].(*SubdirListingRecord).Name)
 
-	records, err = db.ListObjects(10000, "", "", "ba", "a", nil, true, 0)
+	records, err = db.ListObjects(10000, "", "", "ba", "a", nil, true, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "baza", records[0].(*SubdirListingRecord).Name)
@@ -241,13 +243,13 @@ func TestContainerListingsDelimiter(t *testing.T) {
 	require.Nil(t, err)
 	defer cleanup()
 	require.Nil(t, mergeItemsByName(db, []string{"test", "test-bar", "test-foo"}))
-	records, err := db.ListObjects(10000, "", "", "", "-", nil, false, 0)
+	records, err := db.ListObjects(10000, "", "", "", "-", nil, false, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "test", records[0].(*ObjectListingRecord).Name)
 	require.Equal(t, "test-", records[1].(*SubdirListingRecord).Name)
 
-	records, err = db.ListObjects(10000, "", "", "", "-", nil, true, 0)
+	records, err = db.ListObjects(10000, "", "", "", "-", nil, true, 0, nil)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(records))
 	require.Equal(t, "test-", records[0].(*SubdirListingRecord).Name)
@@ -303,7 +305,7 @@ func TestContainerListingsPaths(t *testing.T) {
 	require.Nil(t, mergeItemsByName(db, files))
 	assertListing := func(path string, expected []string) {
 		sort.Strings(expected)
-		records, err := db.ListObjects(10000, "", "", "", "-", &path, false, 0)
+		records, err := db.ListObjects(10000, "", "", "", "-", &path, false, 0, nil)
 		require.Nil(t, err)
 		require.Equal(t, len(expected), len(records))
 		for i, rec := range records {
@@ -345,6 +347,61 @@ func TestContainerListingsPaths(t *testing.T) {
 
 }
 
+func TestContainerListingsFilter(t *testing.T) {
+	db, _, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, db.PutObject("a", "1500000001.00000", 1, "text/plain", "d41d8cd98f00b204e9800998ecf8427e", 0,
+		map[string]string{"X-Object-Meta-Color": "red"}))
+	require.Nil(t, db.PutObject("b", "1500000002.00000", 100, "image/png", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("c", "1500000003.00000", 10, "text/plain;charset=utf-8", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.PutObject("d", "1500000004.00000", 10, "text/plainish", "d41d8cd98f00b204e9800998ecf8427e", 0, nil))
+	require.Nil(t, db.flush())
+	maxBytes := int64(10)
+	for _, tc := range []struct {
+		filter   *ListingFilter
+		expected []string
+	}{
+		{nil, []string{"a", "b", "c", "d"}},
+		{&ListingFilter{ContentType: "text/plain"}, []string{"a", "c"}},
+		{&ListingFilter{ContentType: "text/*"}, []string{"a", "c", "d"}},
+		{&ListingFilter{ModifiedSince: "1500000002.00000"}, []string{"c", "d"}},
+		{&ListingFilter{MaxBytes: &maxBytes, ContentType: "text/plain"}, []string{"a", "c"}},
+	} {
+		records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, tc.filter)
+		require.Nil(t, err)
+		names := []string{}
+		for _, r := range records {
+			names = append(names, r.(*ObjectListingRecord).Name)
+		}
+		require.Equal(t, tc.expected, names)
+	}
+	records, err := db.ListObjects(10000, "", "", "", "", nil, false, 0, &ListingFilter{IncludeMeta: true})
+	require.Nil(t, err)
+	require.Equal(t, ObjectListingMeta{"X-Object-Meta-Color": "red"}, records[0].(*ObjectListingRecord).Metadata)
+	require.Nil(t, records[1].(*ObjectListingRecord).Metadata)
+	items, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	metadata := map[string]string{}
+	for _, item := range items {
+		metadata[item.Name] = item.Metadata
+	}
+	require.Equal(t, `{"X-Object-Meta-Color":"red"}`, metadata["a"])
+}
+
+func TestOldPendingRecord(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("100000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	tuple := []interface{}{"a", "1500000001.00000", int64(1), "text/plain", "d41d8cd98f00b204e9800998ecf8427e", int64(0), int64(0)}
+	require.Nil(t, ioutil.WriteFile(dbFile+".pending", []byte(":"+base64.StdEncoding.EncodeToString(pickle.PickleDumps(tuple))), 0644))
+	items, err := db.ItemsSince(-1, 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	require.Equal(t, "a", items[0].Name)
+	require.Equal(t, "", items[0].Metadata)
+}
+
 func TestCreateAndGetInfo(t *testing.T) {
 	dir, err := ioutil.TempDir("", "")
 	require.Nil(t, err)
@@ -681,3 +738,41 @@ func TestCheckSyncLink(t *testing.T) {
 	db.CheckSyncLink()
 	require.False(t, fs.Exists(link))
 }
+
+func TestInspectDatabase(t *testing.T) {
+	db, dbFile, cleanup, err := createTestDatabase("200000000.00000")
+	require.Nil(t, err)
+	defer cleanup()
+	require.Nil(t, mergeItemsByName(db, []string{"a", "b", "c"}))
+	require.Nil(t, db.DeleteObject("b", "10000000.00002", 0))
+	require.Nil(t, db.MergeSyncTable([]*SyncRecord{{SyncPoint: 2, RemoteID: "remote"}}))
+	// merges the pending delete.
+	_, err = db.GetInfo()
+	require.Nil(t, err)
+	report, err := InspectDatabase(dbFile)
+	require.Nil(t, err)
+	require.Equal(t, "a", report.Info.Account)
+	require.Equal(t, "c", report.Info.Container)
+	require.Equal(t, int64(2), report.Info.ObjectCount)
+	require.Equal(t, int64(2), report.ObjectRows)
+	require.Equal(t, int64(1), report.DeletedRows)
+	syncPoints := map[string]int64{}
+	for _, p := range report.SyncPoints {
+		syncPoints[p.RemoteID] = p.SyncPoint
+	}
+	require.Equal(t, map[string]int64{"remote": 2, report.Info.ID: report.Info.MaxRow}, syncPoints)
+	_, err = InspectDatabase(dbFile + ".missing")
+	require.Equal(t, ErrorNoSuchContainer, err)
+
+	// the database is left as it's found, without merging its pending updates.
+	require.Nil(t, db.PutObject("d", "200000000.00003", 0, "text/plain", "", 0, nil))
+	pending, err := ioutil.ReadFile(dbFile + ".pending")
+	require.Nil(t, err)
+	require.NotEqual(t, 0, len(pending))
+	report, err = InspectDatabase(dbFile)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), report.ObjectRows)
+	after, err := ioutil.ReadFile(dbFile + ".pending")
+	require.Nil(t, err)
+	require.Equal(t, pending, after)
+}
@@ -24,6 +24,7 @@ import (
 
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 )
@@ -46,6 +47,8 @@ func (server *ContainerServer) accountUpdate(writer http.ResponseWriter, request
 			logger.Error("Account update failed: different numbers of hosts and devices in request")
 			return
 		}
+		span := tracing.StartChild(request.Context(), "account update")
+		defer span.Finish()
 		for index, host := range hosts {
 			url := fmt.Sprintf("http://%s/%s/%s/%s/%s", host, devices[index], accpartition,
 				common.Urlencode(vars["account"]), common.Urlencode(vars["container"]))
@@ -60,6 +63,7 @@ func (server *ContainerServer) accountUpdate(writer http.ResponseWriter, request
 			req.Header.Add("X-Bytes-Used", strconv.FormatInt(info.BytesUsed, 10))
 			req.Header.Add("X-Trans-Id", request.Header.Get("X-Trans-Id"))
 			req.Header.Add("X-Backend-Storage-Policy-Index", strconv.Itoa(info.StoragePolicyIndex))
+			span.Inject(req.Header)
 			if request.Header.Get("X-Account-Override-Deleted") == "yes" {
 				req.Header.Add("X-Account-Override-Deleted", "yes")
 			}
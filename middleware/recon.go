@@ -36,6 +36,7 @@ import (
 	"github.com/shirou/gopsutil/mem"
 	"github.com/shirou/gopsutil/process"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 )
 
@@ -260,6 +261,28 @@ func fileMD5(files ...string) (map[string]string, error) {
 	return response, nil
 }
 
+// ringMD5 returns each ring file's md5 along with the build version, build timestamp and format from its header.
+func ringMD5(files ...string) (map[string]interface{}, error) {
+	sums, err := fileMD5(files...)
+	if err != nil {
+		return nil, err
+	}
+	response := make(map[string]interface{})
+	for _, file := range files {
+		info, err := ring.ReadRingInfo(file)
+		if err != nil {
+			return nil, err
+		}
+		response[file] = map[string]interface{}{
+			"md5":             sums[file],
+			"version":         info.Version,
+			"build_timestamp": info.BuildTimestamp,
+			"format_version":  info.FormatVersion,
+		}
+	}
+	return response, nil
+}
+
 func ListDevices(driveRoot string) (map[string][]string, error) {
 	fileInfo, err := ioutil.ReadDir(driveRoot)
 	if err != nil {
@@ -399,10 +422,15 @@ func ReconHandler(driveRoot string, writer http.ResponseWriter, request *http.Re
 			return
 		}
 	case "ringmd5":
+		// plain md5s stay the default, since that's what swift-recon compares; ?versions=true adds the ring headers
+		sums := func(files ...string) (interface{}, error) { return fileMD5(files...) }
+		if request.URL.Query().Get("versions") == "true" {
+			sums = func(files ...string) (interface{}, error) { return ringMD5(files...) }
+		}
 		var err error
-		content, err = fileMD5("/etc/hummingbird/object.ring.gz", "/etc/hummingbird/container.ring.gz", "/etc/hummingbird/account.ring.gz")
+		content, err = sums("/etc/hummingbird/object.ring.gz", "/etc/hummingbird/container.ring.gz", "/etc/hummingbird/account.ring.gz")
 		if err != nil {
-			content, err = fileMD5("/etc/swift/object.ring.gz", "/etc/swift/container.ring.gz", "/etc/swift/account.ring.gz")
+			content, err = sums("/etc/swift/object.ring.gz", "/etc/swift/container.ring.gz", "/etc/swift/account.ring.gz")
 			if err != nil {
 				http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
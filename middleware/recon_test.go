@@ -23,9 +23,11 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
 )
 
@@ -180,3 +182,26 @@ func TestGetLoad(t *testing.T) {
 	require.True(t, ok)
 	require.True(t, m5f > 0.0)
 }
+
+func TestRingMD5(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	b, err := ring.NewRingBuilder(4, 1, 0)
+	require.Nil(t, err)
+	_, err = b.AddDevice(ring.Device{Ip: "127.0.0.1", Port: 6000, Device: "sda", Weight: 1})
+	require.Nil(t, err)
+	_, err = b.Rebalance(1, time.Unix(1500000000, 0))
+	require.Nil(t, err)
+	path := filepath.Join(dir, "object.ring.gz")
+	require.Nil(t, b.WriteRingFile(path))
+	sums, err := fileMD5(path)
+	require.Nil(t, err)
+	content, err := ringMD5(path)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{path: map[string]interface{}{
+		"md5": sums[path], "version": 1, "build_timestamp": int64(1500000000), "format_version": 1,
+	}}, content)
+	_, err = ringMD5(filepath.Join(dir, "missing.ring.gz"))
+	require.NotNil(t, err)
+}
@@ -24,7 +24,10 @@ import (
 )
 
 func Recover(w http.ResponseWriter, r *http.Request, msg string) {
-	if err := recover(); err != nil {
+	if err := recover(); err == http.ErrAbortHandler {
+		// the handler's cutting its response off on purpose, which net/http does quietly.
+		panic(err)
+	} else if err != nil {
 		transactionId := r.Header.Get("X-Trans-Id")
 		srv.GetLogger(r).Error(msg, zap.Any("err", err), zap.String("txn", transactionId))
 		// if we haven't set a status code yet, we can send a 500 response.
@@ -18,8 +18,10 @@ package objectserver
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -30,6 +32,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
@@ -62,6 +65,10 @@ type Auditor struct {
 	bytesProcessed, totalBytes    int64
 	quarantines, totalQuarantines int64
 	errors, totalErrors           int64
+	// counters kept for the life of the process, exported through the object server's /metrics.
+	completedPasses                     int64
+	lifetimeFiles, lifetimeBytes        int64
+	lifetimeQuarantines, lifetimeErrors int64
 }
 
 // OneTimeChan returns a channel that will yield the current time once, then is closed.
@@ -293,6 +300,87 @@ func (a *Auditor) finalLog() {
 		zap.Float64("Auditing rate", audit_rate))
 }
 
+// dumpCounters adds the pass just finished to the lifetime counters and writes them to the recon cache.
+func (a *Auditor) dumpCounters() {
+	a.completedPasses++
+	a.lifetimeFiles += a.totalPasses
+	a.lifetimeBytes += a.totalBytes
+	a.lifetimeQuarantines += a.totalQuarantines
+	a.lifetimeErrors += a.totalErrors
+	middleware.DumpReconCache(a.reconCachePath, "object",
+		map[string]interface{}{"object_auditor_counters_" + a.auditorType: map[string]interface{}{
+			"passes_completed":    a.completedPasses,
+			"files_audited":       a.lifetimeFiles,
+			"bytes_audited":       a.lifetimeBytes,
+			"quarantined":         a.lifetimeQuarantines,
+			"errors":              a.lifetimeErrors,
+			"last_pass_completed": float64(time.Now().UnixNano()) / float64(time.Second),
+			"last_pass_duration":  time.Since(a.passStart).Seconds(),
+		}})
+}
+
+// auditorCounters reads the counters each auditor type last wrote to the recon cache.
+func auditorCounters(reconCachePath string) map[string]map[string]float64 {
+	data, err := ioutil.ReadFile(filepath.Join(reconCachePath, "object.recon"))
+	if err != nil {
+		return nil
+	}
+	var recon map[string]json.RawMessage
+	if json.Unmarshal(data, &recon) != nil {
+		return nil
+	}
+	counters := map[string]map[string]float64{}
+	for key, value := range recon {
+		if !strings.HasPrefix(key, "object_auditor_counters_") {
+			continue
+		}
+		var c map[string]float64
+		if json.Unmarshal(value, &c) == nil && c != nil {
+			counters[strings.TrimPrefix(key, "object_auditor_counters_")] = c
+		}
+	}
+	return counters
+}
+
+// registerAuditorMetrics exports the auditors' counters, labelled by auditor type.
+// The auditors run in their own process, so these come from the recon cache, which is read once per scrape.
+func registerAuditorMetrics(r *metrics.Registry, reconCachePath string) {
+	var lock sync.Mutex
+	var counters map[string]map[string]float64
+	r.OnCollect(func() {
+		c := auditorCounters(reconCachePath)
+		lock.Lock()
+		counters = c
+		lock.Unlock()
+	})
+	for _, m := range []struct{ name, kind, key, help string }{
+		{"hummingbird_object_auditor_passes_total", "counter", "passes_completed", "Completed object audit passes."},
+		{"hummingbird_object_auditor_files_total", "counter", "files_audited", "Object files audited."},
+		{"hummingbird_object_auditor_bytes_total", "counter", "bytes_audited", "Object bytes audited."},
+		{"hummingbird_object_auditor_quarantines_total", "counter", "quarantined", "Objects quarantined by the auditor."},
+		{"hummingbird_object_auditor_errors_total", "counter", "errors", "Errors hit by the auditor."},
+		{"hummingbird_object_auditor_last_pass_completed_seconds", "gauge", "last_pass_completed", "Time the last audit pass finished, since unix epoch in seconds."},
+		{"hummingbird_object_auditor_last_pass_duration_seconds", "gauge", "last_pass_duration", "Duration of the last audit pass in seconds."},
+	} {
+		key := m.key
+		collect := func(emit func(float64, ...string)) {
+			lock.Lock()
+			scraped := counters
+			lock.Unlock()
+			for auditorType, c := range scraped {
+				if v, ok := c[key]; ok {
+					emit(v, auditorType)
+				}
+			}
+		}
+		if m.kind == "counter" {
+			r.NewCounterFunc(m.name, m.help, []string{"auditor_type"}, collect)
+		} else {
+			r.NewGaugeFunc(m.name, m.help, []string{"auditor_type"}, collect)
+		}
+	}
+}
+
 // run audit passes of the whole server until c is closed.
 func (a *Auditor) run(c <-chan time.Time) {
 	for a.passStart = range c {
@@ -319,6 +407,7 @@ func (a *Auditor) run(c <-chan time.Time) {
 			a.auditDevice(filepath.Join(a.driveRoot, dev))
 		}
 		a.finalLog()
+		a.dumpCounters()
 	}
 }
 
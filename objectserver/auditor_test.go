@@ -16,6 +16,7 @@
 package objectserver
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/pickle"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -455,3 +457,32 @@ func TestStatReport(t *testing.T) {
 	require.Equal(t, want[0].Context[8], obslog.Context[8])
 	require.Equal(t, want[0].Context[9], obslog.Context[9])
 }
+
+func TestAuditorCounters(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sda", "objects", "1", "abc", "fffffffffffffffffffffffffffffabc"), 0777)
+	f, _ := os.Create(filepath.Join(dir, "sda", "objects", "1", "abc", "fffffffffffffffffffffffffffffabc", "12345.data"))
+	defer f.Close()
+	WriteMetadata(f.Fd(), map[string]string{"Content-Length": "12", "ETag": "d3ac5112fe464b81184352ccba743001", "name": "", "Content-Type": "", "X-Timestamp": ""})
+	f.Write([]byte("testcontents"))
+	reconDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(reconDir)
+	auditor := makeAuditor("mount_check", "false", "recon_cache_path", reconDir)
+	auditor.driveRoot = dir
+	auditor.auditorType = "ALL"
+	auditor.run(OneTimeChan())
+	auditor.run(OneTimeChan())
+	counters := auditorCounters(reconDir)
+	require.Equal(t, 2.0, counters["ALL"]["passes_completed"])
+	require.Equal(t, 2.0, counters["ALL"]["files_audited"])
+	require.Equal(t, 24.0, counters["ALL"]["bytes_audited"])
+
+	r := metrics.NewRegistry()
+	registerAuditorMetrics(r, reconDir)
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+	require.Contains(t, out.String(), "hummingbird_object_auditor_passes_total{auditor_type=\"ALL\"} 2\n")
+	require.Contains(t, out.String(), "hummingbird_object_auditor_bytes_total{auditor_type=\"ALL\"} 24\n")
+	require.Nil(t, auditorCounters(filepath.Join(reconDir, "missing")))
+}
@@ -153,7 +153,9 @@ func QuarantineHash(hashDir string) error {
 	if err := os.Rename(hashDir, destDir); err != nil {
 		return err
 	}
-	return nil
+	// the directory's mtime is when it was quarantined, for purging old quarantines.
+	now := time.Now()
+	return os.Chtimes(destDir, now, now)
 }
 
 // InvalidateHash invalidates the hashdir's suffix hash, indicating it needs to be recalculated.
@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/fs"
@@ -133,9 +134,17 @@ func TestQuarantineHash(t *testing.T) {
 
 	hashDir := filepath.Join(driveRoot, "sda", "objects", "1", "abc", "fffffffffffffffffffffffffffffabc")
 	os.MkdirAll(hashDir, 0777)
+	old := time.Now().Add(-time.Hour)
+	require.Nil(t, os.Chtimes(hashDir, old, old))
 	QuarantineHash(hashDir)
 	require.True(t, fs.Exists(filepath.Join(driveRoot, "sda", "quarantined", "objects")))
 	require.False(t, fs.Exists(hashDir))
+	quarantined, err := filepath.Glob(filepath.Join(driveRoot, "sda", "quarantined", "objects", "fffffffffffffffffffffffffffffabc-*"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(quarantined))
+	info, err := os.Stat(quarantined[0])
+	require.Nil(t, err)
+	require.True(t, info.ModTime().After(old))
 
 	hashDir = filepath.Join(driveRoot, "sdb", "objects-1", "1", "abc", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
 	os.MkdirAll(hashDir, 0777)
@@ -0,0 +1,485 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/pickle"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// driveReplaceJob is a restore job and how far it's gotten.
+type driveReplaceJob struct {
+	PriorityRepJob
+	// Sent is set once the source's replicator has accepted the job.
+	Sent bool `json:"sent"`
+	// Rebuilt is set once the new drive's suffix hashes for the partition match the source's.
+	Rebuilt bool `json:"rebuilt"`
+}
+
+// transferCounter accumulates a replicator stat that starts over with each replication pass.
+type transferCounter struct {
+	Last  int64 `json:"last"`
+	Total int64 `json:"total"`
+}
+
+func (c *transferCounter) update(value int64) {
+	if value >= c.Last {
+		c.Total += value - c.Last
+	} else {
+		c.Total += value
+	}
+	c.Last = value
+}
+
+// driveReplaceState is everything a drive-replace run needs to pick up where it left off.
+type driveReplaceState struct {
+	Ip      string             `json:"ip"`
+	Device  string             `json:"device"`
+	Policy  int                `json:"policy"`
+	Started time.Time          `json:"started"`
+	Jobs    []*driveReplaceJob `json:"jobs"`
+	// BytesSent and FilesSent are the totals reported by the source devices' replicators since the run started.
+	// They include any regular replication those devices did at the same time.
+	BytesSent map[string]*transferCounter `json:"bytes_sent"`
+	FilesSent map[string]*transferCounter `json:"files_sent"`
+	Verified  bool                        `json:"verified"`
+}
+
+func loadDriveReplaceState(path string) (*driveReplaceState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &driveReplaceState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %v", path, err)
+	}
+	return state, nil
+}
+
+type driveReplacer struct {
+	client    *http.Client
+	ring      ring.Ring
+	state     *driveReplaceState
+	statePath string
+	out       io.Writer
+	// checkLimit is how many partitions to check for being rebuilt each round.
+	checkLimit int
+	// giveUp is how long to keep going without any more partitions being rebuilt, say because a source device is
+	// unreachable; 0 keeps going forever.
+	giveUp time.Duration
+}
+
+// save atomically writes the state file.
+func (d *driveReplacer) save() error {
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(d.statePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".drive_replace")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), d.statePath)
+}
+
+func replicatorURL(dev *ring.Device) string {
+	return fmt.Sprintf("http://%s:%d", dev.ReplicationIp, dev.ReplicationPort+500)
+}
+
+// getRemoteHashes asks a device's replicator for the partition's suffix hashes.
+func getRemoteHashes(client *http.Client, dev *ring.Device, partition uint64, policy int) (map[string]string, error) {
+	req, err := http.NewRequest("REPLICATE", fmt.Sprintf("%s/%s/%d", replicatorURL(dev), dev.Device, partition), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/%s returned %d for partition %d", dev.Ip, dev.Device, resp.StatusCode, partition)
+	}
+	v, err := pickle.PickleLoads(data)
+	if err != nil {
+		return nil, err
+	}
+	pickled, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s/%s returned invalid hashes for partition %d", dev.Ip, dev.Device, partition)
+	}
+	hashes := make(map[string]string, len(pickled))
+	for k, v := range pickled {
+		suffix, _ := k.(string)
+		hash, _ := v.(string)
+		hashes[suffix] = hash
+	}
+	return hashes, nil
+}
+
+// mismatchedSuffixes returns the suffixes any peer has that the target is missing or doesn't have a matching hash
+// for. Peers may disagree with each other while replication is still settling, so agreeing with any one of them is
+// enough.
+func mismatchedSuffixes(target map[string]string, peers []map[string]string) []string {
+	var bad []string
+	seen := map[string]bool{}
+	for _, peer := range peers {
+		for suffix := range peer {
+			if seen[suffix] {
+				continue
+			}
+			seen[suffix] = true
+			hash, ok := target[suffix]
+			matched := false
+			for _, p := range peers {
+				if ph, ok := p[suffix]; ok && ph == hash {
+					matched = true
+					break
+				}
+			}
+			if !ok || !matched {
+				bad = append(bad, suffix)
+			}
+		}
+	}
+	sort.Strings(bad)
+	return bad
+}
+
+// sendJobs enqueues every job that hasn't been accepted yet.
+func (d *driveReplacer) sendJobs() {
+	var jobs []*PriorityRepJob
+	byJob := map[*PriorityRepJob]*driveReplaceJob{}
+	for _, job := range d.state.Jobs {
+		if !job.Sent && !job.Rebuilt {
+			jobs = append(jobs, &job.PriorityRepJob)
+			byJob[&job.PriorityRepJob] = job
+		}
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	for _, accepted := range doPriRepJobs(jobs, 2, d.client, nil, nil) {
+		byJob[accepted].Sent = true
+	}
+}
+
+// pollProgress reads the source devices' transfer counters from their replicators' progress reports.
+func (d *driveReplacer) pollProgress() {
+	sources := map[string][]*ring.Device{}
+	seen := map[string]bool{}
+	for _, job := range d.state.Jobs {
+		key := deviceKey(job.FromDevice, d.state.Policy)
+		url := replicatorURL(job.FromDevice)
+		if !seen[url+"/"+key] {
+			seen[url+"/"+key] = true
+			sources[url] = append(sources[url], job.FromDevice)
+		}
+	}
+	for url, devs := range sources {
+		resp, err := d.client.Get(url + "/progress")
+		if err != nil {
+			fmt.Fprintf(d.out, "Unable to get progress from %s: %v\n", url, err)
+			continue
+		}
+		var progress map[string]map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&progress)
+		resp.Body.Close()
+		if err != nil {
+			fmt.Fprintf(d.out, "Invalid progress report from %s: %v\n", url, err)
+			continue
+		}
+		for _, dev := range devs {
+			key := deviceKey(dev, d.state.Policy)
+			stats, ok := progress[key]
+			if !ok {
+				continue
+			}
+			for name, counters := range map[string]map[string]*transferCounter{"BytesSent": d.state.BytesSent, "FilesSent": d.state.FilesSent} {
+				value, ok := stats[name].(float64)
+				if !ok {
+					continue
+				}
+				counterKey := dev.ReplicationIp + "/" + key
+				if counters[counterKey] == nil {
+					// counts from before the run aren't ours.
+					counters[counterKey] = &transferCounter{Last: int64(value)}
+				} else {
+					counters[counterKey].update(int64(value))
+				}
+			}
+		}
+	}
+}
+
+// checkRebuilt compares the new drive's suffix hashes with the sources' for up to checkLimit unfinished jobs.
+func (d *driveReplacer) checkRebuilt() {
+	checked := 0
+	for _, job := range d.state.Jobs {
+		if job.Rebuilt {
+			continue
+		}
+		if checked >= d.checkLimit {
+			break
+		}
+		checked++
+		sourceHashes, err := getRemoteHashes(d.client, job.FromDevice, job.Partition, d.state.Policy)
+		if err != nil {
+			continue
+		}
+		targetHashes, err := getRemoteHashes(d.client, job.ToDevices[0], job.Partition, d.state.Policy)
+		if err != nil {
+			continue
+		}
+		if len(mismatchedSuffixes(targetHashes, []map[string]string{sourceHashes})) == 0 {
+			job.Rebuilt = true
+		}
+	}
+}
+
+func (d *driveReplacer) rebuiltCount() int {
+	count := 0
+	for _, job := range d.state.Jobs {
+		if job.Rebuilt {
+			count++
+		}
+	}
+	return count
+}
+
+func counterTotal(counters map[string]*transferCounter) int64 {
+	total := int64(0)
+	for _, c := range counters {
+		total += c.Total
+	}
+	return total
+}
+
+func (d *driveReplacer) report() {
+	rebuilt := d.rebuiltCount()
+	percent := 100.0
+	if len(d.state.Jobs) > 0 {
+		percent = float64(rebuilt) * 100 / float64(len(d.state.Jobs))
+	}
+	fmt.Fprintf(d.out, "%d/%d partitions rebuilt (%.1f%%), %d bytes in %d files sent, %s elapsed\n", rebuilt,
+		len(d.state.Jobs), percent, counterTotal(d.state.BytesSent), counterTotal(d.state.FilesSent),
+		time.Since(d.state.Started).Truncate(time.Second))
+}
+
+// verify compares the new drive's suffix hashes for each partition against all of its peers', returning the
+// suffixes that didn't match by partition.
+func (d *driveReplacer) verify() map[uint64][]string {
+	failures := map[uint64][]string{}
+	for _, job := range d.state.Jobs {
+		target := job.ToDevices[0]
+		targetHashes, err := getRemoteHashes(d.client, target, job.Partition, d.state.Policy)
+		if err != nil {
+			fmt.Fprintf(d.out, "Unable to verify partition %d: %v\n", job.Partition, err)
+			failures[job.Partition] = nil
+			continue
+		}
+		var peers []map[string]string
+		for _, dev := range d.ring.GetNodes(job.Partition) {
+			if dev.Id == target.Id {
+				continue
+			}
+			if hashes, err := getRemoteHashes(d.client, dev, job.Partition, d.state.Policy); err == nil {
+				peers = append(peers, hashes)
+			}
+		}
+		if len(peers) == 0 {
+			fmt.Fprintf(d.out, "Unable to verify partition %d: no peers answered\n", job.Partition)
+			failures[job.Partition] = nil
+		} else if bad := mismatchedSuffixes(targetHashes, peers); len(bad) > 0 {
+			failures[job.Partition] = bad
+		}
+	}
+	return failures
+}
+
+// run sends the jobs and reports progress every interval until every partition is rebuilt, then verifies the drive.
+// It gives up if no more partitions are rebuilt within giveUp.
+func (d *driveReplacer) run(interval time.Duration) error {
+	rebuilt := d.rebuiltCount()
+	lastRebuilt := time.Now()
+	for {
+		d.sendJobs()
+		d.pollProgress()
+		d.checkRebuilt()
+		d.report()
+		if err := d.save(); err != nil {
+			fmt.Fprintf(d.out, "Unable to save state to %s: %v\n", d.statePath, err)
+		}
+		if count := d.rebuiltCount(); count == len(d.state.Jobs) {
+			break
+		} else if count > rebuilt {
+			rebuilt = count
+			lastRebuilt = time.Now()
+		} else if d.giveUp > 0 && time.Since(lastRebuilt) >= d.giveUp {
+			return fmt.Errorf("No partitions rebuilt in %s; giving up. Run again to resume once the source devices are reachable.", d.giveUp)
+		}
+		time.Sleep(interval)
+	}
+	fmt.Fprintln(d.out, "Verifying suffix hashes against peers")
+	failures := d.verify()
+	partitions := make([]int, 0, len(failures))
+	for partition := range failures {
+		partitions = append(partitions, int(partition))
+	}
+	sort.Ints(partitions)
+	for _, partition := range partitions {
+		fmt.Fprintf(d.out, "Partition %d does not match its peers: %v\n", partition, failures[uint64(partition)])
+	}
+	d.state.Verified = len(failures) == 0
+	if err := d.save(); err != nil {
+		fmt.Fprintf(d.out, "Unable to save state to %s: %v\n", d.statePath, err)
+	}
+	if !d.state.Verified {
+		return fmt.Errorf("Drive rebuilt but failed verification; run again once replication settles.")
+	}
+	return nil
+}
+
+// checkNewDrive makes sure the replacement drive is mounted, if mountCheck is set, and can store objects.
+func checkNewDrive(devicePath string, mountCheck bool) error {
+	if mountCheck {
+		if mounted, err := fs.IsMount(devicePath); err != nil {
+			return err
+		} else if !mounted {
+			return fmt.Errorf("%s is not mounted", devicePath)
+		}
+	}
+	f, err := ioutil.TempFile(devicePath, ".drive_replace_check")
+	if err != nil {
+		return fmt.Errorf("unable to write to %s: %v", devicePath, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := WriteMetadata(f.Fd(), map[string]string{"name": "/drive/replace/check"}); err != nil {
+		return fmt.Errorf("unable to set xattrs on %s: %v", devicePath, err)
+	}
+	if metadata, err := ReadMetadata(f.Fd()); err != nil || metadata["name"] != "/drive/replace/check" {
+		return fmt.Errorf("unable to read back xattrs on %s: %v", devicePath, err)
+	}
+	return nil
+}
+
+// DriveReplace takes an IP address and device name such as []string{"172.24.0.1", "sda1"} and rebuilds that
+// replaced drive from its peers, reporting progress as it goes and verifying the result. Its progress is kept in a
+// state file so it can be run again to resume after an interruption, or after it gives up on partitions that stop being
+// rebuilt.
+func DriveReplace(args []string) {
+	flags := flag.NewFlagSet("drive-replace", flag.ExitOnError)
+	policy := flags.Int("p", 0, "policy index to use")
+	driveRoot := flags.String("devices", "/srv/node", "where the devices are mounted, for checking the new drive")
+	checkDrive := flags.Bool("check-drive", true, "check the new drive is mounted and usable; requires running on its server")
+	mountCheck := flags.Bool("mount-check", true, "require the new drive to be a mount point")
+	statePath := flags.String("state", "", "state file (default /var/cache/swift/drive_replace_IP_DEVICE_POLICY.json)")
+	interval := flags.Duration("interval", 30*time.Second, "how often to check progress")
+	checkLimit := flags.Int("checks", 100, "partitions to check for completion each interval")
+	giveUp := flags.Duration("give-up", time.Hour, "give up when no partitions have been rebuilt for this long (0 never gives up)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird drive-replace [ARGS] [ip] [device]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(flags.Args()) != 2 {
+		flags.Usage()
+		return
+	}
+	ip, device := flags.Arg(0), flags.Arg(1)
+	if *statePath == "" {
+		*statePath = fmt.Sprintf("/var/cache/swift/drive_replace_%s_%s_%d.json", ip, device, *policy)
+	}
+	d := &driveReplacer{client: &http.Client{Timeout: time.Hour}, statePath: *statePath, out: os.Stdout,
+		checkLimit: *checkLimit, giveUp: *giveUp}
+
+	if *checkDrive {
+		if err := checkNewDrive(filepath.Join(*driveRoot, device), *mountCheck); err != nil {
+			fmt.Fprintln(d.out, "New drive failed checks:", err)
+			return
+		}
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(d.out, "Unable to load hash path prefix and suffix:", err)
+		return
+	}
+	objRing, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, *policy)
+	if err != nil {
+		fmt.Fprintln(d.out, "Unable to load ring:", err)
+		return
+	}
+	d.ring = objRing
+	if d.state, err = loadDriveReplaceState(*statePath); err == nil {
+		if d.state.Ip != ip || d.state.Device != device || d.state.Policy != *policy {
+			fmt.Fprintf(d.out, "State file %s is for %s/%s policy %d\n", *statePath, d.state.Ip, d.state.Device, d.state.Policy)
+			return
+		}
+		// the replicators may have lost queued jobs in whatever interrupted us, so send the rest again.
+		for _, job := range d.state.Jobs {
+			job.Sent = false
+		}
+		fmt.Fprintf(d.out, "Resuming from %s: %d/%d partitions rebuilt\n", *statePath, d.rebuiltCount(), len(d.state.Jobs))
+	} else if os.IsNotExist(err) {
+		d.state = &driveReplaceState{Ip: ip, Device: device, Policy: *policy, Started: time.Now(),
+			BytesSent: map[string]*transferCounter{}, FilesSent: map[string]*transferCounter{}}
+		for _, job := range getRestoreDeviceJobs(objRing, ip, device, *policy) {
+			d.state.Jobs = append(d.state.Jobs, &driveReplaceJob{PriorityRepJob: *job})
+		}
+		fmt.Fprintln(d.out, "Job count:", len(d.state.Jobs))
+	} else {
+		fmt.Fprintln(d.out, err)
+		return
+	}
+	if err := d.run(*interval); err != nil {
+		fmt.Fprintln(d.out, err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(d.out, "Drive rebuilt and verified.")
+}
@@ -0,0 +1,209 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package objectserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/troubling/hummingbird/common/pickle"
+	"github.com/troubling/hummingbird/common/ring"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeReplicators answers for every device's replicator, rebuilding a partition on a priority job by copying the
+// source's suffix hashes.
+type fakeReplicators struct {
+	lock      sync.Mutex
+	hashes    map[string]map[string]string
+	bytesSent int64
+}
+
+func (f *fakeReplicators) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch {
+	case r.URL.Path == "/priorityrep":
+		var job PriorityRepJob
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		source := f.hashes[fmt.Sprintf("%s/%d", job.FromDevice.Device, job.Partition)]
+		f.hashes[fmt.Sprintf("%s/%d", job.ToDevices[0].Device, job.Partition)] = source
+		f.bytesSent += int64(len(source)) * 1000
+	case r.URL.Path == "/progress":
+		json.NewEncoder(w).Encode(map[string]map[string]interface{}{
+			"drive2": {"BytesSent": f.bytesSent, "FilesSent": f.bytesSent / 1000},
+		})
+	case r.Method == "REPLICATE":
+		hashes := f.hashes[strings.TrimPrefix(r.URL.Path, "/")]
+		if hashes == nil {
+			hashes = map[string]string{}
+		}
+		w.Write(pickle.PickleDumps(hashes))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+type driveReplaceRing struct {
+	priFakeRing
+	nodes []*ring.Device
+}
+
+func (d *driveReplaceRing) GetNodes(partition uint64) []*ring.Device {
+	return d.nodes
+}
+
+func (d *driveReplaceRing) GetNodesInOrder(partition uint64) []*ring.Device {
+	return d.nodes
+}
+
+func TestMismatchedSuffixes(t *testing.T) {
+	t.Parallel()
+	peer1 := map[string]string{"abc": "1", "def": "2", "fed": "3"}
+	peer2 := map[string]string{"abc": "1", "def": "4"}
+	require.Equal(t, 0, len(mismatchedSuffixes(map[string]string{"abc": "1", "def": "4", "fed": "3"}, []map[string]string{peer1, peer2})))
+	require.Equal(t, []string{"def", "fed"}, mismatchedSuffixes(map[string]string{"abc": "1", "def": "5"}, []map[string]string{peer1, peer2}))
+	require.Equal(t, 0, len(mismatchedSuffixes(map[string]string{"abc": "1"}, nil)))
+}
+
+func TestTransferCounter(t *testing.T) {
+	t.Parallel()
+	c := &transferCounter{Last: 100}
+	c.update(150)
+	require.EqualValues(t, 50, c.Total)
+	c.update(20)
+	require.EqualValues(t, 70, c.Total)
+	require.EqualValues(t, 20, c.Last)
+}
+
+func TestCheckNewDrive(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, checkNewDrive(dir, false))
+	names, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(names))
+	require.NotNil(t, checkNewDrive(dir, true))
+	require.NotNil(t, checkNewDrive(filepath.Join(dir, "missing"), false))
+}
+
+func TestDriveReplaceRun(t *testing.T) {
+	t.Parallel()
+	replicators := &fakeReplicators{hashes: map[string]map[string]string{
+		"drive2/0": {"abc": "1", "def": "2"},
+		"drive3/0": {"abc": "1", "def": "2"},
+		"drive2/1": {"123": "3"},
+		"drive3/1": {"123": "3"},
+	}}
+	ts := httptest.NewServer(replicators)
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+	var nodes []*ring.Device
+	for i := 1; i <= 3; i++ {
+		nodes = append(nodes, &ring.Device{Id: i, Device: fmt.Sprintf("drive%d", i), Ip: host, Port: port - 500,
+			ReplicationIp: host, ReplicationPort: port - 500})
+	}
+	r := &driveReplaceRing{priFakeRing: priFakeRing{mapping: map[uint64][]int{0: {1, 2, 3}, 1: {1, 2, 3}}}, nodes: nodes}
+
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	state := &driveReplaceState{Ip: host, Device: "drive1", Started: time.Now(),
+		BytesSent: map[string]*transferCounter{}, FilesSent: map[string]*transferCounter{}}
+	for _, partition := range []uint64{0, 1} {
+		state.Jobs = append(state.Jobs, &driveReplaceJob{PriorityRepJob: PriorityRepJob{
+			Partition: partition, FromDevice: nodes[1], ToDevices: []*ring.Device{nodes[0]}}})
+	}
+	// the first job was already done before a restart.
+	state.Jobs[0].Sent = true
+	state.Jobs[0].Rebuilt = true
+	replicators.hashes["drive1/0"] = replicators.hashes["drive2/0"]
+	statePath := filepath.Join(dir, "state.json")
+	out := &bytes.Buffer{}
+	d := &driveReplacer{client: http.DefaultClient, ring: r, state: state, statePath: statePath, out: out, checkLimit: 10}
+
+	d.pollProgress()
+	require.Nil(t, d.run(time.Millisecond))
+	require.Contains(t, out.String(), "2/2 partitions rebuilt (100.0%), 1000 bytes in 1 files sent")
+	require.Contains(t, out.String(), "Verifying suffix hashes against peers\n")
+	saved, err := loadDriveReplaceState(statePath)
+	require.Nil(t, err)
+	require.True(t, saved.Verified)
+	require.True(t, saved.Jobs[1].Sent)
+	require.True(t, saved.Jobs[1].Rebuilt)
+	require.EqualValues(t, 1000, counterTotal(saved.BytesSent))
+
+	// a peer changes after the rebuild.
+	replicators.lock.Lock()
+	replicators.hashes["drive2/1"] = map[string]string{"123": "3", "456": "4"}
+	replicators.hashes["drive3/1"] = map[string]string{"123": "3", "456": "4"}
+	replicators.lock.Unlock()
+	failures := d.verify()
+	require.Equal(t, map[uint64][]string{1: {"456"}}, failures)
+}
+
+func TestDriveReplaceRunGivesUp(t *testing.T) {
+	t.Parallel()
+	// nothing's listening on the source device's replication port.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	u, _ := url.Parse(ts.URL)
+	ts.Close()
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+	var nodes []*ring.Device
+	for i := 1; i <= 3; i++ {
+		nodes = append(nodes, &ring.Device{Id: i, Device: fmt.Sprintf("drive%d", i), Ip: host, Port: port - 500,
+			ReplicationIp: host, ReplicationPort: port - 500})
+	}
+	r := &driveReplaceRing{priFakeRing: priFakeRing{mapping: map[uint64][]int{0: {1, 2, 3}}}, nodes: nodes}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	state := &driveReplaceState{Ip: host, Device: "drive1", Started: time.Now(),
+		BytesSent: map[string]*transferCounter{}, FilesSent: map[string]*transferCounter{},
+		Jobs: []*driveReplaceJob{{PriorityRepJob: PriorityRepJob{Partition: 0, FromDevice: nodes[1],
+			ToDevices: []*ring.Device{nodes[0]}}}}}
+	out := &bytes.Buffer{}
+	d := &driveReplacer{client: http.DefaultClient, ring: r, state: state, statePath: filepath.Join(dir, "state.json"),
+		out: out, checkLimit: 10, giveUp: 10 * time.Millisecond}
+	err = d.run(time.Millisecond)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "No partitions rebuilt in 10ms; giving up")
+	require.False(t, state.Verified)
+	_, err = loadDriveReplaceState(d.statePath)
+	require.Nil(t, err)
+}
@@ -35,7 +35,9 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 )
@@ -56,13 +58,20 @@ type ObjectServer struct {
 	objEngines       map[int]ObjectEngine
 	updateTimeout    time.Duration
 	asyncWG          sync.WaitGroup // Used to wait on async goroutines
+	reconCachePath   string
+	metrics          *metrics.Registry
+	requestDurations *metrics.Histogram
+	tracer           *tracing.Tracer
 }
 
 func (server *ObjectServer) Finalize() {
 	server.asyncWG.Wait()
+	server.tracer.Close()
 }
 
 func (server *ObjectServer) newObject(req *http.Request, vars map[string]string, needData bool) (Object, error) {
+	span := tracing.StartChild(req.Context(), "disk open")
+	defer span.Finish()
 	policy, err := strconv.Atoi(req.Header.Get("X-Backend-Storage-Policy-Index"))
 	if err != nil {
 		policy = 0
@@ -295,7 +304,9 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 
 	hash := md5.New()
+	span := tracing.StartChild(request.Context(), "write")
 	totalSize, err := common.Copy(request.Body, tempFile, hash)
+	span.Finish()
 	if err == io.ErrUnexpectedEOF {
 		srv.StandardResponse(writer, 499)
 		return
@@ -325,7 +336,10 @@ func (server *ObjectServer) ObjPutHandler(writer http.ResponseWriter, request *h
 	}
 	outHeaders.Set("ETag", metadata["ETag"])
 
-	if err := obj.Commit(metadata); err != nil {
+	span = tracing.StartChild(request.Context(), "fsync")
+	err = obj.Commit(metadata)
+	span.Finish()
+	if err != nil {
 		srv.GetLogger(request).Error("Error saving object", zap.Error(err))
 		srv.StandardResponse(writer, http.StatusInternalServerError)
 		return
@@ -395,7 +409,10 @@ func (server *ObjectServer) ObjDeleteHandler(writer http.ResponseWriter, request
 		"X-Timestamp": requestTimestamp,
 		"name":        "/" + vars["account"] + "/" + vars["container"] + "/" + vars["obj"],
 	}
-	if err := obj.Delete(metadata); err == DriveFullError {
+	span := tracing.StartChild(request.Context(), "fsync")
+	err = obj.Delete(metadata)
+	span.Finish()
+	if err == DriveFullError {
 		srv.GetLogger(request).Debug("Not enough space available")
 		srv.CustomErrorResponse(writer, 507, vars)
 		return
@@ -444,7 +461,15 @@ func (server *ObjectServer) LogRequest(next http.Handler) http.Handler {
 		start := time.Now()
 		logr := server.logger.With(zap.String("txn", request.Header.Get("X-Trans-Id")))
 		request = srv.SetLogger(request, logr)
+		span := server.tracer.StartFromHeader("object-server "+request.Method, request.Header)
+		span.SetAttribute("txn", request.Header.Get("X-Trans-Id"))
+		span.SetAttribute("path", request.URL.Path)
+		request = request.WithContext(tracing.ContextWithSpan(request.Context(), span))
 		next.ServeHTTP(newWriter, request)
+		span.SetAttribute("status", strconv.Itoa(newWriter.Status))
+		span.Finish()
+		server.requestDurations.Observe(time.Since(start).Seconds(), request.Method, strconv.Itoa(newWriter.Status),
+			request.Header.Get("X-Backend-Storage-Policy-Index"))
 		forceAcquire := request.Header.Get("X-Force-Acquire") == "true"
 
 		extraInfo := "-"
@@ -516,13 +541,22 @@ func (server *ObjectServer) updateDeviceLocks(seconds int64) {
 	}
 }
 
+func (server *ObjectServer) newMetrics() {
+	server.metrics, server.requestDurations = metrics.NewServerRegistry()
+	server.metrics.NewKeyedGaugeFunc("hummingbird_device_requests_in_use", "Requests currently holding each device.",
+		"device", server.diskInUse.InUse)
+	registerAuditorMetrics(server.metrics, server.reconCachePath)
+}
+
 func (server *ObjectServer) GetHandler(config conf.Config) http.Handler {
+	server.newMetrics()
 	commonHandlers := alice.New(server.LogRequest, middleware.RecoverHandler, middleware.ValidateRequest, server.AcquireDevice)
 	router := srv.NewRouter()
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
 	router.Get("/healthcheck", commonHandlers.ThenFunc(server.HealthcheckHandler))
 	router.Get("/diskusage", commonHandlers.ThenFunc(server.DiskUsageHandler))
+	router.Get("/metrics", commonHandlers.Then(server.metrics))
 	router.Get("/recon/:method/:recon_type", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/recon/:method", commonHandlers.ThenFunc(server.ReconHandler))
 	router.Get("/:device/:partition/:account/:container/*obj", commonHandlers.ThenFunc(server.ObjGetHandler))
@@ -570,6 +604,7 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	server.diskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "disk_limit", 25, 0))
 	server.accountDiskInUse = common.NewKeyedLimit(serverconf.GetLimit("app:object-server", "account_rate_limit", 20, 0))
 	server.expiringDivisor = serverconf.GetInt("app:object-server", "expiring_objects_container_divisor", 86400)
+	server.reconCachePath = serverconf.GetDefault("object-auditor", "recon_cache_path", "/var/cache/swift")
 	bindIP = serverconf.GetDefault("app:object-server", "bind_ip", "0.0.0.0")
 	bindPort = int(serverconf.GetInt("app:object-server", "bind_port", 6000))
 	if allowedHeaders, ok := serverconf.Get("app:object-server", "allowed_headers"); ok {
@@ -584,6 +619,9 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	if server.logger, err = srv.SetupLogger("object-server", &server.logLevel, flags); err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
+	if server.tracer, err = tracing.NewTracerFromConfig(serverconf, "app:object-server", "object-server", server.logger); err != nil {
+		return "", 0, nil, nil, err
+	}
 
 	server.updateTimeout = time.Duration(serverconf.GetFloat("app:object-server", "container_update_timeout", 0.25) * float64(time.Second))
 	connTimeout := time.Duration(serverconf.GetFloat("app:object-server", "conn_timeout", 1.0) * float64(time.Second))
@@ -591,6 +629,8 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (bindIP string, bind
 	server.updateClient = &http.Client{
 		Timeout:   nodeTimeout,
 		Transport: &http.Transport{Dial: (&net.Dialer{Timeout: connTimeout}).Dial},
+		// sharded containers redirect updates to their shards; those are followed by hand.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
 	}
 
 	deviceLockUpdateSeconds := serverconf.GetInt("app:object-server", "device_lock_update_seconds", 0)
@@ -17,6 +17,7 @@ package objectserver
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -37,6 +38,7 @@ import (
 	"github.com/troubling/hummingbird/common/pickle"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/common/tracing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -165,6 +167,68 @@ func TestBasicPutGet(t *testing.T) {
 	assert.Equal(t, "9", resp.Header.Get("Content-Length"))
 }
 
+func TestMetrics(t *testing.T) {
+	ts, err := makeObjectServer()
+	assert.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 404, resp.StatusCode)
+
+	resp, err = ts.Do("GET", "/metrics", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `hummingbird_request_duration_seconds_count{method="GET",status="404",policy="0"} 1`)
+	assert.Contains(t, string(body), `hummingbird_device_requests_in_use{device="sda"} 0`)
+	assert.Contains(t, string(body), "# TYPE hummingbird_object_auditor_passes_total counter")
+}
+
+func TestTracing(t *testing.T) {
+	traceDir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(traceDir)
+	traceFile := filepath.Join(traceDir, "traces.json")
+	ts, err := makeObjectServer("trace_sink", "file", "trace_file", traceFile)
+	require.Nil(t, err)
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s:%d/sda/0/a/c/o", ts.host, ts.port), bytes.NewBuffer([]byte("SOME DATA")))
+	require.Nil(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Length", "9")
+	req.Header.Set("X-Timestamp", common.GetTimestamp())
+	req.Header.Set("X-Backend-Storage-Policy-Index", "0")
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, 201, resp.StatusCode)
+	ts.objServer.Finalize()
+
+	data, err := ioutil.ReadFile(traceFile)
+	require.Nil(t, err)
+	spans := map[string]tracing.SpanData{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var span tracing.SpanData
+		require.Nil(t, json.Unmarshal([]byte(line), &span))
+		require.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.TraceID)
+		require.Equal(t, "object-server", span.Service)
+		spans[span.Name] = span
+	}
+	root, ok := spans["object-server PUT"]
+	require.True(t, ok)
+	require.Equal(t, "b7ad6b7169203331", root.ParentID)
+	require.Equal(t, "201", root.Attributes["status"])
+	for _, name := range []string{"disk open", "write", "fsync"} {
+		require.Equal(t, root.SpanID, spans[name].ParentID, name)
+	}
+}
+
 func TestBasicPutDelete(t *testing.T) {
 	ts, err := makeObjectServer()
 	assert.Nil(t, err)
@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
@@ -71,10 +73,182 @@ func (d *devLimiter) waitForSomethingToFinish() {
 	<-d.somethingFinished
 }
 
-// doPriRepJobs executes a list of PriorityRepJobs, limiting concurrent jobs per device to deviceMax.
-func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) {
+// priRepJobKey identifies a job in a checkpoint file.
+func priRepJobKey(job *PriorityRepJob) string {
+	to := make([]string, len(job.ToDevices))
+	for i, dev := range job.ToDevices {
+		to[i] = strconv.Itoa(dev.Id)
+	}
+	return fmt.Sprintf("%d %d %d %s", job.Policy, job.Partition, job.FromDevice.Id, strings.Join(to, ","))
+}
+
+func formatPriRepJob(job *PriorityRepJob) string {
+	to := make([]string, len(job.ToDevices))
+	for i, dev := range job.ToDevices {
+		to[i] = fmt.Sprintf("%s:%d/%s", dev.Ip, dev.Port, dev.Device)
+	}
+	return fmt.Sprintf("partition %d: %s:%d/%s -> %s", job.Partition, job.FromDevice.Ip, job.FromDevice.Port,
+		job.FromDevice.Device, strings.Join(to, ","))
+}
+
+// priRepCheckpoint is an append-only record of the jobs replicators have accepted, so an interrupted run can skip them.
+type priRepCheckpoint struct {
+	done map[string]bool
+	f    *os.File
+	m    sync.Mutex
+}
+
+func openPriRepCheckpoint(path string) (*priRepCheckpoint, error) {
+	c := &priRepCheckpoint{done: map[string]bool{}}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				c.done[line] = true
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+func (c *priRepCheckpoint) isDone(job *PriorityRepJob) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.done[priRepJobKey(job)]
+}
+
+func (c *priRepCheckpoint) record(job *PriorityRepJob) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	key := priRepJobKey(job)
+	c.done[key] = true
+	_, err := c.f.WriteString(key + "\n")
+	return err
+}
+
+func (c *priRepCheckpoint) Close() error {
+	return c.f.Close()
+}
+
+// priRepThrottle paces job dispatch across all devices, by jobs per second and by the bytes per second the source
+// replicators report sending. Replicators run accepted jobs on their own, so bandwidth can only be limited by holding
+// back new jobs; it's measured as an average since the throttle was created and includes regular replication.
+type priRepThrottle struct {
+	m            sync.Mutex
+	interval     time.Duration
+	next         time.Time
+	bandwidth    int64
+	client       *http.Client
+	replicators  []string
+	counters     map[string]*transferCounter
+	started      time.Time
+	lastPoll     time.Time
+	sent         int64
+	pollInterval time.Duration
+}
+
+func newPriRepThrottle(jobs []*PriorityRepJob, jobsPerSecond float64, bandwidth int64, client *http.Client) *priRepThrottle {
+	t := &priRepThrottle{bandwidth: bandwidth, client: client, counters: map[string]*transferCounter{},
+		started: time.Now(), pollInterval: time.Second}
+	if jobsPerSecond > 0 {
+		t.interval = time.Duration(float64(time.Second) / jobsPerSecond)
+	}
+	if bandwidth > 0 {
+		seen := map[string]bool{}
+		for _, job := range jobs {
+			if url := replicatorURL(job.FromDevice); !seen[url] {
+				seen[url] = true
+				t.replicators = append(t.replicators, url)
+			}
+		}
+		t.poll()
+	}
+	return t
+}
+
+// poll updates the bytes sent by the source replicators since the throttle was created.
+func (t *priRepThrottle) poll() {
+	t.lastPoll = time.Now()
+	for _, url := range t.replicators {
+		resp, err := t.client.Get(url + "/progress")
+		if err != nil {
+			continue
+		}
+		var progress map[string]map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&progress)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		for key, stats := range progress {
+			value, ok := stats["BytesSent"].(float64)
+			if !ok {
+				continue
+			}
+			if counter := t.counters[url+"/"+key]; counter == nil {
+				t.counters[url+"/"+key] = &transferCounter{Last: int64(value)}
+			} else {
+				counter.update(int64(value))
+			}
+		}
+	}
+	t.sent = counterTotal(t.counters)
+}
+
+// bandwidthDelay is how long to hold back so sent bytes over elapsed time averages out to bandwidth.
+func bandwidthDelay(sent int64, elapsed time.Duration, bandwidth int64) time.Duration {
+	allowed := time.Duration(float64(sent) / float64(bandwidth) * float64(time.Second))
+	if allowed > elapsed {
+		return allowed - elapsed
+	}
+	return 0
+}
+
+// wait blocks until another job may be sent.
+func (t *priRepThrottle) wait() {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.interval > 0 {
+		now := time.Now()
+		if t.next.After(now) {
+			time.Sleep(t.next.Sub(now))
+			now = t.next
+		}
+		t.next = now.Add(t.interval)
+	}
+	if t.bandwidth > 0 {
+		for {
+			if time.Since(t.lastPoll) >= t.pollInterval {
+				t.poll()
+			}
+			delay := bandwidthDelay(t.sent, time.Since(t.started), t.bandwidth)
+			if delay <= 0 {
+				break
+			}
+			if delay > t.pollInterval {
+				delay = t.pollInterval
+			}
+			time.Sleep(delay)
+		}
+	}
+}
+
+// doPriRepJobs executes a list of PriorityRepJobs, limiting concurrent jobs per device to deviceMax, and returns the
+// jobs the replicators accepted. The throttle paces jobs and the checkpoint records accepted ones; either may be nil.
+func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client, throttle *priRepThrottle, checkpoint *priRepCheckpoint) []*PriorityRepJob {
 	limiter := &devLimiter{inUse: make(map[int]int), max: deviceMax, somethingFinished: make(chan struct{}, 1)}
 	wg := sync.WaitGroup{}
+	var accepted []*PriorityRepJob
+	acceptedLock := sync.Mutex{}
 	for len(jobs) > 0 {
 		foundDoable := false
 		for i := range jobs {
@@ -82,11 +256,12 @@ func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) {
 				continue
 			}
 			foundDoable = true
+			throttle.wait()
 			wg.Add(1)
 			go func(job *PriorityRepJob) {
 				defer wg.Done()
 				defer limiter.finished(job)
-				url := fmt.Sprintf("http://%s:%d/priorityrep", job.FromDevice.ReplicationIp, job.FromDevice.ReplicationPort+500)
+				url := replicatorURL(job.FromDevice) + "/priorityrep"
 				jsonned, err := json.Marshal(job)
 				if err != nil {
 					fmt.Println("Failed to serialize job for some reason:", err)
@@ -109,6 +284,14 @@ func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) {
 					fmt.Printf("Bad status code moving partition %d: %d\n", job.Partition, resp.StatusCode)
 				} else {
 					fmt.Printf("Replicating partition %d from %s/%s\n", job.Partition, job.FromDevice.Ip, job.FromDevice.Device)
+					acceptedLock.Lock()
+					accepted = append(accepted, job)
+					acceptedLock.Unlock()
+					if checkpoint != nil {
+						if err := checkpoint.record(job); err != nil {
+							fmt.Println("Failed to record job in checkpoint:", err)
+						}
+					}
 				}
 			}(jobs[i])
 			jobs = append(jobs[:i], jobs[i+1:]...)
@@ -119,10 +302,93 @@ func doPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client) {
 		}
 	}
 	wg.Wait()
+	return accepted
+}
+
+// priRepOptions are the settings shared by the priority replication commands.
+type priRepOptions struct {
+	dryRun        *bool
+	jobsPerSecond *float64
+	bandwidth     *int64
+	statePath     *string
+	retries       *int
+	retryWait     *time.Duration
+}
+
+func addPriRepFlags(flags *flag.FlagSet) *priRepOptions {
+	return &priRepOptions{
+		dryRun:        flags.Bool("dry-run", false, "print the planned jobs without sending them"),
+		jobsPerSecond: flags.Float64("jobs-per-second", 0, "maximum jobs to send per second across all devices (0 for no limit)"),
+		bandwidth:     flags.Int64("bandwidth", 0, "hold back jobs while the source replicators average more than this many bytes per second (0 for no limit)"),
+		statePath:     flags.String("state", "", "checkpoint file of sent jobs; rerunning with the same file skips them"),
+		retries:       flags.Int("retries", 0, "times to retry failed jobs"),
+		retryWait:     flags.Duration("retry-wait", 30*time.Second, "time to wait before retrying failed jobs"),
+	}
+}
+
+// runPriRepJobs prints the jobs for a dry run, or else sends them as configured, and returns the jobs that failed.
+func runPriRepJobs(jobs []*PriorityRepJob, deviceMax int, client *http.Client, opts *priRepOptions, out io.Writer) ([]*PriorityRepJob, error) {
+	var checkpoint *priRepCheckpoint
+	if *opts.statePath != "" {
+		var err error
+		if checkpoint, err = openPriRepCheckpoint(*opts.statePath); err != nil {
+			return nil, fmt.Errorf("Unable to open checkpoint: %v", err)
+		}
+		defer checkpoint.Close()
+		var pending []*PriorityRepJob
+		for _, job := range jobs {
+			if !checkpoint.isDone(job) {
+				pending = append(pending, job)
+			}
+		}
+		if skipped := len(jobs) - len(pending); skipped > 0 {
+			fmt.Fprintf(out, "Skipping %d jobs already sent according to %s\n", skipped, *opts.statePath)
+		}
+		jobs = pending
+	}
+	if *opts.dryRun {
+		for _, job := range jobs {
+			fmt.Fprintln(out, "Would replicate", formatPriRepJob(job))
+		}
+		fmt.Fprintf(out, "%d jobs would be sent.\n", len(jobs))
+		return nil, nil
+	}
+	throttle := newPriRepThrottle(jobs, *opts.jobsPerSecond, *opts.bandwidth, client)
+	for attempt := 0; len(jobs) > 0; attempt++ {
+		if attempt > 0 {
+			fmt.Fprintf(out, "Retrying %d failed jobs in %s\n", len(jobs), *opts.retryWait)
+			time.Sleep(*opts.retryWait)
+		}
+		accepted := map[*PriorityRepJob]bool{}
+		for _, job := range doPriRepJobs(append([]*PriorityRepJob(nil), jobs...), deviceMax, client, throttle, checkpoint) {
+			accepted[job] = true
+		}
+		var failed []*PriorityRepJob
+		for _, job := range jobs {
+			if !accepted[job] {
+				failed = append(failed, job)
+			}
+		}
+		jobs = failed
+		if attempt >= *opts.retries {
+			break
+		}
+	}
+	fmt.Fprintln(out, "Done sending jobs.")
+	if len(jobs) > 0 {
+		fmt.Fprintf(out, "%d jobs failed:\n", len(jobs))
+		for _, job := range jobs {
+			fmt.Fprintln(out, "  "+formatPriRepJob(job))
+		}
+		if *opts.statePath != "" {
+			fmt.Fprintf(out, "Run again with -state %s to retry them.\n", *opts.statePath)
+		}
+	}
+	return jobs, nil
 }
 
-// getPartMoveJobs takes two rings and creates a list of jobs for any partition moves between them.
-func getPartMoveJobs(oldRing, newRing ring.Ring) []*PriorityRepJob {
+// getPartMoveJobs takes two rings and creates a list of jobs for any partition moves between them in a storage policy.
+func getPartMoveJobs(oldRing, newRing ring.Ring, policy int) []*PriorityRepJob {
 	jobs := make([]*PriorityRepJob, 0)
 	for partition := uint64(0); true; partition++ {
 		olddevs := oldRing.GetNodesInOrder(partition)
@@ -137,6 +403,7 @@ func getPartMoveJobs(oldRing, newRing ring.Ring) []*PriorityRepJob {
 					Partition:  partition,
 					FromDevice: olddevs[i],
 					ToDevices:  []*ring.Device{newdevs[i]},
+					Policy:     policy,
 				})
 			}
 		}
@@ -148,6 +415,7 @@ func getPartMoveJobs(oldRing, newRing ring.Ring) []*PriorityRepJob {
 func MoveParts(args []string) {
 	flags := flag.NewFlagSet("moveparts", flag.ExitOnError)
 	policy := flags.Int("p", 0, "policy index to use")
+	opts := addPriRepFlags(flags)
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "USAGE: hummingbird moveparts [old ringfile]")
 		flags.PrintDefaults()
@@ -174,14 +442,17 @@ func MoveParts(args []string) {
 		return
 	}
 	client := &http.Client{Timeout: time.Hour}
-	jobs := getPartMoveJobs(oldRing, curRing)
+	jobs := getPartMoveJobs(oldRing, curRing, *policy)
 	fmt.Println("Job count:", len(jobs))
-	doPriRepJobs(jobs, 2, client)
-	fmt.Println("Done sending jobs.")
+	if failed, err := runPriRepJobs(jobs, 2, client, opts, os.Stdout); err != nil {
+		fmt.Println(err)
+	} else if len(failed) > 0 {
+		os.Exit(1)
+	}
 }
 
-// getRestoreDeviceJobs takes an ip address and device name, and creates a list of jobs to restore that device's data from peers.
-func getRestoreDeviceJobs(theRing ring.Ring, ip string, devName string) []*PriorityRepJob {
+// getRestoreDeviceJobs takes an ip address and device name, and creates a list of jobs to restore that device's data in a storage policy from peers.
+func getRestoreDeviceJobs(theRing ring.Ring, ip string, devName string, policy int) []*PriorityRepJob {
 	jobs := make([]*PriorityRepJob, 0)
 	for partition := uint64(0); true; partition++ {
 		devs := theRing.GetNodesInOrder(partition)
@@ -195,6 +466,7 @@ func getRestoreDeviceJobs(theRing ring.Ring, ip string, devName string) []*Prior
 					Partition:  partition,
 					FromDevice: src,
 					ToDevices:  []*ring.Device{dev},
+					Policy:     policy,
 				})
 			}
 		}
@@ -206,6 +478,7 @@ func getRestoreDeviceJobs(theRing ring.Ring, ip string, devName string) []*Prior
 func RestoreDevice(args []string) {
 	flags := flag.NewFlagSet("restoredevice", flag.ExitOnError)
 	policy := flags.Int("p", 0, "policy index to use")
+	opts := addPriRepFlags(flags)
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "USAGE: hummingbird restoredevice [ip] [device]\n")
 		flags.PrintDefaults()
@@ -227,13 +500,16 @@ func RestoreDevice(args []string) {
 		return
 	}
 	client := &http.Client{Timeout: time.Hour}
-	jobs := getRestoreDeviceJobs(objRing, flags.Arg(0), flags.Arg(1))
+	jobs := getRestoreDeviceJobs(objRing, flags.Arg(0), flags.Arg(1), *policy)
 	fmt.Println("Job count:", len(jobs))
-	doPriRepJobs(jobs, 2, client)
-	fmt.Println("Done sending jobs.")
+	if failed, err := runPriRepJobs(jobs, 2, client, opts, os.Stdout); err != nil {
+		fmt.Println(err)
+	} else if len(failed) > 0 {
+		os.Exit(1)
+	}
 }
 
-func getRescuePartsJobs(objRing ring.Ring, partitions []uint64) []*PriorityRepJob {
+func getRescuePartsJobs(objRing ring.Ring, partitions []uint64, policy int) []*PriorityRepJob {
 	jobs := make([]*PriorityRepJob, 0)
 	allDevices := objRing.AllDevices()
 	for d := range allDevices {
@@ -243,6 +519,7 @@ func getRescuePartsJobs(objRing ring.Ring, partitions []uint64) []*PriorityRepJo
 				Partition:  p,
 				FromDevice: &allDevices[d],
 				ToDevices:  nodes,
+				Policy:     policy,
 			})
 		}
 	}
@@ -252,6 +529,7 @@ func getRescuePartsJobs(objRing ring.Ring, partitions []uint64) []*PriorityRepJo
 func RescueParts(args []string) {
 	flags := flag.NewFlagSet("rescueparts", flag.ExitOnError)
 	policy := flags.Int("p", 0, "policy index to use")
+	opts := addPriRepFlags(flags)
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "USAGE: hummingbird rescueparts partnum1,partnum2,...\n")
 		flags.PrintDefaults()
@@ -282,8 +560,11 @@ func RescueParts(args []string) {
 		}
 	}
 	client := &http.Client{Timeout: time.Hour}
-	jobs := getRescuePartsJobs(objRing, partsInt)
+	jobs := getRescuePartsJobs(objRing, partsInt, *policy)
 	fmt.Println("Job count:", len(jobs))
-	doPriRepJobs(jobs, 1, client)
-	fmt.Println("Done sending jobs.")
+	if failed, err := runPriRepJobs(jobs, 1, client, opts, os.Stdout); err != nil {
+		fmt.Println(err)
+	} else if len(failed) > 0 {
+		os.Exit(1)
+	}
 }
@@ -16,15 +16,21 @@
 package objectserver
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/troubling/hummingbird/common/ring"
 
@@ -95,8 +101,12 @@ func TestGetPartMoveJobs(t *testing.T) {
 			1: {6, 7, 8, 9, 11},
 		},
 	}
-	jobs := getPartMoveJobs(oldRing, newRing)
+	jobs := getPartMoveJobs(oldRing, newRing, 1)
 	require.EqualValues(t, 2, len(jobs))
+	require.EqualValues(t, 1, jobs[0].Policy)
+	// the policy is part of a job's checkpoint key, so one policy's run doesn't skip another's jobs.
+	require.Equal(t, "1 0 1 6", priRepJobKey(jobs[0]))
+	require.NotEqual(t, priRepJobKey(getPartMoveJobs(oldRing, newRing, 0)[0]), priRepJobKey(jobs[0]))
 	require.EqualValues(t, 0, jobs[0].Partition)
 	require.EqualValues(t, 1, jobs[0].FromDevice.Id)
 	require.EqualValues(t, 6, jobs[0].ToDevices[0].Id)
@@ -113,8 +123,10 @@ func TestGetRestoreDeviceJobs(t *testing.T) {
 			1: {1, 3},
 		},
 	}
-	jobs := getRestoreDeviceJobs(ring, "127.0.0.1", "drive1")
+	jobs := getRestoreDeviceJobs(ring, "127.0.0.1", "drive1", 2)
 	require.EqualValues(t, 2, len(jobs))
+	require.EqualValues(t, 2, jobs[0].Policy)
+	require.Equal(t, "2 0 2 1", priRepJobKey(jobs[0]))
 	require.EqualValues(t, 0, jobs[0].Partition)
 	require.EqualValues(t, 2, jobs[0].FromDevice.Id)
 	require.EqualValues(t, 1, jobs[0].ToDevices[0].Id)
@@ -158,8 +170,10 @@ func TestPriRepJobs(t *testing.T) {
 			},
 		},
 	}
-	doPriRepJobs(jobs, 2, http.DefaultClient)
+	accepted := doPriRepJobs(jobs, 2, http.DefaultClient, nil, nil)
 	require.Equal(t, true, handlerRan)
+	require.Equal(t, 1, len(accepted))
+	require.EqualValues(t, 0, accepted[0].Partition)
 }
 
 func TestDevLimiter(t *testing.T) {
@@ -192,8 +206,9 @@ func TestGetRescuePartsJobs(t *testing.T) {
 			1: {6, 7, 8},
 		},
 	}
-	jobs := getRescuePartsJobs(objRing, []uint64{1})
+	jobs := getRescuePartsJobs(objRing, []uint64{1}, 3)
 	require.EqualValues(t, 3, len(jobs))
+	require.EqualValues(t, 3, jobs[0].Policy)
 
 	require.EqualValues(t, 0, jobs[0].FromDevice.Id)
 	require.EqualValues(t, 1, jobs[0].ToDevices[0].Id)
@@ -210,3 +225,86 @@ func TestGetRescuePartsJobs(t *testing.T) {
 	require.EqualValues(t, 1, jobs[2].ToDevices[0].Id)
 	require.EqualValues(t, 1, jobs[2].Partition)
 }
+
+func TestRunPriRepJobs(t *testing.T) {
+	t.Parallel()
+	attempts := map[uint64]int{}
+	lock := sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pri PriorityRepJob
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&pri))
+		lock.Lock()
+		attempts[pri.Partition]++
+		lock.Unlock()
+		if pri.Partition == 1 {
+			w.WriteHeader(500)
+		}
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	host, ports, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(ports)
+	var jobs []*PriorityRepJob
+	for i := 0; i < 2; i++ {
+		jobs = append(jobs, &PriorityRepJob{
+			Partition:  uint64(i),
+			FromDevice: &ring.Device{Id: 1, Device: "sda", Ip: host, Port: port - 500, ReplicationIp: host, ReplicationPort: port - 500},
+			ToDevices:  []*ring.Device{{Id: 2, Device: "sdb", Ip: host, Port: 6000}},
+		})
+	}
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts := addPriRepFlags(flags)
+	statePath := filepath.Join(dir, "state")
+	require.Nil(t, flags.Parse([]string{"-dry-run", "-state", statePath, "-retries", "1", "-retry-wait", "1ms"}))
+
+	out := &bytes.Buffer{}
+	failed, err := runPriRepJobs(jobs, 2, http.DefaultClient, opts, out)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(failed))
+	require.Equal(t, 0, len(attempts))
+	require.Contains(t, out.String(), fmt.Sprintf("Would replicate partition 1: %s:%d/sda -> %s:6000/sdb\n", host, port-500, host))
+	require.Contains(t, out.String(), "2 jobs would be sent.\n")
+
+	*opts.dryRun = false
+	out.Reset()
+	failed, err = runPriRepJobs(jobs, 2, http.DefaultClient, opts, out)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(failed))
+	require.EqualValues(t, 1, failed[0].Partition)
+	require.Equal(t, map[uint64]int{0: 1, 1: 2}, attempts)
+	require.Contains(t, out.String(), "Retrying 1 failed jobs in 1ms\n")
+	require.Contains(t, out.String(), "1 jobs failed:\n  partition 1: ")
+	checkpoint, err := ioutil.ReadFile(statePath)
+	require.Nil(t, err)
+	require.Equal(t, "0 0 1 2\n", string(checkpoint))
+
+	out.Reset()
+	*opts.retries = 0
+	failed, err = runPriRepJobs(jobs, 2, http.DefaultClient, opts, out)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(failed))
+	require.Equal(t, map[uint64]int{0: 1, 1: 3}, attempts)
+	require.Contains(t, out.String(), "Skipping 1 jobs already sent according to "+statePath+"\n")
+}
+
+func TestBandwidthDelay(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, time.Duration(0), bandwidthDelay(1000, time.Second, 1000))
+	require.Equal(t, time.Second, bandwidthDelay(2000, time.Second, 1000))
+	require.Equal(t, time.Duration(0), bandwidthDelay(0, 0, 1000))
+}
+
+func TestPriRepThrottle(t *testing.T) {
+	t.Parallel()
+	throttle := newPriRepThrottle(nil, 20, 0, http.DefaultClient)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		throttle.wait()
+	}
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+	var nilThrottle *priRepThrottle
+	nilThrottle.wait()
+}
@@ -32,6 +32,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/pickle"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
@@ -734,6 +735,8 @@ type Replicator struct {
 	onceWaiting        int64
 	loopSleepTime      time.Duration
 	partSleepTime      time.Duration
+	metrics            *metrics.Registry
+	requestDurations   *metrics.Histogram
 }
 
 func (r *Replicator) cancelStalledDevices() {
@@ -864,6 +867,24 @@ func (r *Replicator) getDeviceProgress() map[string]map[string]interface{} {
 	return deviceProgress
 }
 
+// deviceStats returns a copy of each running device's stats and its cancel count.
+func (r *Replicator) deviceStats() (map[string]ReplicationDeviceStats, map[string]int64) {
+	r.runningDevicesLock.Lock()
+	defer r.runningDevicesLock.Unlock()
+	deviceStats := make(map[string]ReplicationDeviceStats, len(r.runningDevices))
+	cancelCounts := make(map[string]int64, len(r.runningDevices))
+	for key, device := range r.runningDevices {
+		stats := *device.Stats()
+		stats.Stats = make(map[string]int64, len(device.Stats().Stats))
+		for k, v := range device.Stats().Stats {
+			stats.Stats[k] = v
+		}
+		deviceStats[key] = stats
+		cancelCounts[key] = r.cancelCounts[key]
+	}
+	return deviceStats, cancelCounts
+}
+
 func (r *Replicator) runLoopCheck(reportTimer <-chan time.Time) {
 	select {
 	case update := <-r.updateStat:
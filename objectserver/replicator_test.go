@@ -1182,6 +1182,47 @@ func TestGetDeviceProgress(t *testing.T) {
 	require.Equal(t, int64(50), sdb["PartitionsDone"])
 }
 
+func TestReplicatorMetrics(t *testing.T) {
+	oldGetRing := GetRing
+	defer func() {
+		GetRing = oldGetRing
+	}()
+
+	GetRing = func(ringType, prefix, suffix string, policy int) (ring.Ring, error) {
+		return &test.FakeRing{}, nil
+	}
+	ts, err := makeReplicatorWebServer()
+	require.Nil(t, err)
+	defer ts.Close()
+	ts.replicator.runningDevicesLock.Lock()
+	ts.replicator.runningDevices = map[string]ReplicationDevice{
+		"sda": &mockReplicationDevice{
+			_Stats: func() *ReplicationDeviceStats {
+				return &ReplicationDeviceStats{
+					LastPassDuration: time.Minute,
+					LastPassDate:     time.Unix(1500000000, 0),
+					TotalPasses:      3,
+					Stats: map[string]int64{
+						"PartitionsTotal": 1000,
+						"PartitionsDone":  500,
+					},
+				}
+			},
+		},
+	}
+	ts.replicator.runningDevicesLock.Unlock()
+	resp, err := ts.Do("GET", "/metrics", nil)
+	require.Nil(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), "hummingbird_replicator_partitions_done{device=\"sda\"} 500\n")
+	require.Contains(t, string(body), "hummingbird_replicator_partitions_total{device=\"sda\"} 1000\n")
+	require.Contains(t, string(body), "hummingbird_replicator_passes_total{device=\"sda\"} 3\n")
+	require.Contains(t, string(body), "hummingbird_replicator_last_pass_duration_seconds{device=\"sda\"} 60\n")
+	require.Contains(t, string(body), "hummingbird_replicator_last_pass_completed_seconds{device=\"sda\"} 1.5e+09\n")
+}
+
 func TestRunLoopOnceDone(t *testing.T) {
 	oldGetRing := GetRing
 	defer func() {
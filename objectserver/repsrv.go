@@ -32,6 +32,7 @@ import (
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/pickle"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/middleware"
@@ -83,6 +84,17 @@ func (r *ReplicationManager) Done(device string) {
 	r.lock.Unlock()
 }
 
+// InUse returns the number of replication sessions currently running on each device.
+func (r *ReplicationManager) InUse() map[string]int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	inUse := make(map[string]int64, len(r.devSem))
+	for device, devSem := range r.devSem {
+		inUse[device] = int64(len(devSem))
+	}
+	return inUse
+}
+
 func NewReplicationManager(limitPerDisk int64, limitOverall int64) *ReplicationManager {
 	return &ReplicationManager{
 		limitPerDisk: limitPerDisk,
@@ -286,6 +298,8 @@ func (r *Replicator) LogRequest(next http.Handler) http.Handler {
 		logr := r.logger.With(zap.String("txn", request.Header.Get("X-Trans-Id")))
 		request = srv.SetLogger(request, logr)
 		next.ServeHTTP(newWriter, request)
+		r.requestDurations.Observe(time.Since(start).Seconds(), request.Method, strconv.Itoa(newWriter.Status),
+			request.Header.Get("X-Backend-Storage-Policy-Index"))
 		lvl, _ := r.logLevel.MarshalText()
 		if (request.Method != "REPLICATE" && request.Method != "REPCONN") || strings.ToUpper(string(lvl)) == "DEBUG" {
 			logr.Info("Request log",
@@ -303,9 +317,73 @@ func (r *Replicator) LogRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// replicationStatMetrics maps the per pass ReplicationDeviceStats.Stats counts to the gauges they're exported as.
+var replicationStatMetrics = []struct{ stat, name, help string }{
+	{"PartitionsDone", "hummingbird_replicator_partitions_done", "Partitions replicated so far this pass."},
+	{"PartitionsTotal", "hummingbird_replicator_partitions_total", "Partitions to replicate this pass."},
+	{"FilesSent", "hummingbird_replicator_files_sent", "Files sent so far this pass."},
+	{"BytesSent", "hummingbird_replicator_bytes_sent", "Bytes sent so far this pass."},
+	{"PriorityRepsDone", "hummingbird_replicator_priority_reps_done", "Priority replication jobs done so far this pass."},
+}
+
+func (r *Replicator) newMetrics() {
+	r.metrics, r.requestDurations = metrics.NewServerRegistry()
+	device := []string{"device"}
+	for _, m := range replicationStatMetrics {
+		stat := m.stat
+		r.metrics.NewGaugeFunc(m.name, m.help, device, func(emit func(float64, ...string)) {
+			deviceStats, _ := r.deviceStats()
+			for key, stats := range deviceStats {
+				emit(float64(stats.Stats[stat]), key)
+			}
+		})
+	}
+	r.metrics.NewCounterFunc("hummingbird_replicator_passes_total", "Completed replication passes.", device,
+		func(emit func(float64, ...string)) {
+			deviceStats, _ := r.deviceStats()
+			for key, stats := range deviceStats {
+				emit(float64(stats.TotalPasses), key)
+			}
+		})
+	r.metrics.NewGaugeFunc("hummingbird_replicator_last_pass_duration_seconds", "Duration of the last completed replication pass in seconds.", device,
+		func(emit func(float64, ...string)) {
+			deviceStats, _ := r.deviceStats()
+			for key, stats := range deviceStats {
+				emit(stats.LastPassDuration.Seconds(), key)
+			}
+		})
+	r.metrics.NewGaugeFunc("hummingbird_replicator_last_pass_completed_seconds", "Time the last replication pass finished, since unix epoch in seconds.", device,
+		func(emit func(float64, ...string)) {
+			deviceStats, _ := r.deviceStats()
+			for key, stats := range deviceStats {
+				if !stats.LastPassDate.IsZero() {
+					emit(float64(stats.LastPassDate.UnixNano())/float64(time.Second), key)
+				}
+			}
+		})
+	r.metrics.NewGaugeFunc("hummingbird_replicator_last_checkin_seconds", "Time each device's replicator last checked in, since unix epoch in seconds.", device,
+		func(emit func(float64, ...string)) {
+			deviceStats, _ := r.deviceStats()
+			for key, stats := range deviceStats {
+				emit(float64(stats.LastCheckin.UnixNano())/float64(time.Second), key)
+			}
+		})
+	r.metrics.NewCounterFunc("hummingbird_replicator_cancels_total", "Times a stalled device replicator has been cancelled.", device,
+		func(emit func(float64, ...string)) {
+			_, cancelCounts := r.deviceStats()
+			for key, count := range cancelCounts {
+				emit(float64(count), key)
+			}
+		})
+	r.metrics.NewKeyedGaugeFunc("hummingbird_device_requests_in_use", "Replication sessions currently holding each device.",
+		"device", r.replicationMan.InUse)
+}
+
 func (r *Replicator) GetHandler() http.Handler {
+	r.newMetrics()
 	commonHandlers := alice.New(r.LogRequest, middleware.ValidateRequest)
 	router := srv.NewRouter()
+	router.Get("/metrics", commonHandlers.Then(r.metrics))
 	router.Get("/priorityrep", commonHandlers.ThenFunc(r.priorityRepHandler))
 	router.Get("/progress", commonHandlers.ThenFunc(r.ProgressReportHandler))
 	for _, policy := range conf.LoadPolicies() {
@@ -31,6 +31,7 @@ import (
 	"github.com/troubling/hummingbird/common/fs"
 	"github.com/troubling/hummingbird/common/pickle"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/middleware"
 	"go.uber.org/zap"
 )
@@ -76,7 +77,9 @@ func (server *ObjectServer) expirerContainer(deleteAt time.Time, account, contai
 	return fmt.Sprintf("%010d", timestamp)
 }
 
-func (server *ObjectServer) sendContainerUpdate(host, device, method, partition, account, container, obj string, headers http.Header) bool {
+// sendContainerUpdate sends an object update to a container server.  If the container has been sharded, the server
+// redirects the update to a shard container, and the redirect's headers are returned so it can be sent on.
+func (server *ObjectServer) sendContainerUpdate(host, device, method, partition, account, container, obj string, headers http.Header) (bool, http.Header) {
 	obj_url := fmt.Sprintf("http://%s/%s/%s/%s/%s/%s", host, device, partition,
 		common.Urlencode(account), common.Urlencode(container), common.Urlencode(obj))
 	if req, err := http.NewRequest(method, obj_url, nil); err == nil {
@@ -84,11 +87,38 @@ func (server *ObjectServer) sendContainerUpdate(host, device, method, partition,
 		if resp, err := server.updateClient.Do(req); err == nil {
 			resp.Body.Close()
 			if resp.StatusCode/100 == 2 {
-				return true
+				return true, nil
+			} else if resp.StatusCode == http.StatusMovedPermanently && resp.Header.Get("X-Backend-Redirect-Host") != "" {
+				return true, resp.Header
 			}
 		}
 	}
-	return false
+	return false, nil
+}
+
+// sendRedirectedUpdate sends an object update on to the shard container a container server redirected it to, saving
+// it for later if that fails.
+func (server *ObjectServer) sendRedirectedUpdate(redirect http.Header, method, obj, localDevice string, headers http.Header, logger srv.LowLevelLogger) {
+	account := redirect.Get("X-Backend-Redirect-Account")
+	container := redirect.Get("X-Backend-Redirect-Container")
+	partition := redirect.Get("X-Backend-Redirect-Partition")
+	hosts := splitHeader(redirect.Get("X-Backend-Redirect-Host"))
+	devices := splitHeader(redirect.Get("X-Backend-Redirect-Device"))
+	failures := 0
+	for index := range hosts {
+		if index >= len(devices) {
+			break
+		}
+		if ok, _ := server.sendContainerUpdate(hosts[index], devices[index], method, partition, account, container, obj, headers); !ok {
+			logger.Error("ERROR shard container update failed (saving for async update later)",
+				zap.String("Host", hosts[index]),
+				zap.String("Device", devices[index]))
+			failures++
+		}
+	}
+	if failures > 0 || len(hosts) == 0 {
+		server.saveAsync(method, account, container, obj, localDevice, headers)
+	}
 }
 
 func (server *ObjectServer) saveAsync(method, account, container, obj, localDevice string, headers http.Header) {
@@ -130,10 +160,21 @@ func (server *ObjectServer) updateContainer(metadata map[string]string, request
 		requestHeaders.Add("X-Content-Type", metadata["Content-Type"])
 		requestHeaders.Add("X-Size", metadata["Content-Length"])
 		requestHeaders.Add("X-Etag", metadata["ETag"])
+		for key, value := range metadata {
+			if strings.HasPrefix(key, "X-Object-Meta-") {
+				requestHeaders.Set(key, value)
+			}
+		}
 	}
+	span := tracing.StartChild(request.Context(), "container update")
+	defer span.Finish()
+	span.Inject(requestHeaders)
 	failures := 0
+	var redirect http.Header
 	for index := range hosts {
-		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders) {
+		if ok, redirected := server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, vars["account"], vars["container"], vars["obj"], requestHeaders); redirected != nil {
+			redirect = redirected
+		} else if !ok {
 			logger.Error("ERROR container update failed (saving for async update later)",
 				zap.String("Host", hosts[index]),
 				zap.String("Device", devices[index]))
@@ -143,6 +184,9 @@ func (server *ObjectServer) updateContainer(metadata map[string]string, request
 	if failures > 0 {
 		server.saveAsync(request.Method, vars["account"], vars["container"], vars["obj"], vars["device"], requestHeaders)
 	}
+	if redirect != nil {
+		server.sendRedirectedUpdate(redirect, request.Method, vars["obj"], vars["device"], requestHeaders, logger)
+	}
 }
 
 func (server *ObjectServer) updateDeleteAt(request *http.Request, deleteAtStr string, vars map[string]string, logger srv.LowLevelLogger) {
@@ -171,8 +215,11 @@ func (server *ObjectServer) updateDeleteAt(request *http.Request, deleteAtStr st
 		requestHeaders.Add("X-Etag", zeroByteHash)
 	}
 	failures := 0
+	var redirect http.Header
 	for index := range hosts {
-		if !server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, deleteAtAccount, container, obj, requestHeaders) {
+		if ok, redirected := server.sendContainerUpdate(hosts[index], devices[index], request.Method, partition, deleteAtAccount, container, obj, requestHeaders); redirected != nil {
+			redirect = redirected
+		} else if !ok {
 			logger.Error("ERROR container update failed with (saving for async update later)",
 				zap.String("Host", hosts[index]),
 				zap.String("Device", devices[index]))
@@ -182,6 +229,9 @@ func (server *ObjectServer) updateDeleteAt(request *http.Request, deleteAtStr st
 	if failures > 0 || len(hosts) == 0 {
 		server.saveAsync(request.Method, deleteAtAccount, container, obj, vars["device"], requestHeaders)
 	}
+	if redirect != nil {
+		server.sendRedirectedUpdate(redirect, request.Method, obj, vars["device"], requestHeaders, logger)
+	}
 }
 
 func (server *ObjectServer) containerUpdates(writer http.ResponseWriter, request *http.Request, metadata map[string]string, deleteAt string, vars map[string]string, logger srv.LowLevelLogger) {
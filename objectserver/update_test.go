@@ -144,6 +144,8 @@ func TestUpdateContainer(t *testing.T) {
 		require.Equal(t, "text/plain", r.Header.Get("X-Content-Type"))
 		require.Equal(t, "30", r.Header.Get("X-Size"))
 		require.Equal(t, "ffffffffffffffffffffffffffffffff", r.Header.Get("X-Etag"))
+		require.Equal(t, "blue", r.Header.Get("X-Object-Meta-Color"))
+		require.Equal(t, "", r.Header.Get("X-Object-Sysmeta-Secret"))
 		requestSent = true
 	}))
 	defer cs.Close()
@@ -161,10 +163,12 @@ func TestUpdateContainer(t *testing.T) {
 	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
 	req = srv.SetVars(req, vars)
 	metadata := map[string]string{
-		"X-Timestamp":    "12345.789",
-		"Content-Type":   "text/plain",
-		"Content-Length": "30",
-		"ETag":           "ffffffffffffffffffffffffffffffff",
+		"X-Timestamp":             "12345.789",
+		"Content-Type":            "text/plain",
+		"Content-Length":          "30",
+		"ETag":                    "ffffffffffffffffffffffffffffffff",
+		"X-Object-Meta-Color":     "blue",
+		"X-Object-Sysmeta-Secret": "shh",
 	}
 	server.updateContainer(metadata, req, vars, dl)
 	require.True(t, requestSent)
@@ -218,3 +222,65 @@ func TestUpdateContainerNoHeaders(t *testing.T) {
 	expectedFile := filepath.Join(ts.root, "sda", "async_pending", "099", "2f714cd91b0e5d803cde2012b01d7099-12345.6789")
 	require.False(t, fs.Exists(expectedFile))
 }
+
+func TestUpdateContainerRedirect(t *testing.T) {
+	ts, err := makeObjectServer()
+	require.Nil(t, err)
+	server := ts.objServer
+	defer ts.Close()
+
+	var shardPaths []string
+	shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shardPaths = append(shardPaths, r.URL.Path)
+		w.WriteHeader(201)
+	}))
+	defer shard.Close()
+	su, err := url.Parse(shard.URL)
+	require.Nil(t, err)
+	rootRequests := 0
+	root := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rootRequests++
+		w.Header().Set("Location", "/.shards_a/c-1-0/o")
+		w.Header().Set("X-Backend-Redirect-Account", ".shards_a")
+		w.Header().Set("X-Backend-Redirect-Container", "c-1-0")
+		w.Header().Set("X-Backend-Redirect-Partition", "7")
+		w.Header().Set("X-Backend-Redirect-Host", su.Host)
+		w.Header().Set("X-Backend-Redirect-Device", "sdc")
+		w.WriteHeader(301)
+	}))
+	defer root.Close()
+	u, err := url.Parse(root.URL)
+	require.Nil(t, err)
+	req, err := http.NewRequest("PUT", "/I/dont/think/this/matters", nil)
+	require.Nil(t, err)
+	req.Header.Add("X-Container-Partition", "1")
+	req.Header.Add("X-Container-Host", u.Host)
+	req.Header.Add("X-Container-Device", "sdb")
+	req.Header.Add("X-Timestamp", "12345.6789")
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda"}
+	req = srv.SetVars(req, vars)
+	metadata := map[string]string{
+		"X-Timestamp":    "12345.789",
+		"Content-Type":   "text/plain",
+		"Content-Length": "30",
+		"ETag":           "ffffffffffffffffffffffffffffffff",
+	}
+	server.updateContainer(metadata, req, vars, zap.NewNop())
+	require.Equal(t, 1, rootRequests)
+	require.Equal(t, []string{"/sdc/7/.shards_a/c-1-0/o"}, shardPaths)
+	require.False(t, fs.Exists(filepath.Join(ts.root, "sda", "async_pending")))
+
+	// a failed shard update is saved for later against the shard container.
+	shard.Close()
+	server.updateContainer(metadata, req, vars, zap.NewNop())
+	files, err := filepath.Glob(filepath.Join(ts.root, "sda", "async_pending", "*", "*"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(files))
+	data, err := ioutil.ReadFile(files[0])
+	require.Nil(t, err)
+	a, err := pickle.PickleLoads(data)
+	require.Nil(t, err)
+	asyncData := a.(map[interface{}]interface{})
+	require.Equal(t, ".shards_a", asyncData["account"])
+	require.Equal(t, "c-1-0", asyncData["container"])
+}
@@ -17,6 +17,7 @@ package proxyserver
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/srv"
@@ -46,10 +47,12 @@ func (server *ProxyServer) AccountGetHandler(writer http.ResponseWriter, request
 			}
 		}
 	}
+	server.allowLargeListing(ctx, request, options)
 	resp := ctx.C.GetAccount(vars["account"], options, request.Header)
 	for k := range resp.Header {
 		writer.Header().Set(k, resp.Header.Get(k))
 	}
+	exposeAccountACL(ctx, writer.Header())
 	writer.WriteHeader(resp.StatusCode)
 	defer resp.Body.Close()
 	common.Copy(resp.Body, writer)
@@ -74,6 +77,7 @@ func (server *ProxyServer) AccountHeadHandler(writer http.ResponseWriter, reques
 	for k := range resp.Header {
 		writer.Header().Set(k, resp.Header.Get(k))
 	}
+	exposeAccountACL(ctx, writer.Header())
 	resp.Body.Close()
 	writer.WriteHeader(resp.StatusCode)
 }
@@ -99,6 +103,10 @@ func (server *ProxyServer) AccountPostHandler(writer http.ResponseWriter, reques
 		writer.Write([]byte(str))
 		return
 	}
+	if status, str := translateAccountACL(ctx, request); status != http.StatusOK {
+		srv.SimpleErrorResponse(writer, status, str)
+		return
+	}
 	defer ctx.InvalidateAccountInfo(vars["account"])
 	resp := ctx.C.PostAccount(vars["account"], request.Header)
 	resp.Body.Close()
@@ -126,6 +134,10 @@ func (server *ProxyServer) AccountPutHandler(writer http.ResponseWriter, request
 		writer.Write([]byte(str))
 		return
 	}
+	if status, str := translateAccountACL(ctx, request); status != http.StatusOK {
+		srv.SimpleErrorResponse(writer, status, str)
+		return
+	}
 	defer ctx.InvalidateAccountInfo(vars["account"])
 	resp := ctx.C.PutAccount(vars["account"], request.Header)
 	resp.Body.Close()
@@ -152,3 +164,31 @@ func (server *ProxyServer) AccountDeleteHandler(writer http.ResponseWriter, requ
 	resp.Body.Close()
 	srv.StandardResponse(writer, resp.StatusCode)
 }
+
+// translateAccountACL validates an X-Account-Access-Control header and moves it into account sysmeta. Only
+// requests with owner-level access to the account may change its ACL.
+func translateAccountACL(ctx *middleware.ProxyContext, request *http.Request) (int, string) {
+	value, ok := request.Header["X-Account-Access-Control"]
+	if !ok {
+		return http.StatusOK, ""
+	}
+	request.Header.Del("X-Account-Access-Control")
+	if !ctx.StorageOwner && ctx.Authorize != nil {
+		return http.StatusForbidden, "Only account owners may set account ACLs"
+	}
+	acl, err := middleware.ParseAccountACL(strings.Join(value, ","))
+	if err != nil {
+		return http.StatusBadRequest, err.Error()
+	}
+	request.Header.Set("X-Account-Sysmeta-"+middleware.AccountACLSysmeta, acl.String())
+	return http.StatusOK, ""
+}
+
+// exposeAccountACL shows the account's ACL to owners as X-Account-Access-Control; the sysmeta it's stored in is
+// stripped from all responses.
+func exposeAccountACL(ctx *middleware.ProxyContext, header http.Header) {
+	sysmeta := "X-Account-Sysmeta-" + middleware.AccountACLSysmeta
+	if acl := header.Get(sysmeta); acl != "" && (ctx.StorageOwner || ctx.Authorize == nil) {
+		header.Set("X-Account-Access-Control", acl)
+	}
+}
@@ -16,9 +16,14 @@
 package proxyserver
 
 import (
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/srv"
 	"github.com/troubling/hummingbird/proxyserver/middleware"
 )
@@ -34,6 +39,31 @@ var listingQueryParms = map[string]bool{
 	"path":       true,
 }
 
+// containerListingQueryParms are the extra query parameters container listings pass through to the container servers.
+var containerListingQueryParms = map[string]bool{
+	"include":        true,
+	"modified_since": true,
+	"content_type":   true,
+	"min_bytes":      true,
+	"max_bytes":      true,
+}
+
+// allowLargeListing lets a reseller admin's listing ask for more than srv.MaxListingLimit entries, up to the proxy's
+// reseller_listing_limit, by telling the backend servers the request's new maximum.
+func (server *ProxyServer) allowLargeListing(ctx *middleware.ProxyContext, request *http.Request, options map[string]string) {
+	if limit, err := strconv.ParseInt(options["limit"], 10, 64); err != nil || limit <= srv.MaxListingLimit ||
+		server.resellerListingLimit <= srv.MaxListingLimit {
+		return
+	}
+	if !ctx.ResellerRequest && ctx.Authorize != nil {
+		// some auth middlewares only recognize reseller admins once asked to authorize the request.
+		ctx.Authorize(request)
+	}
+	if ctx.ResellerRequest {
+		request.Header.Set(srv.ListingLimitHeader, strconv.FormatInt(server.resellerListingLimit, 10))
+	}
+}
+
 func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := srv.GetVars(request)
 	ctx := middleware.GetProxyContext(request)
@@ -48,12 +78,30 @@ func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, reque
 	options := make(map[string]string)
 	if request.ParseForm() == nil {
 		for k, v := range request.Form {
-			if listingQueryParms[k] && len(v) > 0 {
+			if (listingQueryParms[k] || containerListingQueryParms[k]) && len(v) > 0 {
 				options[k] = v[0]
 			}
 		}
 	}
-	resp := ctx.C.GetContainer(vars["account"], vars["container"], options, request.Header)
+	server.allowLargeListing(ctx, request, options)
+	var resp *http.Response
+	var cacheKey string
+	ttl := server.listingCacheTTL(ctx, request, vars["account"], vars["container"], options)
+	if ttl > 0 {
+		if cacheKey = server.listingCacheKey(vars["account"], vars["container"], options, request.Header.Get("Accept")); cacheKey != "" {
+			resp = server.getCachedListing(cacheKey)
+		}
+	}
+	var body io.Reader
+	if resp != nil {
+		body = resp.Body
+	} else {
+		resp = ctx.C.GetContainer(vars["account"], vars["container"], options, request.Header)
+		body = resp.Body
+		if cacheKey != "" && resp.Header.Get("X-Backend-Sharded") != "true" {
+			body = server.cacheListing(cacheKey, resp, ttl)
+		}
+	}
 	defer resp.Body.Close()
 	ctx.ACL = resp.Header.Get("X-Container-Read")
 	if ctx.Authorize != nil && !ctx.Authorize(request) {
@@ -64,11 +112,16 @@ func (server *ProxyServer) ContainerGetHandler(writer http.ResponseWriter, reque
 		srv.StandardResponse(writer, 401)
 		return
 	}
+	if resp.StatusCode/100 == 2 && resp.Header.Get("X-Backend-Sharded") == "true" {
+		server.writeShardedListing(writer, request, ctx, vars["account"], vars["container"], options, resp.Header)
+		return
+	}
 	for k := range resp.Header {
 		writer.Header().Set(k, resp.Header.Get(k))
 	}
+	server.exposePolicyMigration(writer.Header())
 	writer.WriteHeader(resp.StatusCode)
-	common.Copy(resp.Body, writer)
+	common.Copy(body, writer)
 }
 
 func (server *ProxyServer) ContainerHeadHandler(writer http.ResponseWriter, request *http.Request) {
@@ -96,6 +149,7 @@ func (server *ProxyServer) ContainerHeadHandler(writer http.ResponseWriter, requ
 	for k := range resp.Header {
 		writer.Header().Set(k, resp.Header.Get(k))
 	}
+	server.exposePolicyMigration(writer.Header())
 	writer.WriteHeader(resp.StatusCode)
 }
 
@@ -128,6 +182,10 @@ func (server *ProxyServer) ContainerPostHandler(writer http.ResponseWriter, requ
 		writer.Write([]byte(str))
 		return
 	}
+	if status, str := server.translatePolicyMigration(ctx, request, vars["account"], vars["container"]); status != http.StatusOK {
+		srv.SimpleErrorResponse(writer, status, str)
+		return
+	}
 	resp := ctx.C.PostContainer(vars["account"], vars["container"], request.Header)
 	resp.Body.Close()
 	srv.StandardResponse(writer, resp.StatusCode)
@@ -203,3 +261,58 @@ func cleanACLs(r *http.Request) error {
 	}
 	return nil
 }
+
+// translatePolicyMigration validates an X-Migrate-Storage-Policy header, which marks a container for the container
+// migrator to move its objects to the named storage policy, and moves it into container sysmeta. Naming the
+// container's current policy, or no policy, calls off a migration. Only reseller admins may migrate containers.
+func (server *ProxyServer) translatePolicyMigration(ctx *middleware.ProxyContext, request *http.Request, account, container string) (int, string) {
+	value, ok := request.Header["X-Migrate-Storage-Policy"]
+	if !ok {
+		return http.StatusOK, ""
+	}
+	request.Header.Del("X-Migrate-Storage-Policy")
+	if !ctx.ResellerRequest && ctx.Authorize != nil {
+		return http.StatusForbidden, "Only reseller admins may migrate containers between storage policies"
+	}
+	sysmeta := "X-Container-Sysmeta-" + conf.PolicyMigrationSysmeta
+	name := strings.TrimSpace(strings.Join(value, ","))
+	if name == "" {
+		request.Header.Set(sysmeta, "")
+		return http.StatusOK, ""
+	}
+	var policy *conf.Policy
+	for _, p := range server.policyList {
+		if p.Name == name {
+			policy = p
+			break
+		}
+	}
+	if policy == nil {
+		return http.StatusBadRequest, fmt.Sprintf("Invalid X-Migrate-Storage-Policy %q", name)
+	}
+	if policy.Deprecated {
+		return http.StatusBadRequest, fmt.Sprintf("Storage Policy %q is deprecated", name)
+	}
+	ci := ctx.C.GetContainerInfo(account, container)
+	if ci == nil {
+		return http.StatusNotFound, "Container not found"
+	}
+	if policy.Index == ci.StoragePolicyIndex {
+		request.Header.Set(sysmeta, "")
+	} else {
+		request.Header.Set(sysmeta, strconv.Itoa(policy.Index))
+	}
+	return http.StatusOK, ""
+}
+
+// exposePolicyMigration shows the storage policy a container is being migrated to as X-Migrate-Storage-Policy; the
+// sysmeta it's stored in is stripped from all responses.
+func (server *ProxyServer) exposePolicyMigration(header http.Header) {
+	index, err := strconv.Atoi(header.Get("X-Container-Sysmeta-" + conf.PolicyMigrationSysmeta))
+	if err != nil {
+		return
+	}
+	if policy := server.policyList[index]; policy != nil {
+		header.Set("X-Migrate-Storage-Policy", policy.Name)
+	}
+}
@@ -0,0 +1,91 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// policyProxyClient is a ProxyClient with a single container in storage policy 0.
+type policyProxyClient struct {
+	client.ProxyClient
+}
+
+func (c *policyProxyClient) GetContainerInfo(account string, container string) *client.ContainerInfo {
+	if container != "c" {
+		return nil
+	}
+	return &client.ContainerInfo{StoragePolicyIndex: 0}
+}
+
+func TestTranslatePolicyMigration(t *testing.T) {
+	server := &ProxyServer{policyList: conf.PolicyList{
+		0: {Index: 0, Name: "gold", Default: true},
+		1: {Index: 1, Name: "silver"},
+		2: {Index: 2, Name: "bronze", Deprecated: true},
+	}}
+	sysmeta := "X-Container-Sysmeta-" + conf.PolicyMigrationSysmeta
+	reseller := true
+	ctx := &middleware.ProxyContext{C: &policyProxyClient{}, Authorize: func(r *http.Request) bool { return true }}
+	translate := func(container, value string) (int, *http.Request) {
+		ctx.ResellerRequest = reseller
+		req := httptest.NewRequest("POST", "/v1/a/"+container, nil)
+		req.Header.Set("X-Migrate-Storage-Policy", value)
+		status, _ := server.translatePolicyMigration(ctx, req, "a", container)
+		require.Equal(t, "", req.Header.Get("X-Migrate-Storage-Policy"))
+		return status, req
+	}
+
+	status, req := translate("c", "silver")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "1", req.Header.Get(sysmeta))
+	status, req = translate("c", "gold")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{""}, req.Header[sysmeta])
+	status, req = translate("c", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{""}, req.Header[sysmeta])
+	status, _ = translate("c", "tin")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = translate("c", "bronze")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = translate("missing", "silver")
+	require.Equal(t, http.StatusNotFound, status)
+	reseller = false
+	status, req = translate("c", "silver")
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "", req.Header.Get(sysmeta))
+
+	req = httptest.NewRequest("POST", "/v1/a/c", nil)
+	status, _ = server.translatePolicyMigration(ctx, req, "a", "c")
+	require.Equal(t, http.StatusOK, status)
+	_, ok := req.Header[sysmeta]
+	require.False(t, ok)
+
+	header := http.Header{}
+	server.exposePolicyMigration(header)
+	require.Equal(t, "", header.Get("X-Migrate-Storage-Policy"))
+	header.Set(sysmeta, "1")
+	server.exposePolicyMigration(header)
+	require.Equal(t, "silver", header.Get("X-Migrate-Storage-Policy"))
+}
@@ -0,0 +1,126 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// listingCacheMeta is the container metadata that opts a container into listing caching. Its value is how many seconds
+// a listing may be served from memcache, capped by the proxy's container_listing_cache_max_ttl.
+const listingCacheMeta = "Listing-Cache-Ttl"
+
+// maxCachedListingSize is the largest listing body that will be cached, keeping entries under memcache's item size
+// limit once they're encoded.
+const maxCachedListingSize = 512 * 1024
+
+// cachedListing is a container server's listing response as stored in memcache.
+type cachedListing struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// listingCacheTTL returns how long the container's listings may be cached, or 0 if they shouldn't be.  Listings asking
+// for more than srv.MaxListingLimit entries aren't cached, as a reseller admin's large listing mustn't be served to
+// others whose listings are capped.
+func (server *ProxyServer) listingCacheTTL(ctx *middleware.ProxyContext, request *http.Request, account, container string,
+	options map[string]string) int {
+	if server.mc == nil || server.listingCacheMaxTTL <= 0 || common.LooksTrue(request.Header.Get("X-Newest")) {
+		return 0
+	}
+	if limit, err := strconv.ParseInt(options["limit"], 10, 64); err == nil && limit > srv.MaxListingLimit {
+		return 0
+	}
+	ci := ctx.C.GetContainerInfo(account, container)
+	if ci == nil {
+		return 0
+	}
+	ttl, err := strconv.Atoi(strings.TrimSpace(ci.Metadata[listingCacheMeta]))
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	if ttl > server.listingCacheMaxTTL {
+		ttl = server.listingCacheMaxTTL
+	}
+	return ttl
+}
+
+// listingCacheKey returns the memcache key a listing with the given options is cached under. Keys include the
+// container's current listing generation, which is started here if the container doesn't have one; object writes
+// through any proxy delete the generation, so listings cached before the write are never found again.
+func (server *ProxyServer) listingCacheKey(account, container string, options map[string]string, accept string) string {
+	generationKey := client.ContainerListingGenerationKey(account, container)
+	var generation string
+	if err := server.mc.GetStructured(generationKey, &generation); err != nil || generation == "" {
+		generation = common.UUID()
+		if err := server.mc.Set(generationKey, generation, server.listingCacheMaxTTL); err != nil {
+			return ""
+		}
+	}
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hash := md5.New()
+	for _, k := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", k, options[k])
+	}
+	fmt.Fprintf(hash, "accept=%s\n", accept)
+	return fmt.Sprintf("%s/%s/%x", generationKey, generation, hash.Sum(nil))
+}
+
+// getCachedListing returns the listing cached under key as a response, or nil if there isn't one.
+func (server *ProxyServer) getCachedListing(key string) *http.Response {
+	var cached cachedListing
+	if err := server.mc.GetStructured(key, &cached); err != nil || cached.StatusCode == 0 {
+		return nil
+	}
+	return &http.Response{
+		StatusCode:    cached.StatusCode,
+		Header:        cached.Header,
+		Body:          ioutil.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body)),
+	}
+}
+
+// cacheListing caches a successful listing response under key, returning a body to read the listing from in place of
+// the response's. Listings too large to cache are passed through untouched.
+func (server *ProxyServer) cacheListing(key string, resp *http.Response, ttl int) io.Reader {
+	if resp.StatusCode/100 != 2 {
+		return resp.Body
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCachedListingSize+1))
+	if err != nil || len(body) > maxCachedListingSize {
+		return io.MultiReader(bytes.NewReader(body), resp.Body)
+	}
+	server.mc.Set(key, &cachedListing{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, ttl)
+	return bytes.NewReader(body)
+}
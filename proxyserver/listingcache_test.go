@@ -0,0 +1,167 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/test"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// listingProxyClient is a ProxyClient serving a fixed container listing and counting the listings it serves.
+type listingProxyClient struct {
+	client.ProxyClient
+	metadata map[string]string
+	listing  string
+	gets     int
+}
+
+func (c *listingProxyClient) GetContainerInfo(account string, container string) *client.ContainerInfo {
+	return &client.ContainerInfo{Metadata: c.metadata}
+}
+
+func (c *listingProxyClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	c.gets++
+	resp := client.ResponseStub(200, c.listing)
+	resp.Header.Set("X-Container-Read", ".r:*")
+	return resp
+}
+
+func TestContainerGetListingCache(t *testing.T) {
+	mc := test.NewMemoryMemcacheRing()
+	mc.Set("account/a", &middleware.AccountInfo{}, 30)
+	pc := &listingProxyClient{metadata: map[string]string{listingCacheMeta: "300"}, listing: "obj1\n"}
+	server := &ProxyServer{mc: mc, listingCacheMaxTTL: 60}
+	get := func(query string, header http.Header) (int, string) {
+		req := httptest.NewRequest("GET", "/v1/a/c"+query, nil)
+		for k := range header {
+			req.Header.Set(k, header.Get(k))
+		}
+		req = srv.SetVars(req, map[string]string{"account": "a", "container": "c"})
+		ctx := &middleware.ProxyContext{
+			ProxyContextMiddleware: &middleware.ProxyContextMiddleware{Cache: mc},
+			C:                      pc,
+		}
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		rsp := httptest.NewRecorder()
+		server.ContainerGetHandler(rsp, req)
+		require.Equal(t, ".r:*", rsp.Header().Get("X-Container-Read"))
+		return rsp.Code, rsp.Body.String()
+	}
+
+	code, body := get("", nil)
+	require.Equal(t, 200, code)
+	require.Equal(t, "obj1\n", body)
+	require.Equal(t, 1, pc.gets)
+
+	// a repeat listing comes from the cache, but other query parameters don't.
+	pc.listing = "obj1\nobj2\n"
+	_, body = get("", nil)
+	require.Equal(t, "obj1\n", body)
+	require.Equal(t, 1, pc.gets)
+	_, body = get("?prefix=obj", nil)
+	require.Equal(t, "obj1\nobj2\n", body)
+	require.Equal(t, 2, pc.gets)
+	_, body = get("", http.Header{"X-Newest": {"true"}})
+	require.Equal(t, "obj1\nobj2\n", body)
+	require.Equal(t, 3, pc.gets)
+
+	// object writes through the proxy delete the listing generation, invalidating every listing of the container.
+	mc.Delete(client.ContainerListingGenerationKey("a", "c"))
+	_, body = get("", nil)
+	require.Equal(t, "obj1\nobj2\n", body)
+	require.Equal(t, 4, pc.gets)
+
+	// containers that haven't opted in aren't cached.
+	pc.metadata = map[string]string{}
+	pc.listing = "obj3\n"
+	_, body = get("", nil)
+	require.Equal(t, "obj3\n", body)
+	require.Equal(t, 5, pc.gets)
+}
+
+func TestListingCacheTTL(t *testing.T) {
+	mc := test.NewMemoryMemcacheRing()
+	pc := &listingProxyClient{metadata: map[string]string{}}
+	ctx := &middleware.ProxyContext{C: pc}
+	req := httptest.NewRequest("GET", "/v1/a/c", nil)
+	server := &ProxyServer{mc: mc, listingCacheMaxTTL: 60}
+	require.Equal(t, 0, server.listingCacheTTL(ctx, req, "a", "c", nil))
+	pc.metadata[listingCacheMeta] = "bogus"
+	require.Equal(t, 0, server.listingCacheTTL(ctx, req, "a", "c", nil))
+	pc.metadata[listingCacheMeta] = " 10 "
+	require.Equal(t, 10, server.listingCacheTTL(ctx, req, "a", "c", nil))
+	pc.metadata[listingCacheMeta] = "600"
+	require.Equal(t, 60, server.listingCacheTTL(ctx, req, "a", "c", nil))
+	server.listingCacheMaxTTL = 0
+	require.Equal(t, 0, server.listingCacheTTL(ctx, req, "a", "c", nil))
+}
+
+func TestCacheListingTooLarge(t *testing.T) {
+	mc := test.NewMemoryMemcacheRing()
+	server := &ProxyServer{mc: mc, listingCacheMaxTTL: 60}
+	listing := strings.Repeat("x", maxCachedListingSize+10)
+	resp := client.ResponseStub(200, listing)
+	body := server.cacheListing("key", resp, 10)
+	data, err := ioutil.ReadAll(body)
+	require.Nil(t, err)
+	require.Equal(t, listing, string(data))
+	require.Nil(t, server.getCachedListing("key"))
+}
+
+func TestAllowLargeListing(t *testing.T) {
+	server := &ProxyServer{resellerListingLimit: 1000000}
+	reseller := false
+	ctx := &middleware.ProxyContext{Authorize: func(r *http.Request) bool {
+		middleware.GetProxyContext(r).ResellerRequest = reseller
+		return reseller
+	}}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/v1/a/c", nil)
+		return req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+	}
+
+	req := newRequest()
+	server.allowLargeListing(ctx, req, map[string]string{"limit": "50000"})
+	require.Equal(t, "", req.Header.Get(srv.ListingLimitHeader))
+
+	reseller = true
+	req = newRequest()
+	server.allowLargeListing(ctx, req, map[string]string{"limit": "100"})
+	require.Equal(t, "", req.Header.Get(srv.ListingLimitHeader))
+	server.allowLargeListing(ctx, req, map[string]string{"limit": "50000"})
+	require.Equal(t, "1000000", req.Header.Get(srv.ListingLimitHeader))
+
+	// large listings aren't cached, whoever asks for them.
+	server.mc = test.NewMemoryMemcacheRing()
+	server.listingCacheMaxTTL = 60
+	ctx.C = &listingProxyClient{metadata: map[string]string{listingCacheMeta: "300"}}
+	require.Equal(t, 0, server.listingCacheTTL(ctx, req, "a", "c", map[string]string{"limit": "50000"}))
+	reseller = false
+	req = newRequest()
+	server.allowLargeListing(ctx, req, map[string]string{"limit": "50000"})
+	require.Equal(t, 0, server.listingCacheTTL(ctx, req, "a", "c", map[string]string{"limit": "50000"}))
+	require.Equal(t, 60, server.listingCacheTTL(ctx, req, "a", "c", map[string]string{"limit": "10000"}))
+}
@@ -20,12 +20,14 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common"
 	"github.com/troubling/hummingbird/common/conf"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"github.com/troubling/hummingbird/proxyserver/middleware"
 
 	"github.com/justinas/alice"
@@ -37,15 +39,27 @@ type ProxyServer struct {
 	logLevel          zap.AtomicLevel
 	mc                ring.MemcacheRing
 	proxyDirectClient *client.ProxyDirectClient
+	tracer            *tracing.Tracer
+	usageClient       *http.Client
+	// listingCacheMaxTTL caps how many seconds a container that opted in may have its listings cached; 0 disables
+	// listing caching.
+	listingCacheMaxTTL int
+	// resellerListingLimit is the most entries a reseller admin's account or container listing may ask for.
+	resellerListingLimit int64
+	policyList           conf.PolicyList
+	// usageCache holds recent reseller usage reports.
+	usageCache *usageCache
 }
 
 func (server *ProxyServer) Finalize() {
+	server.tracer.Close()
 }
 
 func (server *ProxyServer) GetHandler(config conf.Config) http.Handler {
 	router := srv.NewRouter()
 	router.Get("/loglevel", server.logLevel)
 	router.Put("/loglevel", server.logLevel)
+	router.Get("/v1/"+middleware.UsageAccount, http.HandlerFunc(server.ResellerUsageHandler))
 	router.Get("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectGetHandler))
 	router.Head("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectHeadHandler))
 	router.Put("/v1/:account/:container/*obj", http.HandlerFunc(server.ObjectPutHandler))
@@ -73,47 +87,46 @@ func (server *ProxyServer) GetHandler(config conf.Config) http.Handler {
 	router.Post("/v1/:account", http.HandlerFunc(server.AccountPostHandler))
 	router.Post("/v1/:account/", http.HandlerFunc(server.AccountPostHandler))
 
-	tempAuth := config.GetBool("proxy-server", "tempauth_enabled", true)
-	var middlewares []struct {
+	type middlewareConstructor struct {
 		construct func(config conf.Section) (func(http.Handler) http.Handler, error)
 		section   string
 	}
-	// TODO: make this all dynamical and stuff
-	if tempAuth {
-		middlewares = []struct {
-			construct func(config conf.Section) (func(http.Handler) http.Handler, error)
-			section   string
-		}{
-			{middleware.NewCatchError, "filter:catch_errors"},
-			{middleware.NewHealthcheck, "filter:healthcheck"},
-			{middleware.NewRequestLogger, "filter:proxy-logging"},
-			{middleware.NewFormPost, "filter:formpost"},
-			{middleware.NewTempURL, "filter:tempurl"},
+	var authMiddlewares []middlewareConstructor
+	if config.GetBool("proxy-server", "authservice_enabled", false) {
+		authMiddlewares = []middlewareConstructor{
+			{middleware.NewAuthService, "filter:authservice"},
+		}
+	} else if config.GetBool("proxy-server", "jwtauth_enabled", false) {
+		authMiddlewares = []middlewareConstructor{
+			{middleware.NewJWTAuth, "filter:jwtauth"},
+		}
+	} else if config.GetBool("proxy-server", "tempauth_enabled", true) {
+		authMiddlewares = []middlewareConstructor{
 			{middleware.NewTempAuth, "filter:tempauth"},
-			{middleware.NewRatelimiter, "filter:ratelimit"},
-			{middleware.NewStaticWeb, "filter:staticweb"},
-			{middleware.NewCopyMiddleware, "filter:copy"},
-			{middleware.NewXlo, "filter:slo"},
 		}
 	} else {
-		middlewares = []struct {
-			construct func(config conf.Section) (func(http.Handler) http.Handler, error)
-			section   string
-		}{
-			{middleware.NewCatchError, "filter:catch_errors"},
-			{middleware.NewHealthcheck, "filter:healthcheck"},
-			{middleware.NewRequestLogger, "filter:proxy-logging"},
-			{middleware.NewFormPost, "filter:formpost"},
-			{middleware.NewTempURL, "filter:tempurl"},
+		authMiddlewares = []middlewareConstructor{
 			{middleware.NewAuthToken, "filter:authtoken"},
 			{middleware.NewKeystoneAuth, "filter:keystoneauth"},
-			{middleware.NewRatelimiter, "filter:ratelimit"},
-			{middleware.NewStaticWeb, "filter:staticweb"},
-			{middleware.NewCopyMiddleware, "filter:copy"},
-			{middleware.NewXlo, "filter:slo"},
 		}
 	}
-	pipeline := alice.New(middleware.NewContext(server.mc, server.logger, server.proxyDirectClient))
+	// TODO: make this all dynamical and stuff
+	middlewares := []middlewareConstructor{
+		{middleware.NewCatchError, "filter:catch_errors"},
+		{middleware.NewHealthcheck, "filter:healthcheck"},
+		{middleware.NewRequestLogger, "filter:proxy-logging"},
+		{middleware.NewFormPost, "filter:formpost"},
+		{middleware.NewTempURL, "filter:tempurl"},
+	}
+	middlewares = append(middlewares, authMiddlewares...)
+	middlewares = append(middlewares, []middlewareConstructor{
+		{middleware.NewRatelimiter, "filter:ratelimit"},
+		{middleware.NewStaticWeb, "filter:staticweb"},
+		{middleware.NewCopyMiddleware, "filter:copy"},
+		{middleware.NewXlo, "filter:slo"},
+	}...)
+	pipeline := alice.New(middleware.NewContext(server.mc, server.logger, server.proxyDirectClient, server.tracer,
+		config.GetBool("proxy-server", "expose_metrics", false)))
 	for _, m := range middlewares {
 		mid, err := m.construct(config.GetSection(m.section))
 		if err != nil {
@@ -143,15 +156,22 @@ func GetServer(serverconf conf.Config, flags *flag.FlagSet) (string, int, srv.Se
 	if server.logger, err = srv.SetupLogger("proxy-server", &server.logLevel, flags); err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up logger: %v", err)
 	}
-	policies := conf.LoadPolicies()
-	server.proxyDirectClient, err = client.NewProxyDirectClient(policies)
+	if server.tracer, err = tracing.NewTracerFromConfig(serverconf, "proxy-server", "proxy-server", server.logger); err != nil {
+		return "", 0, nil, nil, err
+	}
+	server.usageClient = &http.Client{Timeout: time.Duration(serverconf.GetInt("proxy-server", "usage_timeout", 600)) * time.Second}
+	server.usageCache = newUsageCache(time.Duration(serverconf.GetInt("proxy-server", "usage_cache_time", 300)) * time.Second)
+	server.listingCacheMaxTTL = int(serverconf.GetInt("proxy-server", "container_listing_cache_max_ttl", 60))
+	server.resellerListingLimit = serverconf.GetInt("proxy-server", "reseller_listing_limit", 1000000)
+	server.policyList = conf.LoadPolicies()
+	server.proxyDirectClient, err = client.NewProxyDirectClient(server.policyList)
 	if err != nil {
 		return "", 0, nil, nil, fmt.Errorf("Error setting up proxyDirectClient: %v", err)
 	}
 	info := map[string]interface{}{
 		"version":          common.Version,
 		"strict_cors_mode": true,
-		"policies":         policies.GetPolicyInfo(),
+		"policies":         server.policyList.GetPolicyInfo(),
 	}
 	for k, v := range DEFAULT_CONSTRAINTS {
 		info[k] = v
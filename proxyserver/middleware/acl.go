@@ -16,6 +16,7 @@
 package middleware
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strings"
@@ -107,3 +108,114 @@ func ReferrerAllowed(referrer string, referrerACL []string) bool {
 	}
 	return allow
 }
+
+const (
+	ACCOUNT_ACL_NONE = iota
+	ACCOUNT_ACL_READ_ONLY
+	ACCOUNT_ACL_READ_WRITE
+	ACCOUNT_ACL_ADMIN
+)
+
+// The account sysmeta key account ACLs are stored under.
+const AccountACLSysmeta = "Core-Access-Control"
+
+// AccountACL is the parsed form of an X-Account-Access-Control header.
+type AccountACL struct {
+	Admin     []string `json:"admin,omitempty"`
+	ReadWrite []string `json:"read-write,omitempty"`
+	ReadOnly  []string `json:"read-only,omitempty"`
+}
+
+// ParseAccountACL parses and validates a JSON account ACL, such as
+// {"admin":["bob"],"read-only":["sue"]}. An empty value returns an empty ACL.
+func ParseAccountACL(value string) (*AccountACL, error) {
+	acl := &AccountACL{}
+	if strings.TrimSpace(value) == "" {
+		return acl, nil
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("Invalid JSON in account ACL: %s", value)
+	}
+	for key, v := range raw {
+		var dst *[]string
+		switch key {
+		case "admin":
+			dst = &acl.Admin
+		case "read-write":
+			dst = &acl.ReadWrite
+		case "read-only":
+			dst = &acl.ReadOnly
+		default:
+			return nil, fmt.Errorf("Unknown key %q in account ACL", key)
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Value for %q in account ACL must be a list", key)
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("Values for %q in account ACL must be non-empty strings", key)
+			}
+			*dst = append(*dst, name)
+		}
+	}
+	return acl, nil
+}
+
+// String returns the canonical JSON form of the ACL, or "" if it grants nothing.
+func (acl *AccountACL) String() string {
+	if len(acl.Admin) == 0 && len(acl.ReadWrite) == 0 && len(acl.ReadOnly) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(acl)
+	return string(data)
+}
+
+// Level returns the highest access level granted to any of the given identities.
+func (acl *AccountACL) Level(identities []string) int {
+	for _, l := range []struct {
+		names []string
+		level int
+	}{{acl.Admin, ACCOUNT_ACL_ADMIN}, {acl.ReadWrite, ACCOUNT_ACL_READ_WRITE}, {acl.ReadOnly, ACCOUNT_ACL_READ_ONLY}} {
+		for _, identity := range identities {
+			if common.StringInSlice(identity, l.names) {
+				return l.level
+			}
+		}
+	}
+	return ACCOUNT_ACL_NONE
+}
+
+// AccountACLAllows returns true if the given access level permits the request. Read-only access allows reading
+// anything in the account, read-write adds writes to containers and objects, and admin access is equivalent to
+// owning the account, which still doesn't allow creating or deleting the account itself.
+func AccountACLAllows(level int, method string, container string) bool {
+	switch level {
+	case ACCOUNT_ACL_ADMIN:
+		return container != "" || (method != "PUT" && method != "DELETE")
+	case ACCOUNT_ACL_READ_WRITE:
+		if container != "" {
+			return true
+		}
+		fallthrough
+	case ACCOUNT_ACL_READ_ONLY:
+		return method == "GET" || method == "HEAD" || method == "OPTIONS"
+	}
+	return false
+}
+
+// accountACLLevel looks up the account ACL stored in the account's sysmeta and returns the access level it grants
+// the identities.
+func accountACLLevel(ctx *ProxyContext, account string, identities []string) int {
+	ai := ctx.GetAccountInfo(account)
+	if ai == nil {
+		return ACCOUNT_ACL_NONE
+	}
+	acl, err := ParseAccountACL(ai.SysMetadata[AccountACLSysmeta])
+	if err != nil {
+		return ACCOUNT_ACL_NONE
+	}
+	return acl.Level(identities)
+}
@@ -137,3 +137,77 @@ func TestReferrerAllowed(t *testing.T) {
 		}
 	}
 }
+
+func TestParseAccountACL(t *testing.T) {
+	var tests = []struct {
+		s        string // input
+		expected string // canonical form, or "" if invalid
+		valid    bool
+	}{
+		{"", "", true},
+		{"{}", "", true},
+		{`{"admin":["bob"]}`, `{"admin":["bob"]}`, true},
+		{`{"read-only":["sue"],"admin":["bob"],"read-write":["AUTH_test:tester"]}`,
+			`{"admin":["bob"],"read-write":["AUTH_test:tester"],"read-only":["sue"]}`, true},
+		{`{"admin":[]}`, "", true},
+		{`not json`, "", false},
+		{`["admin"]`, "", false},
+		{`{"owner":["bob"]}`, "", false},
+		{`{"admin":"bob"}`, "", false},
+		{`{"admin":[1]}`, "", false},
+		{`{"admin":[""]}`, "", false},
+	}
+
+	for _, tt := range tests {
+		acl, err := ParseAccountACL(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseAccountACL(%v): expected valid %v, got error %v", tt.s, tt.valid, err)
+			continue
+		}
+		if err == nil && acl.String() != tt.expected {
+			t.Errorf("ParseAccountACL(%v): expected %v, actual %v", tt.s, tt.expected, acl.String())
+		}
+	}
+}
+
+func TestAccountACLLevel(t *testing.T) {
+	acl, err := ParseAccountACL(`{"admin":["boss"],"read-write":["test:writer","group"],"read-only":["test:reader","*:*"]}`)
+	assert.Nil(t, err)
+	assert.Equal(t, ACCOUNT_ACL_ADMIN, acl.Level([]string{"test:boss", "boss"}))
+	assert.Equal(t, ACCOUNT_ACL_READ_WRITE, acl.Level([]string{"test:writer", "test"}))
+	assert.Equal(t, ACCOUNT_ACL_READ_WRITE, acl.Level([]string{"other:someone", "group"}))
+	assert.Equal(t, ACCOUNT_ACL_READ_ONLY, acl.Level([]string{"test:reader"}))
+	assert.Equal(t, ACCOUNT_ACL_NONE, acl.Level([]string{"test:nobody", "test"}))
+	// the highest level granted wins
+	assert.Equal(t, ACCOUNT_ACL_ADMIN, acl.Level([]string{"test:reader", "boss"}))
+}
+
+func TestAccountACLAllows(t *testing.T) {
+	var tests = []struct {
+		level     int
+		method    string
+		container string
+		expected  bool
+	}{
+		{ACCOUNT_ACL_NONE, "GET", "c", false},
+		{ACCOUNT_ACL_READ_ONLY, "GET", "", true},
+		{ACCOUNT_ACL_READ_ONLY, "HEAD", "c", true},
+		{ACCOUNT_ACL_READ_ONLY, "PUT", "c", false},
+		{ACCOUNT_ACL_READ_ONLY, "POST", "", false},
+		{ACCOUNT_ACL_READ_WRITE, "PUT", "c", true},
+		{ACCOUNT_ACL_READ_WRITE, "DELETE", "c", true},
+		{ACCOUNT_ACL_READ_WRITE, "GET", "", true},
+		{ACCOUNT_ACL_READ_WRITE, "POST", "", false},
+		{ACCOUNT_ACL_ADMIN, "POST", "", true},
+		{ACCOUNT_ACL_ADMIN, "DELETE", "c", true},
+		{ACCOUNT_ACL_ADMIN, "DELETE", "", false},
+		{ACCOUNT_ACL_ADMIN, "PUT", "", false},
+	}
+
+	for _, tt := range tests {
+		actual := AccountACLAllows(tt.level, tt.method, tt.container)
+		if actual != tt.expected {
+			t.Errorf("AccountACLAllows(%v, %v, %v): expected %v, actual %v", tt.level, tt.method, tt.container, tt.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+const (
+	authAdminGroup         = ".admin"
+	authResellerAdminGroup = ".reseller_admin"
+	authSuperAdminUser     = ".super_admin"
+)
+
+// authUser is the record stored for each user, as the object <auth account>/<account>/<user>.
+type authUser struct {
+	Auth   string   `json:"auth"`
+	Groups []string `json:"groups"`
+}
+
+// authIdentity is what a token resolves to; it is cached in memcache for the life of the token.
+type authIdentity struct {
+	Account string   `json:"account"`
+	User    string   `json:"user"`
+	Groups  []string `json:"groups"`
+	Expires int64    `json:"expires"`
+}
+
+func (ai *authIdentity) inGroup(group string) bool {
+	return common.StringInSlice(group, ai.Groups)
+}
+
+// authService stores users, keys and groups in a hidden account in the cluster and issues tokens that are scoped
+// to the user's account.
+type authService struct {
+	next           http.Handler
+	authAccount    string
+	resellerPrefix string
+	superAdminKey  string
+	tokenLife      int
+	storageURL     string
+}
+
+// newAuthToken returns a random token; common.UUID isn't suitable since it uses math/rand.
+func newAuthToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "AUTH_tk" + hex.EncodeToString(b), nil
+}
+
+func hashAuthKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	h := sha512.Sum512(append([]byte(hex.EncodeToString(salt)), key...))
+	return fmt.Sprintf("sha512:%s$%s", hex.EncodeToString(salt), hex.EncodeToString(h[:])), nil
+}
+
+func checkAuthKey(auth, key string) bool {
+	parts := strings.SplitN(auth, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	switch parts[0] {
+	case "plaintext":
+		return hmac.Equal([]byte(parts[1]), []byte(key))
+	case "sha512":
+		saltHash := strings.SplitN(parts[1], "$", 2)
+		if len(saltHash) != 2 {
+			return false
+		}
+		h := sha512.Sum512(append([]byte(saltHash[0]), key...))
+		return hmac.Equal([]byte(saltHash[1]), []byte(hex.EncodeToString(h[:])))
+	}
+	return false
+}
+
+func tokenCacheKey(token string) string {
+	return "authservice/token/" + token
+}
+
+func userTokenCacheKey(account, user string) string {
+	return fmt.Sprintf("authservice/user/%s/%s", account, user)
+}
+
+func (as *authService) getUser(ctx *ProxyContext, account, user string) (*authUser, error) {
+	resp := ctx.C.GetObject(as.authAccount, account, user, http.Header{})
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Unable to load user %s:%s: %d", account, user, resp.StatusCode)
+	}
+	var u authUser
+	if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (as *authService) putUser(ctx *ProxyContext, account, user string, u *authUser) error {
+	body, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{
+		"X-Timestamp":    []string{common.GetTimestamp()},
+		"Content-Type":   []string{"application/json"},
+		"Content-Length": []string{strconv.Itoa(len(body))},
+	}
+	resp := ctx.C.PutObject(as.authAccount, account, user, hdr, bytes.NewReader(body))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unable to save user %s:%s: %d", account, user, resp.StatusCode)
+	}
+	return nil
+}
+
+// ensureAccount creates the container for an account's users, and the auth account itself if needed.
+func (as *authService) ensureAccount(ctx *ProxyContext, account string) error {
+	resp := ctx.C.PutContainer(as.authAccount, account, http.Header{"X-Timestamp": []string{common.GetTimestamp()}})
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		resp = ctx.C.PutAccount(as.authAccount, http.Header{"X-Timestamp": []string{common.GetTimestamp()}})
+		resp.Body.Close()
+		resp = ctx.C.PutContainer(as.authAccount, account, http.Header{"X-Timestamp": []string{common.GetTimestamp()}})
+		resp.Body.Close()
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Unable to create auth container for %s: %d", account, resp.StatusCode)
+	}
+	return nil
+}
+
+// revokeTokens removes any outstanding token for the user, e.g. after a key rotation or deletion.
+func (as *authService) revokeTokens(ctx *ProxyContext, account, user string) {
+	var token string
+	if err := ctx.Cache.GetStructured(userTokenCacheKey(account, user), &token); err == nil && token != "" {
+		ctx.Cache.Delete(tokenCacheKey(token))
+	}
+	ctx.Cache.Delete(userTokenCacheKey(account, user))
+}
+
+func (as *authService) tokenIdentity(ctx *ProxyContext, token string) *authIdentity {
+	var identity authIdentity
+	if err := ctx.Cache.GetStructured(tokenCacheKey(token), &identity); err != nil || identity.User == "" {
+		return nil
+	}
+	if time.Now().Unix() >= identity.Expires {
+		return nil
+	}
+	return &identity
+}
+
+// adminIdentity works out who is making an admin API request, either from X-Auth-Admin-User/X-Auth-Admin-Key or
+// from a valid X-Auth-Token.
+func (as *authService) adminIdentity(ctx *ProxyContext, request *http.Request) *authIdentity {
+	adminUser := request.Header.Get("X-Auth-Admin-User")
+	adminKey := request.Header.Get("X-Auth-Admin-Key")
+	if adminUser == authSuperAdminUser {
+		if as.superAdminKey != "" && hmac.Equal([]byte(adminKey), []byte(as.superAdminKey)) {
+			return &authIdentity{User: authSuperAdminUser, Groups: []string{authSuperAdminUser, authResellerAdminGroup}}
+		}
+		return nil
+	} else if adminUser != "" {
+		parts := strings.SplitN(adminUser, ":", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		u, err := as.getUser(ctx, parts[0], parts[1])
+		if err != nil || u == nil || !checkAuthKey(u.Auth, adminKey) {
+			return nil
+		}
+		return &authIdentity{Account: parts[0], User: parts[1], Groups: u.Groups}
+	} else if token := request.Header.Get("X-Auth-Token"); token != "" {
+		return as.tokenIdentity(ctx, token)
+	}
+	return nil
+}
+
+// canManage returns true if admin is allowed to change users on account; only the super admin can hand out or
+// take away reseller admin rights.
+func (as *authService) canManage(admin *authIdentity, account string, resellerAdmin bool) bool {
+	if admin.inGroup(authSuperAdminUser) {
+		return true
+	}
+	if resellerAdmin {
+		return false
+	}
+	return admin.inGroup(authResellerAdminGroup) || (admin.inGroup(authAdminGroup) && admin.Account == account)
+}
+
+func (as *authService) handleLogin(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	authUserHeader := request.Header.Get("X-Auth-User")
+	key := request.Header.Get("X-Auth-Key")
+	if authUserHeader == "" {
+		authUserHeader = request.Header.Get("X-Storage-User")
+		key = request.Header.Get("X-Storage-Pass")
+	}
+	parts := strings.SplitN(authUserHeader, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || key == "" {
+		srv.StandardResponse(writer, 400)
+		return
+	}
+	account, user := parts[0], parts[1]
+	u, err := as.getUser(ctx, account, user)
+	if err != nil {
+		ctx.Logger.Error("Error loading user", zap.String("account", account), zap.String("user", user), zap.Error(err))
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	if u == nil || !checkAuthKey(u.Auth, key) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+	var token string
+	var identity *authIdentity
+	if err := ctx.Cache.GetStructured(userTokenCacheKey(account, user), &token); err == nil && token != "" {
+		identity = as.tokenIdentity(ctx, token)
+	}
+	if identity == nil {
+		if token, err = newAuthToken(); err != nil {
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		identity = &authIdentity{
+			Account: account,
+			User:    user,
+			Groups:  u.Groups,
+			Expires: time.Now().Unix() + int64(as.tokenLife),
+		}
+		ctx.Cache.Set(tokenCacheKey(token), identity, as.tokenLife)
+		ctx.Cache.Set(userTokenCacheKey(account, user), token, as.tokenLife)
+	}
+	ctx.RemoteUser = authUserHeader
+	storageURL := as.storageURL
+	if storageURL == "" {
+		storageURL = fmt.Sprintf("http://%s", request.Host)
+	}
+	writer.Header().Set("X-Storage-Token", token)
+	writer.Header().Set("X-Auth-Token", token)
+	writer.Header().Set("X-Auth-Token-Expires", strconv.FormatInt(identity.Expires-time.Now().Unix(), 10))
+	writer.Header().Set("X-Storage-URL", fmt.Sprintf("%s/v1/%s%s", storageURL, as.resellerPrefix, account))
+	srv.StandardResponse(writer, 200)
+}
+
+func (as *authService) handleAdmin(writer http.ResponseWriter, request *http.Request, account, user string) {
+	ctx := GetProxyContext(request)
+	admin := as.adminIdentity(ctx, request)
+	if admin == nil {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+	if account == "" || strings.HasPrefix(account, ".") || strings.HasPrefix(user, ".") {
+		srv.StandardResponse(writer, 400)
+		return
+	}
+	if user == "" {
+		if request.Method != "GET" {
+			srv.StandardResponse(writer, 405)
+			return
+		}
+		if !as.canManage(admin, account, false) {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		resp := ctx.C.GetContainer(as.authAccount, account, map[string]string{"format": "json"}, http.Header{})
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			srv.StandardResponse(writer, resp.StatusCode)
+			return
+		}
+		var records []client.ObjectRecord
+		if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		users := []map[string]string{}
+		for _, r := range records {
+			users = append(users, map[string]string{"name": r.Name})
+		}
+		body, _ := json.Marshal(map[string]interface{}{"account": account, "users": users})
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(200)
+		writer.Write(body)
+		return
+	}
+
+	existing, err := as.getUser(ctx, account, user)
+	if err != nil {
+		ctx.Logger.Error("Error loading user", zap.String("account", account), zap.String("user", user), zap.Error(err))
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	existingResellerAdmin := existing != nil && common.StringInSlice(authResellerAdminGroup, existing.Groups)
+
+	switch request.Method {
+	case "GET":
+		if !as.canManage(admin, account, existingResellerAdmin) && !(admin.Account == account && admin.User == user) {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		if existing == nil {
+			srv.StandardResponse(writer, 404)
+			return
+		}
+		body, _ := json.Marshal(map[string]interface{}{"account": account, "user": user, "groups": existing.Groups})
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(200)
+		writer.Write(body)
+	case "PUT":
+		key := request.Header.Get("X-Auth-User-Key")
+		resellerAdmin := common.LooksTrue(request.Header.Get("X-Auth-User-Reseller-Admin"))
+		if key == "" {
+			srv.StandardResponse(writer, 400)
+			return
+		}
+		if !as.canManage(admin, account, resellerAdmin || existingResellerAdmin) {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		groups := []string{fmt.Sprintf("%s:%s", account, user), account}
+		if resellerAdmin {
+			groups = append(groups, authAdminGroup, authResellerAdminGroup)
+		} else if common.LooksTrue(request.Header.Get("X-Auth-User-Admin")) {
+			groups = append(groups, authAdminGroup)
+		}
+		auth, err := hashAuthKey(key)
+		if err != nil {
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		if err := as.ensureAccount(ctx, account); err != nil {
+			ctx.Logger.Error("Error creating auth account", zap.String("account", account), zap.Error(err))
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		if err := as.putUser(ctx, account, user, &authUser{Auth: auth, Groups: groups}); err != nil {
+			ctx.Logger.Error("Error saving user", zap.String("account", account), zap.String("user", user), zap.Error(err))
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		as.revokeTokens(ctx, account, user)
+		srv.StandardResponse(writer, 201)
+	case "POST":
+		key := request.Header.Get("X-Auth-User-Key")
+		if key == "" {
+			srv.StandardResponse(writer, 400)
+			return
+		}
+		if !as.canManage(admin, account, existingResellerAdmin) && !(admin.Account == account && admin.User == user) {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		if existing == nil {
+			srv.StandardResponse(writer, 404)
+			return
+		}
+		auth, err := hashAuthKey(key)
+		if err != nil {
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		existing.Auth = auth
+		if err := as.putUser(ctx, account, user, existing); err != nil {
+			ctx.Logger.Error("Error saving user", zap.String("account", account), zap.String("user", user), zap.Error(err))
+			srv.StandardResponse(writer, 500)
+			return
+		}
+		as.revokeTokens(ctx, account, user)
+		srv.StandardResponse(writer, 204)
+	case "DELETE":
+		if !as.canManage(admin, account, existingResellerAdmin) {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		if existing == nil {
+			srv.StandardResponse(writer, 404)
+			return
+		}
+		resp := ctx.C.DeleteObject(as.authAccount, account, user, http.Header{"X-Timestamp": []string{common.GetTimestamp()}})
+		resp.Body.Close()
+		as.revokeTokens(ctx, account, user)
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+			srv.StandardResponse(writer, resp.StatusCode)
+			return
+		}
+		srv.StandardResponse(writer, 204)
+	default:
+		srv.StandardResponse(writer, 405)
+	}
+}
+
+// authorize returns the AuthorizeFunc for a request made with the given identity, which is nil for anonymous
+// requests.
+func (as *authService) authorize(identity *authIdentity) AuthorizeFunc {
+	return func(r *http.Request) bool {
+		if r.Method == "OPTIONS" {
+			return true
+		}
+		ctx := GetProxyContext(r)
+		pathParts, err := common.ParseProxyPath(r.URL.Path)
+		if err != nil {
+			ctx.Logger.Error("Unable to parse URL", zap.Error(err))
+			return false
+		}
+		if identity != nil && identity.inGroup(authResellerAdminGroup) {
+			ctx.ResellerRequest = true
+			ctx.StorageOwner = true
+			return true
+		}
+		if !strings.HasPrefix(pathParts["account"], as.resellerPrefix) {
+			return false
+		}
+		if identity != nil && pathParts["account"] == as.resellerPrefix+identity.Account && identity.inGroup(authAdminGroup) {
+			if pathParts["container"] == "" && (r.Method == "PUT" || r.Method == "DELETE") {
+				return false
+			}
+			ctx.StorageOwner = true
+			return true
+		}
+		if identity != nil {
+			level := accountACLLevel(ctx, pathParts["account"], identity.Groups)
+			if level == ACCOUNT_ACL_ADMIN {
+				ctx.StorageOwner = true
+			}
+			if AccountACLAllows(level, r.Method, pathParts["container"]) {
+				return true
+			}
+		}
+		referrers, groups := ParseACL(ctx.ACL)
+		if ReferrerAllowed(r.Referer(), referrers) {
+			if pathParts["object"] != "" || common.StringInSlice(".rlistings", groups) {
+				return true
+			}
+		}
+		if identity == nil {
+			return false
+		}
+		for _, group := range identity.Groups {
+			if !strings.HasPrefix(group, ".") && common.StringInSlice(group, groups) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (as *authService) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := GetProxyContext(request)
+	if request.URL.Path == "/auth/v1.0" || request.URL.Path == "/auth/v1.0/" {
+		if request.Method != "GET" {
+			srv.StandardResponse(writer, 405)
+			return
+		}
+		as.handleLogin(writer, request)
+	} else if strings.HasPrefix(request.URL.Path, "/auth/v2/") {
+		parts := strings.SplitN(strings.TrimPrefix(request.URL.Path, "/auth/v2/"), "/", 2)
+		user := ""
+		if len(parts) == 2 {
+			user = parts[1]
+		}
+		as.handleAdmin(writer, request, parts[0], user)
+	} else if strings.HasPrefix(request.URL.Path, "/v1/") {
+		if ctx.Authorize == nil {
+			token := request.Header.Get("X-Auth-Token")
+			if token == "" {
+				token = request.Header.Get("X-Storage-Token")
+			}
+			if token == "" {
+				ctx.Authorize = as.authorize(nil)
+			} else {
+				identity := as.tokenIdentity(ctx, token)
+				if identity == nil {
+					srv.StandardResponse(writer, 401)
+					return
+				}
+				ctx.RemoteUser = fmt.Sprintf("%s:%s", identity.Account, identity.User)
+				ctx.Authorize = as.authorize(identity)
+			}
+		}
+		as.next.ServeHTTP(writer, request)
+	} else {
+		as.next.ServeHTTP(writer, request)
+	}
+}
+
+func NewAuthService(config conf.Section) (func(http.Handler) http.Handler, error) {
+	authAccount := config.GetDefault("auth_account", ".auth")
+	if !strings.HasPrefix(authAccount, ".") {
+		return nil, errors.New("auth_account must start with a '.'")
+	}
+	tokenLife := int(config.GetInt("token_life", 86400))
+	if tokenLife <= 0 {
+		return nil, errors.New("token_life must be positive")
+	}
+	resellerPrefix := config.GetDefault("reseller_prefix", "AUTH")
+	if resellerPrefix != "" && !strings.HasSuffix(resellerPrefix, "_") {
+		resellerPrefix += "_"
+	}
+	RegisterInfo("authservice", map[string]interface{}{"account_acls": true})
+	return func(next http.Handler) http.Handler {
+		return &authService{
+			next:           next,
+			authAccount:    authAccount,
+			resellerPrefix: resellerPrefix,
+			superAdminKey:  config.GetDefault("super_admin_key", ""),
+			tokenLife:      tokenLife,
+			storageURL:     strings.TrimRight(config.GetDefault("storage_url", ""), "/"),
+		}
+	}, nil
+}
@@ -0,0 +1,347 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+// memoryProxyClient is a ProxyClient that keeps containers and objects in memory.
+type memoryProxyClient struct {
+	accounts   map[string]bool
+	containers map[string]bool
+	objects    map[string][]byte
+}
+
+func newMemoryProxyClient() *memoryProxyClient {
+	return &memoryProxyClient{accounts: map[string]bool{}, containers: map[string]bool{}, objects: map[string][]byte{}}
+}
+
+func (c *memoryProxyClient) PutAccount(account string, headers http.Header) *http.Response {
+	c.accounts[account] = true
+	return client.ResponseStub(201, "")
+}
+func (c *memoryProxyClient) PostAccount(account string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) GetAccount(account string, options map[string]string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) HeadAccount(account string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) DeleteAccount(account string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) PutContainer(account string, container string, headers http.Header) *http.Response {
+	if !c.accounts[account] {
+		return client.ResponseStub(404, "")
+	}
+	c.containers[account+"/"+container] = true
+	return client.ResponseStub(201, "")
+}
+func (c *memoryProxyClient) PostContainer(account string, container string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) GetContainer(account string, container string, options map[string]string, headers http.Header) *http.Response {
+	if !c.containers[account+"/"+container] {
+		return client.ResponseStub(404, "")
+	}
+	records := []client.ObjectRecord{}
+	for k := range c.objects {
+		if strings.HasPrefix(k, account+"/"+container+"/") {
+			records = append(records, client.ObjectRecord{Name: k[len(account+"/"+container+"/"):]})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	body, _ := json.Marshal(records)
+	return client.ResponseStub(200, string(body))
+}
+func (c *memoryProxyClient) GetContainerInfo(account string, container string) *client.ContainerInfo {
+	return nil
+}
+func (c *memoryProxyClient) HeadContainer(account string, container string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) DeleteContainer(account string, container string, headers http.Header) *http.Response {
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) PutObject(account string, container string, obj string, headers http.Header, src io.Reader) *http.Response {
+	if !c.containers[account+"/"+container] {
+		return client.ResponseStub(404, "")
+	}
+	body, _ := ioutil.ReadAll(src)
+	c.objects[account+"/"+container+"/"+obj] = body
+	return client.ResponseStub(201, "")
+}
+func (c *memoryProxyClient) PostObject(account string, container string, obj string, headers http.Header) *http.Response {
+	return client.ResponseStub(202, "")
+}
+func (c *memoryProxyClient) GetObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if body, ok := c.objects[account+"/"+container+"/"+obj]; ok {
+		return client.ResponseStub(200, string(body))
+	}
+	return client.ResponseStub(404, "")
+}
+func (c *memoryProxyClient) HeadObject(account string, container string, obj string, headers http.Header) *http.Response {
+	return client.ResponseStub(200, "")
+}
+func (c *memoryProxyClient) DeleteObject(account string, container string, obj string, headers http.Header) *http.Response {
+	if _, ok := c.objects[account+"/"+container+"/"+obj]; !ok {
+		return client.ResponseStub(404, "")
+	}
+	delete(c.objects, account+"/"+container+"/"+obj)
+	return client.ResponseStub(204, "")
+}
+func (c *memoryProxyClient) ObjectRingFor(account string, container string) (ring.Ring, *http.Response) {
+	return nil, client.ResponseStub(500, "")
+}
+
+type authServiceTest struct {
+	t       *testing.T
+	handler http.Handler
+	cache   *test.MemoryMemcacheRing
+	client  *memoryProxyClient
+	lastCtx *ProxyContext
+}
+
+func newAuthServiceTest(t *testing.T) *authServiceTest {
+	config, err := conf.StringConfig("[filter:authservice]\nsuper_admin_key = supersecret\n")
+	require.Nil(t, err)
+	mid, err := NewAuthService(config.GetSection("filter:authservice"))
+	require.Nil(t, err)
+	ast := &authServiceTest{t: t, cache: test.NewMemoryMemcacheRing(), client: newMemoryProxyClient()}
+	ast.handler = mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := GetProxyContext(r)
+		if ctx.Authorize != nil && !ctx.Authorize(r) {
+			if ctx.RemoteUser != "" {
+				w.WriteHeader(403)
+			} else {
+				w.WriteHeader(401)
+			}
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	return ast
+}
+
+func (ast *authServiceTest) do(method, path string, headers map[string]string) *http.Response {
+	r := httptest.NewRequest(method, path, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	ast.lastCtx = &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: ast.cache},
+		Logger:                 zap.NewNop(),
+		C:                      ast.client,
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ast.lastCtx))
+	w := httptest.NewRecorder()
+	ast.handler.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func (ast *authServiceTest) addUser(account, user, key string, headers map[string]string) {
+	hdrs := map[string]string{"X-Auth-Admin-User": ".super_admin", "X-Auth-Admin-Key": "supersecret", "X-Auth-User-Key": key}
+	for k, v := range headers {
+		hdrs[k] = v
+	}
+	require.Equal(ast.t, 201, ast.do("PUT", "/auth/v2/"+account+"/"+user, hdrs).StatusCode)
+}
+
+func (ast *authServiceTest) login(account, user, key string) string {
+	resp := ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": account + ":" + user, "X-Auth-Key": key})
+	require.Equal(ast.t, 200, resp.StatusCode)
+	return resp.Header.Get("X-Auth-Token")
+}
+
+func TestAuthKeyHashing(t *testing.T) {
+	auth, err := hashAuthKey("secret")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(auth, "sha512:"))
+	require.True(t, checkAuthKey(auth, "secret"))
+	require.False(t, checkAuthKey(auth, "Secret"))
+	require.True(t, checkAuthKey("plaintext:secret", "secret"))
+	require.False(t, checkAuthKey("md5:whatever", "secret"))
+	require.False(t, checkAuthKey("garbage", "secret"))
+}
+
+func TestAuthServiceLogin(t *testing.T) {
+	ast := newAuthServiceTest(t)
+	ast.addUser("test", "tester", "testing", map[string]string{"X-Auth-User-Admin": "true"})
+
+	resp := ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test:tester", "X-Auth-Key": "wrong"})
+	require.Equal(t, 401, resp.StatusCode)
+	resp = ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test:nobody", "X-Auth-Key": "testing"})
+	require.Equal(t, 401, resp.StatusCode)
+	resp = ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test", "X-Auth-Key": "testing"})
+	require.Equal(t, 400, resp.StatusCode)
+
+	resp = ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test:tester", "X-Auth-Key": "testing"})
+	require.Equal(t, 200, resp.StatusCode)
+	token := resp.Header.Get("X-Auth-Token")
+	require.True(t, strings.HasPrefix(token, "AUTH_tk"))
+	require.Equal(t, "http://example.com/v1/AUTH_test", resp.Header.Get("X-Storage-Url"))
+	// logging in again hands out the same token
+	require.Equal(t, token, ast.login("test", "tester", "testing"))
+
+	// the user's key is never stored in the clear
+	require.NotContains(t, string(ast.client.objects[".auth/test/tester"]), "testing")
+}
+
+func TestAuthServiceTokenScopedToAccount(t *testing.T) {
+	ast := newAuthServiceTest(t)
+	ast.addUser("test", "tester", "testing", map[string]string{"X-Auth-User-Admin": "true"})
+	ast.addUser("other", "admin", "otherkey", map[string]string{"X-Auth-User-Admin": "true"})
+	token := ast.login("test", "tester", "testing")
+
+	require.Equal(t, 200, ast.do("GET", "/v1/AUTH_test/c", map[string]string{"X-Auth-Token": token}).StatusCode)
+	require.Equal(t, 200, ast.do("PUT", "/v1/AUTH_test/c/o", map[string]string{"X-Auth-Token": token}).StatusCode)
+	require.Equal(t, 403, ast.do("GET", "/v1/AUTH_other/c", map[string]string{"X-Auth-Token": token}).StatusCode)
+	require.Equal(t, 403, ast.do("GET", "/v1/.auth/test/tester", map[string]string{"X-Auth-Token": token}).StatusCode)
+	// owners still can't delete their own account
+	require.Equal(t, 403, ast.do("DELETE", "/v1/AUTH_test", map[string]string{"X-Auth-Token": token}).StatusCode)
+	require.Equal(t, 401, ast.do("GET", "/v1/AUTH_test/c", map[string]string{"X-Auth-Token": "AUTH_tkbogus"}).StatusCode)
+	require.Equal(t, 401, ast.do("GET", "/v1/AUTH_test/c", nil).StatusCode)
+}
+
+func TestAuthServiceResellerAdmin(t *testing.T) {
+	ast := newAuthServiceTest(t)
+	ast.addUser("ops", "root", "rootkey", map[string]string{"X-Auth-User-Reseller-Admin": "true"})
+	token := ast.login("ops", "root", "rootkey")
+	require.Equal(t, 200, ast.do("GET", "/v1/AUTH_anybody/c", map[string]string{"X-Auth-Token": token}).StatusCode)
+	require.True(t, ast.lastCtx.ResellerRequest)
+	require.Equal(t, 200, ast.do("DELETE", "/v1/AUTH_anybody", map[string]string{"X-Auth-Token": token}).StatusCode)
+
+	// reseller admins can manage other accounts' users, but can't create other reseller admins
+	resp := ast.do("PUT", "/auth/v2/test/tester", map[string]string{"X-Auth-Token": token, "X-Auth-User-Key": "k"})
+	require.Equal(t, 201, resp.StatusCode)
+	resp = ast.do("PUT", "/auth/v2/test/boss", map[string]string{"X-Auth-Token": token, "X-Auth-User-Key": "k",
+		"X-Auth-User-Reseller-Admin": "true"})
+	require.Equal(t, 403, resp.StatusCode)
+}
+
+func TestAuthServiceContainerACLs(t *testing.T) {
+	ast := newAuthServiceTest(t)
+	ast.addUser("test", "tester", "testing", map[string]string{"X-Auth-User-Admin": "true"})
+	ast.addUser("test", "reader", "readkey", nil)
+	token := ast.login("test", "reader", "readkey")
+
+	// a non-admin user has no access without an ACL
+	require.Equal(t, 403, ast.do("GET", "/v1/AUTH_test/c/o", map[string]string{"X-Auth-Token": token}).StatusCode)
+
+	r := httptest.NewRequest("GET", "/v1/AUTH_test/c/o", nil)
+	ctx := &ProxyContext{ProxyContextMiddleware: &ProxyContextMiddleware{Cache: ast.cache}, C: ast.client, Logger: zap.NewNop()}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	var identity authIdentity
+	require.Nil(t, ast.cache.GetStructured(tokenCacheKey(token), &identity))
+	as := &authService{resellerPrefix: "AUTH_"}
+	authorize := as.authorize(&identity)
+
+	ctx.ACL = "test:reader"
+	require.True(t, authorize(r))
+	ctx.ACL = "test:someoneelse,other"
+	require.False(t, authorize(r))
+	ctx.ACL = "test"
+	require.True(t, authorize(r))
+	// referrer ACLs work for anonymous users too
+	ctx.ACL = ".r:*"
+	require.True(t, as.authorize(nil)(r))
+	ctx.ACL = ""
+	require.False(t, as.authorize(nil)(r))
+}
+
+func TestAuthServiceAdminAPI(t *testing.T) {
+	ast := newAuthServiceTest(t)
+	ast.addUser("test", "admin", "adminkey", map[string]string{"X-Auth-User-Admin": "true"})
+	ast.addUser("test", "tester", "testing", nil)
+	ast.addUser("other", "admin", "otherkey", map[string]string{"X-Auth-User-Admin": "true"})
+	admin := map[string]string{"X-Auth-Admin-User": "test:admin", "X-Auth-Admin-Key": "adminkey"}
+
+	require.Equal(t, 401, ast.do("GET", "/auth/v2/test", nil).StatusCode)
+	require.Equal(t, 401, ast.do("GET", "/auth/v2/test",
+		map[string]string{"X-Auth-Admin-User": "test:admin", "X-Auth-Admin-Key": "wrong"}).StatusCode)
+
+	resp := ast.do("GET", "/auth/v2/test", admin)
+	require.Equal(t, 200, resp.StatusCode)
+	var listing struct {
+		Users []map[string]string `json:"users"`
+	}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&listing))
+	require.Equal(t, []map[string]string{{"name": "admin"}, {"name": "tester"}}, listing.Users)
+
+	resp = ast.do("GET", "/auth/v2/test/tester", admin)
+	require.Equal(t, 200, resp.StatusCode)
+	var user map[string]interface{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&user))
+	require.Equal(t, []interface{}{"test:tester", "test"}, user["groups"])
+	require.Nil(t, user["auth"])
+
+	// account admins can't manage other accounts
+	require.Equal(t, 403, ast.do("GET", "/auth/v2/other", admin).StatusCode)
+	require.Equal(t, 403, ast.do("DELETE", "/auth/v2/other/admin", admin).StatusCode)
+
+	// rotating a key revokes outstanding tokens
+	token := ast.login("test", "tester", "testing")
+	hdrs := map[string]string{"X-Auth-User-Key": "newkey"}
+	for k, v := range admin {
+		hdrs[k] = v
+	}
+	require.Equal(t, 204, ast.do("POST", "/auth/v2/test/tester", hdrs).StatusCode)
+	require.Equal(t, 401, ast.do("GET", "/v1/AUTH_test/c", map[string]string{"X-Auth-Token": token}).StatusCode)
+	resp = ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test:tester", "X-Auth-Key": "testing"})
+	require.Equal(t, 401, resp.StatusCode)
+	token = ast.login("test", "tester", "newkey")
+
+	// users can rotate their own key with their token
+	require.Equal(t, 204, ast.do("POST", "/auth/v2/test/tester",
+		map[string]string{"X-Auth-Token": token, "X-Auth-User-Key": "newerkey"}).StatusCode)
+	ast.login("test", "tester", "newerkey")
+
+	require.Equal(t, 204, ast.do("DELETE", "/auth/v2/test/tester", admin).StatusCode)
+	require.Equal(t, 404, ast.do("GET", "/auth/v2/test/tester", admin).StatusCode)
+	resp = ast.do("GET", "/auth/v1.0", map[string]string{"X-Auth-User": "test:tester", "X-Auth-Key": "newerkey"})
+	require.Equal(t, 401, resp.StatusCode)
+}
+
+func TestNewAuthServiceConfig(t *testing.T) {
+	config, err := conf.StringConfig("[filter:authservice]\nauth_account = auth\n")
+	require.Nil(t, err)
+	_, err = NewAuthService(config.GetSection("filter:authservice"))
+	require.NotNil(t, err)
+
+	config, err = conf.StringConfig("[filter:authservice]\nreseller_prefix = RESELLER\n")
+	require.Nil(t, err)
+	mid, err := NewAuthService(config.GetSection("filter:authservice"))
+	require.Nil(t, err)
+	require.Equal(t, "RESELLER_", mid(nil).(*authService).resellerPrefix)
+}
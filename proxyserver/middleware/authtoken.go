@@ -17,14 +17,25 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/common/srv"
 	"go.uber.org/zap"
 )
 
@@ -42,8 +53,11 @@ type identity struct {
 
 type authToken struct {
 	*identity
-	next      http.Handler
-	cacheTime int
+	next               http.Handler
+	cacheTime          int
+	tokenCache         *tokenCache
+	revocations        *revocations
+	revocationInterval time.Duration
 }
 
 var authHeaders = []string{"X-Identity-Status",
@@ -96,6 +110,7 @@ type project struct {
 type token struct {
 	ExpiresAt time.Time `json:"expires_at"`
 	IssuedAt  time.Time `json:"issued_at"`
+	AuditIDs  []string  `json:"audit_ids"`
 	Methods   []string
 	User      struct {
 		ID      string
@@ -181,41 +196,323 @@ func (at *authToken) fetchAndValidateToken(ctx *ProxyContext, authToken string)
 	if ctx == nil {
 		return nil, false
 	}
-	var tok *token
-	tokenValid := false
-	if cachedToken, err := ctx.Cache.Get(authToken); err == nil {
-		ctx.Logger.Debug("Found cache token",
-			zap.String("token", authToken))
-		if t, ok := cachedToken.(token); ok {
-			tok = &t
-			tokenValid = true
+	cacheKey := at.tokenCache.key(authToken)
+	tok, err := at.tokenCache.get(ctx.Cache, cacheKey)
+	if err != nil {
+		ctx.Logger.Error("Discarding bad cached token", zap.Error(err))
+		ctx.Cache.Delete(cacheKey)
+		tok = nil
+	} else if tok != nil && (!tok.Valid() || at.revocations.revoked(tok)) {
+		ctx.Logger.Debug("Discarding expired or revoked cached token")
+		ctx.Cache.Delete(cacheKey)
+		tok = nil
+	} else if tok != nil {
+		ctx.Logger.Debug("Found cache token")
+		return tok, true
+	}
+
+	tok, err = at.validate(authToken)
+	if err != nil {
+		ctx.Logger.Debug("Failed to validate token", zap.Error(err))
+		return nil, false
+	}
+	ttl := at.cacheTime
+	if expiresIn := tok.ExpiresAt.Sub(time.Now()); expiresIn < time.Duration(at.cacheTime)*time.Second {
+		ttl = int(expiresIn / time.Second)
+	}
+	if err := at.tokenCache.set(ctx.Cache, cacheKey, tok, ttl); err != nil {
+		ctx.Logger.Error("Unable to cache token", zap.Error(err))
+	}
+	return tok, true
+}
+
+// tokenCache stores validated tokens in memcache.  Token IDs are always hashed into cache keys, so reading memcache
+// doesn't give away usable tokens.  With a memcache_security_strategy of MAC, cached tokens are signed with a key
+// derived from memcache_secret_key so forged entries are rejected; with ENCRYPT they are also encrypted.
+type tokenCache struct {
+	strategy string
+	keyKey   []byte
+	macKey   []byte
+	aead     cipher.AEAD
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func newTokenCache(strategy, secret string) (*tokenCache, error) {
+	strategy = strings.ToUpper(strategy)
+	if strategy == "" || strategy == "NONE" {
+		return &tokenCache{}, nil
+	}
+	if strategy != "MAC" && strategy != "ENCRYPT" {
+		return nil, fmt.Errorf("invalid memcache_security_strategy %q", strategy)
+	}
+	if secret == "" {
+		return nil, errors.New("memcache_secret_key is required with memcache_security_strategy")
+	}
+	tc := &tokenCache{
+		strategy: strategy,
+		keyKey:   hmacSHA256([]byte(secret), "cache-key"),
+		macKey:   hmacSHA256([]byte(secret), "mac"),
+	}
+	if strategy == "ENCRYPT" {
+		block, err := aes.NewCipher(hmacSHA256([]byte(secret), "encrypt"))
+		if err != nil {
+			return nil, err
+		}
+		if tc.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return tc, nil
+}
+
+// key returns the memcache key for a token ID.
+func (tc *tokenCache) key(tokenID string) string {
+	if tc == nil || tc.keyKey == nil {
+		sum := sha256.Sum256([]byte(tokenID))
+		return "authtoken/" + hex.EncodeToString(sum[:])
+	}
+	return "authtoken/" + hex.EncodeToString(hmacSHA256(tc.keyKey, tokenID))
+}
+
+func (tc *tokenCache) set(mc ring.MemcacheRing, key string, tok *token, ttl int) error {
+	if tc == nil || tc.strategy == "" {
+		return mc.Set(key, *tok, ttl)
+	}
+	payload, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	var value string
+	if tc.aead != nil {
+		nonce := make([]byte, tc.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
 		}
+		value = base64.StdEncoding.EncodeToString(tc.aead.Seal(nonce, nonce, payload, []byte(key)))
+	} else {
+		value = base64.StdEncoding.EncodeToString(payload) + "." +
+			base64.StdEncoding.EncodeToString(hmacSHA256(tc.macKey, key+"\n"+string(payload)))
 	}
+	return mc.Set(key, value, ttl)
+}
 
-	if tok == nil {
+// get returns the token cached at key, or nil if there isn't one.  An error means the cached value has been tampered
+// with or was written with a different secret.
+func (tc *tokenCache) get(mc ring.MemcacheRing, key string) (*token, error) {
+	if tc == nil || tc.strategy == "" {
+		var tok token
+		if err := mc.GetStructured(key, &tok); err != nil {
+			return nil, nil
+		}
+		return &tok, nil
+	}
+	var value string
+	if err := mc.GetStructured(key, &value); err != nil {
+		return nil, nil
+	}
+	var payload []byte
+	if tc.aead != nil {
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(data) < tc.aead.NonceSize() {
+			return nil, errors.New("malformed cache entry")
+		}
+		nonce, ciphertext := data[:tc.aead.NonceSize()], data[tc.aead.NonceSize():]
+		if payload, err = tc.aead.Open(nil, nonce, ciphertext, []byte(key)); err != nil {
+			return nil, errors.New("cache entry failed decryption")
+		}
+	} else {
+		parts := strings.SplitN(value, ".", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("malformed cache entry")
+		}
 		var err error
-		tok, err = at.validate(authToken)
+		payload, err = base64.StdEncoding.DecodeString(parts[0])
 		if err != nil {
-			ctx.Logger.Debug("Failed to validate token", zap.Error(err))
-			tokenValid = false
+			return nil, errors.New("malformed cache entry")
+		}
+		mac, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || !hmac.Equal(mac, hmacSHA256(tc.macKey, key+"\n"+string(payload))) {
+			return nil, errors.New("cache entry failed authentication")
 		}
+	}
+	var tok token
+	if err := json.Unmarshal(payload, &tok); err != nil {
+		return nil, errors.New("malformed cache entry")
+	}
+	return &tok, nil
+}
+
+type revocationEvent struct {
+	AuditID      string    `json:"audit_id"`
+	AuditChainID string    `json:"audit_chain_id"`
+	UserID       string    `json:"user_id"`
+	ProjectID    string    `json:"project_id"`
+	DomainID     string    `json:"domain_id"`
+	RoleID       string    `json:"role_id"`
+	IssuedBefore time.Time `json:"issued_before"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
 
-		if tok != nil {
-			tokenValid = true
-			ttl := at.cacheTime
-			if expiresIn := tok.ExpiresAt.Sub(time.Now()); expiresIn < time.Duration(at.cacheTime)*time.Second {
-				ttl = int(expiresIn / time.Second)
-			}
-			ctx.Cache.Set(authToken, *tok, ttl)
+// matches reports whether the event revokes tok; every attribute the event sets must match the token.
+func (ev *revocationEvent) matches(tok *token) bool {
+	if tok.IssuedAt.After(ev.IssuedBefore) {
+		return false
+	}
+	if ev.AuditID != "" && (len(tok.AuditIDs) == 0 || tok.AuditIDs[0] != ev.AuditID) {
+		return false
+	}
+	if ev.AuditChainID != "" && (len(tok.AuditIDs) == 0 || tok.AuditIDs[len(tok.AuditIDs)-1] != ev.AuditChainID) {
+		return false
+	}
+	if ev.UserID != "" && tok.User.ID != ev.UserID {
+		return false
+	}
+	if ev.ProjectID != "" && (tok.Project == nil || tok.Project.ID != ev.ProjectID) {
+		return false
+	}
+	if ev.DomainID != "" && (tok.Domain == nil || tok.Domain.ID != ev.DomainID) &&
+		(tok.Project == nil || tok.Project.Domain == nil || tok.Project.Domain.ID != ev.DomainID) {
+		return false
+	}
+	if ev.RoleID != "" {
+		if tok.Roles == nil {
+			return false
+		}
+		found := false
+		for _, role := range *tok.Roles {
+			found = found || role.ID == ev.RoleID
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// revocations holds recent Keystone revocation events.  Events only need to be kept as long as a token might stay
+// cached, since Keystone itself rejects revoked tokens on validation.
+type revocations struct {
+	lock     sync.Mutex
+	events   []revocationEvent
+	since    time.Time
+	lastPoll time.Time
+	polling  bool
+}
+
+func (rv *revocations) revoked(tok *token) bool {
+	if rv == nil {
+		return false
+	}
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	for i := range rv.events {
+		if rv.events[i].matches(tok) {
+			return true
 		}
 	}
-	return tok, tokenValid
+	return false
+}
+
+// fetchRevocations pulls revocation events from Keystone that are newer than the ones we've already seen.
+func (at *authToken) fetchRevocations() error {
+	rv := at.revocations
+	keep := time.Now().Add(-time.Duration(at.cacheTime) * time.Second)
+	rv.lock.Lock()
+	since := rv.since
+	rv.lock.Unlock()
+	if since.Before(keep) {
+		since = keep
+	}
+	if !strings.HasSuffix(at.authURL, "/") {
+		at.authURL += "/"
+	}
+	req, err := http.NewRequest("GET", at.authURL+"v3/OS-REVOKE/events?since="+
+		url.QueryEscape(since.UTC().Format(time.RFC3339)), nil)
+	if err != nil {
+		return err
+	}
+	serverAuthToken, err := at.serverAuth()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", serverAuthToken)
+	req.Header.Set("User-Agent", at.userAgent)
+	resp, err := at.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("revocation events request gave status %d", resp.StatusCode)
+	}
+	var body struct {
+		Events []revocationEvent `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return err
+	}
+	rv.lock.Lock()
+	defer rv.lock.Unlock()
+	events := []revocationEvent{}
+	for _, ev := range rv.events {
+		if ev.RevokedAt.After(keep) {
+			events = append(events, ev)
+		}
+	}
+	for _, ev := range body.Events {
+		if ev.RevokedAt.IsZero() {
+			ev.RevokedAt = time.Now()
+		}
+		if ev.RevokedAt.After(rv.since) {
+			events = append(events, ev)
+		}
+	}
+	for _, ev := range events {
+		if ev.RevokedAt.After(rv.since) {
+			rv.since = ev.RevokedAt
+		}
+	}
+	rv.events = events
+	return nil
+}
+
+// pollRevocations kicks off a background fetch of revocation events if it's been revocationInterval since the last.
+func (at *authToken) pollRevocations(logger srv.LowLevelLogger) {
+	rv := at.revocations
+	if rv == nil || at.revocationInterval <= 0 {
+		return
+	}
+	rv.lock.Lock()
+	if rv.polling || time.Since(rv.lastPoll) < at.revocationInterval {
+		rv.lock.Unlock()
+		return
+	}
+	rv.polling = true
+	rv.lock.Unlock()
+	go func() {
+		err := at.fetchRevocations()
+		if err != nil {
+			logger.Error("Unable to fetch token revocation events", zap.Error(err))
+		}
+		rv.lock.Lock()
+		rv.polling = false
+		rv.lastPoll = time.Now()
+		rv.lock.Unlock()
+	}()
 }
 
 func (at *authToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	removeAuthHeaders(r)
 	r.Header.Set("X-Identity-Status", "Invalid")
 	ctx := GetProxyContext(r)
+	if ctx != nil {
+		at.pollRevocations(ctx.Logger)
+	}
 	serviceAuthToken := r.Header.Get("X-Service-Token")
 	if serviceAuthToken != "" {
 		serviceToken, serviceTokenValid := at.fetchAndValidateToken(ctx, serviceAuthToken)
@@ -325,10 +622,19 @@ func removeAuthHeaders(r *http.Request) {
 }
 
 func NewAuthToken(config conf.Section) (func(http.Handler) http.Handler, error) {
+	tc, err := newTokenCache(config.GetDefault("memcache_security_strategy", "None"),
+		config.GetDefault("memcache_secret_key", ""))
+	if err != nil {
+		return nil, err
+	}
+	rv := &revocations{}
 	return func(next http.Handler) http.Handler {
 		return &authToken{
-			next:      next,
-			cacheTime: int(config.GetInt("token_cache_time", 300)),
+			next:               next,
+			cacheTime:          int(config.GetInt("token_cache_time", 300)),
+			tokenCache:         tc,
+			revocations:        rv,
+			revocationInterval: time.Duration(config.GetInt("revocation_poll_interval", 10)) * time.Second,
 			identity: &identity{authURL: config.GetDefault("auth_uri", "http://127.0.0.1:5000/"),
 				authPlugin:      config.GetDefault("auth_plugin", "password"),
 				projectDomainID: config.GetDefault("project_domain_id", "default"),
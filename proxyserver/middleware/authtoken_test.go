@@ -16,6 +16,8 @@
 package middleware
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -119,6 +121,7 @@ func (mr *mockTokenMemacacheRing) Decr(key string, delta int64, timeout int) (in
 }
 
 func (mr *mockTokenMemacacheRing) Delete(key string) error {
+	delete(mr.MockValues, key)
 	return nil
 }
 
@@ -130,7 +133,15 @@ func (mr *mockTokenMemacacheRing) Get(key string) (interface{}, error) {
 }
 
 func (mr *mockTokenMemacacheRing) GetStructured(key string, val interface{}) error {
-	return nil
+	v, ok := mr.MockValues[key]
+	if !ok {
+		return errors.New("Some error")
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, val)
 }
 
 func (mr *mockTokenMemacacheRing) GetMulti(serverKey string, keys []string) (map[string]interface{}, error) {
@@ -442,7 +453,7 @@ func TestGetCachedToken(t *testing.T) {
 	require.Nil(t, err)
 	req.Header.Set("X-Auth-Token", "abcd")
 	val := token{ExpiresAt: time.Now().Add(5 * time.Second), IssuedAt: time.Now()}
-	fakeCache := mockTokenMemacacheRing{MockValues: map[string]interface{}{"abcd": val}}
+	fakeCache := mockTokenMemacacheRing{MockValues: map[string]interface{}{(*tokenCache)(nil).key("abcd"): val}}
 	fakeContext := &ProxyContext{
 		Logger:                 zap.NewNop(),
 		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: &fakeCache},
@@ -503,7 +514,10 @@ func TestWriteCachedToken(t *testing.T) {
 	var tok token
 	var tokint interface{}
 	var ok bool
-	if tokint, ok = fakeCache.MockValues["abcd"]; !ok {
+	if _, ok = fakeCache.MockValues["abcd"]; ok {
+		t.Fatal("token ID was used as the cache key")
+	}
+	if tokint, ok = fakeCache.MockValues[(*tokenCache)(nil).key("abcd")]; !ok {
 		t.Fatal("token was not cached")
 	}
 	if tok, ok = tokint.(token); !ok {
@@ -514,3 +528,146 @@ func TestWriteCachedToken(t *testing.T) {
 	}
 
 }
+
+func TestTokenCacheStrategies(t *testing.T) {
+	tok := &token{ExpiresAt: time.Now().Add(time.Hour).Round(time.Second), AuditIDs: []string{"audit"}}
+	tok.User.ID = "secretuser"
+	for _, strategy := range []string{"None", "MAC", "ENCRYPT"} {
+		tc, err := newTokenCache(strategy, "sekrit")
+		require.Nil(t, err)
+		mc := &mockTokenMemacacheRing{MockValues: make(map[string]interface{})}
+		key := tc.key("abcd")
+		require.NotContains(t, key, "abcd")
+		require.Nil(t, tc.set(mc, key, tok, 10))
+		cached, err := tc.get(mc, key)
+		require.Nil(t, err, strategy)
+		require.Equal(t, "secretuser", cached.User.ID, strategy)
+		require.True(t, cached.ExpiresAt.Equal(tok.ExpiresAt), strategy)
+
+		missing, err := tc.get(mc, tc.key("other"))
+		require.Nil(t, err)
+		require.Nil(t, missing)
+		if strategy == "None" {
+			continue
+		}
+
+		// a different secret gives different keys and can't read the entry
+		other, err := newTokenCache(strategy, "other")
+		require.Nil(t, err)
+		require.NotEqual(t, key, other.key("abcd"))
+		_, err = other.get(mc, key)
+		require.NotNil(t, err, strategy)
+
+		// entries can't be moved to another token's key
+		mc.MockValues[tc.key("efgh")] = mc.MockValues[key]
+		_, err = tc.get(mc, tc.key("efgh"))
+		require.NotNil(t, err, strategy)
+
+		// or forged
+		forged, _ := json.Marshal(tok)
+		mc.MockValues[key] = base64.StdEncoding.EncodeToString(forged) + ".AAAA"
+		_, err = tc.get(mc, key)
+		require.NotNil(t, err, strategy)
+	}
+
+	tc, err := newTokenCache("encrypt", "sekrit")
+	require.Nil(t, err)
+	mc := &mockTokenMemacacheRing{MockValues: make(map[string]interface{})}
+	require.Nil(t, tc.set(mc, tc.key("abcd"), tok, 10))
+	require.NotContains(t, mc.MockValues[tc.key("abcd")], "secretuser")
+}
+
+func TestNewTokenCacheConfig(t *testing.T) {
+	_, err := newTokenCache("MAC", "")
+	require.NotNil(t, err)
+	_, err = newTokenCache("ROT13", "sekrit")
+	require.NotNil(t, err)
+	tc, err := newTokenCache("none", "")
+	require.Nil(t, err)
+	require.Equal(t, (*tokenCache)(nil).key("abcd"), tc.key("abcd"))
+}
+
+func TestRevocationEventMatches(t *testing.T) {
+	now := time.Now()
+	tok := &token{IssuedAt: now.Add(-time.Minute), AuditIDs: []string{"a1", "chain"},
+		Project: &project{ID: "p1", Domain: &domain{ID: "d1"}}}
+	tok.User.ID = "u1"
+	tok.Roles = &[]struct {
+		ID   string
+		Name string
+	}{{ID: "r1", Name: "admin"}}
+	for _, tc := range []struct {
+		event   revocationEvent
+		revoked bool
+	}{
+		{revocationEvent{AuditID: "a1", IssuedBefore: now}, true},
+		{revocationEvent{AuditID: "a2", IssuedBefore: now}, false},
+		{revocationEvent{AuditChainID: "chain", IssuedBefore: now}, true},
+		{revocationEvent{UserID: "u1", IssuedBefore: now}, true},
+		{revocationEvent{UserID: "u1", IssuedBefore: now.Add(-time.Hour)}, false},
+		{revocationEvent{UserID: "u1", ProjectID: "p2", IssuedBefore: now}, false},
+		{revocationEvent{ProjectID: "p1", RoleID: "r1", IssuedBefore: now}, true},
+		{revocationEvent{RoleID: "r2", IssuedBefore: now}, false},
+		{revocationEvent{DomainID: "d1", IssuedBefore: now}, true},
+	} {
+		require.Equal(t, tc.revoked, tc.event.matches(tok), fmt.Sprintf("%+v", tc.event))
+	}
+}
+
+func TestRevokedCachedToken(t *testing.T) {
+	revokedAt := time.Now().UTC()
+	polls := 0
+	identityServ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			w.Header().Set("X-Subject-Token", "servicetoken")
+			w.WriteHeader(201)
+		case r.URL.Path == "/v3/OS-REVOKE/events":
+			polls++
+			require.Equal(t, "servicetoken", r.Header.Get("X-Auth-Token"))
+			_, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+			require.Nil(t, err)
+			fmt.Fprintf(w, `{"events": [{"audit_id": "a1", "issued_before": %q, "revoked_at": %q}]}`,
+				revokedAt.Format(time.RFC3339Nano), revokedAt.Format(time.RFC3339Nano))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer identityServ.Close()
+
+	tc, err := newTokenCache("MAC", "sekrit")
+	require.Nil(t, err)
+	fakeCache := &mockTokenMemacacheRing{MockValues: make(map[string]interface{})}
+	tok := &token{ExpiresAt: time.Now().Add(time.Hour), IssuedAt: time.Now().Add(-time.Minute), AuditIDs: []string{"a1"}}
+	require.Nil(t, tc.set(fakeCache, tc.key("abcd"), tok, 300))
+	at := &authToken{
+		cacheTime:   300,
+		tokenCache:  tc,
+		revocations: &revocations{},
+		identity: &identity{authURL: identityServ.URL,
+			client: &http.Client{
+				Timeout: 5 * time.Second,
+			}},
+	}
+	check := func(status string) {
+		at.next = checkHeaders(t, map[string]string{"X-Identity-Status": status})
+		req, err := http.NewRequest("GET", "/someurl", nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Auth-Token", "abcd")
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", &ProxyContext{
+			Logger:                 zap.NewNop(),
+			ProxyContextMiddleware: &ProxyContextMiddleware{Cache: fakeCache},
+		}))
+		at.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	check("Confirmed")
+	require.Nil(t, at.fetchRevocations())
+	require.Equal(t, 1, polls)
+	require.Equal(t, 1, len(at.revocations.events))
+	check("Invalid")
+	require.Equal(t, 0, len(fakeCache.MockValues))
+
+	// events we've already seen aren't added again
+	require.Nil(t, at.fetchRevocations())
+	require.Equal(t, 1, len(at.revocations.events))
+}
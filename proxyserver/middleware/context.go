@@ -26,11 +26,17 @@ import (
 
 	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/metrics"
 	"github.com/troubling/hummingbird/common/ring"
 	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/common/tracing"
 	"go.uber.org/zap"
 )
 
+// UsageAccount is the pseudo-account the proxy serves reseller usage reports under. It's never looked up or
+// auto-created as a real account.
+const UsageAccount = ".usage"
+
 var (
 	autoCreateAccounts = true // TODO; figure out how to plumb this in as a config
 	serverInfo         = make(map[string]interface{})
@@ -72,6 +78,11 @@ type ProxyContextMiddleware struct {
 	log               srv.LowLevelLogger
 	Cache             ring.MemcacheRing
 	proxyDirectClient *client.ProxyDirectClient
+	metrics           *metrics.Registry
+	requestDurations  *metrics.Histogram
+	tracer            *tracing.Tracer
+	// exposeMetrics serves the metrics at /metrics; it's off by default as they'd be open to anyone on the proxy port.
+	exposeMetrics bool
 }
 
 type ProxyContext struct {
@@ -81,6 +92,7 @@ type ProxyContext struct {
 	AuthorizeOverride bool
 	RemoteUser        string
 	ResellerRequest   bool
+	StorageOwner      bool
 	ACL               string
 	Logger            srv.LowLevelLogger
 	TxId              string
@@ -89,6 +101,8 @@ type ProxyContext struct {
 	accountInfoCache  map[string]*AccountInfo
 	depth             int
 	Source            string
+	// Span is the trace span covering this request; nil when tracing is off.
+	Span *tracing.Span
 }
 
 func GetProxyContext(r *http.Request) *ProxyContext {
@@ -116,6 +130,9 @@ func getPathParts(request *http.Request) (bool, string, string, string) {
 }
 
 func (ctx *ProxyContext) GetAccountInfo(account string) *AccountInfo {
+	if account == UsageAccount {
+		return nil
+	}
 	key := fmt.Sprintf("account/%s", account)
 	ai := ctx.accountInfoCache[key]
 	if ai == nil {
@@ -173,19 +190,24 @@ func (ctx *ProxyContext) Subrequest(writer http.ResponseWriter, req *http.Reques
 		authorize = nil
 		authorizeOverride = true
 	}
+	span := ctx.Span.Child("subrequest " + source)
+	span.SetAttribute("method", req.Method)
+	span.SetAttribute("path", req.URL.Path)
+	defer span.Finish()
 	newctx := &ProxyContext{
 		ProxyContextMiddleware: ctx.ProxyContextMiddleware,
 		Authorize:              authorize,
 		AuthorizeOverride:      authorizeOverride,
 		RemoteUser:             ctx.RemoteUser,
 		Logger:                 ctx.Logger.With(zap.String("src", source)),
-		C:                      ctx.C,
+		C:                      client.NewTracedProxyClient(ctx.C, span),
 		TxId:                   ctx.TxId,
 		accountInfoCache:       ctx.accountInfoCache,
 		responseSent:           false,
 		status:                 500,
 		depth:                  ctx.depth + 1,
 		Source:                 source,
+		Span:                   span,
 	}
 	// TODO: check depth
 	newWriter := srv.NewCustomWriter(writer, func(w http.ResponseWriter, status int) int {
@@ -229,6 +251,11 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		}
 	}
 
+	if m.exposeMetrics && request.URL.Path == "/metrics" && (request.Method == "GET" || request.Method == "HEAD") {
+		m.metrics.ServeHTTP(writer, request)
+		return
+	}
+
 	for k := range request.Header {
 		for _, ex := range excludeHeaders {
 			if strings.HasPrefix(k, ex) || k == "X-Timestamp" {
@@ -243,6 +270,11 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 	writer.Header().Set("X-Openstack-Request-Id", transId)
 	request.Header.Set("X-Timestamp", common.GetTimestamp())
 	logr := m.log.With(zap.String("txn", transId))
+	span := m.tracer.StartFromHeader("proxy "+request.Method, request.Header)
+	span.SetAttribute("txn", transId)
+	span.SetAttribute("method", request.Method)
+	span.SetAttribute("path", request.URL.Path)
+	defer span.Finish()
 	ctx := &ProxyContext{
 		ProxyContextMiddleware: m,
 		Authorize:              nil,
@@ -251,11 +283,12 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 		responseSent:           false,
 		status:                 500,
 		accountInfoCache:       make(map[string]*AccountInfo),
-		C:                      client.NewProxyClient(m.proxyDirectClient, m.Cache, make(map[string]*client.ContainerInfo)),
+		C:                      client.NewTracedProxyClient(client.NewProxyClient(m.proxyDirectClient, m.Cache, make(map[string]*client.ContainerInfo)), span),
+		Span:                   span,
 	}
 	// we'll almost certainly need the AccountInfo and ContainerInfo for the current path, so pre-fetch them in parallel.
 	apiRequest, account, container, _ := getPathParts(request)
-	if apiRequest && account != "" {
+	if apiRequest && account != "" && account != UsageAccount {
 		wg := &sync.WaitGroup{}
 		wg.Add(1)
 		go func() {
@@ -294,15 +327,21 @@ func (m *ProxyContextMiddleware) ServeHTTP(writer http.ResponseWriter, request *
 	})
 	request = request.WithContext(context.WithValue(request.Context(), "proxycontext", ctx))
 	m.next.ServeHTTP(newWriter, request)
+	span.SetAttribute("status", strconv.Itoa(ctx.status))
 }
 
-func NewContext(mc ring.MemcacheRing, log srv.LowLevelLogger, proxyDirectClient *client.ProxyDirectClient) func(http.Handler) http.Handler {
+func NewContext(mc ring.MemcacheRing, log srv.LowLevelLogger, proxyDirectClient *client.ProxyDirectClient, tracer *tracing.Tracer, exposeMetrics bool) func(http.Handler) http.Handler {
+	registry, requestDurations := metrics.NewServerRegistry()
 	return func(next http.Handler) http.Handler {
 		return &ProxyContextMiddleware{
 			Cache:             mc,
 			log:               log,
 			next:              next,
 			proxyDirectClient: proxyDirectClient,
+			metrics:           registry,
+			requestDurations:  requestDurations,
+			exposeMetrics:     exposeMetrics,
+			tracer:            tracer,
 		}
 	}
 }
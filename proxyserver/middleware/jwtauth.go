@@ -0,0 +1,467 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/srv"
+	"go.uber.org/zap"
+)
+
+// jwk is a single entry of a JSON Web Key Set, as published by OIDC providers at their jwks_uri.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// parseJWKS returns the RS256 and ES256 signing keys in a JWKS document, skipping any other kinds of keys.
+func parseJWKS(data []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	keys := []jwtKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			if k.Alg != "" && k.Alg != "RS256" {
+				continue
+			}
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid modulus for key %q", k.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("invalid exponent for key %q", k.Kid)
+			}
+			key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys = append(keys, jwtKey{kid: k.Kid, alg: "RS256", key: key})
+		case "EC":
+			if (k.Alg != "" && k.Alg != "ES256") || k.Crv != "P-256" {
+				continue
+			}
+			x, errx := base64.RawURLEncoding.DecodeString(k.X)
+			y, erry := base64.RawURLEncoding.DecodeString(k.Y)
+			if errx != nil || erry != nil || len(x) != 32 || len(y) != 32 {
+				return nil, fmt.Errorf("invalid point for key %q", k.Kid)
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("invalid point for key %q", k.Kid)
+			}
+			keys = append(keys, jwtKey{kid: k.Kid, alg: "ES256", key: key})
+		}
+	}
+	return keys, nil
+}
+
+// jwks holds the keys tokens may be signed with, reloading them from a file or URL when they get stale or when a token
+// names a key we haven't seen.
+type jwks struct {
+	file        string
+	url         string
+	client      *http.Client
+	refresh     time.Duration
+	minRefresh  time.Duration
+	lock        sync.Mutex
+	keys        []jwtKey
+	loaded      time.Time
+	lastAttempt time.Time
+}
+
+func (j *jwks) fetch() ([]byte, error) {
+	if j.file != "" {
+		return ioutil.ReadFile(j.file)
+	}
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request gave status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// reload fetches the key set, keeping the current keys if that fails.  Reloads are rate limited to one per minRefresh.
+func (j *jwks) reload(now time.Time) error {
+	if now.Sub(j.lastAttempt) < j.minRefresh {
+		return nil
+	}
+	j.lastAttempt = now
+	data, err := j.fetch()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	j.keys = keys
+	j.loaded = now
+	return nil
+}
+
+// candidates returns the keys that may have signed a token with the given kid and alg.
+func (j *jwks) candidates(kid, alg string, logger func(error)) []jwtKey {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	now := time.Now()
+	if now.Sub(j.loaded) >= j.refresh {
+		if err := j.reload(now); err != nil {
+			logger(err)
+		}
+	}
+	find := func() []jwtKey {
+		found := []jwtKey{}
+		for _, k := range j.keys {
+			if k.alg == alg && (kid == "" || k.kid == kid) {
+				found = append(found, k)
+			}
+		}
+		return found
+	}
+	found := find()
+	if len(found) == 0 && kid != "" {
+		// the provider may have rotated its keys
+		if err := j.reload(now); err != nil {
+			logger(err)
+		}
+		found = find()
+	}
+	return found
+}
+
+type jwtClaims map[string]interface{}
+
+// lookup returns the claim at path, where dots separate the names of nested objects, e.g. "realm_access.roles".
+func (c jwtClaims) lookup(path string) interface{} {
+	var value interface{} = map[string]interface{}(c)
+	for _, name := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[name]
+	}
+	return value
+}
+
+func (c jwtClaims) str(path string) string {
+	switch v := c.lookup(path).(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// strs returns a claim that may be either a list of strings or a single string of space or comma separated values.
+func (c jwtClaims) strs(path string) []string {
+	switch v := c.lookup(path).(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func (c jwtClaims) time(name string) (time.Time, bool) {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0), true
+	}
+	return time.Time{}, false
+}
+
+// jwtIdentity is what a validated token says about its bearer.
+type jwtIdentity struct {
+	account string
+	user    string
+	roles   []string
+}
+
+type jwtAuth struct {
+	next              http.Handler
+	keys              *jwks
+	issuer            string
+	audience          string
+	leeway            time.Duration
+	resellerPrefix    string
+	accountClaim      string
+	userClaim         string
+	rolesClaim        string
+	operatorRoles     []string
+	resellerAdminRole string
+}
+
+func jwtSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// validate checks the token's signature and registered claims, returning its claims if it is good.
+func (ja *jwtAuth) validate(token string, logger func(error)) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+		Typ string `json:"typ"`
+	}
+	if data, err := jwtSegment(parts[0]); err != nil {
+		return nil, errors.New("malformed token header")
+	} else if err = json.Unmarshal(data, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	sig, err := jwtSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	verified := false
+	for _, k := range ja.keys.candidates(header.Kid, header.Alg, logger) {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			verified = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+		case *ecdsa.PublicKey:
+			verified = len(sig) == 64 &&
+				ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("bad token signature")
+	}
+	claims := jwtClaims{}
+	if data, err := jwtSegment(parts[1]); err != nil {
+		return nil, errors.New("malformed token claims")
+	} else if err = json.Unmarshal(data, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	now := time.Now()
+	if exp, ok := claims.time("exp"); !ok || now.After(exp.Add(ja.leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(ja.leeway).Before(nbf) {
+		return nil, errors.New("token not yet valid")
+	}
+	if ja.issuer != "" && claims.str("iss") != ja.issuer {
+		return nil, errors.New("token has the wrong issuer")
+	}
+	if ja.audience != "" && !common.StringInSlice(ja.audience, claims.strs("aud")) {
+		return nil, errors.New("token has the wrong audience")
+	}
+	return claims, nil
+}
+
+func (ja *jwtAuth) identity(claims jwtClaims) (*jwtIdentity, error) {
+	id := &jwtIdentity{account: claims.str(ja.accountClaim), user: claims.str(ja.userClaim)}
+	if id.account == "" {
+		return nil, fmt.Errorf("token has no %q claim", ja.accountClaim)
+	}
+	if id.user == "" {
+		id.user = claims.str("sub")
+	}
+	for _, role := range claims.strs(ja.rolesClaim) {
+		id.roles = append(id.roles, strings.ToLower(role))
+	}
+	return id, nil
+}
+
+func (ja *jwtAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := GetProxyContext(r)
+	auth := r.Header.Get("Authorization")
+	if ctx.AuthorizeOverride || len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		if ctx.Authorize == nil {
+			ctx.Authorize = ja.authorize(nil)
+		}
+		ja.next.ServeHTTP(w, r)
+		return
+	}
+	claims, err := ja.validate(strings.TrimSpace(auth[7:]), func(err error) {
+		ctx.Logger.Error("Unable to load JWKS", zap.Error(err))
+	})
+	var id *jwtIdentity
+	if err == nil {
+		id, err = ja.identity(claims)
+	}
+	if err != nil {
+		ctx.Logger.Debug("Rejecting bearer token", zap.Error(err))
+		w.Header().Set("Www-Authenticate", `Bearer error="invalid_token"`)
+		srv.StandardResponse(w, 401)
+		return
+	}
+	if ctx.Authorize == nil {
+		ctx.RemoteUser = id.user
+		ctx.Authorize = ja.authorize(id)
+	}
+	if common.StringInSlice(ja.resellerAdminRole, id.roles) {
+		ctx.ResellerRequest = true
+	}
+	ja.next.ServeHTTP(w, r)
+}
+
+// authorize returns the AuthorizeFunc for a request made with the given identity, which is nil for anonymous requests.
+func (ja *jwtAuth) authorize(id *jwtIdentity) AuthorizeFunc {
+	return func(r *http.Request) bool {
+		if r.Method == "OPTIONS" {
+			return true
+		}
+		ctx := GetProxyContext(r)
+		pathParts, err := common.ParseProxyPath(r.URL.Path)
+		if err != nil {
+			ctx.Logger.Error("Unable to parse URL", zap.Error(err))
+			return false
+		}
+		account := pathParts["account"]
+		referrers, groups := ParseACL(ctx.ACL)
+		if id != nil {
+			if common.StringInSlice(ja.resellerAdminRole, id.roles) {
+				ctx.Logger.Debug("User has reseller admin authorization", zap.String("user", id.user))
+				ctx.StorageOwner = true
+				return true
+			}
+			if !strings.HasPrefix(account, ja.resellerPrefix) {
+				return false
+			}
+			if account == ja.resellerPrefix+id.account {
+				for _, role := range ja.operatorRoles {
+					if common.StringInSlice(role, id.roles) {
+						if pathParts["container"] == "" && (r.Method == "PUT" || r.Method == "DELETE") {
+							return false
+						}
+						ctx.StorageOwner = true
+						return true
+					}
+				}
+			}
+			identities := []string{
+				id.account + ":" + id.user, id.account + ":*", "*:" + id.user, "*:*",
+			}
+			level := accountACLLevel(ctx, account, identities)
+			if level == ACCOUNT_ACL_ADMIN {
+				ctx.StorageOwner = true
+			}
+			if AccountACLAllows(level, r.Method, pathParts["container"]) {
+				return true
+			}
+			for _, group := range groups {
+				if common.StringInSlice(group, identities) || common.StringInSlice(strings.ToLower(group), id.roles) {
+					return true
+				}
+			}
+		}
+		if ReferrerAllowed(r.Referer(), referrers) {
+			return pathParts["object"] != "" || common.StringInSlice(".rlistings", groups)
+		}
+		return false
+	}
+}
+
+func NewJWTAuth(config conf.Section) (func(http.Handler) http.Handler, error) {
+	keys := &jwks{
+		file:       config.GetDefault("jwks_file", ""),
+		url:        config.GetDefault("jwks_url", ""),
+		client:     &http.Client{Timeout: 5 * time.Second},
+		refresh:    time.Duration(config.GetInt("jwks_refresh", 3600)) * time.Second,
+		minRefresh: time.Duration(config.GetInt("jwks_min_refresh", 60)) * time.Second,
+	}
+	if (keys.file == "") == (keys.url == "") {
+		return nil, errors.New("exactly one of jwks_file and jwks_url must be set")
+	}
+	if keys.file != "" {
+		// a bad key file is a configuration error, so find out now rather than on the first request
+		if err := keys.reload(time.Now()); err != nil {
+			return nil, fmt.Errorf("unable to load %s: %v", keys.file, err)
+		}
+	}
+	resellerPrefix := config.GetDefault("reseller_prefix", "AUTH")
+	if resellerPrefix != "" && !strings.HasSuffix(resellerPrefix, "_") {
+		resellerPrefix += "_"
+	}
+	operatorRoles := []string{}
+	for _, role := range common.SliceFromCSV(config.GetDefault("operator_roles", "admin, swiftoperator")) {
+		operatorRoles = append(operatorRoles, strings.ToLower(role))
+	}
+	RegisterInfo("jwtauth", map[string]interface{}{"account_acls": true})
+	return func(next http.Handler) http.Handler {
+		return &jwtAuth{
+			next:              next,
+			keys:              keys,
+			issuer:            config.GetDefault("issuer", ""),
+			audience:          config.GetDefault("audience", ""),
+			leeway:            time.Duration(config.GetInt("leeway", 60)) * time.Second,
+			resellerPrefix:    resellerPrefix,
+			accountClaim:      config.GetDefault("account_claim", "project_id"),
+			userClaim:         config.GetDefault("user_claim", "preferred_username"),
+			rolesClaim:        config.GetDefault("roles_claim", "roles"),
+			operatorRoles:     operatorRoles,
+			resellerAdminRole: strings.ToLower(config.GetDefault("reseller_admin_role", "ResellerAdmin")),
+		}
+	}, nil
+}
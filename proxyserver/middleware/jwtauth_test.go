@@ -0,0 +1,306 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+type jwtTestKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) *jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	return &jwtTestKeys{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func (k *jwtTestKeys) jwks() []byte {
+	b64 := base64.RawURLEncoding.EncodeToString
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "alg": "RS256",
+			"n": b64(k.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(k.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256",
+			"x": b64(k.ecKey.X.FillBytes(make([]byte, 32))), "y": b64(k.ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+	}})
+	return data
+}
+
+func (k *jwtTestKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsaKey, crypto.SHA256, digest[:])
+		require.Nil(t, err)
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ecKey, digest[:])
+		require.Nil(t, err)
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwtTestClaims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":                "https://idp.example.com",
+		"aud":                []string{"swift", "other"},
+		"sub":                "1234",
+		"preferred_username": "alice",
+		"project_id":         "test",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"roles":              []string{"member"},
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+func newJWTAuthTest(t *testing.T, keys *jwtTestKeys, extraConf string) (http.Handler, func()) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	jwksFile := filepath.Join(dir, "jwks.json")
+	require.Nil(t, ioutil.WriteFile(jwksFile, keys.jwks(), 0600))
+	config, err := conf.StringConfig("[filter:jwtauth]\njwks_file = " + jwksFile +
+		"\nissuer = https://idp.example.com\naudience = swift\n" + extraConf)
+	require.Nil(t, err)
+	mid, err := NewJWTAuth(config.GetSection("filter:jwtauth"))
+	require.Nil(t, err)
+	return mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := GetProxyContext(r)
+		if !ctx.Authorize(r) {
+			if ctx.RemoteUser != "" {
+				w.WriteHeader(403)
+			} else {
+				w.WriteHeader(401)
+			}
+			return
+		}
+		w.WriteHeader(200)
+	})), func() { os.RemoveAll(dir) }
+}
+
+func doJWTRequest(handler http.Handler, method, path, token string) (*http.Response, *ProxyContext) {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: test.NewMemoryMemcacheRing()},
+		C:                      newMemoryProxyClient(),
+		Logger:                 zap.NewNop(),
+		accountInfoCache: map[string]*AccountInfo{
+			"account/AUTH_shared": {SysMetadata: map[string]string{AccountACLSysmeta: `{"read-only":["test:alice"]}`}},
+		},
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Result(), ctx
+}
+
+func TestJWTAuthValidTokens(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	handler, cleanup := newJWTAuthTest(t, keys, "")
+	defer cleanup()
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa1", "ES256": "ec1"}[alg]
+		token := keys.sign(t, alg, kid, jwtTestClaims(map[string]interface{}{"roles": []string{"Admin"}}))
+		resp, ctx := doJWTRequest(handler, "GET", "/v1/AUTH_test/c", token)
+		require.Equal(t, 200, resp.StatusCode, alg)
+		require.Equal(t, "alice", ctx.RemoteUser)
+		require.True(t, ctx.StorageOwner)
+		// tokens without a kid are checked against every key of the right type
+		token = keys.sign(t, alg, "", jwtTestClaims(map[string]interface{}{"roles": []string{"Admin"}}))
+		resp, _ = doJWTRequest(handler, "PUT", "/v1/AUTH_test/c/o", token)
+		require.Equal(t, 200, resp.StatusCode, alg)
+	}
+}
+
+func TestJWTAuthInvalidTokens(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	handler, cleanup := newJWTAuthTest(t, keys, "")
+	defer cleanup()
+	other := newJWTTestKeys(t)
+
+	expired := keys.sign(t, "RS256", "rsa1", jwtTestClaims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}))
+	tampered := keys.sign(t, "RS256", "rsa1", jwtTestClaims(nil))
+	tampered = tampered[:len(tampered)-4] + "AAAA"
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"project_id":"test"}`)) + "."
+	for name, token := range map[string]string{
+		"expired":      expired,
+		"tampered":     tampered,
+		"unsigned":     unsigned,
+		"garbage":      "not.a.jwt",
+		"wrong key":    other.sign(t, "ES256", "ec1", jwtTestClaims(nil)),
+		"unknown kid":  keys.sign(t, "RS256", "rsa2", jwtTestClaims(nil)),
+		"not yet":      keys.sign(t, "ES256", "ec1", jwtTestClaims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		"wrong issuer": keys.sign(t, "ES256", "ec1", jwtTestClaims(map[string]interface{}{"iss": "https://evil.example.com"})),
+		"wrong aud":    keys.sign(t, "ES256", "ec1", jwtTestClaims(map[string]interface{}{"aud": "other"})),
+		"no account":   keys.sign(t, "ES256", "ec1", jwtTestClaims(map[string]interface{}{"project_id": nil})),
+	} {
+		resp, _ := doJWTRequest(handler, "GET", "/v1/AUTH_test/c", token)
+		require.Equal(t, 401, resp.StatusCode, name)
+	}
+
+	// anonymous requests only get in by referrer ACLs
+	resp, _ := doJWTRequest(handler, "GET", "/v1/AUTH_test/c/o", "")
+	require.Equal(t, 401, resp.StatusCode)
+}
+
+func TestJWTAuthAuthorization(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	handler, cleanup := newJWTAuthTest(t, keys, "roles_claim = realm_access.roles\n")
+	defer cleanup()
+	token := func(roles ...string) string {
+		return keys.sign(t, "ES256", "ec1", jwtTestClaims(map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": roles},
+		}))
+	}
+
+	// members without an operator role have no access, even to their own account
+	resp, _ := doJWTRequest(handler, "GET", "/v1/AUTH_test/c", token("member"))
+	require.Equal(t, 403, resp.StatusCode)
+	resp, _ = doJWTRequest(handler, "GET", "/v1/AUTH_test/c", token("swiftoperator"))
+	require.Equal(t, 200, resp.StatusCode)
+	resp, _ = doJWTRequest(handler, "DELETE", "/v1/AUTH_test", token("swiftoperator"))
+	require.Equal(t, 403, resp.StatusCode)
+	resp, _ = doJWTRequest(handler, "GET", "/v1/AUTH_other/c", token("swiftoperator"))
+	require.Equal(t, 403, resp.StatusCode)
+
+	// account ACLs
+	resp, _ = doJWTRequest(handler, "GET", "/v1/AUTH_shared/c", token("member"))
+	require.Equal(t, 200, resp.StatusCode)
+	resp, _ = doJWTRequest(handler, "PUT", "/v1/AUTH_shared/c/o", token("member"))
+	require.Equal(t, 403, resp.StatusCode)
+
+	resp, ctx := doJWTRequest(handler, "DELETE", "/v1/AUTH_other", token("resellerADMIN"))
+	require.Equal(t, 200, resp.StatusCode)
+	require.True(t, ctx.ResellerRequest)
+}
+
+func TestJWTAuthContainerACLs(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	mid, cleanup := newJWTAuthTest(t, keys, "")
+	defer cleanup()
+	ja := mid.(*jwtAuth)
+	r := httptest.NewRequest("GET", "/v1/AUTH_other/c/o", nil)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: test.NewMemoryMemcacheRing()},
+		C:                      newMemoryProxyClient(),
+		Logger:                 zap.NewNop(),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	authorize := ja.authorize(&jwtIdentity{account: "test", user: "alice", roles: []string{"member"}})
+	for acl, expected := range map[string]bool{
+		"test:alice": true,
+		"*:alice":    true,
+		"test:bob":   false,
+		"Member":     true,
+		"":           false,
+	} {
+		ctx.ACL = acl
+		require.Equal(t, expected, authorize(r), acl)
+	}
+	ctx.ACL = ".r:*"
+	require.True(t, ja.authorize(nil)(r))
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	served := []byte(`{"keys":[]}`)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(served)
+	}))
+	defer server.Close()
+	j := &jwks{url: server.URL, client: server.Client(), refresh: time.Hour}
+	logger := func(err error) { require.Nil(t, err) }
+	require.Equal(t, 0, len(j.candidates("rsa1", "RS256", logger)))
+	require.Equal(t, 2, requests) // the initial load, then again for the unknown kid
+
+	// a token signed with a new key triggers a reload
+	served = keys.jwks()
+	require.Equal(t, 1, len(j.candidates("rsa1", "RS256", logger)))
+	require.Equal(t, 3, requests)
+	require.Equal(t, 1, len(j.candidates("ec1", "ES256", logger)))
+	require.Equal(t, 3, requests)
+
+	// reloads are rate limited and failures keep the old keys
+	j.minRefresh = time.Hour
+	served = []byte("garbage")
+	require.Equal(t, 0, len(j.candidates("ec2", "ES256", logger)))
+	require.Equal(t, 3, requests)
+	j.minRefresh = 0
+	j.loaded = time.Time{}
+	require.Equal(t, 1, len(j.candidates("ec1", "ES256", func(err error) { require.NotNil(t, err) })))
+	require.Equal(t, 4, requests)
+}
+
+func TestNewJWTAuthConfig(t *testing.T) {
+	for _, c := range []string{
+		"",
+		"jwks_file = /a\njwks_url = http://b/",
+		"jwks_file = /nonexistent/jwks.json",
+	} {
+		config, err := conf.StringConfig("[filter:jwtauth]\n" + c)
+		require.Nil(t, err)
+		_, err = NewJWTAuth(config.GetSection("filter:jwtauth"))
+		require.NotNil(t, err, c)
+	}
+	config, err := conf.StringConfig("[filter:jwtauth]\njwks_url = https://idp.example.com/certs\n")
+	require.Nil(t, err)
+	_, err = NewJWTAuth(config.GetSection("filter:jwtauth"))
+	require.Nil(t, err)
+}
@@ -72,7 +72,10 @@ func (ka *keystoneAuth) accountMatchesTenant(account string, tenantID string) bo
 
 func (ka *keystoneAuth) getProjectDomainID(r *http.Request, account string) string {
 	ctx := GetProxyContext(r)
-	return ctx.GetAccountInfo(account).SysMetadata["Project-Domain-Id"]
+	if ai := ctx.GetAccountInfo(account); ai != nil {
+		return ai.SysMetadata["Project-Domain-Id"]
+	}
+	return ""
 }
 
 func (ka *keystoneAuth) setProjectDomainID(r *http.Request, pathParts map[string]string, identityMap map[string]string) {
@@ -121,21 +124,30 @@ func (ka *keystoneAuth) isNameAllowedinACL(r *http.Request, account string, iden
 
 func (ka *keystoneAuth) authorizeCrossTenant(userID string, userName string,
 	tenantID string, tenantName string, roles []string, allowNames bool) string {
+	for _, s := range ka.aclIdentities(userID, userName, tenantID, tenantName, allowNames) {
+		if common.StringInSlice(s, roles) {
+			return s
+		}
+	}
+	return ""
+}
+
+// aclIdentities returns the names a user may be granted access by in an account ACL, in the same
+// "tenant:user" form used by container ACLs.
+func (ka *keystoneAuth) aclIdentities(userID string, userName string, tenantID string, tenantName string, allowNames bool) []string {
 	tenantMatch := []string{tenantID, "*"}
 	userMatch := []string{userID, "*"}
 	if allowNames {
 		tenantMatch = append(tenantMatch, tenantName)
 		userMatch = append(userMatch, userName)
 	}
+	identities := []string{}
 	for _, tenant := range tenantMatch {
 		for _, user := range userMatch {
-			s := fmt.Sprintf("%s:%s", tenant, user)
-			if common.StringInSlice(s, roles) {
-				return s
-			}
+			identities = append(identities, fmt.Sprintf("%s:%s", tenant, user))
 		}
 	}
-	return ""
+	return identities
 }
 
 func (ka *keystoneAuth) authorize(r *http.Request) bool {
@@ -170,6 +182,7 @@ func (ka *keystoneAuth) authorize(r *http.Request) bool {
 	}
 	if common.StringInSlice(ka.resellerAdminRole, userRoles) {
 		ctx.Logger.Debug("User has reseller admin authorization", zap.String("userid", tenantID))
+		ctx.StorageOwner = true
 		return true
 	}
 
@@ -180,9 +193,17 @@ func (ka *keystoneAuth) authorize(r *http.Request) bool {
 			zap.String("userName", userName))
 		return false
 	}
+	allowNames := ka.isNameAllowedinACL(r, pathParts["account"], identityMap)
+	level := accountACLLevel(ctx, pathParts["account"], ka.aclIdentities(userID, userName, tenantID, tenantName, allowNames))
+	if level == ACCOUNT_ACL_ADMIN {
+		ctx.StorageOwner = true
+	}
+	if AccountACLAllows(level, r.Method, pathParts["container"]) {
+		ctx.Logger.Debug("user allowed by account ACL", zap.String("userid", userID))
+		return true
+	}
 	matchedACL := ""
 	if len(roles) > 0 {
-		allowNames := ka.isNameAllowedinACL(r, pathParts["account"], identityMap)
 		matchedACL = ka.authorizeCrossTenant(userID, userName, tenantID, tenantName, roles, allowNames)
 	}
 	if matchedACL != "" {
@@ -223,6 +244,7 @@ func (ka *keystoneAuth) authorize(r *http.Request) bool {
 		allowed = true
 	}
 	if allowed {
+		ctx.StorageOwner = true
 		return true
 	}
 	if !isAuthorized && authErr == nil {
@@ -17,6 +17,7 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/troubling/hummingbird/common"
@@ -32,6 +33,7 @@ func NewRequestLogger(config conf.Section) (func(http.Handler) http.Handler, err
 				next.ServeHTTP(writer, request)
 				ctx := GetProxyContext(request)
 				_, status := ctx.Response()
+				ctx.requestDurations.Observe(time.Since(start).Seconds(), request.Method, strconv.Itoa(status), requestPolicy(ctx, request, status))
 				ctx.Logger.Info("Request log",
 					zap.String("remoteAddr", request.RemoteAddr),
 					zap.String("eventTime", time.Now().Format("02/Jan/2006:15:04:05 -0700")),
@@ -46,3 +48,16 @@ func NewRequestLogger(config conf.Section) (func(http.Handler) http.Handler, err
 		)
 	}, nil
 }
+
+// requestPolicy returns the storage policy index of a successful object request, or "" for anything else.
+// The container info was fetched to serve the request, so this is answered from cache.
+func requestPolicy(ctx *ProxyContext, request *http.Request, status int) string {
+	apiRequest, account, container, obj := getPathParts(request)
+	if !apiRequest || obj == "" || status/100 != 2 {
+		return ""
+	}
+	if ci := ctx.C.GetContainerInfo(account, container); ci != nil {
+		return strconv.Itoa(ci.StoragePolicyIndex)
+	}
+	return ""
+}
@@ -35,23 +35,87 @@ type testUser struct {
 }
 
 type tempAuth struct {
-	testUsers []testUser
-	next      http.Handler
+	testUsers      []testUser
+	resellerPrefix string
+	next           http.Handler
 }
 
-func (ta *tempAuth) login(account, user, key string) (string, string, error) {
-	for _, tu := range ta.testUsers {
+func (ta *tempAuth) login(account, user, key string) (string, *testUser, error) {
+	for i, tu := range ta.testUsers {
 		if tu.Account == account && tu.Username == user && tu.Password == key {
 			token := common.UUID()
-			return token, tu.Url, nil
+			return token, &ta.testUsers[i], nil
 		}
 	}
-	return "", "", errors.New("User not found.")
+	return "", nil, errors.New("User not found.")
 }
 
 type cachedAuth struct {
-	Authenticated bool   `json:"authed"`
-	User          string `json:"user"`
+	Authenticated bool     `json:"authed"`
+	User          string   `json:"user"`
+	Account       string   `json:"account"`
+	Groups        []string `json:"groups"`
+}
+
+// accountID returns the storage account a user's token grants access to.
+func (ta *tempAuth) accountID(tu *testUser) string {
+	if tu.Url != "" {
+		return tu.Url[strings.LastIndex(tu.Url, "/")+1:]
+	}
+	return ta.resellerPrefix + tu.Account
+}
+
+// authorize returns the AuthorizeFunc for a request made with the given credentials, which are nil for anonymous
+// requests.
+func (ta *tempAuth) authorize(authed *cachedAuth) AuthorizeFunc {
+	return func(r *http.Request) bool {
+		if r.Method == "OPTIONS" {
+			return true
+		}
+		ctx := GetProxyContext(r)
+		pathParts, err := common.ParseProxyPath(r.URL.Path)
+		if err != nil {
+			return false
+		}
+		account := pathParts["account"]
+		groups := []string{}
+		if authed != nil {
+			groups = authed.Groups
+		}
+		if common.StringInSlice(".reseller_admin", groups) {
+			ctx.ResellerRequest = true
+			ctx.StorageOwner = true
+			return true
+		}
+		if authed != nil && account == authed.Account && common.StringInSlice(".admin", groups) {
+			if pathParts["container"] == "" && (r.Method == "PUT" || r.Method == "DELETE") {
+				return false
+			}
+			ctx.StorageOwner = true
+			return true
+		}
+		if authed != nil {
+			level := accountACLLevel(ctx, account, groups)
+			if level == ACCOUNT_ACL_ADMIN {
+				ctx.StorageOwner = true
+			}
+			if AccountACLAllows(level, r.Method, pathParts["container"]) {
+				return true
+			}
+		}
+		referrers, aclGroups := ParseACL(ctx.ACL)
+		if ReferrerAllowed(r.Referer(), referrers) {
+			if pathParts["object"] != "" || common.StringInSlice(".rlistings", aclGroups) {
+				return true
+			}
+		}
+		for _, group := range groups {
+			if !strings.HasPrefix(group, ".") && common.StringInSlice(group, aclGroups) {
+				return true
+			}
+		}
+		return false
+	}
 }
 
 func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -65,35 +129,38 @@ func (ta *tempAuth) ServeHTTP(writer http.ResponseWriter, request *http.Request)
 		account := parts[0]
 		user = parts[1]
 		password := request.Header.Get("X-Auth-Key")
-		token, url, err := ta.login(account, user, password)
+		token, tu, err := ta.login(account, user, password)
 		if err != nil {
 			srv.StandardResponse(writer, 401)
 			return
 		}
 		if ctx := GetProxyContext(request); ctx != nil {
-			ctx.Cache.Set("auth:"+token, &cachedAuth{Authenticated: true, User: user}, 3600)
+			groups := append([]string{fmt.Sprintf("%s:%s", account, user), account}, tu.Roles...)
+			ctx.Cache.Set("auth:"+token, &cachedAuth{Authenticated: true, User: user, Account: ta.accountID(tu), Groups: groups}, 3600)
 			ctx.RemoteUser = user
 		}
 		writer.Header().Set("X-Storage-Token", token)
 		writer.Header().Set("X-Auth-Token", token)
-		if url != "" {
-			writer.Header().Set("X-Storage-URL", url)
+		if tu.Url != "" {
+			writer.Header().Set("X-Storage-URL", tu.Url)
 		} else {
-			writer.Header().Set("X-Storage-URL", fmt.Sprintf("http://%s/v1/AUTH_%s", request.Host, account))
+			writer.Header().Set("X-Storage-URL", fmt.Sprintf("http://%s/v1/%s", request.Host, ta.accountID(tu)))
 		}
 		srv.StandardResponse(writer, 200)
 	} else if strings.HasPrefix(request.URL.Path, "/v1") || strings.HasPrefix(request.URL.Path, "/V1") {
 		token := request.Header.Get("X-Auth-Token")
 		ctx := GetProxyContext(request)
 		if ctx.Authorize == nil {
-			var authed cachedAuth
-			if err := ctx.Cache.GetStructured("auth:"+token, &authed); err != nil {
-				srv.StandardResponse(writer, 401)
-				return
-			}
-			ctx.RemoteUser = authed.User
-			ctx.Authorize = func(r *http.Request) bool {
-				return authed.Authenticated
+			if token == "" {
+				ctx.Authorize = ta.authorize(nil)
+			} else {
+				var authed cachedAuth
+				if err := ctx.Cache.GetStructured("auth:"+token, &authed); err != nil || !authed.Authenticated {
+					srv.StandardResponse(writer, 401)
+					return
+				}
+				ctx.RemoteUser = authed.User
+				ctx.Authorize = ta.authorize(&authed)
 			}
 		}
 		ta.next.ServeHTTP(writer, request)
@@ -130,11 +197,16 @@ func NewTempAuth(config conf.Section) (func(http.Handler) http.Handler, error) {
 		user := testUser{keyparts[1], keyparts[2], valparts[0], groups, url}
 		users = append(users, user)
 	}
+	resellerPrefix := config.GetDefault("reseller_prefix", "AUTH")
+	if resellerPrefix != "" && !strings.HasSuffix(resellerPrefix, "_") {
+		resellerPrefix += "_"
+	}
 	RegisterInfo("tempauth", map[string]interface{}{"account_acls": true})
 	return func(next http.Handler) http.Handler {
 		return &tempAuth{
-			next:      next,
-			testUsers: users,
+			next:           next,
+			testUsers:      users,
+			resellerPrefix: resellerPrefix,
 		}
 	}, nil
 }
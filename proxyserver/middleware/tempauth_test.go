@@ -0,0 +1,121 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/test"
+	"go.uber.org/zap"
+)
+
+func tempAuthRequest(method, path string, acl string) (*http.Request, *ProxyContext) {
+	r := httptest.NewRequest(method, path, nil)
+	ctx := &ProxyContext{
+		ProxyContextMiddleware: &ProxyContextMiddleware{Cache: test.NewMemoryMemcacheRing()},
+		C:                      newMemoryProxyClient(),
+		Logger:                 zap.NewNop(),
+		accountInfoCache: map[string]*AccountInfo{
+			"account/AUTH_test":  {SysMetadata: map[string]string{AccountACLSysmeta: acl}},
+			"account/AUTH_other": {SysMetadata: map[string]string{}},
+		},
+	}
+	return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx)), ctx
+}
+
+func TestTempAuthLogin(t *testing.T) {
+	config, err := conf.StringConfig("[filter:tempauth]\nuser_test_tester = testing .admin\n")
+	require.Nil(t, err)
+	mid, err := NewTempAuth(config.GetSection("filter:tempauth"))
+	require.Nil(t, err)
+	handler := mid(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := GetProxyContext(r)
+		if !ctx.Authorize(r) {
+			w.WriteHeader(403)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+
+	r, ctx := tempAuthRequest("GET", "/auth/v1.0", "")
+	r.Header.Set("X-Auth-User", "test:tester")
+	r.Header.Set("X-Auth-Key", "testing")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "http://example.com/v1/AUTH_test", w.Result().Header.Get("X-Storage-Url"))
+	token := w.Result().Header.Get("X-Auth-Token")
+
+	// tokens are only good for the user's own account
+	for path, expected := range map[string]int{"/v1/AUTH_test/c": 200, "/v1/AUTH_other/c": 403} {
+		r, rctx := tempAuthRequest("GET", path, "")
+		rctx.Cache = ctx.Cache
+		r.Header.Set("X-Auth-Token", token)
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, expected, w.Result().StatusCode, path)
+	}
+
+	r, rctx := tempAuthRequest("GET", "/v1/AUTH_test/c", "")
+	rctx.Cache = ctx.Cache
+	r.Header.Set("X-Auth-Token", "bogus")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestTempAuthAccountACLs(t *testing.T) {
+	ta := &tempAuth{resellerPrefix: "AUTH_"}
+	acl := `{"admin":["other:boss"],"read-write":["other:writer"],"read-only":["other:reader"]}`
+	user := func(name string) *cachedAuth {
+		return &cachedAuth{Authenticated: true, User: name, Account: "AUTH_other", Groups: []string{"other:" + name, "other"}}
+	}
+
+	r, ctx := tempAuthRequest("GET", "/v1/AUTH_test/c/o", acl)
+	require.True(t, ta.authorize(user("reader"))(r))
+	require.False(t, ctx.StorageOwner)
+	require.False(t, ta.authorize(user("nobody"))(r))
+
+	r, _ = tempAuthRequest("PUT", "/v1/AUTH_test/c/o", acl)
+	require.False(t, ta.authorize(user("reader"))(r))
+	require.True(t, ta.authorize(user("writer"))(r))
+
+	r, _ = tempAuthRequest("POST", "/v1/AUTH_test", acl)
+	require.False(t, ta.authorize(user("writer"))(r))
+	r, ctx = tempAuthRequest("POST", "/v1/AUTH_test", acl)
+	require.True(t, ta.authorize(user("boss"))(r))
+	require.True(t, ctx.StorageOwner)
+
+	// account ACLs don't leak across accounts
+	r, _ = tempAuthRequest("GET", "/v1/AUTH_other2/c", acl)
+	require.False(t, ta.authorize(user("boss"))(r))
+
+	// account owners need .admin
+	owner := &cachedAuth{Authenticated: true, User: "tester", Account: "AUTH_test", Groups: []string{"test:tester", "test", ".admin"}}
+	r, ctx = tempAuthRequest("POST", "/v1/AUTH_test", "")
+	require.True(t, ta.authorize(owner)(r))
+	require.True(t, ctx.StorageOwner)
+	r, _ = tempAuthRequest("DELETE", "/v1/AUTH_test", "")
+	require.False(t, ta.authorize(owner)(r))
+	owner.Groups = owner.Groups[:2]
+	r, _ = tempAuthRequest("GET", "/v1/AUTH_test/c", "")
+	require.False(t, ta.authorize(owner)(r))
+}
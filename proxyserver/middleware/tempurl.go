@@ -18,8 +18,14 @@ package middleware
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"net"
 	"net/http"
 	"path/filepath"
 	"strings"
@@ -36,6 +42,12 @@ const (
 	SCOPE_CONTAINER
 )
 
+var tempurlDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
 type tuWriter struct {
 	http.ResponseWriter
 	method   string
@@ -73,127 +85,212 @@ func (w *tuWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
-func checkhmac(key, sig []byte, method, path string, expires time.Time) bool {
+func checkhmac(key, sig []byte, digest func() hash.Hash, method, path string, expires time.Time, ipRange string) bool {
+	ipPrefix := ""
+	if ipRange != "" {
+		ipPrefix = fmt.Sprintf("ip=%s\n", ipRange)
+	}
+	methods := []string{method}
 	if method == "HEAD" {
-		for _, meth := range []string{"HEAD", "GET", "POST", "PUT"} {
-			mac := hmac.New(sha1.New, key)
-			fmt.Fprintf(mac, "%s\n%d\n%s", meth, expires.Unix(), path)
-			if hmac.Equal(sig, mac.Sum(nil)) {
-				return true
-			}
+		methods = []string{"HEAD", "GET", "POST", "PUT"}
+	}
+	for _, meth := range methods {
+		mac := hmac.New(digest, key)
+		fmt.Fprintf(mac, "%s%s\n%d\n%s", ipPrefix, meth, expires.Unix(), path)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
 		}
-		return false
-	} else {
-		mac := hmac.New(sha1.New, key)
-		fmt.Fprintf(mac, "%s\n%d\n%s", method, expires.Unix(), path)
-		return hmac.Equal(sig, mac.Sum(nil))
 	}
+	return false
 }
 
-func tempurl(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		if request.Method == "OPTIONS" {
-			next.ServeHTTP(writer, request)
-			return
+// parseSignature decodes a temp_url_sig value, which is either a hex digest whose length identifies the
+// algorithm, or "<digest>:<base64 digest>" as described in the Swift tempurl docs.
+func parseSignature(sig string, allowed map[string]func() hash.Hash) ([]byte, func() hash.Hash, error) {
+	var name string
+	var sigb []byte
+	var err error
+	if i := strings.Index(sig, ":"); i >= 0 {
+		name = sig[:i]
+		b64 := strings.TrimRight(sig[i+1:], "=")
+		if sigb, err = base64.RawURLEncoding.DecodeString(b64); err != nil {
+			if sigb, err = base64.RawStdEncoding.DecodeString(b64); err != nil {
+				return nil, nil, err
+			}
 		}
-		ctx := GetProxyContext(request)
-		if ctx.Authorize != nil {
-			next.ServeHTTP(writer, request)
-			return
+	} else {
+		if sigb, err = hex.DecodeString(sig); err != nil {
+			return nil, nil, err
 		}
-		q := request.URL.Query()
-		sig := q.Get("temp_url_sig")
-		exps := q.Get("temp_url_expires")
-		_, inline := q["inline"]
-
-		if sig == "" && exps == "" {
-			next.ServeHTTP(writer, request)
-			return
-		} else if sig == "" || exps == "" {
-			srv.StandardResponse(writer, 401)
-			return
+		switch len(sigb) {
+		case sha1.Size:
+			name = "sha1"
+		case sha256.Size:
+			name = "sha256"
+		case sha512.Size:
+			name = "sha512"
+		default:
+			return nil, nil, errors.New("Unrecognized signature length")
 		}
+	}
+	digest, ok := allowed[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("Digest %q not allowed", name)
+	}
+	if len(sigb) != digest().Size() {
+		return nil, nil, errors.New("Signature length does not match digest")
+	}
+	return sigb, digest, nil
+}
 
-		expires, err := common.ParseDate(exps)
-		if err != nil || time.Now().After(expires) {
-			srv.StandardResponse(writer, 401)
-			return
-		}
+// ipAllowed returns true if the request's remote address falls within ipRange, which may be a single address or
+// a CIDR block.
+func ipAllowed(remoteAddr, ipRange string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if !strings.Contains(ipRange, "/") {
+		allowed := net.ParseIP(ipRange)
+		return allowed != nil && allowed.Equal(ip)
+	}
+	_, ipNet, err := net.ParseCIDR(ipRange)
+	return err == nil && ipNet.Contains(ip)
+}
 
-		sigb, err := hex.DecodeString(sig)
-		if err != nil {
-			srv.StandardResponse(writer, 401)
-			return
-		}
+type tempURL struct {
+	next    http.Handler
+	digests map[string]func() hash.Hash
+}
 
-		apiReq, account, container, obj := getPathParts(request)
-		if !apiReq || account == "" || container == "" {
-			srv.StandardResponse(writer, 401)
-			return
-		}
+func (tu *tempURL) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method == "OPTIONS" {
+		tu.next.ServeHTTP(writer, request)
+		return
+	}
+	ctx := GetProxyContext(request)
+	if ctx.Authorize != nil {
+		tu.next.ServeHTTP(writer, request)
+		return
+	}
+	q := request.URL.Query()
+	sig := q.Get("temp_url_sig")
+	exps := q.Get("temp_url_expires")
+	_, inline := q["inline"]
 
-		if bh := request.Header.Get("X-Object-Manifest"); bh != "" && (request.Method == "PUT" || request.Method == "POST") {
-			srv.StandardResponse(writer, 400)
-			return
-		}
+	if sig == "" && exps == "" {
+		tu.next.ServeHTTP(writer, request)
+		return
+	} else if sig == "" || exps == "" {
+		srv.StandardResponse(writer, 401)
+		return
+	}
 
-		path := ""
-		if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
-			prefix := q.Get("temp_url_prefix")
-			if !strings.HasPrefix(obj, prefix) {
-				srv.StandardResponse(writer, 401)
-				return
-			}
-			path = fmt.Sprintf("prefix:/v1/%s/%s/%s", account, container, prefix)
-		} else {
-			path = fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
-		}
+	expires, err := common.ParseDate(exps)
+	if err != nil || time.Now().After(expires) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
 
-		scope := SCOPE_INVALID
-		if ai := ctx.GetAccountInfo(account); ai != nil {
-			if key, ok := ai.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-				scope = SCOPE_ACCOUNT
-			} else if key, ok := ai.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-				scope = SCOPE_ACCOUNT
-			} else if ci := ctx.C.GetContainerInfo(account, container); ci != nil {
-				if key, ok := ci.Metadata["Temp-Url-Key"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_CONTAINER
-				} else if key, ok := ci.Metadata["Temp-Url-Key-2"]; ok && checkhmac([]byte(key), sigb, request.Method, path, expires) {
-					scope = SCOPE_CONTAINER
-				}
-			}
-		}
-		if scope == SCOPE_INVALID {
+	apiReq, account, container, obj := getPathParts(request)
+	if !apiReq || account == "" || container == "" {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	if bh := request.Header.Get("X-Object-Manifest"); bh != "" && (request.Method == "PUT" || request.Method == "POST") {
+		srv.StandardResponse(writer, 400)
+		return
+	}
+
+	sigb, digest, err := parseSignature(sig, tu.digests)
+	if err != nil {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	ipRange := q.Get("temp_url_ip_range")
+	if ipRange != "" && !ipAllowed(request.RemoteAddr, ipRange) {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+
+	path := ""
+	if _, hasPrefix := q["temp_url_prefix"]; hasPrefix {
+		prefix := q.Get("temp_url_prefix")
+		if !strings.HasPrefix(obj, prefix) {
 			srv.StandardResponse(writer, 401)
 			return
 		}
-		ctx.RemoteUser = ".tempurl"
-		ctx.AuthorizeOverride = true
-		ctx.Authorize = func(r *http.Request) bool {
-			ar, a, c, _ := getPathParts(r)
-			return ar && ((scope == SCOPE_ACCOUNT && a == account) || (scope == SCOPE_CONTAINER && c == container))
+		path = fmt.Sprintf("prefix:/v1/%s/%s/%s", account, container, prefix)
+	} else {
+		path = fmt.Sprintf("/v1/%s/%s/%s", account, container, obj)
+	}
+
+	validKey := func(metadata map[string]string) bool {
+		for _, name := range []string{"Temp-Url-Key", "Temp-Url-Key-2"} {
+			if key, ok := metadata[name]; ok && checkhmac([]byte(key), sigb, digest, request.Method, path, expires, ipRange) {
+				return true
+			}
 		}
+		return false
+	}
+	scope := SCOPE_INVALID
+	if ai := ctx.GetAccountInfo(account); ai != nil && validKey(ai.Metadata) {
+		scope = SCOPE_ACCOUNT
+	} else if ci := ctx.C.GetContainerInfo(account, container); ci != nil && validKey(ci.Metadata) {
+		scope = SCOPE_CONTAINER
+	}
+	if scope == SCOPE_INVALID {
+		srv.StandardResponse(writer, 401)
+		return
+	}
+	ctx.RemoteUser = ".tempurl"
+	ctx.AuthorizeOverride = true
+	ctx.Authorize = func(r *http.Request) bool {
+		ar, a, c, _ := getPathParts(r)
+		return ar && a == account && (scope == SCOPE_ACCOUNT || (scope == SCOPE_CONTAINER && c == container))
+	}
 
-		next.ServeHTTP(
-			&tuWriter{
-				ResponseWriter: writer,
-				method:         request.Method,
-				obj:            obj,
-				filename:       q.Get("filename"),
-				expires:        expires.Format(time.RFC1123),
-				inline:         inline,
-			},
-			request,
-		)
-	})
+	tu.next.ServeHTTP(
+		&tuWriter{
+			ResponseWriter: writer,
+			method:         request.Method,
+			obj:            obj,
+			filename:       q.Get("filename"),
+			expires:        expires.Format(time.RFC1123),
+			inline:         inline,
+		},
+		request,
+	)
 }
 
 func NewTempURL(config conf.Section) (func(http.Handler) http.Handler, error) {
+	digests := make(map[string]func() hash.Hash)
+	allowed := []string{}
+	for _, name := range strings.Fields(config.GetDefault("allowed_digests", "sha1 sha256 sha512")) {
+		digest, ok := tempurlDigests[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown tempurl digest %q", name)
+		}
+		digests[name] = digest
+		allowed = append(allowed, name)
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("No tempurl digests allowed")
+	}
 	RegisterInfo("tempurl", map[string]interface{}{
 		"methods":                 []string{"GET", "HEAD", "PUT", "POST", "DELETE"},
 		"incoming_remove_headers": []string{"x-timestamp"},
 		"incoming_allow_headers":  []string{},
 		"outgoing_remove_headers": []string{"x-object-meta-*"}, "outgoing_allow_headers": []string{"x-object-meta-public-*"},
+		"allowed_digests": allowed,
 	})
-	return tempurl, nil
+	return func(next http.Handler) http.Handler {
+		return &tempURL{next: next, digests: digests}
+	}, nil
 }
@@ -17,7 +17,10 @@ package middleware
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"hash"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -26,6 +29,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/troubling/hummingbird/client"
 	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
 )
 
 func TestDispositionFormat(t *testing.T) {
@@ -50,20 +54,85 @@ func TestCheckHmac(t *testing.T) {
 	// test cases generated by example python code
 	sig, err := hex.DecodeString("6deb0c7da21f396f1368681dc0bd57df0d1c4369")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "GET",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac([]byte("mykey"), sig, sha1.New, "GET",
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1ad2301fcc4e525ee0167298c0fbb426e90fb3b1")
 	require.Nil(t, err)
-	require.True(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.True(t, checkhmac([]byte("mykey"), sig, sha1.New, "HEAD",
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
 
 	// sig is actually for a POST, but make sure we can HEAD with it.
 	sig, err = hex.DecodeString("1111111111111111111111111111111111111111")
 	require.Nil(t, err)
-	require.False(t, checkhmac([]byte("mykey"), sig, "HEAD",
-		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC)))
+	require.False(t, checkhmac([]byte("mykey"), sig, sha1.New, "HEAD",
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
+
+	sig, err = hex.DecodeString("54e1a94e4f5594e3687f01c4e0ceca09889fd40ea50d2248e6f28a0c46ef6053")
+	require.Nil(t, err)
+	require.True(t, checkhmac([]byte("mykey"), sig, sha256.New, "GET",
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), ""))
+	require.False(t, checkhmac([]byte("mykey"), sig, sha256.New, "GET",
+		"/v1/AUTH_account/container/object", time.Unix(1493709631, 0).In(time.UTC), "127.0.0.1"))
+}
+
+func TestParseSignature(t *testing.T) {
+	sigb, digest, err := parseSignature("6deb0c7da21f396f1368681dc0bd57df0d1c4369", tempurlDigests)
+	require.Nil(t, err)
+	require.Equal(t, 20, len(sigb))
+	require.Equal(t, sha1.Size, digest().Size())
+
+	_, digest, err = parseSignature("54e1a94e4f5594e3687f01c4e0ceca09889fd40ea50d2248e6f28a0c46ef6053", tempurlDigests)
+	require.Nil(t, err)
+	require.Equal(t, sha256.Size, digest().Size())
+
+	sigb, digest, err = parseSignature("sha512:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow==", tempurlDigests)
+	require.Nil(t, err)
+	require.Equal(t, 64, len(sigb))
+	require.Equal(t, 64, digest().Size())
+
+	// sha1 is disallowed here
+	_, _, err = parseSignature("6deb0c7da21f396f1368681dc0bd57df0d1c4369", map[string]func() hash.Hash{"sha256": sha256.New})
+	require.NotNil(t, err)
+
+	// base64 length doesn't match the named digest
+	_, _, err = parseSignature("sha256:bWVo", tempurlDigests)
+	require.NotNil(t, err)
+
+	_, _, err = parseSignature("md5:bWVo", tempurlDigests)
+	require.NotNil(t, err)
+
+	_, _, err = parseSignature("ABCDEF", tempurlDigests)
+	require.NotNil(t, err)
+}
+
+func TestIpAllowed(t *testing.T) {
+	require.True(t, ipAllowed("192.168.1.20:5555", "192.168.1.0/24"))
+	require.False(t, ipAllowed("192.168.2.20:5555", "192.168.1.0/24"))
+	require.True(t, ipAllowed("10.0.0.1:5555", "10.0.0.1"))
+	require.False(t, ipAllowed("10.0.0.2:5555", "10.0.0.1"))
+	require.True(t, ipAllowed("[::1]:5555", "::1/128"))
+	require.False(t, ipAllowed("10.0.0.1:5555", "garbage"))
+}
+
+func TestNewTempURLDigests(t *testing.T) {
+	_, err := NewTempURL(conf.Section{})
+	require.Nil(t, err)
+	info := serverInfo["tempurl"].(map[string]interface{})
+	require.Equal(t, []string{"sha1", "sha256", "sha512"}, info["allowed_digests"])
+
+	config, err := conf.StringConfig("[filter:tempurl]\nallowed_digests = sha256 sha512\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(config.GetSection("filter:tempurl"))
+	require.Nil(t, err)
+	info = serverInfo["tempurl"].(map[string]interface{})
+	require.Equal(t, []string{"sha256", "sha512"}, info["allowed_digests"])
+
+	config, err = conf.StringConfig("[filter:tempurl]\nallowed_digests = md5\n")
+	require.Nil(t, err)
+	_, err = NewTempURL(config.GetSection("filter:tempurl"))
+	require.NotNil(t, err)
 }
 
 func TestTuWriter(t *testing.T) {
@@ -101,7 +170,7 @@ func TestTempurlMiddlewarePassOptions(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -121,7 +190,7 @@ func TestTempurlMiddlewarePassAlreadyAuthorized(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -136,7 +205,7 @@ func TestTempurlMiddlewarePassNoQuery(t *testing.T) {
 		require.Equal(t, r, request)
 		served = true
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.True(t, served)
 }
@@ -146,7 +215,7 @@ func TestTempurlMiddleware401OnlySig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -156,7 +225,7 @@ func TestTempurlMiddleware401Expired(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -166,7 +235,7 @@ func TestTempurlMiddleware401BadSig(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -176,7 +245,7 @@ func TestTempurlMiddleware401NoContainer(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -187,7 +256,7 @@ func TestTempurlMiddleware400PuttingManifest(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", &ProxyContext{}))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 400, w.Result().StatusCode)
 }
@@ -205,7 +274,7 @@ func TestTempurlMiddleware401NoKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -223,7 +292,7 @@ func TestTempurlMiddleware401WrongKeys(t *testing.T) {
 	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
 	w := httptest.NewRecorder()
 	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 401, w.Result().StatusCode)
 }
@@ -249,7 +318,7 @@ func TestTempurlMiddlewareContainerKey(t *testing.T) {
 		require.True(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a/c/o2", nil)))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -271,7 +340,7 @@ func TestTempurlMiddlewarePath(t *testing.T) {
 		require.True(t, ctx.Authorize(request))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
@@ -298,7 +367,89 @@ func TestTempurlMiddlewareAccountKey(t *testing.T) {
 		require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a2/b/o", nil)))
 		writer.WriteHeader(200)
 	})
-	mid := tempurl(handler)
+	mid := &tempURL{next: handler, digests: tempurlDigests}
 	mid.ServeHTTP(w, r)
 	require.Equal(t, 200, w.Result().StatusCode)
 }
+
+func TestTempurlMiddlewareSha256(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("GET", "/v1/a/c/o?temp_url_sig=f80dab871904cb255498a5605767554fd7e73285e0b1813619036fc32b2b99cf&"+
+			"temp_url_expires=9999999999", nil)
+		ctx := &ProxyContext{
+			C: client.NewProxyClient(nil, nil, map[string]*client.ContainerInfo{
+				"container/a/c": {Metadata: map[string]string{}},
+			}),
+			accountInfoCache: map[string]*AccountInfo{
+				"account/a": {Metadata: map[string]string{"Temp-Url-Key-2": "mykey"}}},
+		}
+		return r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	}
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})
+	w := httptest.NewRecorder()
+	mid := &tempURL{next: handler, digests: tempurlDigests}
+	mid.ServeHTTP(w, newRequest())
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	// the same signature is refused if sha256 isn't an allowed digest
+	w = httptest.NewRecorder()
+	mid = &tempURL{next: handler, digests: map[string]func() hash.Hash{"sha1": sha1.New}}
+	mid.ServeHTTP(w, newRequest())
+	require.Equal(t, 401, w.Result().StatusCode)
+}
+
+func TestTempurlMiddlewareSha512Base64(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/a/c/o?temp_url_sig=sha512:FIJu3WZBgH44HOE0N5_10rmAJNkJXyte17S8IxX4WiZppej43qap48ltM3ImjoJj-D4CxNSpmC988c_bfkd4Ow&"+
+		"temp_url_expires=9999999999", nil)
+	ctx := &ProxyContext{
+		C: client.NewProxyClient(nil, nil, map[string]*client.ContainerInfo{
+			"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+		}),
+		accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+	}
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", ctx))
+	w := httptest.NewRecorder()
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := GetProxyContext(request)
+		require.True(t, ctx.Authorize(request))
+		// container keys don't grant access to the same container name in other accounts
+		require.False(t, ctx.Authorize(httptest.NewRequest("GET", "/v1/a2/c/o", nil)))
+		writer.WriteHeader(200)
+	})
+	mid := &tempURL{next: handler, digests: tempurlDigests}
+	mid.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+}
+
+func TestTempurlMiddlewareIpRange(t *testing.T) {
+	newContext := func() *ProxyContext {
+		return &ProxyContext{
+			C: client.NewProxyClient(nil, nil, map[string]*client.ContainerInfo{
+				"container/a/c": {Metadata: map[string]string{"Temp-Url-Key": "mykey"}},
+			}),
+			accountInfoCache: map[string]*AccountInfo{"account/a": {Metadata: map[string]string{}}},
+		}
+	}
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(200)
+	})
+	mid := &tempURL{next: handler, digests: tempurlDigests}
+	url := "/v1/a/c/o?temp_url_sig=c3b96389cbdb37a3f53444ca30fb5e261d5853569d0569801ddfd547e7c95334&" +
+		"temp_url_expires=9999999999&temp_url_ip_range=192.168.1.0/24"
+
+	r := httptest.NewRequest("GET", url, nil)
+	r.RemoteAddr = "192.168.1.33:45678"
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", newContext()))
+	w := httptest.NewRecorder()
+	mid.ServeHTTP(w, r)
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	r = httptest.NewRequest("GET", url, nil)
+	r.RemoteAddr = "192.168.2.33:45678"
+	r = r.WithContext(context.WithValue(r.Context(), "proxycontext", newContext()))
+	w = httptest.NewRecorder()
+	mid.ServeHTTP(w, r)
+	require.Equal(t, 401, w.Result().StatusCode)
+}
@@ -0,0 +1,230 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// shardRange is the part of a container server's shard range the proxy needs to list a sharded container.
+type shardRange struct {
+	Name  string `json:"name"`
+	Lower string `json:"lower"`
+	Upper string `json:"upper"`
+}
+
+// listingEntry is an object or subdir from a JSON container listing.  The original JSON is kept so it can be passed
+// through untouched.
+type listingEntry struct {
+	raw          json.RawMessage
+	Name         string                            `json:"name"`
+	Hash         string                            `json:"hash"`
+	Bytes        int64                             `json:"bytes"`
+	ContentType  string                            `json:"content_type"`
+	LastModified string                            `json:"last_modified"`
+	Subdir       string                            `json:"subdir"`
+	Meta         containerserver.ObjectListingMeta `json:"meta"`
+}
+
+func parseListing(data []byte) ([]*listingEntry, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	entries := make([]*listingEntry, len(raw))
+	for i, r := range raw {
+		entries[i] = &listingEntry{raw: r}
+		if err := json.Unmarshal(r, entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// shardedListing lists a sharded container by listing the shard containers that could hold matching names, in order,
+// until the limit is reached.  getShard returns a shard container's JSON listing for the given options.
+func shardedListing(ranges []shardRange, options map[string]string, getShard func(name string, options map[string]string) ([]*listingEntry, int)) ([]*listingEntry, int) {
+	limit := 10000
+	if v, err := strconv.Atoi(options["limit"]); err == nil && v > 0 && v < limit {
+		limit = v
+	}
+	marker, endMarker, prefix := options["marker"], options["end_marker"], options["prefix"]
+	reverse := common.LooksTrue(options["reverse"])
+	// a range is before the prefix if it ends before it, and after it if it starts after every name with the prefix.
+	beforePrefix := func(r shardRange) bool { return prefix != "" && r.Upper != "" && r.Upper < prefix }
+	afterPrefix := func(r shardRange) bool {
+		return prefix != "" && r.Lower >= prefix && !strings.HasPrefix(r.Lower, prefix)
+	}
+	entries := []*listingEntry{}
+	for i := range ranges {
+		r := ranges[i]
+		if reverse {
+			r = ranges[len(ranges)-1-i]
+			if (marker != "" && r.Lower >= marker) || afterPrefix(r) {
+				continue
+			}
+			if (endMarker != "" && r.Upper != "" && r.Upper <= endMarker) || beforePrefix(r) {
+				break
+			}
+		} else {
+			if (marker != "" && r.Upper != "" && r.Upper <= marker) || beforePrefix(r) {
+				continue
+			}
+			if (endMarker != "" && r.Lower >= endMarker) || afterPrefix(r) {
+				break
+			}
+		}
+		shardOptions := map[string]string{}
+		for k, v := range options {
+			shardOptions[k] = v
+		}
+		shardOptions["format"] = "json"
+		shardOptions["limit"] = strconv.Itoa(limit - len(entries))
+		shardEntries, status := getShard(r.Name, shardOptions)
+		if status == http.StatusNotFound {
+			continue
+		} else if status/100 != 2 {
+			return nil, status
+		}
+		for _, e := range shardEntries {
+			// a subdir can span shards.
+			if e.Subdir != "" && len(entries) > 0 && entries[len(entries)-1].Subdir == e.Subdir {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) >= limit {
+			entries = entries[:limit]
+			break
+		}
+	}
+	return entries, http.StatusOK
+}
+
+// formatListing renders listing entries the way the container server would have, returning the status, content type
+// and body.
+func formatListing(format, container string, entries []*listingEntry) (int, string, []byte) {
+	switch format {
+	case srv.ListingJSON:
+		raw := make([][]byte, len(entries))
+		for i, e := range entries {
+			raw[i] = e.raw
+		}
+		return http.StatusOK, srv.ListingContentType(format), append(append([]byte("["), bytes.Join(raw, []byte(","))...), ']')
+	case srv.ListingNDJSON:
+		buf := &bytes.Buffer{}
+		for _, e := range entries {
+			buf.Write(e.raw)
+			buf.WriteByte('\n')
+		}
+		if buf.Len() == 0 {
+			return http.StatusNoContent, srv.ListingContentType(format), nil
+		}
+		return http.StatusOK, srv.ListingContentType(format), buf.Bytes()
+	case srv.ListingXML:
+		type subdir struct {
+			XMLName xml.Name `xml:"subdir"`
+			Name2   string   `xml:"name,attr"`
+			Name    string   `xml:"name"`
+		}
+		type listing struct {
+			XMLName xml.Name `xml:"container"`
+			Name    string   `xml:"name,attr"`
+			Objects []interface{}
+		}
+		l := &listing{Name: container}
+		for _, e := range entries {
+			if e.Subdir != "" {
+				l.Objects = append(l.Objects, &subdir{Name2: e.Subdir, Name: e.Subdir})
+			} else {
+				l.Objects = append(l.Objects, &containerserver.ObjectListingRecord{Name: e.Name,
+					LastModified: e.LastModified, Size: e.Bytes, ContentType: e.ContentType, ETag: e.Hash, Metadata: e.Meta})
+			}
+		}
+		output, _ := xml.Marshal(l)
+		return http.StatusOK, srv.ListingContentType(format), append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), output...)
+	default:
+		buf := &bytes.Buffer{}
+		for _, e := range entries {
+			if e.Subdir != "" {
+				buf.WriteString(e.Subdir + "\n")
+			} else {
+				buf.WriteString(e.Name + "\n")
+			}
+		}
+		if buf.Len() == 0 {
+			return http.StatusNoContent, "text/plain; charset=utf-8", nil
+		}
+		return http.StatusOK, "text/plain; charset=utf-8", buf.Bytes()
+	}
+}
+
+// writeShardedListing answers a GET of a sharded container with a listing merged from its shard containers.
+func (server *ProxyServer) writeShardedListing(writer http.ResponseWriter, request *http.Request, ctx *middleware.ProxyContext,
+	account, container string, options map[string]string, rootHeaders http.Header) {
+	rangeHeaders := http.Header{"X-Backend-Record-Type": {"shard"}}
+	resp := ctx.C.GetContainer(account, container, map[string]string{"format": "json"}, rangeHeaders)
+	defer resp.Body.Close()
+	var ranges []shardRange
+	if resp.StatusCode/100 != 2 || json.NewDecoder(resp.Body).Decode(&ranges) != nil {
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	entries, status := shardedListing(ranges, options, func(name string, options map[string]string) ([]*listingEntry, int) {
+		resp := ctx.C.GetContainer(containerserver.ShardAccount(account), name, options, request.Header)
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, resp.StatusCode
+		}
+		data := &bytes.Buffer{}
+		if _, err := data.ReadFrom(resp.Body); err != nil {
+			return nil, http.StatusServiceUnavailable
+		}
+		entries, err := parseListing(data.Bytes())
+		if err != nil {
+			return nil, http.StatusServiceUnavailable
+		}
+		return entries, resp.StatusCode
+	})
+	if status != http.StatusOK {
+		srv.StandardResponse(writer, http.StatusServiceUnavailable)
+		return
+	}
+	format := srv.ListingFormat(request)
+	if format == "" {
+		srv.StandardResponse(writer, http.StatusNotAcceptable)
+		return
+	}
+	status, contentType, body := formatListing(format, container, entries)
+	for k := range rootHeaders {
+		writer.Header().Set(k, rootHeaders.Get(k))
+	}
+	writer.Header().Del("X-Backend-Sharded")
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(status)
+	writer.Write(body)
+}
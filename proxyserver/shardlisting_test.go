@@ -0,0 +1,163 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/containerserver"
+)
+
+// fakeShards lists shard containers out of a fixed set of names, honoring the options the merge passes down.
+func fakeShards(shards map[string][]string, queried *[]string) func(name string, options map[string]string) ([]*listingEntry, int) {
+	return func(name string, options map[string]string) ([]*listingEntry, int) {
+		*queried = append(*queried, name)
+		names, ok := shards[name]
+		if !ok {
+			return nil, http.StatusNotFound
+		}
+		names = append([]string{}, names...)
+		if options["reverse"] == "true" {
+			sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		}
+		limit, _ := strconv.Atoi(options["limit"])
+		var entries []*listingEntry
+		for _, n := range names {
+			if !strings.HasPrefix(n, options["prefix"]) {
+				continue
+			}
+			if options["delimiter"] != "" {
+				if i := strings.Index(n[len(options["prefix"]):], options["delimiter"]); i >= 0 {
+					subdir := n[:len(options["prefix"])+i+1]
+					if len(entries) == 0 || entries[len(entries)-1].Subdir != subdir {
+						entries = append(entries, &listingEntry{Subdir: subdir, raw: []byte(fmt.Sprintf(`{"subdir":%q}`, subdir))})
+					}
+					continue
+				}
+			}
+			entries = append(entries, &listingEntry{Name: n, Bytes: 1, raw: []byte(fmt.Sprintf(`{"name":%q}`, n))})
+			if len(entries) >= limit {
+				break
+			}
+		}
+		return entries, http.StatusOK
+	}
+}
+
+func entryNames(entries []*listingEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		if e.Subdir != "" {
+			names = append(names, e.Subdir)
+		} else {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+func TestShardedListing(t *testing.T) {
+	ranges := []shardRange{{Name: "s0", Upper: "c"}, {Name: "s1", Lower: "c", Upper: "f"}, {Name: "s2", Lower: "f"}}
+	shards := map[string][]string{"s0": {"a", "b/1", "c"}, "s1": {"d", "e/1", "e/2"}, "s2": {"g", "h"}}
+
+	var queried []string
+	entries, status := shardedListing(ranges, map[string]string{}, fakeShards(shards, &queried))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"a", "b/1", "c", "d", "e/1", "e/2", "g", "h"}, entryNames(entries))
+
+	queried = nil
+	entries, _ = shardedListing(ranges, map[string]string{"limit": "4"}, fakeShards(shards, &queried))
+	require.Equal(t, []string{"a", "b/1", "c", "d"}, entryNames(entries))
+	require.Equal(t, []string{"s0", "s1"}, queried)
+
+	queried = nil
+	entries, _ = shardedListing(ranges, map[string]string{"marker": "c", "end_marker": "f"}, fakeShards(shards, &queried))
+	require.Equal(t, []string{"s1"}, queried)
+
+	queried = nil
+	entries, _ = shardedListing(ranges, map[string]string{"prefix": "e"}, fakeShards(shards, &queried))
+	require.Equal(t, []string{"e/1", "e/2"}, entryNames(entries))
+	require.Equal(t, []string{"s1"}, queried)
+
+	queried = nil
+	entries, _ = shardedListing(ranges, map[string]string{"reverse": "true", "limit": "3"}, fakeShards(shards, &queried))
+	require.Equal(t, []string{"h", "g", "e/2"}, entryNames(entries))
+	require.Equal(t, []string{"s2", "s1"}, queried)
+
+	// a subdir spanning shards is only listed once.
+	shards["s2"] = []string{"e/3", "g"}
+	queried = nil
+	entries, _ = shardedListing(ranges, map[string]string{"delimiter": "/"}, fakeShards(shards, &queried))
+	require.Equal(t, []string{"a", "b/", "c", "d", "e/", "g"}, entryNames(entries))
+
+	// a missing shard lists as empty, but a failed one fails the listing.
+	delete(shards, "s1")
+	entries, status = shardedListing(ranges, map[string]string{}, fakeShards(shards, &queried))
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"a", "b/1", "c", "e/3", "g"}, entryNames(entries))
+	_, status = shardedListing(ranges, map[string]string{}, func(name string, options map[string]string) ([]*listingEntry, int) {
+		return nil, http.StatusServiceUnavailable
+	})
+	require.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestFormatListing(t *testing.T) {
+	entries, err := parseListing([]byte(`[{"name":"a","last_modified":"2017-01-01T00:00:00.000000","bytes":3,"content_type":"text/plain","hash":"abc"},{"subdir":"b/"}]`))
+	require.Nil(t, err)
+
+	status, contentType, body := formatListing("text", "c", entries)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "text/plain; charset=utf-8", contentType)
+	require.Equal(t, "a\nb/\n", string(body))
+
+	_, contentType, body = formatListing("json", "c", entries)
+	require.Equal(t, "application/json; charset=utf-8", contentType)
+	require.Equal(t, `[{"name":"a","last_modified":"2017-01-01T00:00:00.000000","bytes":3,"content_type":"text/plain","hash":"abc"},{"subdir":"b/"}]`, string(body))
+
+	_, contentType, body = formatListing("ndjson", "c", entries)
+	require.Equal(t, "application/x-ndjson; charset=utf-8", contentType)
+	require.Equal(t, "{\"name\":\"a\",\"last_modified\":\"2017-01-01T00:00:00.000000\",\"bytes\":3,\"content_type\":\"text/plain\",\"hash\":\"abc\"}\n{\"subdir\":\"b/\"}\n", string(body))
+
+	_, contentType, body = formatListing("xml", "c", entries)
+	require.Equal(t, "application/xml; charset=utf-8", contentType)
+	require.Equal(t, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c\"><object><name>a</name>"+
+		"<last_modified>2017-01-01T00:00:00.000000</last_modified><bytes>3</bytes><content_type>text/plain</content_type>"+
+		"<hash>abc</hash></object><subdir name=\"b/\"><name>b/</name></subdir></container>", string(body))
+
+	status, _, body = formatListing("text", "c", nil)
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, 0, len(body))
+	status, _, _ = formatListing("ndjson", "c", nil)
+	require.Equal(t, http.StatusNoContent, status)
+}
+
+func TestFormatListingMeta(t *testing.T) {
+	entries, err := parseListing([]byte(`[{"name":"a","last_modified":"2017-01-01T00:00:00.000000","bytes":3,"content_type":"text/plain","hash":"abc","meta":{"X-Object-Meta-Size":"L","X-Object-Meta-Color":"blue"}}]`))
+	require.Nil(t, err)
+	require.Equal(t, containerserver.ObjectListingMeta{"X-Object-Meta-Color": "blue", "X-Object-Meta-Size": "L"}, entries[0].Meta)
+
+	_, _, body := formatListing("xml", "c", entries)
+	require.Equal(t, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<container name=\"c\"><object><name>a</name>"+
+		"<last_modified>2017-01-01T00:00:00.000000</last_modified><bytes>3</bytes><content_type>text/plain</content_type>"+
+		"<hash>abc</hash><meta name=\"X-Object-Meta-Color\">blue</meta><meta name=\"X-Object-Meta-Size\">L</meta>"+
+		"</object></container>", string(body))
+}
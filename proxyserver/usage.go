@@ -0,0 +1,160 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/common/srv"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+// usageConcurrency is how many account server devices a usage report queries at once.
+const usageConcurrency = 8
+
+// resellerUsage is the total usage of the accounts on a reseller prefix.
+type resellerUsage struct {
+	Prefix         string                       `json:"prefix"`
+	AccountCount   int64                        `json:"account_count"`
+	ContainerCount int64                        `json:"container_count"`
+	ObjectCount    int64                        `json:"object_count"`
+	BytesUsed      int64                        `json:"bytes_used"`
+	Policies       []*accountserver.PolicyUsage `json:"policies"`
+	// FailedDevices are the account server devices that couldn't report; their accounts may be missing or stale.
+	FailedDevices []string `json:"failed_devices"`
+}
+
+// usageReport is a reseller usage report, cached or still being gathered.
+type usageReport struct {
+	done    chan struct{}
+	summary *resellerUsage
+	expires time.Time
+}
+
+// usageCache keeps reseller usage reports for a while, so reseller clients polling for usage don't have every account
+// server crawl its account databases each time.  Only one report on a prefix is gathered at once; requests for it
+// meanwhile wait for that one.
+type usageCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	reports map[string]*usageReport
+}
+
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{ttl: ttl, reports: map[string]*usageReport{}}
+}
+
+// get returns the usage report on a prefix, gathering a new one if there isn't a fresh one.
+func (c *usageCache) get(prefix string, gather func() *resellerUsage) *resellerUsage {
+	c.Lock()
+	now := time.Now()
+	report := c.reports[prefix]
+	// a report that's still being gathered has no expiry yet.
+	if report != nil && (report.expires.IsZero() || now.Before(report.expires)) {
+		c.Unlock()
+		<-report.done
+		return report.summary
+	}
+	for p, r := range c.reports {
+		if !r.expires.IsZero() && now.After(r.expires) {
+			delete(c.reports, p)
+		}
+	}
+	report = &usageReport{done: make(chan struct{})}
+	c.reports[prefix] = report
+	c.Unlock()
+	summary := gather()
+	c.Lock()
+	report.summary = summary
+	report.expires = time.Now().Add(c.ttl)
+	c.Unlock()
+	close(report.done)
+	return summary
+}
+
+// summarizeUsage totals the accounts' usage, in all and by storage policy.
+func summarizeUsage(prefix string, usages []*accountserver.AccountUsage, failed []string) *resellerUsage {
+	summary := &resellerUsage{Prefix: prefix, Policies: []*accountserver.PolicyUsage{}, FailedDevices: failed}
+	policies := map[int]*accountserver.PolicyUsage{}
+	for _, usage := range usages {
+		summary.AccountCount++
+		summary.ContainerCount += usage.ContainerCount
+		summary.ObjectCount += usage.ObjectCount
+		summary.BytesUsed += usage.BytesUsed
+		for _, p := range usage.Policies {
+			total := policies[p.StoragePolicyIndex]
+			if total == nil {
+				total = &accountserver.PolicyUsage{Policy: p.Policy, StoragePolicyIndex: p.StoragePolicyIndex}
+				policies[p.StoragePolicyIndex] = total
+				summary.Policies = append(summary.Policies, total)
+			}
+			total.ContainerCount += p.ContainerCount
+			total.ObjectCount += p.ObjectCount
+			total.BytesUsed += p.BytesUsed
+		}
+	}
+	sort.Slice(summary.Policies, func(i, j int) bool {
+		return summary.Policies[i].StoragePolicyIndex < summary.Policies[j].StoragePolicyIndex
+	})
+	if summary.FailedDevices == nil {
+		summary.FailedDevices = []string{}
+	}
+	return summary
+}
+
+// ResellerUsageHandler handles GET /v1/.usage?prefix=PREFIX, totaling the usage of every account whose name starts
+// with the reseller prefix. Only reseller admins may use it, and it isn't quick: every account server crawls its
+// account databases to answer.
+func (server *ProxyServer) ResellerUsageHandler(writer http.ResponseWriter, request *http.Request) {
+	ctx := middleware.GetProxyContext(request)
+	if ctx == nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	if ctx.Authorize == nil || !ctx.Authorize(request) || !ctx.ResellerRequest {
+		if ctx.RemoteUser != "" {
+			srv.StandardResponse(writer, 403)
+			return
+		}
+		srv.StandardResponse(writer, 401)
+		return
+	}
+	prefix := request.URL.Query().Get("prefix")
+	if prefix == "" {
+		srv.SimpleErrorResponse(writer, http.StatusBadRequest, "A reseller prefix is required")
+		return
+	}
+	summary := server.usageCache.get(prefix, func() *resellerUsage {
+		usages, failed := accountserver.GatherUsage(server.usageClient, server.proxyDirectClient.AccountRing, prefix,
+			usageConcurrency)
+		return summarizeUsage(prefix, usages, failed)
+	})
+	output, err := json.Marshal(summary)
+	if err != nil {
+		srv.StandardResponse(writer, 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(output)
+}
@@ -0,0 +1,116 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package proxyserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/proxyserver/middleware"
+)
+
+func TestSummarizeUsage(t *testing.T) {
+	usages := []*accountserver.AccountUsage{
+		{Account: "AUTH_a", ContainerCount: 2, ObjectCount: 3, BytesUsed: 30, Policies: []*accountserver.PolicyUsage{
+			{Policy: "silver", StoragePolicyIndex: 1, ContainerCount: 1, ObjectCount: 1, BytesUsed: 10},
+			{Policy: "gold", StoragePolicyIndex: 0, ContainerCount: 1, ObjectCount: 2, BytesUsed: 20},
+		}},
+		{Account: "AUTH_b", ContainerCount: 1, ObjectCount: 4, BytesUsed: 40, Policies: []*accountserver.PolicyUsage{
+			{Policy: "silver", StoragePolicyIndex: 1, ContainerCount: 1, ObjectCount: 4, BytesUsed: 40},
+		}},
+		{Account: "AUTH_c", Policies: []*accountserver.PolicyUsage{}},
+	}
+	summary := summarizeUsage("AUTH_", usages, nil)
+	require.Equal(t, &resellerUsage{
+		Prefix:         "AUTH_",
+		AccountCount:   3,
+		ContainerCount: 3,
+		ObjectCount:    7,
+		BytesUsed:      70,
+		Policies: []*accountserver.PolicyUsage{
+			{Policy: "gold", StoragePolicyIndex: 0, ContainerCount: 1, ObjectCount: 2, BytesUsed: 20},
+			{Policy: "silver", StoragePolicyIndex: 1, ContainerCount: 2, ObjectCount: 5, BytesUsed: 50},
+		},
+		FailedDevices: []string{},
+	}, summary)
+
+	summary = summarizeUsage("AUTH_", nil, []string{"127.0.0.1:6012/sda"})
+	require.Equal(t, int64(0), summary.AccountCount)
+	require.Equal(t, []*accountserver.PolicyUsage{}, summary.Policies)
+	require.Equal(t, []string{"127.0.0.1:6012/sda"}, summary.FailedDevices)
+}
+
+func TestResellerUsageHandlerAuth(t *testing.T) {
+	server := &ProxyServer{}
+	serve := func(ctx *middleware.ProxyContext, path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), "proxycontext", ctx))
+		rsp := httptest.NewRecorder()
+		server.ResellerUsageHandler(rsp, req)
+		return rsp.Code
+	}
+	allow := func(r *http.Request) bool { return true }
+
+	require.Equal(t, 401, serve(&middleware.ProxyContext{}, "/v1/.usage?prefix=AUTH_"))
+	require.Equal(t, 401, serve(&middleware.ProxyContext{Authorize: func(r *http.Request) bool { return false }},
+		"/v1/.usage?prefix=AUTH_"))
+	require.Equal(t, 403, serve(&middleware.ProxyContext{Authorize: allow, RemoteUser: "test:tester"},
+		"/v1/.usage?prefix=AUTH_"))
+	require.Equal(t, 400, serve(&middleware.ProxyContext{Authorize: allow, RemoteUser: "admin", ResellerRequest: true},
+		"/v1/.usage"))
+}
+
+func TestUsageCache(t *testing.T) {
+	cache := newUsageCache(time.Hour)
+	var lock sync.Mutex
+	gathered := 0
+	release := make(chan struct{})
+	gather := func() *resellerUsage {
+		<-release
+		lock.Lock()
+		gathered++
+		lock.Unlock()
+		return &resellerUsage{Prefix: "AUTH_"}
+	}
+	// requests made while a report's being gathered all wait on that one.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, "AUTH_", cache.get("AUTH_", gather).Prefix)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(t, 1, gathered)
+	cache.get("AUTH_", gather)
+	require.Equal(t, 1, gathered)
+	cache.get("OTHER_", gather)
+	require.Equal(t, 2, gathered)
+
+	// an expired report is gathered again.
+	cache.reports["AUTH_"].expires = time.Now().Add(-time.Second)
+	cache.get("AUTH_", gather)
+	require.Equal(t, 3, gathered)
+}
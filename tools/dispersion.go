@@ -0,0 +1,451 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+const dispersionPrefix = "dispersion_"
+
+// dispersionObjectContainer is the container holding a policy's dispersion objects; policy 0 uses the same name
+// swift-dispersion-populate does.
+func dispersionObjectContainer(policy int) string {
+	if policy == 0 {
+		return dispersionPrefix + "objects"
+	}
+	return fmt.Sprintf("%sobjects_%d", dispersionPrefix, policy)
+}
+
+// partitionsWanted is how many partitions of r a coverage percentage calls for.
+func partitionsWanted(r ring.Ring, coverage float64) int {
+	return int(math.Ceil(float64(r.PartitionCount()) * math.Min(coverage, 100) / 100))
+}
+
+// coveringNames returns names made from format and a counter, chosen so each lands in a different partition, until
+// wanted partitions are covered.  part maps a name to its partition.
+func coveringNames(format string, wanted int, part func(name string) uint64) []string {
+	covered := map[uint64]bool{}
+	var names []string
+	// the odds of a new name landing on an uncovered partition fall as coverage grows, so allow plenty of tries
+	for i := 0; len(names) < wanted && i < wanted*100; i++ {
+		name := fmt.Sprintf(format, i)
+		if p := part(name); !covered[p] {
+			covered[p] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// runConcurrently calls work for each name with up to concurrency calls at once, returning how many failed.
+func runConcurrently(names []string, concurrency int, work func(name string) bool) int {
+	failures := 0
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	queue := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				if !work(name) {
+					lock.Lock()
+					failures++
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+	return failures
+}
+
+func closeResponse(resp *http.Response) int {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// populateContainers creates containers spread across coverage percent of the container ring's partitions.
+func populateContainers(c client.Client, account string, containerRing ring.Ring, coverage float64, concurrency int) (int, error) {
+	names := coveringNames(dispersionPrefix+"%d", partitionsWanted(containerRing, coverage), func(name string) uint64 {
+		return containerRing.GetPartition(account, name, "")
+	})
+	failures := runConcurrently(names, concurrency, func(name string) bool {
+		return closeResponse(c.PutContainer(name, nil))/100 == 2
+	})
+	if failures > 0 {
+		return len(names) - failures, fmt.Errorf("%d of %d container PUTs failed", failures, len(names))
+	}
+	return len(names), nil
+}
+
+// populateObjects creates the policy's dispersion container and objects in it spread across coverage percent of
+// the policy's object ring partitions.
+func populateObjects(c client.Client, account string, policy *conf.Policy, objectRing ring.Ring, coverage float64, concurrency int) (int, error) {
+	container := dispersionObjectContainer(policy.Index)
+	if status := closeResponse(c.PutContainer(container, map[string]string{"X-Storage-Policy": policy.Name})); status/100 != 2 {
+		return 0, fmt.Errorf("PUT of container %s returned %d", container, status)
+	}
+	names := coveringNames(dispersionPrefix+"%d", partitionsWanted(objectRing, coverage), func(name string) uint64 {
+		return objectRing.GetPartition(account, container, name)
+	})
+	failures := runConcurrently(names, concurrency, func(name string) bool {
+		return closeResponse(c.PutObject(container, name, nil, bytes.NewReader([]byte(name))))/100 == 2
+	})
+	if failures > 0 {
+		return len(names) - failures, fmt.Errorf("%d of %d object PUTs in %s failed", failures, len(names), container)
+	}
+	return len(names), nil
+}
+
+// DispersionStats summarizes how many copies of the sampled containers or objects were found on their primaries.
+type DispersionStats struct {
+	// Queried is the number of containers or objects checked.
+	Queried        int     `json:"queried"`
+	CopiesExpected int     `json:"copies_expected"`
+	CopiesFound    int     `json:"copies_found"`
+	PctFound       float64 `json:"pct_found"`
+	// Missing counts the sampled items missing each number of copies; an item with no copies found counts under
+	// its replica count.
+	Missing map[int]int `json:"missing"`
+	// Errors counts primaries that couldn't be reached or gave a response other than success or not found.
+	Errors int `json:"errors"`
+	// PctPartitions is the percentage of the ring's partitions the sample covers.
+	PctPartitions float64 `json:"pct_partitions"`
+}
+
+// DispersionReport is the output of "hummingbird dispersion report".
+type DispersionReport struct {
+	Container *DispersionStats `json:"container,omitempty"`
+	// Object holds the stats for each storage policy, by policy name.
+	Object map[string]*DispersionStats `json:"object,omitempty"`
+}
+
+// dispersionChecker HEADs each replica of an account's containers or objects directly on its primary devices.
+type dispersionChecker struct {
+	client      *http.Client
+	account     string
+	concurrency int
+}
+
+// headReplica sends a HEAD straight to one device, returning whether the replica is there and whether the
+// device failed to give a clear answer.
+func (d *dispersionChecker) headReplica(dev *ring.Device, partition uint64, itemPath string, policy int) (found bool, failed bool) {
+	req, err := http.NewRequest("HEAD", fmt.Sprintf("http://%s:%d/%s/%d/%s", dev.Ip, dev.Port, dev.Device, partition, itemPath), nil)
+	if err != nil {
+		return false, true
+	}
+	req.Header.Set("X-Backend-Storage-Policy-Index", strconv.Itoa(policy))
+	req.Header.Set("User-Agent", "hummingbird-dispersion")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, true
+	}
+	status := closeResponse(resp)
+	return status/100 == 2, status/100 != 2 && status != http.StatusNotFound
+}
+
+// check HEADs every replica of the named items and tallies the results.  container is "" to check containers.
+func (d *dispersionChecker) check(r ring.Ring, container string, names []string, policy int) *DispersionStats {
+	stats := &DispersionStats{Missing: map[int]int{}}
+	partitions := map[uint64]bool{}
+	lock := sync.Mutex{}
+	runConcurrently(names, d.concurrency, func(name string) bool {
+		var partition uint64
+		itemPath := common.Urlencode(d.account) + "/" + common.Urlencode(name)
+		if container == "" {
+			partition = r.GetPartition(d.account, name, "")
+		} else {
+			partition = r.GetPartition(d.account, container, name)
+			itemPath = common.Urlencode(d.account) + "/" + common.Urlencode(container) + "/" + common.Urlencode(name)
+		}
+		nodes := r.GetNodes(partition)
+		found, errors := 0, 0
+		for _, dev := range nodes {
+			ok, failed := d.headReplica(dev, partition, itemPath, policy)
+			if ok {
+				found++
+			}
+			if failed {
+				errors++
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		partitions[partition] = true
+		stats.Queried++
+		stats.CopiesExpected += len(nodes)
+		stats.CopiesFound += found
+		stats.Errors += errors
+		if found < len(nodes) {
+			stats.Missing[len(nodes)-found]++
+		}
+		return true
+	})
+	if stats.CopiesExpected > 0 {
+		stats.PctFound = 100 * float64(stats.CopiesFound) / float64(stats.CopiesExpected)
+	}
+	if count := r.PartitionCount(); count > 0 {
+		stats.PctPartitions = 100 * float64(len(partitions)) / float64(count)
+	}
+	return stats
+}
+
+// listContainers returns the account's dispersion containers, leaving out the object containers.
+func listContainers(c client.Client) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		records, resp := c.GetAccount(marker, "", 10000, dispersionPrefix, "", "", nil)
+		if status := closeResponse(resp); status/100 != 2 {
+			return nil, fmt.Errorf("account listing returned %d", status)
+		}
+		if len(records) == 0 {
+			return names, nil
+		}
+		for _, record := range records {
+			if !strings.HasPrefix(record.Name, dispersionPrefix+"objects") {
+				names = append(names, record.Name)
+			}
+		}
+		marker = records[len(records)-1].Name
+	}
+}
+
+// listObjects returns the objects in a dispersion object container.
+func listObjects(c client.Client, container string) ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		records, resp := c.GetContainer(container, marker, "", 10000, "", "", "", nil)
+		if status := closeResponse(resp); status/100 != 2 {
+			return nil, fmt.Errorf("listing of %s returned %d", container, status)
+		}
+		if len(records) == 0 {
+			return names, nil
+		}
+		for _, record := range records {
+			names = append(names, record.Name)
+		}
+		marker = records[len(records)-1].Name
+	}
+}
+
+func printDispersionStats(w io.Writer, kind string, stats *DispersionStats) {
+	fmt.Fprintf(w, "Queried %d %ss for dispersion reporting, %d errors\n", stats.Queried, kind, stats.Errors)
+	var missing []int
+	for copies := range stats.Missing {
+		missing = append(missing, copies)
+	}
+	sort.Ints(missing)
+	for _, copies := range missing {
+		fmt.Fprintf(w, "There were %d %ss missing %d copies.\n", stats.Missing[copies], kind, copies)
+	}
+	fmt.Fprintf(w, "%.02f%% of %s copies found (%d of %d)\n", stats.PctFound, kind, stats.CopiesFound, stats.CopiesExpected)
+	fmt.Fprintf(w, "Sample represents %.02f%% of the %s partition space\n", stats.PctPartitions, kind)
+}
+
+func dispersionUsage(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "USAGE: hummingbird dispersion [populate|report] [ARGS]")
+	fmt.Fprintln(os.Stderr, "  populate creates containers and objects spread across the rings' partitions;")
+	fmt.Fprintln(os.Stderr, "  report checks how many copies of them are on their primary devices.")
+	fmt.Fprintln(os.Stderr, "The configuration file should look something like:")
+	fmt.Fprintln(os.Stderr, "    [dispersion]")
+	fmt.Fprintln(os.Stderr, "    auth_url = http://localhost:8080/auth/v1.0")
+	fmt.Fprintln(os.Stderr, "    auth_user = test:tester")
+	fmt.Fprintln(os.Stderr, "    auth_key = testing")
+	fmt.Fprintln(os.Stderr, "    dispersion_coverage = 1.0")
+	fmt.Fprintln(os.Stderr, "    container_populate = yes")
+	fmt.Fprintln(os.Stderr, "    object_populate = yes")
+	fmt.Fprintln(os.Stderr, "    concurrency = 25")
+	fmt.Fprintln(os.Stderr, "    allow_insecure_auth_cert = no")
+	flags.PrintDefaults()
+}
+
+// Dispersion implements "hummingbird dispersion populate" and "hummingbird dispersion report".
+func Dispersion(args []string) {
+	flags := flag.NewFlagSet("dispersion", flag.ExitOnError)
+	configFile := flags.String("c", "/etc/hummingbird/dispersion.conf", "Config file to use")
+	asJSON := flags.Bool("json", false, "report: output JSON")
+	flags.Usage = func() { dispersionUsage(flags) }
+	if len(args) < 1 || (args[0] != "populate" && args[0] != "report") {
+		flags.Usage()
+		os.Exit(1)
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+
+	dispersionConf, err := conf.LoadConfig(*configFile)
+	if err != nil {
+		if dispersionConf, err = conf.LoadConfig("/etc/swift/dispersion.conf"); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to load", *configFile)
+			os.Exit(1)
+		}
+	}
+	section := dispersionConf.GetSection("dispersion")
+	authURL := section.GetDefault("auth_url", "http://localhost:8080/auth/v1.0")
+	authUser := section.GetDefault("auth_user", "test:tester")
+	authKey := section.GetDefault("auth_key", "testing")
+	coverage := section.GetFloat("dispersion_coverage", 1.0)
+	concurrency := int(section.GetInt("concurrency", 25))
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var c client.Client
+	var resp *http.Response
+	if section.GetBool("allow_insecure_auth_cert", false) {
+		c, resp = client.NewInsecureClient("", authUser, "", authKey, "", authURL, false)
+	} else {
+		c, resp = client.NewClient("", authUser, "", authKey, "", authURL, false)
+	}
+	if resp != nil {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		fmt.Fprintln(os.Stderr, "Unable to authenticate:", string(msg))
+		os.Exit(1)
+	}
+	storageURL, err := url.Parse(c.GetURL())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid storage url:", c.GetURL())
+		os.Exit(1)
+	}
+	account := path.Base(storageURL.Path)
+
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	containerRing, err := ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load container ring:", err)
+		os.Exit(1)
+	}
+	var policies []*conf.Policy
+	for _, policy := range conf.LoadPolicies() {
+		if !policy.Deprecated {
+			policies = append(policies, policy)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Index < policies[j].Index })
+
+	failed := false
+	if command == "populate" {
+		if section.GetBool("container_populate", true) {
+			start := time.Now()
+			count, err := populateContainers(c, account, containerRing, coverage, concurrency)
+			fmt.Printf("Created %d containers for dispersion reporting, %.1fs\n", count, time.Since(start).Seconds())
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				failed = true
+			}
+		}
+		if section.GetBool("object_populate", true) {
+			for _, policy := range policies {
+				objectRing, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to load object ring for policy %s: %v\n", policy.Name, err)
+					failed = true
+					continue
+				}
+				start := time.Now()
+				count, err := populateObjects(c, account, policy, objectRing, coverage, concurrency)
+				fmt.Printf("Created %d objects in policy %s for dispersion reporting, %.1fs\n", count, policy.Name, time.Since(start).Seconds())
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					failed = true
+				}
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	checker := &dispersionChecker{client: &http.Client{Timeout: 30 * time.Second}, account: account, concurrency: concurrency}
+	report := &DispersionReport{Object: map[string]*DispersionStats{}}
+	if names, err := listContainers(c); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to list dispersion containers:", err)
+		failed = true
+	} else {
+		report.Container = checker.check(containerRing, "", names, 0)
+	}
+	for _, policy := range policies {
+		objectRing, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to load object ring for policy %s: %v\n", policy.Name, err)
+			failed = true
+			continue
+		}
+		container := dispersionObjectContainer(policy.Index)
+		names, err := listObjects(c, container)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list dispersion objects for policy %s: %v\n", policy.Name, err)
+			failed = true
+			continue
+		}
+		report.Object[policy.Name] = checker.check(objectRing, container, names, policy.Index)
+	}
+	if *asJSON {
+		data, err := json.Marshal(report)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		if report.Container != nil {
+			printDispersionStats(os.Stdout, "container", report.Container)
+		}
+		for _, policy := range policies {
+			if stats := report.Object[policy.Name]; stats != nil {
+				fmt.Printf("\nPolicy %s:\n", policy.Name)
+				printDispersionStats(os.Stdout, "object", stats)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
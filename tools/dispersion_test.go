@@ -0,0 +1,196 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/client"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// fakeDispersionClient is the part of a user client the dispersion tools use.
+type fakeDispersionClient struct {
+	client.Client
+	lock       sync.Mutex
+	containers map[string]map[string]string
+	objects    map[string][]string
+}
+
+func newFakeDispersionClient() *fakeDispersionClient {
+	return &fakeDispersionClient{containers: map[string]map[string]string{}, objects: map[string][]string{}}
+}
+
+func (c *fakeDispersionClient) PutContainer(container string, headers map[string]string) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.containers[container] = headers
+	return client.ResponseStub(http.StatusCreated, "")
+}
+
+func (c *fakeDispersionClient) PutObject(container string, obj string, headers map[string]string, src io.Reader) *http.Response {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.objects[container] = append(c.objects[container], obj)
+	return client.ResponseStub(http.StatusCreated, "")
+}
+
+func (c *fakeDispersionClient) GetAccount(marker string, endMarker string, limit int, prefix string, delimiter string, reverse string, headers map[string]string) ([]client.ContainerRecord, *http.Response) {
+	var records []client.ContainerRecord
+	if marker == "" {
+		for name := range c.containers {
+			records = append(records, client.ContainerRecord{Name: name})
+		}
+	}
+	return records, client.ResponseStub(http.StatusOK, "")
+}
+
+func (c *fakeDispersionClient) GetContainer(container string, marker string, endMarker string, limit int, prefix string, delimiter string, reverse string, headers map[string]string) ([]client.ObjectRecord, *http.Response) {
+	var records []client.ObjectRecord
+	if marker == "" {
+		for _, name := range c.objects[container] {
+			records = append(records, client.ObjectRecord{Name: name})
+		}
+	}
+	return records, client.ResponseStub(http.StatusOK, "")
+}
+
+// fakeStorage answers HEADs for the device paths it's been told about.
+type fakeStorage struct {
+	lock  sync.Mutex
+	paths map[string]bool
+}
+
+func (s *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r.Header.Get("X-Backend-Storage-Policy-Index") == "" {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if s.paths[r.URL.Path] {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// testDispersionRing writes and loads a three replica ring whose devices are all served by server.
+func testDispersionRing(t *testing.T, dir string, server *httptest.Server) ring.Ring {
+	host, portStr, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	require.Nil(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.Nil(t, err)
+	b, err := ring.NewRingBuilder(4, 3, 0)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := b.AddDevice(ring.Device{Region: 1, Zone: i, Ip: host, Port: port, Device: fmt.Sprintf("sd%c", 'a'+i), Weight: 1})
+		require.Nil(t, err)
+	}
+	_, err = b.Rebalance(1, time.Now())
+	require.Nil(t, err)
+	path := filepath.Join(dir, "test.ring.gz")
+	require.Nil(t, b.WriteRingFile(path))
+	r, err := ring.LoadRing(path, "prefix", "suffix")
+	require.Nil(t, err)
+	return r
+}
+
+func TestDispersionPopulateAndReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	storage := &fakeStorage{paths: map[string]bool{}}
+	server := httptest.NewServer(storage)
+	defer server.Close()
+	r := testDispersionRing(t, dir, server)
+	c := newFakeDispersionClient()
+
+	count, err := populateContainers(c, "AUTH_test", r, 100, 4)
+	require.Nil(t, err)
+	require.Equal(t, 16, count)
+	policy := &conf.Policy{Index: 1, Name: "gold"}
+	count, err = populateObjects(c, "AUTH_test", policy, r, 50, 4)
+	require.Nil(t, err)
+	require.Equal(t, 8, count)
+	require.Equal(t, map[string]string{"X-Storage-Policy": "gold"}, c.containers["dispersion_objects_1"])
+
+	containers, err := listContainers(c)
+	require.Nil(t, err)
+	require.Equal(t, 16, len(containers))
+	objects, err := listObjects(c, "dispersion_objects_1")
+	require.Nil(t, err)
+	require.Equal(t, 8, len(objects))
+
+	// every container is fully replicated; one object is missing a copy and another is missing two
+	for _, name := range containers {
+		part := r.GetPartition("AUTH_test", name, "")
+		for _, dev := range r.GetNodes(part) {
+			storage.paths[fmt.Sprintf("/%s/%d/AUTH_test/%s", dev.Device, part, name)] = true
+		}
+	}
+	for i, name := range objects {
+		part := r.GetPartition("AUTH_test", "dispersion_objects_1", name)
+		for replica, dev := range r.GetNodes(part) {
+			if (i == 0 && replica == 0) || (i == 1 && replica > 0) {
+				continue
+			}
+			storage.paths[fmt.Sprintf("/%s/%d/AUTH_test/dispersion_objects_1/%s", dev.Device, part, name)] = true
+		}
+	}
+	checker := &dispersionChecker{client: &http.Client{}, account: "AUTH_test", concurrency: 4}
+	stats := checker.check(r, "", containers, 0)
+	require.Equal(t, &DispersionStats{Queried: 16, CopiesExpected: 48, CopiesFound: 48, PctFound: 100, Missing: map[int]int{},
+		PctPartitions: 100}, stats)
+	stats = checker.check(r, "dispersion_objects_1", objects, 1)
+	require.Equal(t, 8, stats.Queried)
+	require.Equal(t, 24, stats.CopiesExpected)
+	require.Equal(t, 21, stats.CopiesFound)
+	require.InDelta(t, 87.5, stats.PctFound, 0.001)
+	require.Equal(t, map[int]int{1: 1, 2: 1}, stats.Missing)
+	require.Equal(t, 50.0, stats.PctPartitions)
+	require.Equal(t, 0, stats.Errors)
+
+	// unreachable devices count as errors
+	server.Close()
+	stats = checker.check(r, "", containers[:1], 0)
+	require.Equal(t, 0, stats.CopiesFound)
+	require.Equal(t, 3, stats.Errors)
+	require.Equal(t, map[int]int{3: 1}, stats.Missing)
+}
+
+func TestCoveringNames(t *testing.T) {
+	names := coveringNames("n%d", 4, func(name string) uint64 {
+		i, _ := strconv.Atoi(strings.TrimPrefix(name, "n"))
+		return uint64(i % 4)
+	})
+	require.Equal(t, []string{"n0", "n1", "n2", "n3"}, names)
+	// gives up rather than looping forever when partitions can't be covered
+	names = coveringNames("n%d", 4, func(name string) uint64 { return 0 })
+	require.Equal(t, []string{"n0"}, names)
+}
@@ -0,0 +1,502 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/common"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+// nameHash is the md5 of a hash path, as used to name on-disk directories.
+func nameHash(hashPathPrefix, hashPathSuffix, account, container, obj string) string {
+	path := "/" + account
+	if container != "" {
+		path += "/" + container
+		if obj != "" {
+			path += "/" + obj
+		}
+	}
+	h := md5.Sum([]byte(hashPathPrefix + path + hashPathSuffix))
+	return hex.EncodeToString(h[:])
+}
+
+// findPolicy looks a policy up by index, name or alias; an empty name is the default policy.
+func findPolicy(policies conf.PolicyList, name string) *conf.Policy {
+	if name == "" {
+		return policies[policies.Default()]
+	}
+	if index, err := strconv.Atoi(name); err == nil {
+		return policies[index]
+	}
+	for _, p := range policies {
+		if strings.EqualFold(p.Name, name) {
+			return p
+		}
+		for _, alias := range p.Aliases {
+			if strings.EqualFold(alias, name) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+func policyName(policies conf.PolicyList, index int) string {
+	if p := policies[index]; p != nil {
+		return fmt.Sprintf("%s (%d)", p.Name, index)
+	}
+	return fmt.Sprintf("unknown (%d)", index)
+}
+
+// NodeLocation is one device holding a replica of an item.
+type NodeLocation struct {
+	Device  *ring.Device
+	Handoff bool
+	// Path is the item's directory on the device's server.
+	Path string
+}
+
+// NodesReport is where the ring places an account, container or object.
+type NodesReport struct {
+	Type      string
+	Account   string
+	Container string
+	Object    string
+	Policy    *conf.Policy
+	Partition uint64
+	Hash      string
+	Nodes     []NodeLocation
+}
+
+// nodesReport locates the item in r, listing its primaries and up to handoffs handoff nodes, with on-disk paths
+// under driveRoot.
+func nodesReport(r ring.Ring, policy *conf.Policy, account, container, obj string, handoffs int, driveRoot, hashPathPrefix, hashPathSuffix string) *NodesReport {
+	report := &NodesReport{Account: account, Container: container, Object: obj, Policy: policy}
+	report.Type = "account"
+	if obj != "" {
+		report.Type = "object"
+	} else if container != "" {
+		report.Type = "container"
+	}
+	report.Partition = r.GetPartition(account, container, obj)
+	report.Hash = nameHash(hashPathPrefix, hashPathSuffix, account, container, obj)
+	partition := strconv.FormatUint(report.Partition, 10)
+	location := func(dev *ring.Device, handoff bool) NodeLocation {
+		var path string
+		if report.Type == "object" {
+			path = objectserver.ObjHashDir(map[string]string{"account": account, "container": container, "obj": obj,
+				"device": dev.Device, "partition": partition}, driveRoot, hashPathPrefix, hashPathSuffix, policy.Index)
+		} else {
+			path = filepath.Join(driveRoot, dev.Device, report.Type+"s", partition, report.Hash[29:32], report.Hash)
+		}
+		return NodeLocation{Device: dev, Handoff: handoff, Path: path}
+	}
+	for _, dev := range r.GetNodes(report.Partition) {
+		report.Nodes = append(report.Nodes, location(dev, false))
+	}
+	if more := r.GetMoreNodes(report.Partition); more != nil {
+		for i := 0; i < handoffs; i++ {
+			dev := more.Next()
+			if dev == nil {
+				break
+			}
+			report.Nodes = append(report.Nodes, location(dev, true))
+		}
+	}
+	return report
+}
+
+func printNodesReport(w io.Writer, report *NodesReport) {
+	fmt.Fprintf(w, "Account      %s\n", report.Account)
+	if report.Container != "" {
+		fmt.Fprintf(w, "Container    %s\n", report.Container)
+	}
+	if report.Object != "" {
+		fmt.Fprintf(w, "Object       %s\n", report.Object)
+		fmt.Fprintf(w, "Policy       %s (%d)\n", report.Policy.Name, report.Policy.Index)
+	}
+	fmt.Fprintf(w, "Partition    %d\n", report.Partition)
+	fmt.Fprintf(w, "Hash         %s\n\n", report.Hash)
+	for _, node := range report.Nodes {
+		role := "Primary"
+		if node.Handoff {
+			role = "Handoff"
+		}
+		fmt.Fprintf(w, "%-12s %s %s\n", role, net.JoinHostPort(node.Device.Ip, strconv.Itoa(node.Device.Port)), node.Device.Device)
+	}
+	fmt.Fprintln(w)
+	path := "/" + common.Urlencode(report.Account)
+	if report.Container != "" {
+		path += "/" + common.Urlencode(report.Container)
+		if report.Object != "" {
+			path += "/" + common.Urlencode(report.Object)
+		}
+	}
+	for _, node := range report.Nodes {
+		fmt.Fprintf(w, "curl -I -XHEAD \"http://%s/%s/%d%s\"", net.JoinHostPort(node.Device.Ip, strconv.Itoa(node.Device.Port)),
+			node.Device.Device, report.Partition, path)
+		if report.Policy != nil {
+			fmt.Fprintf(w, " -H \"X-Backend-Storage-Policy-Index: %d\"", report.Policy.Index)
+		}
+		if node.Handoff {
+			fmt.Fprint(w, " # [Handoff]")
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w)
+	for _, node := range report.Nodes {
+		fmt.Fprintf(w, "ssh %s \"ls -lah %s\"", node.Device.Ip, node.Path)
+		if node.Handoff {
+			fmt.Fprint(w, " # [Handoff]")
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// GetNodes implements "hummingbird get-nodes", which shows where the rings place an account, container or object.
+func GetNodes(args []string) {
+	flags := flag.NewFlagSet("get-nodes", flag.ExitOnError)
+	driveRoot := flags.String("devices", "/srv/node", "where the servers mount their devices")
+	handoffs := flags.Int("handoffs", -1, "handoff nodes to list (default as many as there are replicas)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird get-nodes [ARGS] [policy] account[/container[/object]]\n")
+		fmt.Fprintf(os.Stderr, "  The policy is a name or index, used for objects; it defaults to the default policy.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	var policyArg, path string
+	switch flags.NArg() {
+	case 1:
+		path = flags.Arg(0)
+	case 2:
+		policyArg, path = flags.Arg(0), flags.Arg(1)
+	default:
+		flags.Usage()
+		os.Exit(1)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	if parts[0] == "" || (parts[1] == "" && parts[2] != "") {
+		fmt.Fprintf(os.Stderr, "Invalid path %q\n", path)
+		os.Exit(1)
+	}
+
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	var policy *conf.Policy
+	var r ring.Ring
+	if parts[2] != "" {
+		if policy = findPolicy(conf.LoadPolicies(), policyArg); policy == nil {
+			fmt.Fprintf(os.Stderr, "Unknown policy %q\n", policyArg)
+			os.Exit(1)
+		}
+		r, err = ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index)
+	} else if parts[1] != "" {
+		r, err = ring.GetRing("container", hashPathPrefix, hashPathSuffix, 0)
+	} else {
+		r, err = ring.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load ring:", err)
+		os.Exit(1)
+	}
+	if *handoffs < 0 {
+		*handoffs = int(r.ReplicaCount())
+	}
+	printNodesReport(os.Stdout, nodesReport(r, policy, parts[0], parts[1], parts[2], *handoffs, *driveRoot, hashPathPrefix, hashPathSuffix))
+}
+
+// ObjectReport describes an object file and whether it's consistent with its metadata.
+type ObjectReport struct {
+	File     string
+	Metadata map[string]string
+	// Size and ETag are of the file's contents.
+	Size int64
+	ETag string
+	// Hash is the md5 of the object's name; the file should be in a directory of that name.
+	Hash string
+}
+
+// objectReport reads the object file's metadata and, for .data files, checksums its contents.
+func objectReport(file, hashPathPrefix, hashPathSuffix string) (*ObjectReport, error) {
+	metadata, err := objectserver.ReadMetadata(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read metadata: %v", err)
+	}
+	report := &ObjectReport{File: file, Metadata: metadata}
+	if parts := strings.SplitN(strings.TrimPrefix(metadata["name"], "/"), "/", 3); len(parts) == 3 {
+		report.Hash = nameHash(hashPathPrefix, hashPathSuffix, parts[0], parts[1], parts[2])
+	}
+	if strings.HasSuffix(file, ".data") {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := md5.New()
+		if report.Size, err = io.Copy(h, f); err != nil {
+			return nil, err
+		}
+		report.ETag = hex.EncodeToString(h.Sum(nil))
+	}
+	return report, nil
+}
+
+func formatTimestamp(ts string) string {
+	t, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return ts
+	}
+	return fmt.Sprintf("%s (%s)", ts, formatTime(t))
+}
+
+func printObjectReport(w io.Writer, report *ObjectReport) {
+	name := report.Metadata["name"]
+	fmt.Fprintf(w, "Path: %s\n", name)
+	if parts := strings.SplitN(strings.TrimPrefix(name, "/"), "/", 3); len(parts) == 3 {
+		fmt.Fprintf(w, "  Account: %s\n  Container: %s\n  Object: %s\n", parts[0], parts[1], parts[2])
+	}
+	if report.Hash != "" {
+		if dir := filepath.Base(filepath.Dir(report.File)); dir == report.Hash {
+			fmt.Fprintf(w, "  Object hash: %s\n", report.Hash)
+		} else {
+			fmt.Fprintf(w, "  Object hash: %s (but the file is in %s)\n", report.Hash, dir)
+		}
+	}
+	fmt.Fprintf(w, "Content-Type: %s\n", report.Metadata["Content-Type"])
+	fmt.Fprintf(w, "Timestamp: %s\n", formatTimestamp(report.Metadata["X-Timestamp"]))
+	var userMeta, otherMeta []string
+	for key := range report.Metadata {
+		switch {
+		case key == "name" || key == "Content-Type" || key == "X-Timestamp" || key == "ETag" || key == "Content-Length":
+		case strings.HasPrefix(key, "X-Object-Meta-"):
+			userMeta = append(userMeta, key)
+		default:
+			otherMeta = append(otherMeta, key)
+		}
+	}
+	for _, section := range []struct {
+		title string
+		keys  []string
+	}{{"User Metadata", userMeta}, {"Other Metadata", otherMeta}} {
+		sort.Strings(section.keys)
+		if len(section.keys) == 0 {
+			fmt.Fprintf(w, "%s: none\n", section.title)
+			continue
+		}
+		fmt.Fprintf(w, "%s:\n", section.title)
+		for _, key := range section.keys {
+			fmt.Fprintf(w, "  %s: %s\n", key, report.Metadata[key])
+		}
+	}
+	if report.ETag == "" {
+		fmt.Fprintf(w, "ETag: %s (not checked)\n", report.Metadata["ETag"])
+		fmt.Fprintf(w, "Content-Length: %s (not checked)\n", report.Metadata["Content-Length"])
+		return
+	}
+	if report.Metadata["ETag"] == report.ETag {
+		fmt.Fprintf(w, "ETag: %s (valid)\n", report.ETag)
+	} else {
+		fmt.Fprintf(w, "ETag: %s doesn't match file hash of %s!\n", report.Metadata["ETag"], report.ETag)
+	}
+	if report.Metadata["Content-Length"] == strconv.FormatInt(report.Size, 10) {
+		fmt.Fprintf(w, "Content-Length: %d (valid)\n", report.Size)
+	} else {
+		fmt.Fprintf(w, "Content-Length: %s doesn't match file length of %d!\n", report.Metadata["Content-Length"], report.Size)
+	}
+}
+
+// ObjectInfo implements "hummingbird object-info", which decodes an object file's metadata and verifies its contents.
+func ObjectInfo(args []string) {
+	flags := flag.NewFlagSet("object-info", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird object-info OBJECT_FILE\n")
+		fmt.Fprintf(os.Stderr, "  The file may be a .data, .meta or .ts file; only .data files have their contents checked.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	report, err := objectReport(flags.Arg(0), hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	printObjectReport(os.Stdout, report)
+}
+
+// dbType guesses whether a database is an account or container one from its place under the devices directory.
+func dbType(file string) string {
+	for dir := filepath.Dir(file); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		switch filepath.Base(dir) {
+		case "accounts":
+			return "account"
+		case "containers":
+			return "container"
+		}
+	}
+	return ""
+}
+
+func printDBMetadata(w io.Writer, metadata map[string][]string) {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		fmt.Fprintln(w, "Metadata: none")
+		return
+	}
+	fmt.Fprintln(w, "Metadata:")
+	for _, key := range keys {
+		if value := metadata[key]; len(value) == 2 {
+			fmt.Fprintf(w, "  %s: %q at %s\n", key, value[0], formatTimestamp(value[1]))
+		} else {
+			fmt.Fprintf(w, "  %s: %q\n", key, value)
+		}
+	}
+}
+
+func printSyncPoint(w io.Writer, localID, remoteID string, point int64) {
+	if remoteID == localID {
+		fmt.Fprintf(w, "  %s: %d (local)\n", remoteID, point)
+	} else {
+		fmt.Fprintf(w, "  %s: %d\n", remoteID, point)
+	}
+}
+
+func printContainerDB(w io.Writer, report *containerserver.DatabaseReport, policies conf.PolicyList) {
+	info := report.Info
+	fmt.Fprintf(w, "Path: /%s/%s\n", info.Account, info.Container)
+	fmt.Fprintf(w, "  Account: %s\n  Container: %s\n", info.Account, info.Container)
+	fmt.Fprintf(w, "Created at: %s\n", formatTimestamp(info.CreatedAt))
+	fmt.Fprintf(w, "Put Timestamp: %s\n", formatTimestamp(info.PutTimestamp))
+	fmt.Fprintf(w, "Delete Timestamp: %s\n", formatTimestamp(info.DeleteTimestamp))
+	fmt.Fprintf(w, "Status Timestamp: %s\n", formatTimestamp(info.StatusChangedAt))
+	fmt.Fprintf(w, "Object Count: %d\n", info.ObjectCount)
+	fmt.Fprintf(w, "Bytes Used: %d\n", info.BytesUsed)
+	fmt.Fprintf(w, "Storage Policy: %s\n", policyName(policies, info.StoragePolicyIndex))
+	fmt.Fprintf(w, "Reported Put Timestamp: %s\n", formatTimestamp(info.ReportedPutTimestamp))
+	fmt.Fprintf(w, "Reported Delete Timestamp: %s\n", formatTimestamp(info.ReportedDeleteTimestamp))
+	fmt.Fprintf(w, "Reported Object Count: %d\n", info.ReportedObjectCount)
+	fmt.Fprintf(w, "Reported Bytes Used: %d\n", info.ReportedBytesUsed)
+	fmt.Fprintf(w, "Chexor: %s\n", info.Hash)
+	fmt.Fprintf(w, "ID: %s\n", info.ID)
+	fmt.Fprintf(w, "Max Row: %d\n", info.MaxRow)
+	fmt.Fprintf(w, "X-Container-Sync-Point1: %s\n", info.XContainerSyncPoint1)
+	fmt.Fprintf(w, "X-Container-Sync-Point2: %s\n", info.XContainerSyncPoint2)
+	printDBMetadata(w, info.Metadata)
+	fmt.Fprintln(w, "Sync points:")
+	for _, p := range report.SyncPoints {
+		printSyncPoint(w, info.ID, p.RemoteID, p.SyncPoint)
+	}
+	fmt.Fprintf(w, "Object rows: %d, deleted: %d\n", report.ObjectRows, report.DeletedRows)
+}
+
+func printAccountDB(w io.Writer, report *accountserver.DatabaseReport, policies conf.PolicyList) {
+	info := report.Info
+	fmt.Fprintf(w, "Path: /%s\n", info.Account)
+	fmt.Fprintf(w, "  Account: %s\n", info.Account)
+	fmt.Fprintf(w, "Created at: %s\n", formatTimestamp(info.CreatedAt))
+	fmt.Fprintf(w, "Put Timestamp: %s\n", formatTimestamp(info.PutTimestamp))
+	fmt.Fprintf(w, "Delete Timestamp: %s\n", formatTimestamp(info.DeleteTimestamp))
+	fmt.Fprintf(w, "Status Timestamp: %s\n", formatTimestamp(info.StatusChangedAt))
+	fmt.Fprintf(w, "Container Count: %d\n", info.ContainerCount)
+	fmt.Fprintf(w, "Object Count: %d\n", info.ObjectCount)
+	fmt.Fprintf(w, "Bytes Used: %d\n", info.BytesUsed)
+	for _, ps := range report.PolicyStats {
+		fmt.Fprintf(w, "  Policy %s: %d containers, %d objects, %d bytes\n", policyName(policies, ps.StoragePolicyIndex),
+			ps.ContainerCount, ps.ObjectCount, ps.BytesUsed)
+	}
+	fmt.Fprintf(w, "Chexor: %s\n", info.Hash)
+	fmt.Fprintf(w, "ID: %s\n", info.ID)
+	fmt.Fprintf(w, "Max Row: %d\n", info.MaxRow)
+	printDBMetadata(w, info.Metadata)
+	fmt.Fprintln(w, "Sync points:")
+	for _, p := range report.SyncPoints {
+		printSyncPoint(w, info.ID, p.RemoteID, p.SyncPoint)
+	}
+	fmt.Fprintf(w, "Container rows: %d, deleted: %d\n", report.ContainerRows, report.DeletedRows)
+}
+
+// DBInfo implements "hummingbird db-info", which shows the contents of an account or container database's info,
+// metadata and replication bookkeeping.
+func DBInfo(args []string) {
+	flags := flag.NewFlagSet("db-info", flag.ExitOnError)
+	kind := flags.String("type", "", "account or container; by default guessed from the file's path")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird db-info [ARGS] DB_FILE\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	file := flags.Arg(0)
+	if *kind == "" {
+		*kind = dbType(file)
+	}
+	policies := conf.LoadPolicies()
+	switch *kind {
+	case "container":
+		report, err := containerserver.InspectDatabase(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read container database:", err)
+			os.Exit(1)
+		}
+		printContainerDB(os.Stdout, report, policies)
+	case "account":
+		report, err := accountserver.InspectDatabase(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read account database:", err)
+			os.Exit(1)
+		}
+		printAccountDB(os.Stdout, report, policies)
+	default:
+		fmt.Fprintf(os.Stderr, "Can't tell what kind of database %s is; use -type\n", file)
+		os.Exit(1)
+	}
+}
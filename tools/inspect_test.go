@@ -0,0 +1,145 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+// testInspectRing writes and loads a three replica ring of five servers, each with an sda device.
+func testInspectRing(t *testing.T, dir string) ring.Ring {
+	b, err := ring.NewRingBuilder(4, 3, 0)
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := b.AddDevice(ring.Device{Region: 1, Zone: i, Ip: fmt.Sprintf("10.0.0.%d", i+1), Port: 6000, Device: "sda", Weight: 1})
+		require.Nil(t, err)
+	}
+	_, err = b.Rebalance(1, time.Now())
+	require.Nil(t, err)
+	path := filepath.Join(dir, "test.ring.gz")
+	require.Nil(t, b.WriteRingFile(path))
+	r, err := ring.LoadRing(path, "prefix", "suffix")
+	require.Nil(t, err)
+	return r
+}
+
+func TestGetNodesReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	r := testInspectRing(t, dir)
+
+	policy := &conf.Policy{Index: 1, Name: "gold"}
+	report := nodesReport(r, policy, "a", "c", "o", 2, "/srv/node", "prefix", "suffix")
+	require.Equal(t, "object", report.Type)
+	require.Equal(t, r.GetPartition("a", "c", "o"), report.Partition)
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("prefix/a/c/osuffix"))), report.Hash)
+	require.Equal(t, 5, len(report.Nodes))
+	for i, node := range report.Nodes {
+		require.Equal(t, i >= 3, node.Handoff)
+		require.Equal(t, fmt.Sprintf("/srv/node/sda/objects-1/%d/%s/%s", report.Partition, report.Hash[29:], report.Hash), node.Path)
+	}
+	out := &bytes.Buffer{}
+	printNodesReport(out, report)
+	require.Contains(t, out.String(), "Policy       gold (1)\n")
+	require.Contains(t, out.String(), fmt.Sprintf("curl -I -XHEAD \"http://%s:6000/sda/%d/a/c/o\" -H \"X-Backend-Storage-Policy-Index: 1\"\n",
+		report.Nodes[0].Device.Ip, report.Partition))
+	require.Contains(t, out.String(), " # [Handoff]\n")
+
+	report = nodesReport(r, nil, "a", "c", "", 0, "/srv/node", "prefix", "suffix")
+	require.Equal(t, "container", report.Type)
+	require.Equal(t, 3, len(report.Nodes))
+	require.Equal(t, fmt.Sprintf("/srv/node/sda/containers/%d/%s/%s", report.Partition, report.Hash[29:], report.Hash), report.Nodes[0].Path)
+	out.Reset()
+	printNodesReport(out, report)
+	require.False(t, strings.Contains(out.String(), "X-Backend-Storage-Policy-Index"))
+}
+
+func TestFindPolicy(t *testing.T) {
+	policies := conf.PolicyList{
+		0: {Index: 0, Name: "gold", Default: true},
+		1: {Index: 1, Name: "silver", Aliases: []string{"ec"}},
+	}
+	require.Equal(t, 0, findPolicy(policies, "").Index)
+	require.Equal(t, 1, findPolicy(policies, "1").Index)
+	require.Equal(t, 1, findPolicy(policies, "Silver").Index)
+	require.Equal(t, 1, findPolicy(policies, "ec").Index)
+	require.Nil(t, findPolicy(policies, "bronze"))
+	require.Nil(t, findPolicy(policies, "2"))
+}
+
+func TestObjectReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("prefix/a/c/osuffix")))
+	file := filepath.Join(dir, hash, "1500000000.00000.data")
+	require.Nil(t, os.MkdirAll(filepath.Dir(file), 0755))
+	f, err := os.Create(file)
+	require.Nil(t, err)
+	_, err = f.WriteString("SOME DATA")
+	require.Nil(t, err)
+	require.Nil(t, objectserver.WriteMetadata(f.Fd(), map[string]string{
+		"name":                "/a/c/o",
+		"X-Timestamp":         "1500000000.00000",
+		"Content-Type":        "text/plain",
+		"Content-Length":      "9",
+		"ETag":                fmt.Sprintf("%x", md5.Sum([]byte("SOME DATA"))),
+		"X-Object-Meta-Color": "blue",
+	}))
+	f.Close()
+
+	report, err := objectReport(file, "prefix", "suffix")
+	require.Nil(t, err)
+	require.Equal(t, hash, report.Hash)
+	require.Equal(t, int64(9), report.Size)
+	out := &bytes.Buffer{}
+	printObjectReport(out, report)
+	require.Contains(t, out.String(), "Path: /a/c/o\n")
+	require.Contains(t, out.String(), "  Object hash: "+hash+"\n")
+	require.Contains(t, out.String(), "Timestamp: 1500000000.00000 (2017-07-14T02:40:00Z)\n")
+	require.Contains(t, out.String(), "  X-Object-Meta-Color: blue\n")
+	require.Contains(t, out.String(), "(valid)\nContent-Length: 9 (valid)\n")
+
+	report.Metadata["ETag"] = "bad"
+	report.Metadata["Content-Length"] = "10"
+	out.Reset()
+	printObjectReport(out, report)
+	require.Contains(t, out.String(), "ETag: bad doesn't match file hash of "+report.ETag+"!\n")
+	require.Contains(t, out.String(), "Content-Length: 10 doesn't match file length of 9!\n")
+
+	_, err = objectReport(filepath.Join(dir, "missing.data"), "prefix", "suffix")
+	require.NotNil(t, err)
+}
+
+func TestDBType(t *testing.T) {
+	require.Equal(t, "container", dbType("/srv/node/sda/containers/1/abc/hash/hash.db"))
+	require.Equal(t, "account", dbType("/srv/node/sda/accounts/1/abc/hash/hash.db"))
+	require.Equal(t, "", dbType("/tmp/hash.db"))
+}
@@ -0,0 +1,418 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/common/ring"
+	"github.com/troubling/hummingbird/containerserver"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+// QuarantinedItem is an object hash directory or database that was moved into a device's quarantined directory.
+type QuarantinedItem struct {
+	Device string
+	// Type is the quarantined subdirectory: objects, objects-N, containers or accounts.
+	Type string
+	Name string
+	Path string
+	// Quarantined is when the item was quarantined; for items quarantined by older versions, when it last changed.
+	Quarantined time.Time
+	Size        int64
+}
+
+// kind is object, container or account.
+func (q *QuarantinedItem) kind() string {
+	if strings.HasPrefix(q.Type, "objects") {
+		return "object"
+	}
+	return strings.TrimSuffix(q.Type, "s")
+}
+
+func quarantinedItem(device, typ, path string) (*QuarantinedItem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	q := &QuarantinedItem{Device: device, Type: typ, Name: filepath.Base(path), Path: path, Quarantined: info.ModTime()}
+	if !info.IsDir() {
+		q.Size = info.Size()
+		return q, nil
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		q.Size += f.Size()
+	}
+	return q, nil
+}
+
+// listQuarantined returns the items quarantined on every device under driveRoot, optionally only those of one kind
+// (object, container or account), oldest first.
+func listQuarantined(driveRoot string, kind string) ([]*QuarantinedItem, error) {
+	devices, err := fs.ReadDirNames(driveRoot)
+	if err != nil {
+		return nil, err
+	}
+	var items []*QuarantinedItem
+	for _, device := range devices {
+		quarantineDir := filepath.Join(driveRoot, device, "quarantined")
+		types, err := fs.ReadDirNames(quarantineDir)
+		if err != nil {
+			continue
+		}
+		for _, typ := range types {
+			names, err := fs.ReadDirNames(filepath.Join(quarantineDir, typ))
+			if err != nil {
+				continue
+			}
+			for _, name := range names {
+				q, err := quarantinedItem(device, typ, filepath.Join(quarantineDir, typ, name))
+				if err != nil {
+					return nil, err
+				}
+				if kind == "" || q.kind() == kind {
+					items = append(items, q)
+				}
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Quarantined.Before(items[j].Quarantined) })
+	return items, nil
+}
+
+// findQuarantined looks up an item given either its path or DEVICE/TYPE/NAME as shown by list.
+func findQuarantined(driveRoot string, item string) (*QuarantinedItem, error) {
+	path := item
+	if !filepath.IsAbs(path) {
+		parts := strings.Split(item, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%q is neither a path nor DEVICE/TYPE/NAME", item)
+		}
+		path = filepath.Join(driveRoot, parts[0], "quarantined", parts[1], parts[2])
+	}
+	path = filepath.Clean(path)
+	typeDir := filepath.Dir(path)
+	if filepath.Base(filepath.Dir(typeDir)) != "quarantined" {
+		return nil, fmt.Errorf("%s is not in a quarantined directory", path)
+	}
+	return quarantinedItem(filepath.Base(filepath.Dir(filepath.Dir(typeDir))), filepath.Base(typeDir), path)
+}
+
+// quarantinedDB returns the database file of a quarantined account or container.
+func quarantinedDB(q *QuarantinedItem) (string, error) {
+	if !strings.HasSuffix(q.Path, ".db") {
+		names, err := fs.ReadDirNames(q.Path)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, ".db") {
+				return filepath.Join(q.Path, name), nil
+			}
+		}
+		return "", fmt.Errorf("no database in %s", q.Path)
+	}
+	return q.Path, nil
+}
+
+func printQuarantinedList(w io.Writer, items []*QuarantinedItem) {
+	for _, q := range items {
+		fmt.Fprintf(w, "%s/%s/%s  %s  %d bytes\n", q.Device, q.Type, q.Name, q.Quarantined.UTC().Format(time.RFC3339), q.Size)
+	}
+	fmt.Fprintf(w, "%d quarantined\n", len(items))
+}
+
+// inspectQuarantined prints the object files' metadata or the database's info.
+func inspectQuarantined(w io.Writer, q *QuarantinedItem, hashPathPrefix, hashPathSuffix string) error {
+	fmt.Fprintf(w, "%s (%s, quarantined %s)\n", q.Path, q.kind(), q.Quarantined.UTC().Format(time.RFC3339))
+	switch q.kind() {
+	case "object":
+		names, err := fs.ReadDirNames(q.Path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Fprintf(w, "\n%s:\n", name)
+			report, err := objectReport(filepath.Join(q.Path, name), hashPathPrefix, hashPathSuffix)
+			if err != nil {
+				fmt.Fprintln(w, err)
+				continue
+			}
+			printObjectReport(w, report)
+		}
+	case "container":
+		file, err := quarantinedDB(q)
+		if err != nil {
+			return err
+		}
+		report, err := containerserver.InspectDatabase(file)
+		if err != nil {
+			return fmt.Errorf("unable to read container database: %v", err)
+		}
+		printContainerDB(w, report, conf.LoadPolicies())
+	case "account":
+		file, err := quarantinedDB(q)
+		if err != nil {
+			return err
+		}
+		report, err := accountserver.InspectDatabase(file)
+		if err != nil {
+			return fmt.Errorf("unable to read account database: %v", err)
+		}
+		printAccountDB(w, report, conf.LoadPolicies())
+	default:
+		return fmt.Errorf("unknown quarantine type %q", q.Type)
+	}
+	return nil
+}
+
+// quarantinedRing loads the ring the item belongs in.
+func quarantinedRing(q *QuarantinedItem, hashPathPrefix, hashPathSuffix string) (ring.Ring, error) {
+	if q.kind() == "object" {
+		policy, err := objectserver.UnPolicyDir(q.Type)
+		if err != nil {
+			return nil, err
+		}
+		return ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy)
+	}
+	return ring.GetRing(q.kind(), hashPathPrefix, hashPathSuffix, 0)
+}
+
+// restoreObject moves the files of a quarantined object back into its hash dir and invalidates the suffix hash so
+// replication notices. Unless force is set, the object's .data file must match its ETag and Content-Length, and its
+// name must hash to the quarantined hash dir. It won't overwrite any files already in the hash dir.
+func restoreObject(q *QuarantinedItem, driveRoot string, r ring.Ring, hashPathPrefix, hashPathSuffix string, force bool) (string, error) {
+	policy, err := objectserver.UnPolicyDir(q.Type)
+	if err != nil {
+		return "", err
+	}
+	file, metaFile := objectserver.ObjectFiles(q.Path)
+	if file == "" {
+		return "", fmt.Errorf("no .data or .ts file in %s", q.Path)
+	}
+	report, err := objectReport(file, hashPathPrefix, hashPathSuffix)
+	if err != nil {
+		return "", err
+	}
+	if !force && report.ETag != "" {
+		if report.Metadata["ETag"] != report.ETag {
+			return "", fmt.Errorf("%s has ETag %s but its contents hash to %s", file, report.Metadata["ETag"], report.ETag)
+		}
+		if report.Metadata["Content-Length"] != strconv.FormatInt(report.Size, 10) {
+			return "", fmt.Errorf("%s has Content-Length %s but is %d bytes", file, report.Metadata["Content-Length"], report.Size)
+		}
+	}
+	if metaFile != "" {
+		if _, err := objectserver.ReadMetadata(metaFile); err != nil && !force {
+			return "", fmt.Errorf("unable to read %s: %v", metaFile, err)
+		}
+	}
+	parts := strings.SplitN(strings.TrimPrefix(report.Metadata["name"], "/"), "/", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%s has an invalid name %q", file, report.Metadata["name"])
+	}
+	vars := map[string]string{"account": parts[0], "container": parts[1], "obj": parts[2], "device": q.Device,
+		"partition": strconv.FormatUint(r.GetPartition(parts[0], parts[1], parts[2]), 10)}
+	hashDir := objectserver.ObjHashDir(vars, driveRoot, hashPathPrefix, hashPathSuffix, policy)
+	// quarantined hash dirs are named after their hash, with a uuid appended.
+	if hash := filepath.Base(hashDir); !force && q.Name != hash && !strings.HasPrefix(q.Name, hash+"-") {
+		return "", fmt.Errorf("%s is named %q, which hashes to %s, not %s", file, report.Metadata["name"], hash, q.Name)
+	}
+	names, err := fs.ReadDirNames(q.Path)
+	if err != nil {
+		return "", err
+	}
+	var conflicts []string
+	for _, name := range names {
+		if fs.Exists(filepath.Join(hashDir, name)) {
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return "", fmt.Errorf("%s already has %s", hashDir, strings.Join(conflicts, ", "))
+	}
+	if err := os.MkdirAll(hashDir, 0755); err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if err := os.Rename(filepath.Join(q.Path, name), filepath.Join(hashDir, name)); err != nil {
+			return "", err
+		}
+	}
+	if err := objectserver.InvalidateHash(hashDir); err != nil {
+		return "", err
+	}
+	// only remove the quarantine dir once it's empty, so nothing that wasn't restored goes with it.
+	return hashDir, os.Remove(q.Path)
+}
+
+// restoreDB moves a quarantined account or container database back to where the ring puts it. It won't replace a
+// database that has since been recreated there; replication will bring that one up to date.
+func restoreDB(q *QuarantinedItem, driveRoot string, r ring.Ring, hashPathPrefix, hashPathSuffix string) (string, error) {
+	file, err := quarantinedDB(q)
+	if err != nil {
+		return "", err
+	}
+	var account, container string
+	if q.kind() == "container" {
+		report, err := containerserver.InspectDatabase(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read container database: %v", err)
+		}
+		account, container = report.Info.Account, report.Info.Container
+	} else {
+		report, err := accountserver.InspectDatabase(file)
+		if err != nil {
+			return "", fmt.Errorf("unable to read account database: %v", err)
+		}
+		account = report.Info.Account
+	}
+	hash := nameHash(hashPathPrefix, hashPathSuffix, account, container, "")
+	partition := strconv.FormatUint(r.GetPartition(account, container, ""), 10)
+	dest := filepath.Join(driveRoot, q.Device, q.Type, partition, hash[29:32], hash, hash+".db")
+	if fs.Exists(dest) {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file, dest); err != nil {
+		return "", err
+	}
+	return dest, os.RemoveAll(q.Path)
+}
+
+// purgeQuarantined deletes the items quarantined before cutoff, returning those it deleted.
+func purgeQuarantined(items []*QuarantinedItem, cutoff time.Time) ([]*QuarantinedItem, error) {
+	var purged []*QuarantinedItem
+	for _, q := range items {
+		if !q.Quarantined.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(q.Path); err != nil {
+			return purged, err
+		}
+		purged = append(purged, q)
+	}
+	return purged, nil
+}
+
+var errQuarantineUsage = errors.New("usage")
+
+func runQuarantine(w io.Writer, command string, args []string, driveRoot, kind string, force bool, age time.Duration) error {
+	needsItem := command == "inspect" || command == "restore"
+	if (needsItem && len(args) != 1) || (!needsItem && len(args) != 0) {
+		return errQuarantineUsage
+	}
+	var hashPathPrefix, hashPathSuffix string
+	if needsItem {
+		var err error
+		if hashPathPrefix, hashPathSuffix, err = conf.GetHashPrefixAndSuffix(); err != nil {
+			return fmt.Errorf("unable to load hash path prefix and suffix: %v", err)
+		}
+	}
+	switch command {
+	case "list":
+		items, err := listQuarantined(driveRoot, kind)
+		if err != nil {
+			return err
+		}
+		printQuarantinedList(w, items)
+	case "inspect":
+		q, err := findQuarantined(driveRoot, args[0])
+		if err != nil {
+			return err
+		}
+		return inspectQuarantined(w, q, hashPathPrefix, hashPathSuffix)
+	case "restore":
+		q, err := findQuarantined(driveRoot, args[0])
+		if err != nil {
+			return err
+		}
+		r, err := quarantinedRing(q, hashPathPrefix, hashPathSuffix)
+		if err != nil {
+			return fmt.Errorf("unable to load ring: %v", err)
+		}
+		var dest string
+		if q.kind() == "object" {
+			dest, err = restoreObject(q, driveRoot, r, hashPathPrefix, hashPathSuffix, force)
+		} else {
+			dest, err = restoreDB(q, driveRoot, r, hashPathPrefix, hashPathSuffix)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Restored %s to %s\n", q.Path, dest)
+	case "purge":
+		items, err := listQuarantined(driveRoot, kind)
+		if err != nil {
+			return err
+		}
+		purged, err := purgeQuarantined(items, time.Now().Add(-age))
+		for _, q := range purged {
+			fmt.Fprintf(w, "Purged %s\n", q.Path)
+		}
+		fmt.Fprintf(w, "%d purged\n", len(purged))
+		return err
+	default:
+		return errQuarantineUsage
+	}
+	return nil
+}
+
+// Quarantine implements "hummingbird quarantine", for looking at, restoring and cleaning up the objects and databases
+// that have been quarantined on this server's devices.
+func Quarantine(args []string) {
+	flags := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	driveRoot := flags.String("devices", "/srv/node", "where the devices are mounted")
+	kind := flags.String("type", "", "only list or purge object, container or account quarantines")
+	force := flags.Bool("force", false, "restore objects even if their contents don't match their metadata")
+	age := flags.Duration("age", 30*24*time.Hour, "purge quarantines older than this")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird quarantine [ARGS] list|inspect ITEM|restore ITEM|purge\n")
+		fmt.Fprintf(os.Stderr, "  ITEM is a quarantined path or DEVICE/TYPE/NAME as shown by list.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 1 || (*kind != "" && *kind != "object" && *kind != "container" && *kind != "account") {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if err := runQuarantine(os.Stdout, flags.Arg(0), flags.Args()[1:], *driveRoot, *kind, *force, *age); err == errQuarantineUsage {
+		flags.Usage()
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
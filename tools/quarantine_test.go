@@ -0,0 +1,173 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/fs"
+	"github.com/troubling/hummingbird/objectserver"
+)
+
+// quarantineTestObject writes an object's .data file into a new hash dir and quarantines it.
+func quarantineTestObject(t *testing.T, driveRoot, device, policyDir, name, data, etag string) string {
+	hash := fmt.Sprintf("%x", md5.Sum([]byte("prefix"+name+"suffix")))
+	hashDir := filepath.Join(driveRoot, device, policyDir, "0", hash[29:32], hash)
+	require.Nil(t, os.MkdirAll(hashDir, 0755))
+	f, err := os.Create(filepath.Join(hashDir, "1500000000.00000.data"))
+	require.Nil(t, err)
+	_, err = f.WriteString(data)
+	require.Nil(t, err)
+	require.Nil(t, objectserver.WriteMetadata(f.Fd(), map[string]string{
+		"name":           name,
+		"X-Timestamp":    "1500000000.00000",
+		"Content-Type":   "text/plain",
+		"Content-Length": strconv.Itoa(len(data)),
+		"ETag":           etag,
+	}))
+	f.Close()
+	require.Nil(t, objectserver.QuarantineHash(hashDir))
+	quarantined, err := filepath.Glob(filepath.Join(driveRoot, device, "quarantined", policyDir, "*"))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(quarantined))
+	return quarantined[0]
+}
+
+func TestQuarantineListAndPurge(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	etag := fmt.Sprintf("%x", md5.Sum([]byte("DATA")))
+	objPath := quarantineTestObject(t, driveRoot, "sda", "objects-1", "/a/c/o", "DATA", etag)
+	dbPath := filepath.Join(driveRoot, "sdb", "quarantined", "containers", "hash-uuid")
+	require.Nil(t, os.MkdirAll(dbPath, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dbPath, "hash.db"), []byte("db"), 0644))
+	old := time.Now().Add(-48 * time.Hour)
+	require.Nil(t, os.Chtimes(dbPath, old, old))
+
+	items, err := listQuarantined(driveRoot, "")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "container", items[0].kind())
+	require.Equal(t, "sdb", items[0].Device)
+	require.Equal(t, int64(2), items[0].Size)
+	require.Equal(t, "object", items[1].kind())
+	require.Equal(t, "objects-1", items[1].Type)
+	require.Equal(t, int64(4), items[1].Size)
+	items, err = listQuarantined(driveRoot, "object")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	out := &bytes.Buffer{}
+	printQuarantinedList(out, items)
+	require.Contains(t, out.String(), "sda/objects-1/"+filepath.Base(objPath)+"  ")
+
+	q, err := findQuarantined(driveRoot, "sda/objects-1/"+filepath.Base(objPath))
+	require.Nil(t, err)
+	require.Equal(t, objPath, q.Path)
+	q, err = findQuarantined(driveRoot, objPath)
+	require.Nil(t, err)
+	require.Equal(t, "sda", q.Device)
+	_, err = findQuarantined(driveRoot, "sda/objects-1")
+	require.NotNil(t, err)
+	_, err = findQuarantined(driveRoot, "/tmp")
+	require.NotNil(t, err)
+
+	items, err = listQuarantined(driveRoot, "")
+	require.Nil(t, err)
+	purged, err := purgeQuarantined(items, time.Now().Add(-24*time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(purged))
+	require.False(t, fs.Exists(dbPath))
+	require.True(t, fs.Exists(objPath))
+}
+
+func TestQuarantineRestoreObject(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	r := testInspectRing(t, driveRoot)
+	etag := fmt.Sprintf("%x", md5.Sum([]byte("DATA")))
+
+	objPath := quarantineTestObject(t, driveRoot, "sda", "objects-1", "/a/c/o", "DATA", etag)
+	q, err := findQuarantined(driveRoot, objPath)
+	require.Nil(t, err)
+	hashDir, err := restoreObject(q, driveRoot, r, "prefix", "suffix", false)
+	require.Nil(t, err)
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda",
+		"partition": strconv.FormatUint(r.GetPartition("a", "c", "o"), 10)}
+	require.Equal(t, objectserver.ObjHashDir(vars, driveRoot, "prefix", "suffix", 1), hashDir)
+	require.True(t, fs.Exists(filepath.Join(hashDir, "1500000000.00000.data")))
+	require.False(t, fs.Exists(objPath))
+	invalid, err := ioutil.ReadFile(filepath.Join(filepath.Dir(filepath.Dir(hashDir)), "hashes.invalid"))
+	require.Nil(t, err)
+	require.Equal(t, filepath.Base(filepath.Dir(hashDir))+"\n", string(invalid))
+
+	objPath = quarantineTestObject(t, driveRoot, "sda", "objects", "/a/c/o2", "DATA", "bad")
+	q, err = findQuarantined(driveRoot, objPath)
+	require.Nil(t, err)
+	_, err = restoreObject(q, driveRoot, r, "prefix", "suffix", false)
+	require.NotNil(t, err)
+	require.True(t, fs.Exists(objPath))
+	hashDir, err = restoreObject(q, driveRoot, r, "prefix", "suffix", true)
+	require.Nil(t, err)
+	require.True(t, fs.Exists(filepath.Join(hashDir, "1500000000.00000.data")))
+}
+
+func TestQuarantineRestoreObjectConflicts(t *testing.T) {
+	driveRoot, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(driveRoot)
+	r := testInspectRing(t, driveRoot)
+	etag := fmt.Sprintf("%x", md5.Sum([]byte("DATA")))
+
+	// a file that's already back in the hash dir isn't overwritten, and the quarantined copy is kept.
+	objPath := quarantineTestObject(t, driveRoot, "sda", "objects-1", "/a/c/o", "DATA", etag)
+	q, err := findQuarantined(driveRoot, objPath)
+	require.Nil(t, err)
+	vars := map[string]string{"account": "a", "container": "c", "obj": "o", "device": "sda",
+		"partition": strconv.FormatUint(r.GetPartition("a", "c", "o"), 10)}
+	hashDir := objectserver.ObjHashDir(vars, driveRoot, "prefix", "suffix", 1)
+	require.Nil(t, os.MkdirAll(hashDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(hashDir, "1500000000.00000.data"), []byte("NEW"), 0644))
+	_, err = restoreObject(q, driveRoot, r, "prefix", "suffix", true)
+	require.NotNil(t, err)
+	require.True(t, fs.Exists(filepath.Join(objPath, "1500000000.00000.data")))
+	data, err := ioutil.ReadFile(filepath.Join(hashDir, "1500000000.00000.data"))
+	require.Nil(t, err)
+	require.Equal(t, "NEW", string(data))
+
+	// an object whose name doesn't hash to its quarantined hash dir isn't restored unless forced.
+	renamed := filepath.Join(filepath.Dir(objPath), "00000000000000000000000000000abc-uuid")
+	require.Nil(t, os.Rename(objPath, renamed))
+	require.Nil(t, os.RemoveAll(hashDir))
+	q, err = findQuarantined(driveRoot, renamed)
+	require.Nil(t, err)
+	_, err = restoreObject(q, driveRoot, r, "prefix", "suffix", false)
+	require.NotNil(t, err)
+	require.True(t, fs.Exists(renamed))
+	_, err = restoreObject(q, driveRoot, r, "prefix", "suffix", true)
+	require.Nil(t, err)
+	require.False(t, fs.Exists(renamed))
+}
@@ -0,0 +1,560 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+var reconChecks = []string{"replication", "async", "unmounted", "diskusage", "ringmd5"}
+
+// reconHosts returns the sorted, unique ip:port of every device in the rings.
+func reconHosts(rings []ring.Ring) []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, r := range rings {
+		for _, dev := range r.AllDevices() {
+			host := net.JoinHostPort(dev.Ip, strconv.Itoa(dev.Port))
+			if dev.Ip != "" && !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// reconResponse is one host's answer to a recon request; Err is set if the host couldn't be reached or the response
+// wasn't a 200 with JSON.
+type reconResponse struct {
+	Host string
+	Data json.RawMessage
+	Err  error
+}
+
+type reconClient struct {
+	client      *http.Client
+	concurrency int
+}
+
+// query GETs /recon/<path> from every host concurrently, returning the responses in host order.
+func (rc *reconClient) query(hosts []string, path string) []*reconResponse {
+	responses := make(map[string]*reconResponse, len(hosts))
+	lock := sync.Mutex{}
+	runConcurrently(hosts, rc.concurrency, func(host string) bool {
+		response := &reconResponse{Host: host}
+		if resp, err := rc.client.Get(fmt.Sprintf("http://%s/recon/%s", host, path)); err != nil {
+			response.Err = err
+		} else {
+			if resp.StatusCode != http.StatusOK {
+				response.Err = fmt.Errorf("%s returned %d", path, resp.StatusCode)
+			} else if err := json.NewDecoder(resp.Body).Decode(&response.Data); err != nil {
+				response.Err = fmt.Errorf("%s returned invalid JSON: %v", path, err)
+			}
+			closeResponse(resp)
+		}
+		lock.Lock()
+		responses[host] = response
+		lock.Unlock()
+		return response.Err == nil
+	})
+	results := make([]*reconResponse, 0, len(hosts))
+	for _, host := range hosts {
+		results = append(results, responses[host])
+	}
+	return results
+}
+
+// ReconStats summarizes one number reported by each host.
+type ReconStats struct {
+	Low      float64 `json:"low"`
+	High     float64 `json:"high"`
+	Average  float64 `json:"average"`
+	Reported int     `json:"reported"`
+	// None counts hosts that answered but had nothing to report yet.
+	None  int `json:"none"`
+	total float64
+}
+
+func (s *ReconStats) add(value *float64) {
+	if value == nil {
+		s.None++
+		return
+	}
+	if s.Reported == 0 || *value < s.Low {
+		s.Low = *value
+	}
+	if s.Reported == 0 || *value > s.High {
+		s.High = *value
+	}
+	s.Reported++
+	s.total += *value
+	s.Average = s.total / float64(s.Reported)
+}
+
+// hostErrors returns the hosts that failed, with why.
+func hostErrors(responses []*reconResponse) map[string]string {
+	errors := map[string]string{}
+	for _, r := range responses {
+		if r.Err != nil {
+			errors[r.Host] = r.Err.Error()
+		}
+	}
+	return errors
+}
+
+// ReplicationReport summarizes each host's replication pass times.
+type ReplicationReport struct {
+	// Time is the minutes each host's last complete replication pass took.
+	Time *ReconStats `json:"replication_time"`
+	// OldestCompletion is the unix time of the least recent replication pass completion, and OldestHost the host
+	// that reported it.
+	OldestCompletion float64           `json:"oldest_completion"`
+	OldestHost       string            `json:"oldest_host"`
+	Errors           map[string]string `json:"errors"`
+}
+
+// unmarshalRaw decodes a value from a recon response, leaving v alone if the value is missing.
+func unmarshalRaw(data json.RawMessage, v interface{}) error {
+	if data == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func replicationReport(responses []*reconResponse, serverType string) *ReplicationReport {
+	timeKey, lastKey := "replication_time", "replication_last"
+	if serverType == "object" {
+		timeKey, lastKey = "object_replication_time", "object_replication_last"
+	}
+	report := &ReplicationReport{Time: &ReconStats{}, Errors: hostErrors(responses)}
+	for _, r := range responses {
+		if r.Err != nil {
+			continue
+		}
+		// account and container servers also report replication_stats, which isn't a number.
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(r.Data, &raw); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid replication data: %v", err)
+			continue
+		}
+		var elapsed, last *float64
+		if err := unmarshalRaw(raw[timeKey], &elapsed); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid replication data: %v", err)
+			continue
+		}
+		if err := unmarshalRaw(raw[lastKey], &last); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid replication data: %v", err)
+			continue
+		}
+		report.Time.add(elapsed)
+		if last != nil && (report.OldestHost == "" || *last < report.OldestCompletion) {
+			report.OldestCompletion, report.OldestHost = *last, r.Host
+		}
+	}
+	return report
+}
+
+// AsyncReport totals the async pending container updates on each host.
+type AsyncReport struct {
+	Total  int64             `json:"total"`
+	Stats  *ReconStats       `json:"async_pending"`
+	Errors map[string]string `json:"errors"`
+}
+
+func asyncReport(responses []*reconResponse) *AsyncReport {
+	report := &AsyncReport{Stats: &ReconStats{}, Errors: hostErrors(responses)}
+	for _, r := range responses {
+		if r.Err != nil {
+			continue
+		}
+		var data map[string]*float64
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid async data: %v", err)
+			continue
+		}
+		report.Stats.add(data["async_pending"])
+		if pending := data["async_pending"]; pending != nil {
+			report.Total += int64(*pending)
+		}
+	}
+	return report
+}
+
+// HostDevice identifies a device on a host.
+type HostDevice struct {
+	Host   string `json:"host"`
+	Device string `json:"device"`
+}
+
+// UnmountedReport lists the devices hosts report as not mounted.
+type UnmountedReport struct {
+	Unmounted []HostDevice      `json:"unmounted"`
+	Errors    map[string]string `json:"errors"`
+}
+
+func unmountedReport(responses []*reconResponse) *UnmountedReport {
+	report := &UnmountedReport{Unmounted: []HostDevice{}, Errors: hostErrors(responses)}
+	for _, r := range responses {
+		if r.Err != nil {
+			continue
+		}
+		var data []struct {
+			Device  string `json:"device"`
+			Mounted bool   `json:"mounted"`
+		}
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid unmounted data: %v", err)
+			continue
+		}
+		for _, d := range data {
+			if !d.Mounted {
+				report.Unmounted = append(report.Unmounted, HostDevice{r.Host, d.Device})
+			}
+		}
+	}
+	return report
+}
+
+// DiskUsageReport summarizes how full the mounted devices are.
+type DiskUsageReport struct {
+	// Used summarizes the percent used of every mounted device.
+	Used      *ReconStats `json:"used"`
+	Fullest   HostDevice  `json:"fullest"`
+	Emptiest  HostDevice  `json:"emptiest"`
+	TotalSize int64       `json:"total_size"`
+	TotalUsed int64       `json:"total_used"`
+	// Distribution counts devices by percent used, in buckets of 10%: 0 is 0-9%, 1 is 10-19%, and so on.
+	Distribution map[int]int       `json:"distribution"`
+	Errors       map[string]string `json:"errors"`
+}
+
+func diskUsageReport(responses []*reconResponse) *DiskUsageReport {
+	report := &DiskUsageReport{Used: &ReconStats{}, Distribution: map[int]int{}, Errors: hostErrors(responses)}
+	for _, r := range responses {
+		if r.Err != nil {
+			continue
+		}
+		var data []struct {
+			Device  string          `json:"device"`
+			Mounted bool            `json:"mounted"`
+			Size    json.RawMessage `json:"size"`
+			Used    json.RawMessage `json:"used"`
+		}
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid diskusage data: %v", err)
+			continue
+		}
+		for _, d := range data {
+			var size, used int64
+			// unmounted devices report their sizes as ""
+			if !d.Mounted || json.Unmarshal(d.Size, &size) != nil || json.Unmarshal(d.Used, &used) != nil || size <= 0 {
+				continue
+			}
+			pct := 100 * float64(used) / float64(size)
+			if report.Used.Reported == 0 || pct > report.Used.High {
+				report.Fullest = HostDevice{r.Host, d.Device}
+			}
+			if report.Used.Reported == 0 || pct < report.Used.Low {
+				report.Emptiest = HostDevice{r.Host, d.Device}
+			}
+			report.Used.add(&pct)
+			report.TotalSize += size
+			report.TotalUsed += used
+			report.Distribution[int(math.Min(pct/10, 9))]++
+		}
+	}
+	return report
+}
+
+// RingMismatch is a ring file on a host that differs from the local copy.
+type RingMismatch struct {
+	Host string `json:"host"`
+	File string `json:"file"`
+	MD5  string `json:"md5"`
+}
+
+// RingMD5Report compares each host's rings to the local ones.
+type RingMD5Report struct {
+	// Local is the md5 of each ring file on this machine, by file name.
+	Local      map[string]string `json:"local"`
+	Matched    int               `json:"matched"`
+	Mismatches []RingMismatch    `json:"mismatches"`
+	Errors     map[string]string `json:"errors"`
+}
+
+// localRingMD5s returns the md5s of the ring files recon's ringmd5 reports on, by file name, from the first of dirs
+// that has them.
+func localRingMD5s(dirs ...string) (map[string]string, error) {
+	var err error
+	for _, dir := range dirs {
+		sums := map[string]string{}
+		for _, name := range []string{"object.ring.gz", "container.ring.gz", "account.ring.gz"} {
+			var fp *os.File
+			if fp, err = os.Open(filepath.Join(dir, name)); err != nil {
+				break
+			}
+			hash := md5.New()
+			_, err = io.Copy(hash, fp)
+			fp.Close()
+			if err != nil {
+				break
+			}
+			sums[name] = fmt.Sprintf("%x", hash.Sum(nil))
+		}
+		if err == nil {
+			return sums, nil
+		}
+	}
+	return nil, err
+}
+
+func ringMD5Report(responses []*reconResponse, local map[string]string) *RingMD5Report {
+	report := &RingMD5Report{Local: local, Mismatches: []RingMismatch{}, Errors: hostErrors(responses)}
+	for _, r := range responses {
+		if r.Err != nil {
+			continue
+		}
+		var data map[string]string
+		if err := json.Unmarshal(r.Data, &data); err != nil {
+			report.Errors[r.Host] = fmt.Sprintf("invalid ringmd5 data: %v", err)
+			continue
+		}
+		matched := true
+		// hosts may keep their rings in /etc/swift or /etc/hummingbird, so compare by file name
+		for path, sum := range data {
+			if name := filepath.Base(path); local[name] != "" && local[name] != sum {
+				report.Mismatches = append(report.Mismatches, RingMismatch{r.Host, name, sum})
+				matched = false
+			}
+		}
+		if matched {
+			report.Matched++
+		}
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		if report.Mismatches[i].Host != report.Mismatches[j].Host {
+			return report.Mismatches[i].Host < report.Mismatches[j].Host
+		}
+		return report.Mismatches[i].File < report.Mismatches[j].File
+	})
+	return report
+}
+
+func formatTime(unix float64) string {
+	if unix == 0 {
+		return "never"
+	}
+	return time.Unix(int64(unix), 0).UTC().Format(time.RFC3339)
+}
+
+func printHostErrors(w io.Writer, errors map[string]string) {
+	hosts := make([]string, 0, len(errors))
+	for host := range errors {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "  -> %s: %s\n", host, errors[host])
+	}
+}
+
+func printStats(w io.Writer, name string, s *ReconStats) {
+	if s.Reported == 0 {
+		fmt.Fprintf(w, "[%s] no hosts reported\n", name)
+		return
+	}
+	fmt.Fprintf(w, "[%s] low: %.2f, high: %.2f, avg: %.2f, reported: %d, none: %d\n", name, s.Low, s.High, s.Average,
+		s.Reported, s.None)
+}
+
+func printReconReport(w io.Writer, report interface{}, hostCount int) {
+	fmt.Fprintln(w, "===============================================================================")
+	switch r := report.(type) {
+	case *ReplicationReport:
+		fmt.Fprintf(w, "[replication] checked %d hosts, %d failed\n", hostCount, len(r.Errors))
+		printStats(w, "replication_time (minutes)", r.Time)
+		if r.OldestHost != "" {
+			fmt.Fprintf(w, "Oldest completion was %s (%s ago) at %s\n", formatTime(r.OldestCompletion),
+				time.Since(time.Unix(int64(r.OldestCompletion), 0)).Truncate(time.Second), r.OldestHost)
+		}
+		printHostErrors(w, r.Errors)
+	case *AsyncReport:
+		fmt.Fprintf(w, "[async_pending] checked %d hosts, %d failed\n", hostCount, len(r.Errors))
+		printStats(w, "async_pending", r.Stats)
+		fmt.Fprintf(w, "Total async pendings: %d\n", r.Total)
+		printHostErrors(w, r.Errors)
+	case *UnmountedReport:
+		fmt.Fprintf(w, "[unmounted] checked %d hosts, %d failed\n", hostCount, len(r.Errors))
+		for _, d := range r.Unmounted {
+			fmt.Fprintf(w, "Not mounted: %s on %s\n", d.Device, d.Host)
+		}
+		fmt.Fprintf(w, "%d unmounted drives\n", len(r.Unmounted))
+		printHostErrors(w, r.Errors)
+	case *DiskUsageReport:
+		fmt.Fprintf(w, "[diskusage] checked %d hosts, %d failed\n", hostCount, len(r.Errors))
+		if r.Used.Reported > 0 {
+			fmt.Fprintln(w, "Distribution Graph:")
+			for bucket := 0; bucket < 10; bucket++ {
+				if count := r.Distribution[bucket]; count > 0 {
+					fmt.Fprintf(w, " %3d%% %4d %s\n", bucket*10, count, bar(count, r.Used.Reported))
+				}
+			}
+			fmt.Fprintf(w, "Disk usage: space used: %d of %d\n", r.TotalUsed, r.TotalSize)
+			fmt.Fprintf(w, "Disk usage: lowest: %.2f%% (%s on %s), highest: %.2f%% (%s on %s), avg: %.2f%%\n",
+				r.Used.Low, r.Emptiest.Device, r.Emptiest.Host, r.Used.High, r.Fullest.Device, r.Fullest.Host, r.Used.Average)
+		} else {
+			fmt.Fprintln(w, "No hosts returned valid data.")
+		}
+		printHostErrors(w, r.Errors)
+	case *RingMD5Report:
+		fmt.Fprintf(w, "[ringmd5] checked %d hosts, %d failed\n", hostCount, len(r.Errors))
+		for _, m := range r.Mismatches {
+			fmt.Fprintf(w, "!! %s has %s md5 %s, doesn't match local %s\n", m.Host, m.File, m.MD5, r.Local[m.File])
+		}
+		fmt.Fprintf(w, "%d/%d hosts matched, %d error[s] while checking hosts.\n", r.Matched, hostCount, len(r.Errors))
+		printHostErrors(w, r.Errors)
+	}
+}
+
+func bar(count, total int) string {
+	width := 50 * count / total
+	if width == 0 {
+		width = 1
+	}
+	b := make([]byte, width)
+	for i := range b {
+		b[i] = '*'
+	}
+	return string(b)
+}
+
+// runReconCheck queries the hosts for check and builds its report.
+func runReconCheck(rc *reconClient, hosts []string, serverType string, check string) (interface{}, error) {
+	switch check {
+	case "replication":
+		return replicationReport(rc.query(hosts, "replication/"+serverType), serverType), nil
+	case "async":
+		return asyncReport(rc.query(hosts, "async")), nil
+	case "unmounted":
+		return unmountedReport(rc.query(hosts, "unmounted")), nil
+	case "diskusage":
+		return diskUsageReport(rc.query(hosts, "diskusage")), nil
+	case "ringmd5":
+		local, err := localRingMD5s("/etc/hummingbird", "/etc/swift")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read local rings: %v", err)
+		}
+		return ringMD5Report(rc.query(hosts, "ringmd5"), local), nil
+	}
+	return nil, fmt.Errorf("unknown check %q", check)
+}
+
+// Recon implements "hummingbird recon", which queries the recon endpoint of every server in the rings and prints
+// cluster-wide summaries.
+func Recon(args []string) {
+	flags := flag.NewFlagSet("recon", flag.ExitOnError)
+	serverType := flags.String("type", "object", "server type to query: object, container or account")
+	timeout := flags.Duration("timeout", 5*time.Second, "time to wait for each host")
+	concurrency := flags.Int("concurrency", 32, "hosts to query at once")
+	asJSON := flags.Bool("json", false, "output JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird recon [ARGS] [check ...]\n")
+		fmt.Fprintf(os.Stderr, "  Checks are %v; by default all of them run.\n", reconChecks)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *serverType != "object" && *serverType != "container" && *serverType != "account" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	checks := flags.Args()
+	if len(checks) == 0 {
+		checks = reconChecks
+	}
+
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	var rings []ring.Ring
+	if *serverType == "object" {
+		for _, policy := range conf.LoadPolicies() {
+			if r, err := ring.GetRing("object", hashPathPrefix, hashPathSuffix, policy.Index); err == nil {
+				rings = append(rings, r)
+			} else {
+				fmt.Fprintf(os.Stderr, "Unable to load object ring for policy %s: %v\n", policy.Name, err)
+			}
+		}
+	} else if r, err := ring.GetRing(*serverType, hashPathPrefix, hashPathSuffix, 0); err == nil {
+		rings = append(rings, r)
+	} else {
+		fmt.Fprintf(os.Stderr, "Unable to load %s ring: %v\n", *serverType, err)
+	}
+	hosts := reconHosts(rings)
+	if len(hosts) == 0 {
+		fmt.Fprintln(os.Stderr, "No hosts to query")
+		os.Exit(1)
+	}
+
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	rc := &reconClient{client: &http.Client{Timeout: *timeout}, concurrency: *concurrency}
+	reports := map[string]interface{}{}
+	if !*asJSON {
+		fmt.Printf("--> Starting reconnaissance on %d hosts (%s)\n", len(hosts), *serverType)
+	}
+	for _, check := range checks {
+		report, err := runReconCheck(rc, hosts, *serverType, check)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		reports[check] = report
+		if !*asJSON {
+			printReconReport(os.Stdout, report, len(hosts))
+		}
+	}
+	if *asJSON {
+		data, err := json.Marshal(reports)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		fmt.Println("===============================================================================")
+	}
+}
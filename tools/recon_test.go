@@ -0,0 +1,161 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+// reconServer serves canned recon responses, by path.
+func reconServer(responses map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, ok := responses[r.URL.Path]; ok {
+			w.Write([]byte(body))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestReconReports(t *testing.T) {
+	a := reconServer(map[string]string{
+		"/recon/replication/object": `{"object_replication_time": 10, "object_replication_last": 1500000000}`,
+		"/recon/async":              `{"async_pending": 5}`,
+		"/recon/unmounted":          `[{"device": "sdb", "mounted": false}]`,
+		"/recon/diskusage": `[{"device": "sda", "mounted": true, "size": 1000, "used": 250, "avail": 750},
+			{"device": "sdb", "mounted": false, "size": "", "used": "", "avail": ""}]`,
+		"/recon/ringmd5": `{"/etc/hummingbird/object.ring.gz": "aaa", "/etc/hummingbird/container.ring.gz": "bbb"}`,
+	})
+	defer a.Close()
+	b := reconServer(map[string]string{
+		"/recon/replication/object": `{"object_replication_time": 20, "object_replication_last": 1400000000}`,
+		"/recon/async":              `{"async_pending": null}`,
+		"/recon/unmounted":          `[]`,
+		"/recon/diskusage":          `[{"device": "sda", "mounted": true, "size": 1000, "used": 950, "avail": 50}]`,
+		"/recon/ringmd5":            `{"/etc/swift/object.ring.gz": "zzz", "/etc/swift/container.ring.gz": "bbb"}`,
+	})
+	defer b.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	hostA, hostB, hostDown := strings.TrimPrefix(a.URL, "http://"), strings.TrimPrefix(b.URL, "http://"), strings.TrimPrefix(down.URL, "http://")
+	hosts := []string{hostA, hostB, hostDown}
+	rc := &reconClient{client: &http.Client{Timeout: time.Second}, concurrency: 2}
+
+	report, err := runReconCheck(rc, hosts, "object", "replication")
+	require.Nil(t, err)
+	replication := report.(*ReplicationReport)
+	require.Equal(t, 10.0, replication.Time.Low)
+	require.Equal(t, 20.0, replication.Time.High)
+	require.Equal(t, 15.0, replication.Time.Average)
+	require.Equal(t, 1400000000.0, replication.OldestCompletion)
+	require.Equal(t, hostB, replication.OldestHost)
+	require.Equal(t, 1, len(replication.Errors))
+	require.Contains(t, replication.Errors, hostDown)
+
+	report, err = runReconCheck(rc, hosts, "object", "async")
+	require.Nil(t, err)
+	async := report.(*AsyncReport)
+	require.Equal(t, int64(5), async.Total)
+	require.Equal(t, 1, async.Stats.Reported)
+	require.Equal(t, 1, async.Stats.None)
+
+	report, err = runReconCheck(rc, hosts, "object", "unmounted")
+	require.Nil(t, err)
+	require.Equal(t, []HostDevice{{hostA, "sdb"}}, report.(*UnmountedReport).Unmounted)
+
+	report, err = runReconCheck(rc, hosts, "object", "diskusage")
+	require.Nil(t, err)
+	usage := report.(*DiskUsageReport)
+	require.Equal(t, 2, usage.Used.Reported)
+	require.Equal(t, 25.0, usage.Used.Low)
+	require.Equal(t, 95.0, usage.Used.High)
+	require.Equal(t, HostDevice{hostB, "sda"}, usage.Fullest)
+	require.Equal(t, HostDevice{hostA, "sda"}, usage.Emptiest)
+	require.Equal(t, map[int]int{2: 1, 9: 1}, usage.Distribution)
+	require.Equal(t, int64(2000), usage.TotalSize)
+	require.Equal(t, int64(1200), usage.TotalUsed)
+
+	ringmd5 := ringMD5Report(rc.query(hosts, "ringmd5"), map[string]string{"object.ring.gz": "aaa", "container.ring.gz": "bbb"})
+	require.Equal(t, 1, ringmd5.Matched)
+	require.Equal(t, []RingMismatch{{hostB, "object.ring.gz", "zzz"}}, ringmd5.Mismatches)
+	require.Equal(t, 1, len(ringmd5.Errors))
+
+	_, err = runReconCheck(rc, hosts, "object", "frobnicate")
+	require.NotNil(t, err)
+
+	// the text output mentions what matters
+	out := &bytes.Buffer{}
+	printReconReport(out, replication, len(hosts))
+	printReconReport(out, usage, len(hosts))
+	printReconReport(out, ringmd5, len(hosts))
+	require.Contains(t, out.String(), "Oldest completion was 2014-05-13T16:53:20Z")
+	require.Contains(t, out.String(), "highest: 95.00% (sda on "+hostB+")")
+	require.Contains(t, out.String(), "1/3 hosts matched")
+}
+
+func TestReplicationReportContainers(t *testing.T) {
+	report := replicationReport([]*reconResponse{
+		{Host: "a", Data: []byte(`{"replication_time": 3, "replication_last": 1500000000,
+			"replication_stats": {"attempted": 4, "success": 4, "failure": 0}}`)},
+		{Host: "b", Data: []byte(`{"replication_time": null, "replication_last": null, "replication_stats": null}`)},
+		{Host: "c", Data: []byte(`{"replication_time": "soon"}`)},
+	}, "container")
+	require.Equal(t, 1, report.Time.Reported)
+	require.Equal(t, 3.0, report.Time.Average)
+	require.Equal(t, 1500000000.0, report.OldestCompletion)
+	require.Equal(t, "a", report.OldestHost)
+	require.Equal(t, 1, len(report.Errors))
+	require.Contains(t, report.Errors, "c")
+}
+
+func TestReconHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	r := testDispersionRing(t, dir, server)
+	// three devices on one server
+	require.Equal(t, []string{strings.TrimPrefix(server.URL, "http://")}, reconHosts([]ring.Ring{r, r}))
+}
+
+func TestLocalRingMD5s(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"object.ring.gz", "container.ring.gz", "account.ring.gz"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("ring"), 0644))
+	}
+	sums, err := localRingMD5s(filepath.Join(dir, "missing"), dir)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(sums))
+	require.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("ring"))), sums["account.ring.gz"])
+	_, err = localRingMD5s(filepath.Join(dir, "missing"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,104 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/troubling/hummingbird/accountserver"
+	"github.com/troubling/hummingbird/common/conf"
+	"github.com/troubling/hummingbird/common/ring"
+)
+
+var usageCSVHeader = []string{"account", "policy", "storage_policy_index", "container_count", "object_count", "bytes_used"}
+
+// writeUsageCSV writes a row for each account's usage of each storage policy. Accounts without any containers get a
+// single row with an empty policy, so every account appears in the report.
+func writeUsageCSV(w io.Writer, usages []*accountserver.AccountUsage) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(usageCSVHeader); err != nil {
+		return err
+	}
+	for _, usage := range usages {
+		if len(usage.Policies) == 0 {
+			if err := cw.Write([]string{usage.Account, "", "", "0", "0", "0"}); err != nil {
+				return err
+			}
+		}
+		for _, policy := range usage.Policies {
+			if err := cw.Write([]string{usage.Account, policy.Policy, strconv.Itoa(policy.StoragePolicyIndex),
+				strconv.FormatInt(policy.ContainerCount, 10), strconv.FormatInt(policy.ObjectCount, 10),
+				strconv.FormatInt(policy.BytesUsed, 10)}); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// UsageReport crawls the account databases on every account server and prints each account's usage by storage policy.
+func UsageReport(args []string) {
+	flags := flag.NewFlagSet("usage-report", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only report accounts whose names start with this, such as a reseller prefix")
+	format := flags.String("format", "csv", "output format: csv or json")
+	timeout := flags.Duration("timeout", 10*time.Minute, "time to wait for each device to report")
+	concurrency := flags.Int("concurrency", 8, "devices to query at once")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: hummingbird usage-report [ARGS]\n")
+		fmt.Fprintf(os.Stderr, "  Reports every account's usage by storage policy, for billing.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *format != "csv" && *format != "json" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	hashPathPrefix, hashPathSuffix, err := conf.GetHashPrefixAndSuffix()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load hash path prefix and suffix:", err)
+		os.Exit(1)
+	}
+	accountRing, err := ring.GetRing("account", hashPathPrefix, hashPathSuffix, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to load account ring:", err)
+		os.Exit(1)
+	}
+	usages, failed := accountserver.GatherUsage(&http.Client{Timeout: *timeout}, accountRing, *prefix, *concurrency)
+	for _, dev := range failed {
+		fmt.Fprintln(os.Stderr, "Unable to get usage from", dev)
+	}
+	if *format == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(usages)
+	} else {
+		err = writeUsageCSV(os.Stdout, usages)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+}
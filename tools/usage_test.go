@@ -0,0 +1,40 @@
+//  Copyright (c) 2017 Rackspace
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+//  implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package tools
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/troubling/hummingbird/accountserver"
+)
+
+func TestWriteUsageCSV(t *testing.T) {
+	usages := []*accountserver.AccountUsage{
+		{Account: "AUTH_a", Policies: []*accountserver.PolicyUsage{
+			{Policy: "gold", StoragePolicyIndex: 0, ContainerCount: 1, ObjectCount: 2, BytesUsed: 20},
+			{Policy: "silver", StoragePolicyIndex: 1, ContainerCount: 3, ObjectCount: 4, BytesUsed: 40},
+		}},
+		{Account: "AUTH_b,c"},
+	}
+	buf := &bytes.Buffer{}
+	require.Nil(t, writeUsageCSV(buf, usages))
+	require.Equal(t, "account,policy,storage_policy_index,container_count,object_count,bytes_used\n"+
+		"AUTH_a,gold,0,1,2,20\n"+
+		"AUTH_a,silver,1,3,4,40\n"+
+		"\"AUTH_b,c\",,,0,0,0\n", buf.String())
+}